@@ -0,0 +1,405 @@
+// access.go
+//
+// requests for access from users who are not allowed yet
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	maxAccessRequestPreviewLength = 200 // max number of runes of the first message in access requests
+)
+
+// statuses of access requests
+const (
+	accessRequestStatusPending  = "pending"
+	accessRequestStatusApproved = "approved"
+	accessRequestStatusDenied   = "denied"
+)
+
+// ids of users and chats which are allowed in the config (set once on launch)
+var allowedIDs = struct {
+	users map[int64]bool
+	chats map[int64]bool
+}{
+	users: map[int64]bool{},
+	chats: map[int64]bool{},
+}
+
+// load ids of allowed users and chats from the config
+func loadAllowedIDs(conf config) {
+	for _, userID := range conf.AllowedTelegramUserIDs {
+		allowedIDs.users[userID] = true
+	}
+	for _, chatID := range conf.AllowedChatIDs {
+		allowedIDs.chats[chatID] = true
+	}
+}
+
+// check if given update is from an allowed user id, or in an allowed chat
+func isAllowedID(update tg.Update) bool {
+	if from := update.GetFrom(); from != nil && allowedIDs.users[from.ID] {
+		return true
+	}
+
+	var chat *tg.Chat
+	if update.HasMessage() {
+		chat = &update.Message.Chat
+	} else if update.HasEditedMessage() {
+		chat = &update.EditedMessage.Chat
+	} else if update.HasCallbackQuery() && update.CallbackQuery.Message != nil {
+		chat = &update.CallbackQuery.Message.Chat
+	}
+	return chat != nil && allowedIDs.chats[chat.ID]
+}
+
+// ids and usernames of users who were approved by admins (cached from the database)
+var approvedUsers = struct {
+	sync.RWMutex
+
+	ids       map[int64]bool
+	usernames map[string]bool
+}{
+	ids:       map[int64]bool{},
+	usernames: map[string]bool{},
+}
+
+// load approved users from the database
+func loadApprovedUsers(db *Database) {
+	if db == nil {
+		return
+	}
+
+	users, err := db.loadAllowedUsers()
+	if err != nil {
+		log.Printf("failed to load allowed users: %s", err)
+		return
+	}
+	usernames, err := db.loadAllowedUsernames()
+	if err != nil {
+		log.Printf("failed to load allowed usernames: %s", err)
+		return
+	}
+
+	approvedUsers.Lock()
+	defer approvedUsers.Unlock()
+
+	approvedUsers.ids = map[int64]bool{}
+	for _, user := range users {
+		approvedUsers.ids[user.UserID] = true
+	}
+	approvedUsers.usernames = map[string]bool{}
+	for _, allowed := range usernames {
+		approvedUsers.usernames[allowed.Username] = true
+	}
+}
+
+// check if given user was approved by admins
+func isApprovedUser(user *tg.User) bool {
+	approvedUsers.RLock()
+	defer approvedUsers.RUnlock()
+
+	return approvedUsers.ids[user.ID] || (user.Username != nil && approvedUsers.usernames[*user.Username])
+}
+
+// reply to a user who is not allowed (only once), and forward the request for access to `access_requests_chat_id`
+//
+// (only for direct messages)
+func requestAccess(bot telegramClient, conf config, db *Database, message tg.Message) {
+	if conf.AccessRequestsChatID == nil || db == nil || message.From == nil || isGroupChat(message.Chat) {
+		return
+	}
+
+	user := message.From
+	if requested, err := db.hasAccessRequest(user.ID); err != nil {
+		log.Printf("failed to check access request: %s", err)
+		return
+	} else if requested {
+		return
+	}
+
+	preview := []rune(captionOf(message))
+	if message.Text != nil {
+		preview = []rune(*message.Text)
+	}
+	if len(preview) > maxAccessRequestPreviewLength {
+		preview = append(preview[:maxAccessRequestPreviewLength], '…')
+	}
+
+	request := AccessRequest{
+		UserID:   user.ID,
+		Username: userName(user),
+		ChatID:   message.Chat.ID,
+		Preview:  string(preview),
+		Status:   accessRequestStatusPending,
+	}
+	if err := db.saveAccessRequest(&request); err != nil {
+		log.Printf("failed to save access request: %s", err)
+		return
+	}
+
+	// forward to admins
+	button := func(text, action string) tg.InlineKeyboardButton {
+		return tg.InlineKeyboardButton{
+			Text:         text,
+			CallbackData: ptr(fmt.Sprintf("%s%s/%d", callbackDataPrefixAccess, action, user.ID)),
+		}
+	}
+	options := tg.OptionsSendMessage{}.
+		SetReplyMarkup(tg.NewInlineKeyboardMarkup([][]tg.InlineKeyboardButton{
+			{button(msgAccessApprove, "approve"), button(msgAccessDeny, "deny")},
+		}))
+	if res := withRetries(bot).SendMessage(*conf.AccessRequestsChatID, filterOutgoingText(conf, formatAccessRequest(request)), options); !res.Ok {
+		log.Printf("failed to forward access request: %s", *res.Description)
+		return
+	}
+
+	_, _ = sendMessage(bot, conf, msgAccessRequested, message.Chat.ID, &message.MessageID)
+}
+
+// format given access request for admins
+func formatAccessRequest(request AccessRequest) string {
+	return fmt.Sprintf(msgAccessRequestFormat, request.Username, request.UserID, request.Preview)
+}
+
+// approve (or deny) an access request with given callback query
+func handleAccessCallback(b telegramClient, conf config, db *Database, update tg.Update, callbackQuery tg.CallbackQuery, data string) {
+	if !isAdmin(update, conf) {
+		_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgNotAdmin))
+		return
+	}
+
+	action, id, _ := strings.Cut(strings.TrimPrefix(data, callbackDataPrefixAccess), "/")
+	userID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || db == nil {
+		_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgAccessRequestNotFound))
+		return
+	}
+
+	request, err := db.loadAccessRequest(userID)
+	if err != nil || request.Status != accessRequestStatusPending {
+		_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgAccessRequestNotFound))
+		return
+	}
+
+	var result, notice string
+	if action == "approve" {
+		if err := approveUser(db, request.UserID, request.Username); err != nil {
+			log.Printf("failed to approve user: %s", err)
+
+			_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(fmt.Sprintf("Failed to approve: %s", err)))
+			return
+		}
+		request.Status = accessRequestStatusApproved
+		result, notice = fmt.Sprintf(msgAccessApprovedByFormat, userName(&callbackQuery.From)), msgAccessApproved
+	} else {
+		request.Status = accessRequestStatusDenied
+		result, notice = fmt.Sprintf(msgAccessDeniedByFormat, userName(&callbackQuery.From)), msgAccessDenied
+	}
+	if err := db.saveAccessRequest(&request); err != nil {
+		log.Printf("failed to save access request: %s", err)
+	}
+
+	_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(result))
+
+	// update the forwarded request (without buttons), and notify the user
+	if callbackQuery.Message != nil {
+		_ = updateMessage(b, conf, formatAccessRequest(request)+"\n\n"+result, callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID)
+	}
+	_, _ = sendMessage(b, conf, notice, request.ChatID, nil)
+}
+
+// allow given user, in the database and the cache
+func approveUser(db *Database, userID int64, username string) error {
+	if err := db.saveAllowedUser(AllowedUser{
+		UserID:   userID,
+		Username: username,
+	}); err != nil {
+		return err
+	}
+
+	approvedUsers.Lock()
+	approvedUsers.ids[userID] = true
+	approvedUsers.Unlock()
+
+	return nil
+}
+
+// allow given username (or user id if username is empty), in the database and the cache
+func allowUserTarget(db *Database, userID int64, username string) error {
+	if username == "" {
+		return approveUser(db, userID, "")
+	}
+
+	if err := db.saveAllowedUsername(username); err != nil {
+		return err
+	}
+
+	approvedUsers.Lock()
+	approvedUsers.usernames[username] = true
+	approvedUsers.Unlock()
+
+	return nil
+}
+
+// deny given username (or user id if username is empty) which was allowed by admins, and reload the cache
+//
+// (usernames are also matched against the users approved from access requests, which are stored with their ids)
+func denyUserTarget(db *Database, userID int64, username string) (deleted bool, err error) {
+	if username != "" {
+		var deletedUsername, deletedUsers bool
+		if deletedUsername, err = db.deleteAllowedUsername(username); err == nil {
+			deletedUsers, err = denyApprovedUsername(db, username)
+		}
+		deleted = deletedUsername || deletedUsers
+	} else {
+		deleted, err = db.deleteAllowedUser(userID)
+	}
+	if err == nil && deleted {
+		loadApprovedUsers(db)
+	}
+	return deleted, err
+}
+
+// delete the users approved from access requests with given username
+func denyApprovedUsername(db *Database, username string) (deleted bool, err error) {
+	var users []AllowedUser
+	if users, err = db.loadAllowedUsers(); err != nil {
+		return false, err
+	}
+
+	for _, user := range users {
+		if !strings.EqualFold(usernameFromUserName(user.Username), username) {
+			continue
+		}
+
+		var deletedUser bool
+		if deletedUser, err = db.deleteAllowedUser(user.UserID); err != nil {
+			return deleted, err
+		}
+		deleted = deleted || deletedUser
+	}
+
+	return deleted, nil
+}
+
+// get the username from given name of a user (generated with `userName`), or an empty string if there is none
+func usernameFromUserName(name string) string {
+	if !strings.HasPrefix(name, "@") {
+		return ""
+	}
+	username, _, _ := strings.Cut(strings.TrimPrefix(name, "@"), " ")
+	return username
+}
+
+// parse the target user of /allow and /deny: a username (with or without '@'), or a user id
+func parseUserTarget(arg string) (userID int64, username string) {
+	arg = strings.TrimSpace(arg)
+	if id, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		return id, ""
+	}
+	return 0, strings.TrimPrefix(arg, "@")
+}
+
+// check if given user id or username is allowed in the config
+func isAllowedInConfig(conf config, userID int64, username string) bool {
+	if username != "" {
+		return slices.Contains(conf.AllowedTelegramUsers, username)
+	}
+	return slices.Contains(conf.AllowedTelegramUserIDs, userID)
+}
+
+// return a /allow command handler
+func allowCommandHandler(conf config, db *Database) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if !isAdmin(update, conf) {
+			log.Printf("allow command not allowed: %s", userNameFromUpdate(update))
+
+			_, _ = sendMessage(b, conf, msgNotAdmin, chatID, &messageID)
+			return
+		}
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		userID, username := parseUserTarget(args)
+		if userID == 0 && username == "" {
+			_, _ = sendMessage(b, conf, msgAllowUsage, chatID, &messageID)
+			return
+		}
+
+		if err := allowUserTarget(db, userID, username); err != nil {
+			_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to allow: %s", err), chatID, &messageID)
+			return
+		}
+
+		_, _ = sendMessage(b, conf, fmt.Sprintf(msgAllowedFormat, strings.TrimSpace(args)), chatID, &messageID)
+	}
+}
+
+// return a /deny command handler
+func denyCommandHandler(conf config, db *Database) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if !isAdmin(update, conf) {
+			log.Printf("deny command not allowed: %s", userNameFromUpdate(update))
+
+			_, _ = sendMessage(b, conf, msgNotAdmin, chatID, &messageID)
+			return
+		}
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		target := strings.TrimSpace(args)
+		userID, username := parseUserTarget(target)
+		if userID == 0 && username == "" {
+			_, _ = sendMessage(b, conf, msgDenyUsage, chatID, &messageID)
+			return
+		}
+		if isAllowedInConfig(conf, userID, username) {
+			_, _ = sendMessage(b, conf, fmt.Sprintf(msgDenyInConfigFormat, target), chatID, &messageID)
+			return
+		}
+
+		deleted, err := denyUserTarget(db, userID, username)
+		if err != nil {
+			_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to deny: %s", err), chatID, &messageID)
+			return
+		}
+		if !deleted {
+			_, _ = sendMessage(b, conf, fmt.Sprintf(msgDenyNotFoundFormat, target), chatID, &messageID)
+			return
+		}
+
+		_, _ = sendMessage(b, conf, fmt.Sprintf(msgDeniedFormat, target), chatID, &messageID)
+	}
+}
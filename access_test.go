@@ -0,0 +1,45 @@
+// access_test.go
+//
+// tests of allowing and denying users at runtime
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDenyUserTarget(t *testing.T) {
+	conf := testConfig(t)
+
+	db, err := openDatabase(dbDriverSQLite, filepath.Join(t.TempDir(), "test.db"), conf.SQLite)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+
+	// approved from access requests (stored with their ids)
+	if err := approveUser(db, 301, "@approved_user (Approved)"); err != nil {
+		t.Fatalf("failed to approve user: %s", err)
+	}
+	if err := approveUser(db, 302, "No Username"); err != nil {
+		t.Fatalf("failed to approve user: %s", err)
+	}
+
+	if deleted, err := denyUserTarget(db, 0, "Approved_User"); err != nil || !deleted {
+		t.Errorf("expected the approved user to be denied with the username, got %t (error: %v)", deleted, err)
+	}
+	if deleted, err := denyUserTarget(db, 0, "approved_user"); err != nil || deleted {
+		t.Errorf("expected nothing to match after denied, got %t (error: %v)", deleted, err)
+	}
+	if deleted, err := denyUserTarget(db, 0, "No"); err != nil || deleted {
+		t.Errorf("expected users without usernames not to match, got %t (error: %v)", deleted, err)
+	}
+
+	users, err := db.loadAllowedUsers()
+	if err != nil {
+		t.Fatalf("failed to load allowed users: %s", err)
+	}
+	if len(users) != 1 || users[0].UserID != 302 {
+		t.Errorf("expected only user(302) to be left, got %+v", users)
+	}
+}
@@ -0,0 +1,316 @@
+// analyze.go
+//
+// functions for analyzing table data (.csv and .xlsx files)
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	// my libraries
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	mimeTypeCSV  = "text/csv"
+	mimeTypeXLSX = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+	maxTableCharsInPrompt = 50000 // include all rows if the table is smaller than this
+	numSampleTableRows    = 20    // or include only these rows as a sample
+
+	maxXLSXColumns = 16384 // columns of a worksheet (A ~ XFD)
+)
+
+// check if given document is a supported table file
+func isTableDocument(document tg.Document) bool {
+	_, err := tableFormat(document)
+	return err == nil
+}
+
+// get the format ("csv" or "xlsx") of given document
+func tableFormat(document tg.Document) (format string, err error) {
+	if document.MimeType != nil {
+		switch *document.MimeType {
+		case mimeTypeCSV:
+			return "csv", nil
+		case mimeTypeXLSX:
+			return "xlsx", nil
+		}
+	}
+	if document.FileName != nil {
+		switch strings.ToLower(filepath.Ext(*document.FileName)) {
+		case ".csv":
+			return "csv", nil
+		case ".xlsx":
+			return "xlsx", nil
+		}
+	}
+
+	return "", fmt.Errorf("not a supported table file (only .csv and .xlsx files are supported)")
+}
+
+// parse given table file into rows
+func parseTable(format string, data []byte) (rows [][]string, err error) {
+	switch format {
+	case "csv":
+		reader := csv.NewReader(bytes.NewReader(data))
+		reader.FieldsPerRecord = -1 // allow variable number of fields
+		reader.LazyQuotes = true
+		rows, err = reader.ReadAll()
+	case "xlsx":
+		rows, err = parseXLSX(data)
+	default:
+		err = fmt.Errorf("not a supported table format: %s", format)
+	}
+
+	if err == nil && len(rows) <= 0 {
+		err = fmt.Errorf("no rows in the table")
+	}
+
+	return rows, err
+}
+
+// shared strings of a .xlsx file
+type xlsxSharedStrings struct {
+	Items []struct {
+		Text string `xml:"t"`
+		Runs []struct {
+			Text string `xml:"t"`
+		} `xml:"r"`
+	} `xml:"si"`
+}
+
+// worksheet of a .xlsx file
+type xlsxWorksheet struct {
+	Rows []struct {
+		Cells []struct {
+			Ref    string `xml:"r,attr"`
+			Type   string `xml:"t,attr"`
+			Value  string `xml:"v"`
+			Inline string `xml:"is>t"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// parse the first worksheet of given .xlsx file into rows
+func parseXLSX(data []byte) (rows [][]string, err error) {
+	var reader *zip.Reader
+	if reader, err = zip.NewReader(bytes.NewReader(data), int64(len(data))); err != nil {
+		return nil, fmt.Errorf("failed to open xlsx file: %s", err)
+	}
+
+	readXML := func(name string, v any) error {
+		f, err := reader.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return xml.NewDecoder(f).Decode(v)
+	}
+
+	// shared strings (can be missing)
+	sharedStrings := []string{}
+	var sst xlsxSharedStrings
+	if err := readXML("xl/sharedStrings.xml", &sst); err == nil {
+		for _, item := range sst.Items {
+			text := item.Text
+			for _, run := range item.Runs {
+				text += run.Text
+			}
+			sharedStrings = append(sharedStrings, text)
+		}
+	}
+
+	// the first worksheet
+	var sheet xlsxWorksheet
+	if err = readXML("xl/worksheets/sheet1.xml", &sheet); err != nil {
+		return nil, fmt.Errorf("failed to read the first worksheet: %s", err)
+	}
+
+	for _, r := range sheet.Rows {
+		row := []string{}
+		for i, cell := range r.Cells {
+			// fill the skipped (empty) cells
+			col, err := xlsxColumnIndex(cell.Ref)
+			if err != nil {
+				return nil, err
+			}
+			if col < 0 {
+				col = i
+			}
+			for len(row) < col {
+				row = append(row, "")
+			}
+
+			var value string
+			switch cell.Type {
+			case "s":
+				if idx, err := strconv.Atoi(cell.Value); err == nil && idx >= 0 && idx < len(sharedStrings) {
+					value = sharedStrings[idx]
+				}
+			case "inlineStr":
+				value = cell.Inline
+			default:
+				value = cell.Value
+			}
+			row = append(row, value)
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// get the 0-based column index from given cell reference (eg. "C12" => 2), or -1 if it has no column
+//
+// (returns an error if the column is beyond the limit of worksheets, for not growing rows without limit)
+func xlsxColumnIndex(ref string) (int, error) {
+	index := 0
+	letters := 0
+	for _, r := range ref {
+		if r >= 'A' && r <= 'Z' {
+			index = index*26 + int(r-'A'+1)
+			letters++
+
+			if index > maxXLSXColumns {
+				return -1, fmt.Errorf("column of cell '%s' is out of range", ref)
+			}
+		} else {
+			break
+		}
+	}
+	if letters == 0 {
+		return -1, nil
+	}
+
+	return index - 1, nil
+}
+
+// summarize given rows (the first row is the header) for prompting
+func summarizeTable(rows [][]string) string {
+	header := rows[0]
+	records := rows[1:]
+
+	lines := []string{
+		fmt.Sprintf("Rows: %d (excluding the header)", len(records)),
+		fmt.Sprintf("Columns: %d", len(header)),
+		"",
+		"Column summaries:",
+	}
+
+	for col, name := range header {
+		count, numerics := 0, 0
+		sum, min, max := 0.0, math.Inf(1), math.Inf(-1)
+		distinct := map[string]bool{}
+
+		for _, record := range records {
+			if col >= len(record) {
+				continue
+			}
+			value := strings.TrimSpace(record[col])
+			if value == "" {
+				continue
+			}
+			count++
+			distinct[value] = true
+
+			if f, err := strconv.ParseFloat(strings.ReplaceAll(value, ",", ""), 64); err == nil {
+				numerics++
+				sum += f
+				min = math.Min(min, f)
+				max = math.Max(max, f)
+			}
+		}
+
+		if count > 0 && numerics == count {
+			lines = append(lines, fmt.Sprintf("- %s (numeric): count=%d, min=%g, max=%g, mean=%g, sum=%g", name, count, min, max, sum/float64(count), sum))
+		} else {
+			lines = append(lines, fmt.Sprintf("- %s (text): count=%d, distinct=%d", name, count, len(distinct)))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// convert given rows to a csv string
+func tableToCSV(rows [][]string) string {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	_ = writer.WriteAll(rows)
+
+	return buf.String()
+}
+
+// build a prompt for analyzing given table file
+func tablePrompt(filename string, rows [][]string, question string) string {
+	data := tableToCSV(rows)
+	description := "all rows"
+	if len(data) > maxTableCharsInPrompt && len(rows) > numSampleTableRows+1 {
+		data = tableToCSV(rows[:numSampleTableRows+1])
+		description = fmt.Sprintf("first %d rows as a sample", numSampleTableRows)
+	}
+
+	return fmt.Sprintf(analyzeTablePromptFormat,
+		filename,
+		summarizeTable(rows),
+		description,
+		data,
+		question,
+	)
+}
+
+// analyze given table document, and answer the question about it
+func analyzeTable(ctx context.Context, bot telegramClient, conf config, db *Database, gtc geminiClient, document tg.Document, question string, chatID, userID int64, username string, admin bool, messageID int64) {
+	format, err := tableFormat(document)
+	if err != nil {
+		_, _ = sendMessage(bot, conf, err.Error(), chatID, &messageID)
+		return
+	}
+
+	var data []byte
+	if data, err = readMedia(bot, "document", document.FileID); err != nil {
+		_, _ = sendMessage(bot, conf, fmt.Sprintf("Failed to read the table file: %s", redact(conf, err)), chatID, &messageID)
+		return
+	}
+
+	var rows [][]string
+	if rows, err = parseTable(format, data); err != nil {
+		_, _ = sendMessage(bot, conf, fmt.Sprintf("Failed to parse the table file: %s", err), chatID, &messageID)
+		return
+	}
+
+	filename := "table." + format
+	if document.FileName != nil {
+		filename = *document.FileName
+	}
+	question = strings.TrimSpace(question)
+	if question == "" {
+		question = defaultQuestionForTables
+	}
+
+	logVerbose(verboseFiles, "analyzing table '%s' with %d rows", filename, len(rows))
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	answer(ctx, bot, conf, db, gtc, responseModeStreamed, nil, &chatMessage{
+		role: chatMessageRoleUser,
+		text: tablePrompt(filename, rows, question),
+	}, chatID, userID, username, admin, messageID)
+
+	if err = ctx.Err(); err != nil {
+		log.Printf("failed to analyze table in %d seconds: %s", conf.AnswerTimeoutSeconds, redact(conf, err))
+	}
+}
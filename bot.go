@@ -10,8 +10,14 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	// google ai
 	"github.com/google/generative-ai-go/genai"
@@ -23,11 +29,6 @@ import (
 	// my libraries
 	gt "github.com/meinside/gemini-things-go"
 	tg "github.com/meinside/telegram-bot-go"
-
-	// others
-	"golang.org/x/text/language"
-	"golang.org/x/text/message"
-	"google.golang.org/api/option"
 )
 
 // constants for default values
@@ -53,19 +54,194 @@ const (
 
 	cmdStart   = "/start"
 	cmdStats   = "/stats"
+	cmdMyStats = "/mystats"
 	cmdPrivacy = "/privacy"
 	cmdHelp    = "/help"
+	cmdQuery   = "/query"
+	cmdScribe  = "/scribe"
+	cmdVerbose = "/verbose"
+	cmdConfig  = "/config"
+	cmdDBCheck = "/dbcheck"
+	cmdDebug   = "/debug"
+	cmdQueue   = "/queue"
+	cmdAB      = "/ab"
+
+	cmdAnalyze    = "/analyze"
+	cmdTranscribe = "/transcribe"
+	cmdSetKey     = "/setkey"
+	cmdHarmReport = "/harm_report"
+
+	cmdAllow = "/allow"
+	cmdDeny  = "/deny"
+
+	cmdExport          = "/export"
+	cmdExportLogs      = "/export_logs"
+	cmdExportLogsAlias = "/export-logs"
+
+	cmdBranch = "/branch"
+
+	cmdLatex = "/latex"
+
+	cmdQuiz = "/quiz"
+
+	cmdContext = "/context"
+	cmdSpace   = "/space"
+
+	cmdEphemeral = "/ephemeral"
+
+	cmdShorten   = "/shorten"
+	cmdExpand    = "/expand"
+	cmdFormal    = "/formal"
+	cmdCasual    = "/casual"
+	cmdBulletize = "/bulletize"
+
+	cmdSummarize = "/summarize"
+
+	cmdLeaderboard = "/leaderboard"
+
+	cmdWatch   = "/watch"
+	cmdWatches = "/watches"
+	cmdUnwatch = "/unwatch"
+
+	cmdMySettings     = "/mysettings"
+	cmdChatSettings   = "/chatsettings"
+	cmdRespondIn      = "/respond_in"
+	cmdRespondInAlias = "/respond-in"
+
+	cmdSuggestTitle      = "/suggest_title"
+	cmdSuggestTitleAlias = "/suggest-title"
+
+	cmdBroadcast         = "/broadcast"
+	cmdBroadcastGen      = "/broadcast_gen"
+	cmdBroadcastGenAlias = "/broadcast-gen"
 
 	descStats   = "show stats of this bot."
 	descPrivacy = "show privacy policy of this bot."
 	descHelp    = "show help message."
-
-	msgStart                 = "This bot will answer your messages with Gemini API :-)"
-	msgCmdNotSupported       = "Not a supported bot command: %s"
-	msgTypeNotSupported      = "Not a supported message type."
-	msgDatabaseNotConfigured = "Database not configured. Set `db_filepath` in your config file."
-	msgDatabaseEmpty         = "Database is empty."
-	msgHelp                  = `Help message here:
+	descMyStats = "show stats of your own usage."
+	descQuery   = "query stats of this bot in natural language. (admin only)"
+
+	descAnalyze      = "analyze a table file (csv or xlsx)."
+	descTranscribe   = "transcribe an audio, voice note, or video."
+	descQuiz         = "start a quiz on a topic."
+	descLatex        = "render a LaTeX formula to an image."
+	descEphemeral    = "get an answer which will be deleted after given minutes."
+	descShorten      = "shorten the replied message."
+	descExpand       = "expand the replied message."
+	descFormal       = "rewrite the replied message in a formal tone."
+	descCasual       = "rewrite the replied message in a casual tone."
+	descBulletize    = "rewrite the replied message as bullet points."
+	descSummarize    = "summarize a url, document, or the replied message."
+	descBranch       = "branch the conversation from the replied message."
+	descQueue        = "show queued and in-flight requests."
+	descExport       = "export your own logged history."
+	descMySettings   = "show or change your own settings."
+	descSetKey       = "register your own google ai api key. (in direct messages)"
+	descWatch        = "watch a url for changes."
+	descWatches      = "list your watched urls."
+	descUnwatch      = "stop watching a url."
+	descLeaderboard  = "show the weekly leaderboard of this group."
+	descScribe       = "opt out of (or in to) the scribe mode of this group."
+	descChatSettings = "show or change settings of this chat."
+	descRespondIn    = "pin the language of answers in this chat."
+	descSuggestTitle = "suggest a title and description of this group."
+	descContext      = "pin a document as the context of this chat."
+	descSpace        = "join or manage knowledge spaces shared across chats."
+	descAB           = "compare answers of two models. (admin only)"
+	descConfig       = "show the config of this bot. (admin only)"
+	descVerbose      = "toggle verbose logging. (admin only)"
+	descDBCheck      = "check the database. (admin only)"
+	descDebug        = "show latencies of the latest answer in this chat. (admin only)"
+	descHarmReport   = "report safety blocks. (admin only)"
+	descAllow        = "allow a user at runtime. (admin only)"
+	descDeny         = "deny a user at runtime. (admin only)"
+	descExportLogs   = "export request logs. (admin only)"
+	descBroadcast    = "opt in to (or out of) broadcasts in this chat."
+	descBroadcastGen = "generate and broadcast a message to chats. (admin only)"
+
+	msgStart                  = "This bot will answer your messages with Gemini API :-)"
+	msgCmdNotSupported        = "Not a supported bot command: %s"
+	msgTypeNotSupported       = "Not a supported message type."
+	msgDatabaseNotConfigured  = "Database not configured. Set `db_filepath` (or `db_driver` and `db_dsn`) in your config file."
+	msgRequestLoggingDisabled = "Request logging is disabled by `disable_request_logging` in the config file."
+	msgDatabaseEmpty          = "Database is empty."
+	msgNoUsage                = "You have not used this bot yet."
+	msgNotAdmin               = "This command is only for admins."
+	msgQueueUsage             = "Usage: /queue [cancel <id>] (cancel is only for admins)"
+	msgQueueEmpty             = "There are no queued or in-flight requests."
+	msgJobCanceled            = "The request was canceled by an admin."
+	msgQueryUsage             = "Usage: /query <question in natural language>"
+	msgExperimentUsage        = "Usage: /ab <variant A> | <variant B> | <prompt> (a variant is a system instruction, and/or a model with `model:NAME`)"
+	msgQueryEmptyResult       = "No matching rows."
+	msgScribeUsage            = "Usage: /scribe [optout|optin]"
+	msgVerboseUsage           = "Usage: /verbose [telegram|gemini|stream|db|files|tools|all] [on|off]"
+	msgNotGroupChat           = "This command is only for group chats."
+	msgAnalyzeUsage           = "Usage: send a .csv or .xlsx file with caption '/analyze <question>', or reply to the file with it."
+	msgNotGroupAdmin          = "This command is only for admins of this group."
+	msgNoRecentConversation   = "There is no recent conversation in this chat."
+	msgBranchUsage            = "Usage: reply to a message with /branch to continue the conversation from there."
+	msgLatexUsage             = "Usage: /latex <formula> (eg. /latex \\int_0^1 x^2 dx = \\frac{1}{3})"
+	msgQuizUsage              = "Usage: /quiz <topic> [number of questions] (eg. /quiz world capitals 5)"
+	msgQuizQuestionFormat     = "[%d/%d] %s"
+	msgQuizSummaryFormat      = "Quiz on '%s' finished: %d of %d answers were correct."
+	msgNoRequestLogsFormat    = "There are no request logs in the last %d days."
+	msgExportedLogsFormat     = "%d request logs of the last %d days (JSONL)"
+	msgMySettingsUsage        = "Usage: /mysettings [language|length|voice] [value|reset]"
+	msgChatSettingsUsage      = "Usage: /chatsettings [persona|model|stream|draft|respond_in|leaderboard|reply_followups|stop_sequences|banned_words] [value|reset]"
+	msgRespondInFormat        = "Answers in this chat are pinned to language: %[1]s\n\nUsage: /respond_in [language|reset]"
+	msgSettingSaved           = "Saved."
+	msgUserSettingsFormat     = `Your settings (in all chats):
+
+- language: %[1]s
+- length: %[2]s
+- voice: %[3]s`
+	msgChatSettingsFormat = `Settings of this chat:
+
+- persona: %[1]s
+- model: %[2]s
+- stream: %[3]s
+- draft: %[4]s
+- respond_in: %[5]s
+- leaderboard: %[6]s
+- reply_followups: %[7]s
+- stop_sequences: %[8]s
+- banned_words: %[9]s`
+	msgBroadcastUsage        = "Usage: /broadcast [optin|optout]"
+	msgBroadcastOptedIn      = "This chat will receive broadcasts."
+	msgBroadcastOptedOut     = "This chat will not receive broadcasts anymore."
+	msgBroadcastGenUsage     = "Usage: /broadcast_gen [group:NAME] <prompt> (placeholders: {{chat_title}}, {{chat_id}}, {{date}})"
+	msgBroadcastNoTargets    = "There is no chat to broadcast to."
+	msgBroadcastResultFormat = "Broadcasted to %[1]d chat(s). (failed: %[2]d)"
+	msgContinue              = "Continue ▶"
+	msgContinueExpired       = "The rest of this answer is not available anymore."
+	msgShare                 = "Share 🔗"
+	msgShareExpired          = "This answer cannot be shared anymore."
+	msgShareNotYours         = "Only the requester of this answer can share it."
+	msgShareFailed           = "Failed to share the answer."
+	msgSharedFormat          = "Shared: %s"
+	msgSorryForTheDelay      = "Sorry for the delay, I was offline when this message arrived. Answering now…"
+	msgDMOnly                = "I only answer in direct messages."
+	msgDMOnlyFormat          = "I only answer in direct messages: https://t.me/%s"
+	msgBranched              = "Branched from here. Reply to this message to continue the conversation from the replied message."
+	msgTitleSuggestionFormat = `Suggested title:
+%[1]s
+
+Suggested description:
+%[2]s`
+	msgApplyTitle          = "Apply title"
+	msgApplyDescription    = "Apply description"
+	msgApplyBoth           = "Apply both"
+	msgCancel              = "Cancel"
+	msgSuggestionApplied   = "Applied."
+	msgSuggestionCanceled  = "Canceled."
+	msgSuggestionExpired   = "This suggestion is not available anymore."
+	msgScribeNotEnabled    = "Scribe mode is not enabled in this chat."
+	msgScribeOptedOut      = "Your messages will not be collected for the daily summary anymore."
+	msgScribeOptedIn       = "Your messages will be collected for the daily summary."
+	msgScribeSummaryFormat = `Daily summary of %[1]s:
+
+%[2]s`
+	msgHelp = `Help message here:
 
 %[3]s : %[4]s
 %[5]s : %[6]s
@@ -73,10 +249,365 @@ const (
 
 - model: %[1]s
 - version: %[2]s
+
+%[9]s
 `
 	msgPrivacy = `Privacy Policy:
 
 https://github.com/meinside/telegram-gemini-bot/raw/master/PRIVACY.md`
+	msgStillThinking             = "Still thinking…"
+	msgFirstTokenTimedOut        = "Failed to receive the first token in %d seconds."
+	msgRetryWithFasterModel      = "Retry with faster model (%s)"
+	msgRetryingWithFasterModel   = "Retrying with faster model…"
+	msgRetryExpired              = "This request cannot be retried anymore."
+	msgRetryNotYours             = "Only the requester can retry this request."
+	msgAnsweredNonStreamed       = "Streaming failed, so the whole answer was generated and sent at once."
+	msgAnsweredWithFastModel     = "This answer was generated with the faster model (%s)."
+	msgDraftFooterFormat         = "\n\n— %[1]s (%[2]d tokens)"
+	msgDowngradedFooterFormat    = "\n\n(Answered with %s, as the daily token budget is nearly used up.)"
+	msgVoiceNoteOptionsFormat    = "This voice note is %d minute(s) %d second(s) long. What do you want?"
+	msgVoiceNoteTranscript       = "Transcript"
+	msgVoiceNoteSummary          = "Summary"
+	msgVoiceNoteBoth             = "Both"
+	msgVoiceNoteProcessing       = "Processing the voice note…"
+	msgVoiceNoteExpired          = "This voice note is not available anymore."
+	msgVoiceNoteTranscriptFormat = `Transcript:
+
+%s`
+	msgVoiceNoteSummaryFormat = `Summary:
+
+%s`
+	msgLeaderboardFormat = `Leaderboard of this week (since %[1]s):
+
+Top question-askers:
+%[2]s
+
+Top token consumers:
+%[3]s`
+	msgLeaderboardEmpty      = "No questions were asked in this chat this week."
+	msgLeaderboardAnonymized = "(Names are hidden. Admins of this group can show them with: /chatsettings leaderboard on)"
+	msgWatchUsage            = "Usage: /watch <url> <what to look for>"
+	msgUnwatchUsage          = "Usage: /unwatch <id> (ids are listed with /watches)"
+	msgTooManyWatchesFormat  = "There can be up to %d watches in a chat. Remove some with /unwatch first."
+	msgWatchAddedFormat      = "Watching #%[1]d: %[2]s (checked every %[3]d minute(s))"
+	msgWatchRemoved          = "Removed."
+	msgNoSuchWatch           = "No such watch in this chat."
+	msgNoWatches             = "There are no watches in this chat."
+	msgWatchOccurredFormat   = `Watch #%[1]d: %[2]s
+
+%[4]s
+
+%[3]s`
+	msgExperimentResultFormat = `%[1]s (%[2]s):
+
+%[3]s`
+	msgCalendarConfirmFormat = `Add this event to your calendar?
+
+%s`
+	msgCalendarAdd           = "Add"
+	msgCalendarEventAdded    = "Added to your calendar."
+	msgCalendarEventCanceled = "Canceled."
+	msgCalendarExpired       = "This event is not available anymore."
+	msgCalendarNotOwner      = "Only the owner of the calendar can do this."
+	msgAccessRequested       = "You are not allowed to use this bot yet. Your request for access was sent to the admins."
+	msgAccessRequestFormat   = `Access request from %[1]s (id: %[2]d):
+
+%[3]s`
+	msgAccessApprove          = "Approve"
+	msgAccessDeny             = "Deny"
+	msgAccessApprovedByFormat = "Approved by %s."
+	msgAccessDeniedByFormat   = "Denied by %s."
+	msgAccessApproved         = "Your request for access was approved. You can use this bot now."
+	msgAccessDenied           = "Sorry, your request for access was denied."
+	msgAccessRequestNotFound  = "This request is not pending anymore."
+	msgAllowUsage             = "Usage: /allow <@username|user id>"
+	msgDenyUsage              = "Usage: /deny <@username|user id>"
+	msgAllowedFormat          = "Allowed: %s"
+	msgDeniedFormat           = "Denied: %s"
+	msgDenyInConfigFormat     = "%s is allowed in the config file, and cannot be denied at runtime."
+	msgDenyNotFoundFormat     = "Nothing matched: %s was neither allowed nor approved at runtime."
+	msgCircuitOpenedFormat    = "Telegram API became unreachable at %s (%d of %d recent requests failed). Sends were queued until it got reachable again."
+	msgCircuitClosedFormat    = "Telegram API is reachable again after %s, and %d queued requests were delivered."
+	msgQuotaExceededFormat    = "You have used %d of your daily quota of %d tokens (%d remaining). It will be reset in %s."
+	msgBudgetCapReachedFormat = "The monthly budget cap ($%.2f) is reached. It will be reset at the beginning of next month."
+	msgContextUsage           = "Usage: /context set (as a reply to a document) | show | clear"
+	msgContextPinnedFormat    = "Pinned '%s' as the context of this chat."
+	msgContextShowFormat      = "Context of this chat: '%s'"
+	msgContextNotPinned       = "No context is pinned in this chat."
+	msgContextCleared         = "Cleared the context of this chat."
+
+	// for /space
+	msgSpaceUsage               = "Usage: /space [list] | create <name> | join <name> | leave <name> | add <name> (as a reply to a document) | remember <name> <memory> | forget <name> <item id> | allow <name> <user id> | deny <name> <user id> | show <name>"
+	msgSpaceInvalidName         = "Names of spaces should be 1 ~ 32 characters of lowercase letters, digits, hyphens, and underscores."
+	msgSpaceExistsFormat        = "Space '%s' already exists."
+	msgSpaceCreatedFormat       = "Created space '%[1]s'. Join it with `/space join %[1]s` in the chats which should use it."
+	msgSpaceNotAccessibleFormat = "Space '%s' does not exist, or you are not a member of it."
+	msgSpaceNotOwner            = "Only the owner of the space can allow or deny users."
+	msgSpaceJoinedFormat        = "This chat joined space '%s'."
+	msgSpaceLeftFormat          = "This chat left space '%s'."
+	msgSpaceAddedFormat         = "Added '%s' to space '%s'."
+	msgSpaceRememberedFormat    = "Saved the memory to space '%s'."
+	msgSpaceNoSuchItemFormat    = "There is no item %d in space '%s'."
+	msgSpaceForgotFormat        = "Removed item %d from space '%s'."
+	msgSpaceAllowedFormat       = "Allowed user %d to use space '%s'."
+	msgSpaceDeniedFormat        = "Denied user %d from using space '%s'."
+	msgSpaceEmptyFormat         = "Space '%s' has no documents or memories yet."
+	msgSpaceShowFormat          = "Items of space '%s':\n\n%s"
+	msgSpaceNoneJoined          = "This chat has not joined any space."
+	msgSpaceListFormat          = "Spaces joined by this chat:\n\n%s"
+
+	msgRewriteUsageFormat     = "Usage: reply to a message with %s (or %s <text>)"
+	msgSummarizeUsage         = "Usage: /summarize <url|text> (or as a reply to a message or document, or as a caption of a document)"
+	msgExportUsage            = "Usage: /export [json|csv]"
+	msgExportInPrivateChat    = "Your history can be exported only in a private chat with this bot."
+	msgExportedHistoryFormat  = "Exported %d requests of yours in %s."
+	msgModerationReportFormat = "⚠️ Flagged a message of %s\n\nRule: %s\nReason: %s\nSuggested action: %s"
+	msgModerationChatFormat   = "Chat: %s\nMessage: %s\n\n"
+	msgModerationDeleted      = "\n\n(The message was deleted.)"
+	msgEphemeralUsage         = "Usage: /ephemeral <minutes> <prompt> (minutes: 1 ~ 1440)"
+	msgEphemeralNoticeFormat  = "This question and its answer will be deleted in %d minute(s)."
+	msgCostPreviewFormat      = "The attached file is large (%s bytes), and this prompt will take about %s tokens."
+	msgCostPreviewCostFormat  = "\n\nEstimated cost of the prompt: %s (excluding the answer)"
+	msgCostPreviewProceed     = "Proceed"
+	msgCostPreviewCancel      = "Cancel"
+	msgCostPreviewProcessing  = "Processing the prompt…"
+	msgCostPreviewCanceled    = "Canceled."
+	msgCostPreviewExpired     = "This prompt is not available anymore."
+	msgCostPreviewNotYours    = "Only the sender of this prompt can decide."
+	msgUnderMaintenance       = "The bot is under maintenance. Please try again later."
+	msgDebugNoAnswers         = "There is no answer in this chat yet."
+	msgTranscribeUsage        = "Usage: /transcribe [timestamps] (as a caption of, or a reply to an audio, voice note, video note, or video)"
+	msgSetKeyOnlyInPrivate    = "Api keys can be registered only in direct messages with the bot."
+	msgSetKeyNotEnabled       = "Registering your own api key is not enabled on this bot."
+	msgSetKeyRegistered       = "Your own api key is registered, and your requests are answered with it. (`/setkey clear` for removing it)"
+	msgSetKeyNotRegistered    = "Your own api key is not registered. (`/setkey <api key>` for registering one)"
+	msgSetKeySaved            = "Your api key was saved (encrypted), and your requests will be answered with it."
+	msgSetKeyCleared          = "Your api key was removed, and your requests will be answered with the bot's key."
+	msgDebugLatenciesFormat   = `Latencies of the latest answer (%s, %s):
+
+- download: %s
+- upload: %s
+- first token: %s
+- generation: %s
+- delivery: %s
+- total: %s`
+
+	// prefixes of callback data of inline keyboard buttons
+	callbackDataPrefixRetryFast    = "retry_fast/"
+	callbackDataPrefixSuggestTitle = "suggest_title/"
+	callbackDataPrefixVoiceNote    = "voice_note/"
+	callbackDataPrefixContinue     = "continue/"
+	callbackDataPrefixCalendar     = "calendar/"
+	callbackDataPrefixAccess       = "access/"
+	callbackDataPrefixCostPreview  = "cost_preview/"
+	callbackDataPrefixShare        = "share/"
+
+	// for converting natural language questions to stats queries
+	statsQueryPromptFormat = `Convert the following question about the usage logs of a Telegram bot into a query.
+
+Each row of the logs is a prompt (with its generated result) which has columns:
+- chat_id: id of the chat
+- user_id: id of the user
+- username: name of the user
+- prompt_tokens: number of tokens of the prompt
+- result_tokens: number of tokens of the generated result
+- successful: 1 if the result was generated successfully, 0 otherwise
+- date: date of the prompt (in the form of 'YYYY-MM-DD')
+- created_at: datetime of the prompt (in the form of 'YYYY-MM-DD HH:MM:SS')
+
+Today is %[1]s.
+
+Question: %[2]s`
+
+	// for summarizing messages collected in the scribe mode
+	scribeSummaryPromptFormat = `Following messages were sent in a group chat today.
+
+Summarize them with the following sections:
+- Summary: what were discussed
+- Decisions: what were decided
+- Action items: who should do what
+
+If a section has nothing to mention, omit it.
+
+Messages:
+%[1]s`
+
+	// for suggesting chat titles and descriptions
+	titleSuggestionPromptFormat = `Following are recent conversations in a group chat.
+
+Suggest a short title (less than 128 characters) and a description (less than 255 characters) for this group chat, which describe the conversations well.
+
+Conversations:
+%[1]s`
+
+	// for analyzing table data
+	analyzeTablePromptFormat = `Answer the question about the following table data.
+
+Do calculations precisely, and base the answer on the summaries and data below.
+
+<table filename="%[1]s">
+%[2]s
+
+Data (%[3]s, in CSV):
+%[4]s
+</table>
+
+Question: %[5]s`
+	defaultQuestionForTables = "Describe this table data and what can be learned from it."
+
+	defaultScribeSummaryTime = "21:00"
+
+	defaultMaxMissedUpdateAgeSeconds = 60 * 60 // 1 hour
+
+	// for applying user-level and chat-level settings to prompts
+	settingsInstructionFormat = `<settings>
+Follow these settings when answering:
+%[1]s
+</settings>
+
+`
+
+	// for checking watched urls
+	watchCheckPromptFormat = `A web page is being watched for the following condition:
+<condition>
+%[1]s
+</condition>
+
+Previous content of the page (empty if it was not fetched before):
+<previous>
+%[2]s
+</previous>
+
+Current content of the page:
+<current>
+%[3]s
+</current>
+
+Judge whether the condition has newly occurred with the changes from the previous content to the current one, and summarize the relevant changes briefly.`
+
+	// for answering with calendar events
+	calendarEventsPromptFormat = `<calendar_events from="%[1]s" to="%[2]s">
+%[3]s
+</calendar_events>
+
+Answer the following request with the calendar events above:
+
+`
+
+	// for generating broadcasts
+	broadcastPromptFormat = `Generate a message which will be broadcasted to multiple Telegram chats, for the following request.
+
+You can use these placeholders which will be replaced for each chat: {{chat_title}} (title of the chat), {{chat_id}} (id of the chat), and {{date}} (today's date).
+Reply with the message only.
+
+Request: %[1]s`
+
+	// for transcribing and summarizing long voice notes
+	minLongVoiceNoteSeconds      = 60
+	voiceNoteTranscriptionPrompt = `Transcribe the attached voice note verbatim, in its original language. Reply with the transcript only.`
+	voiceNoteSummaryPromptFormat = `Condense the following transcript of a voice note into a few bullet points, in its original language. Reply with the bullet points only.
+
+Transcript:
+%[1]s`
+
+	// for /transcribe
+	transcriptionPromptFormat               = `Transcribe the speech in the attached %s verbatim, in its original language. Reply with the transcript only, as plain text.`
+	transcriptionWithTimestampsPromptFormat = `Transcribe the speech in the attached %s verbatim, in its original language. Start each utterance on a new line with its timestamp in [mm:ss] format. Reply with the transcript only, as plain text.`
+
+	// for generating quizzes
+	quizPromptFormat = `Generate %[1]d multiple-choice questions for a quiz on the following topic.
+
+Each question should have 2 to 4 options (each shorter than 100 characters) with only one correct option, and a short explanation of the answer (shorter than 200 characters).
+Questions should be shorter than 250 characters, and vary in difficulty.
+
+Topic: %[2]s`
+
+	// for pinned knowledge files of chats
+	pinnedContextPromptFormat    = `The attached file '%[1]s' is the context of this chat. Refer to it when answering the following messages.`
+	pinnedContextAcknowledgement = `Understood. I will refer to the file when answering.`
+
+	// for documents and memories of joined spaces
+	spaceContextPromptFormat = `The attached files and the following memories are shared in the space '%[1]s' of this chat. Refer to them when answering the following messages.
+
+Memories:
+%[2]s`
+	spaceContextAcknowledgement = `Understood. I will refer to the space when answering.`
+
+	// for rewriting messages
+	shortenPromptFormat = `Shorten the following text, keeping its key points, tone, and original language. Reply with the shortened text only.
+
+Text:
+%[1]s`
+	expandPromptFormat = `Expand the following text with more details and explanations, keeping its tone and original language. Do not make up facts. Reply with the expanded text only.
+
+Text:
+%[1]s`
+	formalPromptFormat = `Rewrite the following text in a formal and polite tone, keeping its meaning and original language. Reply with the rewritten text only.
+
+Text:
+%[1]s`
+	casualPromptFormat = `Rewrite the following text in a casual and friendly tone, keeping its meaning and original language. Reply with the rewritten text only.
+
+Text:
+%[1]s`
+	bulletizePromptFormat = `Rewrite the following text as concise bullet points, keeping its meaning and original language. Reply with the bullet points only.
+
+Text:
+%[1]s`
+
+	// for /summarize
+	summarizePromptFormat = `Summarize the following content in its original language, with a one-sentence TL;DR first and then the key points as concise bullet points.
+
+Content:
+%[1]s`
+	summaryOfAttachedDocument = `(the attached document)`
+
+	// for moderating group chats
+	moderationPromptFormat = `Evaluate the following message of a group chat against the rules below, as a moderator.
+
+Rules:
+%[1]s
+
+If it violates any of the rules, reply with the violated rule, a short reason, and a suggested action (warn, delete, or ban) for the admins.
+Otherwise, reply with no violation and 'none' as the suggested action.
+
+Message:
+%[2]s`
+
+	// for reporting safety blocks
+	defaultHarmReportDays       = 30
+	harmReportRelaxRatio        = 10.0 // suggest relaxing the threshold when blocked more than this percent
+	harmReportTightenRatio      = 1.0  // or tightening it when blocked less than this percent
+	harmReportChatRatio         = 25.0 // and mention chats which are blocked more than this percent
+	harmReportMinResultsForChat = 5
+
+	numRecentPromptsForTitleSuggestion = 30
+
+	numLeaderboardEntries = 5
+
+	defaultWatchIntervalMinutes = 60
+
+	defaultStreamEditIntervalMilliseconds = 1000
+	defaultStreamEditMinChars             = 500
+
+	defaultShortPromptTimeoutSeconds = 10
+
+	defaultPasteMinCodeLines = 10
+
+	maxStopSequences = 5 // limit of the gemini api
+
+	// usernames of the generations which are not requested by users, in request logs
+	moderationUsername = "(moderation)"
+	watchUsername      = "(watch)"
+	scribeUsername     = "(scribe)"
+
+	dbDriverSQLite   = "sqlite"
+	dbDriverPostgres = "postgres"
+	dbDriverMySQL    = "mysql"
+
+	defaultSQLiteJournalMode             = "WAL"
+	defaultSQLiteBusyTimeoutMilliseconds = 5000
+	defaultSQLiteSynchronous             = "NORMAL"
 
 	defaultAnswerTimeoutSeconds   = 180 // 3 minutes
 	defaultFetchURLTimeoutSeconds = 10  // 10 seconds
@@ -86,6 +617,17 @@ https://github.com/meinside/telegram-gemini-bot/raw/master/PRIVACY.md`
 	urlToTextFormat = `<link url="%[1]s" content-type="%[2]s">
 %[3]s
 </link>`
+
+	// for replacing references to telegram files in prompt to attached files
+	tgFileIDRegexp        = `tgfile://([A-Za-z0-9_-]+)`
+	tgMessageLinkRegexp   = `https?://t\.me/(c/\d+|[A-Za-z0-9_]{4,})/(\d+)`
+	tgFileRefToFileFormat = `<file telegram-reference="%[1]s">This element was replaced with the telegram file referenced by '%[1]s', and is attached to the prompt as a file.</file>`
+
+	// for replacing data urls and fenced base64 blocks in prompt to attached files
+	dataURLRegexp            = `data:([\w.+-]+/[\w.+-]+)?(?:;[\w-]+=[\w.-]+)*;base64,([A-Za-z0-9+/]+={0,2})`
+	fencedBase64Regexp       = "(?s)```base64[ \\t]*\\n([A-Za-z0-9+/=\\s]+?)\\n?```"
+	embeddedDataToFileFormat = `<file embedded-data="%[1]d">This element was replaced with the embedded data (%[2]s), and is attached to the prompt as 'file %[1]d'.</file>`
+	maxEmbeddedDataBytes     = 5 * 1024 * 1024 // 5MB
 )
 
 type chatMessageRole string
@@ -95,10 +637,81 @@ const (
 	chatMessageRoleUser  chatMessageRole = "user"
 )
 
+// behaviors for edits to stale messages
+type staleEditBehavior string
+
+const (
+	staleEditBehaviorIgnore staleEditBehavior = "ignore" // ignore edits (default)
+	staleEditBehaviorFresh  staleEditBehavior = "fresh"  // answer edited messages as fresh prompts
+)
+
+// check if given edited message is older than `max_edit_age_seconds`
+func isStaleEdit(conf config, message tg.Message) bool {
+	if conf.MaxEditAgeSeconds <= 0 {
+		return false
+	}
+
+	return time.Since(time.Unix(int64(message.Date), 0)) > time.Duration(conf.MaxEditAgeSeconds)*time.Second
+}
+
+// handle a message which arrived while the bot was not running
+//
+// returns false if it is too old to be answered, or sends a notice for the delayed answer and returns true
+func handleMissedMessage(bot telegramClient, conf config, startedAt time.Time, message tg.Message) bool {
+	sentAt := time.Unix(int64(message.Date), 0)
+	if !sentAt.Before(startedAt) {
+		return true
+	}
+
+	if time.Since(sentAt) > time.Duration(conf.MaxMissedUpdateAgeSeconds)*time.Second {
+		log.Printf("ignoring message(%d) in chat(%d) which was sent too long ago during downtime", message.MessageID, message.Chat.ID)
+		return false
+	}
+
+	_, _ = sendMessage(bot, conf, msgSorryForTheDelay, message.Chat.ID, &message.MessageID)
+	return true
+}
+
+// modes of delivering answers
+type responseMode string
+
+const (
+	responseModeStreamed    responseMode = "streamed"
+	responseModeNonStreamed responseMode = "non-streamed" // fell back to a non-streamed answer as streaming failed
+	responseModeFastModel   responseMode = "fast-model"   // retried with the faster model
+	responseModeRewrite     responseMode = "rewrite"      // rewriting a message with a low temperature
+)
+
+// reaction emoji for the answers in this mode
+func (m responseMode) reaction() string {
+	switch m {
+	case responseModeNonStreamed:
+		return "✍"
+	case responseModeFastModel:
+		return "⚡"
+	default:
+		return "👌"
+	}
+}
+
+// status message for the answers in this mode (empty if not needed)
+func (m responseMode) statusMessage(conf config) string {
+	switch m {
+	case responseModeNonStreamed:
+		return msgAnsweredNonStreamed
+	case responseModeFastModel:
+		return fmt.Sprintf(msgAnsweredWithFastModel, *conf.GoogleGenerativeModel)
+	default:
+		return ""
+	}
+}
+
 type chatMessage struct {
 	role  chatMessageRole
 	text  string
 	files [][]byte
+
+	downloaded time.Duration // time taken for downloading its files from telegram
 }
 
 // config struct for loading a configuration file
@@ -112,11 +725,134 @@ type config struct {
 
 	// configurations
 	AllowedTelegramUsers    []string `json:"allowed_telegram_users"`
+	AllowedTelegramUserIDs  []int64  `json:"allowed_telegram_user_ids,omitempty"` // for users without usernames (and not affected by renames)
+	AllowedChatIDs          []int64  `json:"allowed_chat_ids,omitempty"`          // all members of these (group) chats are allowed in them
+	AdminTelegramUsers      []string `json:"admin_telegram_users,omitempty"`
 	RequestLogsDBFilepath   string   `json:"db_filepath,omitempty"`
+	DBDriver                string   `json:"db_driver,omitempty"` // "sqlite" (default, with `db_filepath`), "postgres", or "mysql" (with `db_dsn`)
+	DBDSN                   string   `json:"db_dsn,omitempty"`
+	LogRetentionDays        int      `json:"log_retention_days,omitempty"`      // request logs older than this will be deleted (0 for keeping them forever)
+	DisableRequestLogging   bool     `json:"disable_request_logging,omitempty"` // if true, database will not be used at all
 	AnswerTimeoutSeconds    int      `json:"answer_timeout_seconds,omitempty"`
 	ReplaceHTTPURLsInPrompt bool     `json:"replace_http_urls_in_prompt,omitempty"`
 	FetchURLTimeoutSeconds  int      `json:"fetch_url_timeout_seconds,omitempty"`
 	Verbose                 bool     `json:"verbose,omitempty"`
+	VerboseScopes           []string `json:"verbose_scopes,omitempty"` // telegram, gemini, stream, db, files, and tools
+
+	// sampling and truncation of verbose logs in the `stream` scope (for keeping them usable with long answers)
+	VerboseStream verboseStreamSetting `json:"verbose_stream,omitempty"`
+
+	// pragmas of the sqlite database at `db_filepath` (for avoiding "database is locked" errors under load)
+	SQLite sqliteSetting `json:"sqlite,omitempty"`
+
+	// web-based admin console (with basic authentication), listening on a separate address
+	AdminConsole *adminConsoleSetting `json:"admin_console,omitempty"`
+
+	// scribe mode: quietly collect messages in these group chats, and post summaries daily at `scribe_summary_time` (HH:MM, local time)
+	ScribeChatIDs     []int64 `json:"scribe_chat_ids,omitempty"`
+	ScribeSummaryTime string  `json:"scribe_summary_time,omitempty"`
+
+	// moderation mode: evaluate messages in these group chats against `moderation_rules`, and flag violations in the chats
+	// (or report them to `moderation_reports_chat_id`); flagged messages are deleted only with `moderation_auto_delete`
+	ModerationChatIDs       []int64  `json:"moderation_chat_ids,omitempty"`
+	ModerationRules         []string `json:"moderation_rules,omitempty"`
+	ModerationReportsChatID *int64   `json:"moderation_reports_chat_id,omitempty"`
+	ModerationAutoDelete    bool     `json:"moderation_auto_delete,omitempty"`
+
+	// latency budget for the first token of streamed answers
+	MaxFirstTokenSeconds      int     `json:"max_first_token_seconds,omitempty"`
+	FirstTokenDeadlineSeconds int     `json:"first_token_deadline_seconds,omitempty"`
+	GoogleGenerativeModelFast *string `json:"google_generative_model_fast,omitempty"`
+
+	// daily token budget (prompt + result tokens); low priority background jobs will be postponed when it is nearly used up
+	DailyTokenBudget int64 `json:"daily_token_budget,omitempty"`
+
+	// daily token quota (prompt + result tokens) of each non-admin user; requests will be refused when it is used up
+	DailyTokenQuota int64 `json:"daily_token_quota,omitempty"`
+
+	// pricing table of models (in USD per 1M tokens, eg. {"gemini-1.5-pro-latest": {"input": 1.25, "output": 5.0}}) for calculating costs of requests,
+	// and the monthly budget cap (in USD); requests of non-admin users will be refused when the costs of this month reach it
+	ModelPricing     map[string]modelPricing `json:"model_pricing,omitempty"`
+	MonthlyBudgetCap float64                 `json:"monthly_budget_cap,omitempty"`
+
+	// prompts with documents or videos larger than this (in bytes) will be answered only after confirming their estimated tokens (and costs); 0 for no previews
+	CostPreviewMinFileBytes int `json:"cost_preview_min_file_bytes,omitempty"`
+
+	// model for non-admin users when 80% of `daily_token_budget` is used (default: `google_generative_model_fast`)
+	GoogleGenerativeModelFallback *string `json:"google_generative_model_fallback,omitempty"`
+
+	// messages which arrived during downtime will be answered if they are not older than this (default: 1 hour)
+	MaxMissedUpdateAgeSeconds int `json:"max_missed_update_age_seconds,omitempty"`
+
+	// edits to messages older than `max_edit_age_seconds` will be ignored (`stale_edit_behavior`: "ignore", default),
+	// or answered as fresh prompts without the replied context (`stale_edit_behavior`: "fresh")
+	MaxEditAgeSeconds int               `json:"max_edit_age_seconds,omitempty"`
+	StaleEditBehavior staleEditBehavior `json:"stale_edit_behavior,omitempty"`
+
+	// named groups of chat ids for `/broadcast_gen group:NAME`
+	BroadcastChatGroups map[string][]int64 `json:"broadcast_chat_groups,omitempty"`
+
+	// which messages to answer in group chats: "all" (default), or "triggered" (only mentions of the bot,
+	// replies to the bot, and messages starting with one of `group_trigger_prefixes`)
+	GroupTriggerMode     groupTriggerMode `json:"group_trigger_mode,omitempty"`
+	GroupTriggerPrefixes []string         `json:"group_trigger_prefixes,omitempty"` // eg. "!ask", "gemini,"
+
+	// chat for notifying admins of outages of telegram bot api
+	AdminNotificationsChatID *int64 `json:"admin_notifications_chat_id,omitempty"`
+
+	// where to answer in forum supergroups: "all" (default), "dedicated", or "dm_only"
+	ForumTopicsMode        forumTopicsMode `json:"forum_topics_mode,omitempty"`
+	DedicatedForumTopicIDs map[int64]int64 `json:"dedicated_forum_topic_ids,omitempty"` // message thread ids of dedicated topics, keyed by chat ids
+
+	// filters applied (in order) to all outgoing texts: "regex", "banned_words", and "disclaimer"
+	OutputFilters []outputFilterConfig `json:"output_filters,omitempty"`
+	outputFilters []outputFilter       // built from `OutputFilters`
+
+	// sequences which stop generating answers (max 5; can be overridden with `/chatsettings stop_sequences`)
+	StopSequences []string `json:"stop_sequences,omitempty"`
+
+	// interval of checking urls of `/watch` (default: 60 minutes)
+	WatchIntervalMinutes int `json:"watch_interval_minutes,omitempty"`
+
+	// chat (of admins) where requests for access from unknown users will be forwarded (unknown users are ignored if not set)
+	AccessRequestsChatID *int64 `json:"access_requests_chat_id,omitempty"`
+
+	// streamed answers are edited when `stream_edit_interval_milliseconds` (default: 1000) passed,
+	// or `stream_edit_min_chars` (default: 500) characters were generated since the last edit;
+	// edits with less than `stream_edit_min_delta_chars` (default: 0) new characters are skipped even when the interval passed
+	StreamEditIntervalMilliseconds int `json:"stream_edit_interval_milliseconds,omitempty"`
+	StreamEditMinChars             int `json:"stream_edit_min_chars,omitempty"`
+	StreamEditMinDeltaChars        int `json:"stream_edit_min_delta_chars,omitempty"`
+
+	// prompts (without files) shorter than `short_prompt_max_chars` are answered with one message without streaming,
+	// falling back to streaming when not answered in `short_prompt_timeout_seconds` (default: 10); 0 for streaming all prompts
+	ShortPromptMaxChars       int `json:"short_prompt_max_chars,omitempty"`
+	ShortPromptTimeoutSeconds int `json:"short_prompt_timeout_seconds,omitempty"`
+
+	// render display formulas ($$...$$ or \[...\]) in answers to images, and send them with the answers (needs `latex` and `dvipng`)
+	RenderLatex bool `json:"render_latex,omitempty"`
+
+	// send long answers as multiple messages, instead of offering the rest with a continue button
+	SplitLongAnswers bool `json:"split_long_answers,omitempty"`
+
+	// format of answers: "plain" (default), "html", or "markdownv2"
+	AnswerFormat answerFormat `json:"answer_format,omitempty"`
+
+	// max number of tokens of histories (oldest turns will be trimmed to fit in it; 0 for no limit)
+	MaxHistoryTokens int32 `json:"max_history_tokens,omitempty"`
+
+	// max depth of reply chains to be traversed for histories (default: 20)
+	MaxReplyChainDepth int `json:"max_reply_chain_depth,omitempty"`
+
+	// paste service for sharing code-heavy answers (github gist with `github_token`, or a self-hosted pastebin at `pastebin_url`)
+	Paste *pasteSetting `json:"paste,omitempty"`
+
+	// CalDAV calendar for calendar tools (function calls)
+	Calendar *calendarSetting `json:"calendar,omitempty"`
+
+	// secret for encrypting users' own google ai api keys (bring-your-own-key mode is enabled only with it)
+	UserAPIKeysSecret *string `json:"user_api_keys_secret,omitempty"`
+	userAPIKey        *string // user's own api key of the current request (for redacting errors with it)
 
 	// telegram bot and google api tokens
 	TelegramBotToken *string `json:"telegram_bot_token,omitempty"`
@@ -139,10 +875,10 @@ type infisicalSetting struct {
 	GoogleAIAPIKeyKeyPath   string `json:"google_ai_api_key_key_path"`
 }
 
-// load config at given path
+// load config at given path (local filepath, or url of `s3://` or `gs://` object)
 func loadConfig(fpath string) (conf config, err error) {
 	var bytes []byte
-	if bytes, err = os.ReadFile(fpath); err == nil {
+	if bytes, err = readConfigBytes(fpath); err == nil {
 		if bytes, err = standardizeJSON(bytes); err == nil {
 			if err = json.Unmarshal(bytes, &conf); err == nil {
 				if (conf.TelegramBotToken == nil || conf.GoogleAIAPIKey == nil) &&
@@ -206,6 +942,62 @@ func loadConfig(fpath string) (conf config, err error) {
 				if conf.FetchURLTimeoutSeconds <= 0 {
 					conf.FetchURLTimeoutSeconds = defaultFetchURLTimeoutSeconds
 				}
+				if conf.ScribeSummaryTime == "" {
+					conf.ScribeSummaryTime = defaultScribeSummaryTime
+				}
+				if len(conf.ModerationRules) <= 0 {
+					conf.ModerationRules = defaultModerationRules
+				}
+				if conf.GroupTriggerMode == "" {
+					conf.GroupTriggerMode = groupTriggerModeAll
+				}
+				if conf.ForumTopicsMode == "" {
+					conf.ForumTopicsMode = forumTopicsModeAll
+				}
+				if conf.MaxMissedUpdateAgeSeconds <= 0 {
+					conf.MaxMissedUpdateAgeSeconds = defaultMaxMissedUpdateAgeSeconds
+				}
+				if conf.StaleEditBehavior == "" {
+					conf.StaleEditBehavior = staleEditBehaviorIgnore
+				}
+				if conf.WatchIntervalMinutes <= 0 {
+					conf.WatchIntervalMinutes = defaultWatchIntervalMinutes
+				}
+				if conf.StreamEditIntervalMilliseconds <= 0 {
+					conf.StreamEditIntervalMilliseconds = defaultStreamEditIntervalMilliseconds
+				}
+				if conf.StreamEditMinChars <= 0 {
+					conf.StreamEditMinChars = defaultStreamEditMinChars
+				}
+				if conf.ShortPromptTimeoutSeconds <= 0 {
+					conf.ShortPromptTimeoutSeconds = defaultShortPromptTimeoutSeconds
+				}
+				if conf.SQLite.JournalMode == "" {
+					conf.SQLite.JournalMode = defaultSQLiteJournalMode
+				}
+				if conf.SQLite.BusyTimeoutMilliseconds <= 0 {
+					conf.SQLite.BusyTimeoutMilliseconds = defaultSQLiteBusyTimeoutMilliseconds
+				}
+				if conf.SQLite.Synchronous == "" {
+					conf.SQLite.Synchronous = defaultSQLiteSynchronous
+				}
+				if conf.AnswerFormat == "" {
+					conf.AnswerFormat = answerFormatPlain
+				}
+				if conf.MaxReplyChainDepth <= 0 {
+					conf.MaxReplyChainDepth = maxThreadDepth
+				}
+				if conf.Paste != nil {
+					if conf.Paste.GitHubToken == "" && conf.Paste.PastebinURL == "" {
+						log.Printf("ignoring `paste`: neither `github_token` nor `pastebin_url` is set")
+						conf.Paste = nil
+					} else if conf.Paste.MinCodeLines <= 0 {
+						conf.Paste.MinCodeLines = defaultPasteMinCodeLines
+					}
+				}
+				if conf.outputFilters, err = buildOutputFilters(conf.OutputFilters); err != nil {
+					return config{}, err
+				}
 
 				// check the existence of essential values
 				if conf.TelegramBotToken == nil || conf.GoogleAIAPIKey == nil {
@@ -226,6 +1018,13 @@ func runBot(conf config) {
 	for _, user := range conf.AllowedTelegramUsers {
 		allowedUsers[user] = true
 	}
+	loadAllowedIDs(conf)
+
+	// circuit breaker for outgoing requests
+	initTelegramCircuit(conf)
+
+	// verbose logging scopes
+	initVerboseScopes(conf)
 
 	// telegram bot client
 	bot := tg.NewClient(*token)
@@ -247,39 +1046,279 @@ func runBot(conf config) {
 		}
 	})
 
-	ctx := context.Background()
+	// gemini-things client with the faster model (for retrying answers which exceeded the latency budget)
+	var gtcFast *gt.Client = nil
+	if conf.GoogleGenerativeModelFast != nil {
+		confFast := conf
+		confFast.GoogleGenerativeModel = conf.GoogleGenerativeModelFast
+
+		if gtcFast, err = gt.NewClient(*conf.GoogleAIAPIKey, *conf.GoogleGenerativeModelFast); err != nil {
+			log.Printf("error initializing gemini-things client with the faster model: %s", redact(conf, err))
+
+			os.Exit(1)
+		}
+		defer gtcFast.Close()
+		gtcFast.SetTimeout(conf.AnswerTimeoutSeconds)
+		gtcFast.SetSystemInstructionFunc(func() string {
+			if confFast.SystemInstruction == nil {
+				return defaultSystemInstruction(confFast)
+			} else {
+				return *confFast.SystemInstruction
+			}
+		})
+	}
+
+	// client for counting tokens of histories (with `max_history_tokens`) and previewed prompts (with `cost_preview_min_file_bytes`)
+	if conf.MaxHistoryTokens > 0 || conf.CostPreviewMinFileBytes > 0 {
+		if err := initHistoryTokenCounter(conf); err != nil {
+			log.Printf("error initializing client for counting tokens: %s", redact(conf, err))
+
+			os.Exit(1)
+		}
+		defer closeHistoryTokenCounter()
+	}
+
+	// gemini-things client for moderating group chats (the faster model is cheaper)
+	var moderationClient geminiClient = gtc
+	moderationConf := conf
+	if gtcFast != nil {
+		moderationClient = gtcFast
+		moderationConf.GoogleGenerativeModel = conf.GoogleGenerativeModelFast
+	}
 
-	_ = bot.DeleteWebhook(false) // delete webhook before polling updates
+	// (canceled on SIGINT or SIGTERM, for shutting down gracefully)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	startedAt := time.Now() // for detecting messages which arrived during downtime
+
+	// fetch metadata of models for `/help` and `/config`
+	go fetchModelInfos(ctx, conf)
+
+	_ = bot.DeleteWebhook(false) // delete webhook before polling updates (pending updates are kept)
 	if b := bot.GetMe(); b.Ok {
 		log.Printf("launching bot: %s", userName(b.Result))
 
+		botUsername := b.Result.Username
+
 		// database
 		var db *Database = nil
-		if conf.RequestLogsDBFilepath != "" {
+		if conf.DisableRequestLogging {
+			log.Printf("request logging is disabled, database will not be used")
+		} else if dsn := databaseDSN(conf); dsn != "" {
 			var err error
-			if db, err = openDatabase(conf.RequestLogsDBFilepath); err != nil {
+			if db, err = openDatabase(conf.DBDriver, dsn, conf.SQLite); err != nil {
 				log.Printf("failed to open request logs db: %s", redact(conf, err))
+			} else {
+				// write prompts in the background, and flush them before exiting
+				db.startPromptWriter()
+				defer db.flushPromptWriter()
+			}
+		}
+
+		// users approved by admins
+		if db != nil {
+			loadApprovedUsers(db)
+		} else if conf.AccessRequestsChatID != nil {
+			log.Printf("access requests are not available without the database")
+		}
+
+		// scribe mode
+		if len(conf.ScribeChatIDs) > 0 {
+			if db == nil {
+				log.Printf("scribe mode is not available without the database")
+			} else if err := runDaily(ctx, conf.ScribeSummaryTime, func(ctx context.Context) {
+				runLowPriority(ctx, conf, db, "scribe summaries", func(ctx context.Context) {
+					summarizeScribedMessages(ctx, bot, conf, db, gtc)
+				})
+			}); err != nil {
+				log.Printf("failed to schedule scribe summaries: %s", err)
 			}
 		}
 
+		// ephemeral answers which were scheduled to be deleted before restarting
+		if db != nil {
+			restoreScheduledDeletions(ctx, bot, db)
+		}
+
+		// web-based admin console
+		if conf.AdminConsole != nil {
+			runAdminConsole(ctx, conf, db, allowedUsers, startedAt)
+		}
+
+		// delete expired request logs periodically
+		if db != nil && conf.LogRetentionDays > 0 {
+			deleteExpiredRequestLogs(conf, db)
+			runEvery(ctx, logRetentionIntervalHours*time.Hour, func(ctx context.Context) {
+				deleteExpiredRequestLogs(conf, db)
+			})
+		}
+
+		// check watched urls periodically
+		if db != nil {
+			runEvery(ctx, time.Duration(conf.WatchIntervalMinutes)*time.Minute, func(ctx context.Context) {
+				runLowPriority(ctx, conf, db, "watches", func(ctx context.Context) {
+					checkWatches(ctx, bot, conf, db, gtc)
+				})
+			})
+		}
+
 		// set message handler
 		bot.SetMessageHandler(func(b *tg.Bot, update tg.Update, message tg.Message, edited bool) {
+			// evaluate messages in moderated chats (with the cheap model if possible)
+			if isModeratedChat(conf, message.Chat.ID) {
+				go moderateMessage(ctx, b, moderationConf, db, moderationClient, message)
+			}
+
+			// collect messages quietly in scribe chats
+			if isScribeChat(conf, message.Chat.ID) {
+				if !edited {
+					scribeMessage(db, message)
+				}
+				return
+			}
+
 			if !isAllowed(update, allowedUsers) {
 				log.Printf("message not allowed: %s", userNameFromUpdate(update))
+
+				if !edited {
+					requestAccess(b, conf, db, message)
+				}
+				return
+			}
+			setAdminMenuCommands(b, conf, db, update)
+			if !isTriggeredInGroup(conf, db, botUsername, message) {
+				return
+			}
+			rememberMessageTopic(message)
+			if !isAnswerableInTopic(b, conf, botUsername, message) {
+				return
+			}
+			if replyUnderMaintenance(b, conf, update, message) {
+				return
+			}
+
+			// strip trigger prefixes from prompts
+			message = withoutTriggerPrefix(conf, message)
+			if edited {
+				update.EditedMessage = &message
+			} else {
+				update.Message = &message
+			}
+
+			// messages which arrived during downtime
+			if !edited && !handleMissedMessage(b, conf, startedAt, message) {
 				return
 			}
 
-			handleMessages(ctx, b, conf, db, gtc, []tg.Update{update}, nil)
+			// edits to stale messages
+			if edited && isStaleEdit(conf, message) {
+				if conf.StaleEditBehavior != staleEditBehaviorFresh {
+					log.Printf("ignoring edit of a stale message(%d) in chat(%d)", message.MessageID, message.Chat.ID)
+					return
+				}
+
+				// answer as a fresh prompt, without the replied context
+				fresh := message
+				fresh.ReplyToMessage = nil
+				update.EditedMessage = &fresh
+			}
+
+			// handle messages of each chat one by one
+			dispatchToChat(ctx, message.Chat.ID, update.UpdateID, func(ctx context.Context) {
+				// long voice notes without captions
+				if isLongVoiceNote(message) {
+					offerVoiceNoteOptions(b, conf, message)
+					return
+				}
+
+				// media with /transcribe command in their captions
+				if args, isTranscribe := strings.CutPrefix(captionOf(message), cmdTranscribe); isTranscribe {
+					transcribe(ctx, b, conf, gtc, message, args)
+					return
+				}
+
+				// documents with /summarize command in their captions
+				if args, isSummarize := strings.CutPrefix(captionOf(message), cmdSummarize); isSummarize && message.HasDocument() {
+					summarize(ctx, b, conf, db, gtc, message, userNameFromUpdate(update), isAdmin(update, conf), args)
+					return
+				}
+
+				// table files with /analyze command in their captions
+				if question, isAnalyze := strings.CutPrefix(captionOf(message), cmdAnalyze); isAnalyze && message.HasDocument() {
+					analyzeTable(ctx, b, conf, db, gtc, *message.Document, question, message.Chat.ID, message.From.ID, userNameFromUpdate(update), isAdmin(update, conf), message.MessageID)
+					return
+				}
+
+				// prompts with large files
+				if needsCostPreview(conf, []tg.Update{update}) && offerCostPreview(ctx, b, conf, db, gtc, []tg.Update{update}, nil) {
+					return
+				}
+
+				handleMessages(ctx, b, conf, db, gtc, []tg.Update{update}, nil)
+			})
 		})
 		bot.SetMediaGroupHandler(func(b *tg.Bot, updates []tg.Update, mediaGroupID string) {
+			// evaluate captions in moderated chats (messages without captions are skipped)
+			for _, update := range updates {
+				if update.HasMessage() && isModeratedChat(conf, update.Message.Chat.ID) {
+					go moderateMessage(ctx, b, moderationConf, db, moderationClient, *update.Message)
+				}
+			}
+
+			// collect messages quietly in scribe chats
+			if message := usableMessageFromUpdate(updates[0]); message != nil && isScribeChat(conf, message.Chat.ID) {
+				for _, update := range updates {
+					if update.HasMessage() {
+						scribeMessage(db, *update.Message)
+					}
+				}
+				return
+			}
+
 			for _, update := range updates {
 				if !isAllowed(update, allowedUsers) {
 					log.Printf("message (media group id: %s) not allowed: %s", mediaGroupID, userNameFromUpdate(update))
 					return
 				}
 			}
+			if !slices.ContainsFunc(updates, func(update tg.Update) bool {
+				message := usableMessageFromUpdate(update)
+				return message != nil && isTriggeredInGroup(conf, db, botUsername, *message)
+			}) {
+				return
+			}
+			for i, update := range updates {
+				if update.HasMessage() {
+					rememberMessageTopic(*update.Message)
+
+					message := withoutTriggerPrefix(conf, *update.Message)
+					updates[i].Message = &message
+				}
+			}
+			if message := usableMessageFromUpdate(updates[0]); message != nil && !isAnswerableInTopic(b, conf, botUsername, *message) {
+				return
+			}
+			if message := usableMessageFromUpdate(updates[0]); message != nil && replyUnderMaintenance(b, conf, updates[0], *message) {
+				return
+			}
+			if message := usableMessageFromUpdate(updates[0]); message != nil && updates[0].HasMessage() && !handleMissedMessage(b, conf, startedAt, *message) {
+				return
+			}
+
+			if message := usableMessageFromUpdate(updates[0]); message != nil {
+				dispatchToChat(ctx, message.Chat.ID, updates[0].UpdateID, func(ctx context.Context) {
+					// prompts with large files
+					if needsCostPreview(conf, updates) && offerCostPreview(ctx, b, conf, db, gtc, updates, &mediaGroupID) {
+						return
+					}
 
-			handleMessages(ctx, b, conf, db, gtc, updates, &mediaGroupID)
+					handleMessages(ctx, b, conf, db, gtc, updates, &mediaGroupID)
+				})
+			}
+		})
+		bot.SetPollAnswerHandler(func(b *tg.Bot, update tg.Update, pollAnswer tg.PollAnswer) {
+			handleQuizAnswer(b, conf, pollAnswer)
 		})
 		bot.SetInlineQueryHandler(func(b *tg.Bot, update tg.Update, inlineQuery tg.InlineQuery) {
 			options := tg.OptionsAnswerInlineQuery{}.
@@ -289,21 +1328,29 @@ func runBot(conf config) {
 			results := []any{}
 			prompts := retrieveSuccessfulPrompts(db, inlineQuery.From.ID)
 			if len(prompts) > 0 {
-				printer := message.NewPrinter(language.English) // for adding commas to numbers
+				f := newFormatter(userLocale(db, &inlineQuery.From)) // for formatting numbers in the user's locale
 
 				for _, prompt := range prompts {
 					article, _ := tg.NewInlineQueryResultArticle(
 						prompt.Text,
-						prompt.Result.Text,
+						filterOutgoingText(conf, prompt.Result.Text),
 						fmt.Sprintf(
 							"Tokens: input %s, output: %s",
-							printer.Sprintf("%d", prompt.Tokens),
-							printer.Sprintf("%d", prompt.Result.Tokens),
+							f.number(int64(prompt.Tokens)),
+							f.number(int64(prompt.Result.Tokens)),
 						),
 					)
 
 					results = append(results, article)
 				}
+			} else if conf.DisableRequestLogging {
+				article, _ := tg.NewInlineQueryResultArticle(
+					"No result",
+					"Prompts are not logged in this bot.",
+					"Prompts are not logged in this bot.",
+				)
+
+				results = append(results, article)
 			} else {
 				article, _ := tg.NewInlineQueryResultArticle(
 					"No result",
@@ -319,30 +1366,66 @@ func runBot(conf config) {
 			}
 		})
 
+		bot.SetCallbackQueryHandler(callbackQueryHandler(ctx, conf, db, gtc, gtcFast, allowedUsers))
+
 		// set command handlers
-		bot.AddCommandHandler(cmdStart, startCommandHandler(conf, allowedUsers))
-		bot.AddCommandHandler(cmdStats, statsCommandHandler(conf, db, allowedUsers))
-		bot.AddCommandHandler(cmdHelp, helpCommandHandler(conf, allowedUsers))
-		bot.AddCommandHandler(cmdPrivacy, privacyCommandHandler(conf))
+		bot.AddCommandHandler(cmdStart, topicGuarded(conf, botUsername, startCommandHandler(conf, db, allowedUsers)))
+		bot.AddCommandHandler(cmdStats, topicGuarded(conf, botUsername, statsCommandHandler(conf, db, allowedUsers)))
+		bot.AddCommandHandler(cmdMyStats, topicGuarded(conf, botUsername, myStatsCommandHandler(conf, db, allowedUsers)))
+		bot.AddCommandHandler(cmdHelp, topicGuarded(conf, botUsername, helpCommandHandler(conf, allowedUsers)))
+		bot.AddCommandHandler(cmdPrivacy, topicGuarded(conf, botUsername, privacyCommandHandler(conf)))
+		bot.AddCommandHandler(cmdQuery, topicGuarded(conf, botUsername, queryCommandHandler(ctx, conf, db, gtc)))
+		bot.AddCommandHandler(cmdAB, topicGuarded(conf, botUsername, experimentCommandHandler(ctx, conf, db)))
+		bot.AddCommandHandler(cmdScribe, topicGuarded(conf, botUsername, scribeCommandHandler(conf, db)))
+		bot.AddCommandHandler(cmdVerbose, topicGuarded(conf, botUsername, verboseCommandHandler(conf)))
+		bot.AddCommandHandler(cmdDBCheck, topicGuarded(conf, botUsername, dbCheckCommandHandler(conf, db)))
+		bot.AddCommandHandler(cmdDebug, topicGuarded(conf, botUsername, debugCommandHandler(conf, db)))
+		bot.AddCommandHandler(cmdQueue, topicGuarded(conf, botUsername, queueCommandHandler(conf, allowedUsers)))
+		bot.AddCommandHandler(cmdConfig, topicGuarded(conf, botUsername, configCommandHandler(ctx, conf, db, gtc, gtcFast)))
+		bot.AddCommandHandler(cmdAnalyze, topicGuarded(conf, botUsername, analyzeCommandHandler(ctx, conf, db, gtc, allowedUsers)))
+		bot.AddCommandHandler(cmdTranscribe, topicGuarded(conf, botUsername, transcribeCommandHandler(ctx, conf, gtc, allowedUsers)))
+		bot.AddCommandHandler(cmdSummarize, topicGuarded(conf, botUsername, summarizeCommandHandler(ctx, conf, db, gtc, allowedUsers)))
+		bot.AddCommandHandler(cmdSetKey, setKeyCommandHandler(conf, db, allowedUsers))
+		bot.AddCommandHandler(cmdHarmReport, topicGuarded(conf, botUsername, harmReportCommandHandler(conf, db)))
+		bot.AddCommandHandler(cmdAllow, topicGuarded(conf, botUsername, allowCommandHandler(conf, db)))
+		bot.AddCommandHandler(cmdDeny, topicGuarded(conf, botUsername, denyCommandHandler(conf, db)))
+		bot.AddCommandHandler(cmdExport, topicGuarded(conf, botUsername, exportCommandHandler(conf, db, allowedUsers)))
+		bot.AddCommandHandler(cmdExportLogs, topicGuarded(conf, botUsername, exportLogsCommandHandler(conf, db)))
+		bot.AddCommandHandler(cmdExportLogsAlias, topicGuarded(conf, botUsername, exportLogsCommandHandler(conf, db)))
+		bot.AddCommandHandler(cmdLeaderboard, topicGuarded(conf, botUsername, leaderboardCommandHandler(conf, db, allowedUsers)))
+		bot.AddCommandHandler(cmdWatch, topicGuarded(conf, botUsername, watchCommandHandler(conf, db, allowedUsers)))
+		bot.AddCommandHandler(cmdWatches, topicGuarded(conf, botUsername, watchesCommandHandler(conf, db, allowedUsers)))
+		bot.AddCommandHandler(cmdUnwatch, topicGuarded(conf, botUsername, unwatchCommandHandler(conf, db, allowedUsers)))
+		bot.AddCommandHandler(cmdBranch, topicGuarded(conf, botUsername, branchCommandHandler(conf, allowedUsers)))
+		bot.AddCommandHandler(cmdLatex, topicGuarded(conf, botUsername, latexCommandHandler(ctx, conf, allowedUsers)))
+		bot.AddCommandHandler(cmdQuiz, topicGuarded(conf, botUsername, quizCommandHandler(ctx, conf, db, gtc, allowedUsers)))
+		bot.AddCommandHandler(cmdContext, topicGuarded(conf, botUsername, contextCommandHandler(conf, db, allowedUsers)))
+		bot.AddCommandHandler(cmdSpace, topicGuarded(conf, botUsername, spaceCommandHandler(conf, db, allowedUsers)))
+		bot.AddCommandHandler(cmdEphemeral, topicGuarded(conf, botUsername, ephemeralCommandHandler(ctx, conf, db, gtc, allowedUsers)))
+		for _, cmd := range []string{cmdShorten, cmdExpand, cmdFormal, cmdCasual, cmdBulletize} {
+			bot.AddCommandHandler(cmd, topicGuarded(conf, botUsername, rewriteCommandHandler(ctx, conf, db, gtc, allowedUsers, cmd)))
+		}
+		bot.AddCommandHandler(cmdMySettings, topicGuarded(conf, botUsername, mySettingsCommandHandler(conf, db, allowedUsers)))
+		bot.AddCommandHandler(cmdChatSettings, topicGuarded(conf, botUsername, chatSettingsCommandHandler(conf, db, allowedUsers)))
+		bot.AddCommandHandler(cmdRespondIn, topicGuarded(conf, botUsername, respondInCommandHandler(conf, db, allowedUsers)))
+		bot.AddCommandHandler(cmdRespondInAlias, topicGuarded(conf, botUsername, respondInCommandHandler(conf, db, allowedUsers)))
+		bot.AddCommandHandler(cmdSuggestTitle, topicGuarded(conf, botUsername, suggestTitleCommandHandler(ctx, conf, db, gtc, allowedUsers)))
+		bot.AddCommandHandler(cmdSuggestTitleAlias, topicGuarded(conf, botUsername, suggestTitleCommandHandler(ctx, conf, db, gtc, allowedUsers)))
+		bot.AddCommandHandler(cmdBroadcast, topicGuarded(conf, botUsername, broadcastCommandHandler(conf, db, allowedUsers)))
+		bot.AddCommandHandler(cmdBroadcastGen, topicGuarded(conf, botUsername, broadcastGenCommandHandler(ctx, conf, db, gtc)))
+		bot.AddCommandHandler(cmdBroadcastGenAlias, topicGuarded(conf, botUsername, broadcastGenCommandHandler(ctx, conf, db, gtc)))
 		bot.SetNoMatchingCommandHandler(noSuchCommandHandler(conf, allowedUsers))
 
-		// set bot commands
-		if res := bot.SetMyCommands([]tg.BotCommand{
-			{
-				Command:     cmdStats,
-				Description: descStats,
-			},
-			{
-				Command:     cmdPrivacy,
-				Description: descPrivacy,
-			},
-			{
-				Command:     cmdHelp,
-				Description: descHelp,
-			},
-		}, tg.OptionsSetMyCommands{}); !res.Ok {
-			log.Printf("failed to set bot commands: %s", *res.Description)
-		}
+		// set bot commands (of enabled features, for each role)
+		setMenuCommands(bot, conf, db)
+
+		// stop polling updates on shutdown
+		go func() {
+			<-ctx.Done()
+
+			log.Printf("shutting down...")
+			bot.StopPollingUpdates()
+		}()
 
 		// poll updates
 		bot.StartPollingUpdates(0, intervalSeconds, func(b *tg.Bot, update tg.Update, err error) {
@@ -366,8 +1449,16 @@ func runBot(conf config) {
 	}
 }
 
+// check if given prompt is short enough (and without files) for answering without streaming
+//
+// (files of the history are folded into `promptFiles` too)
+func isShortPrompt(conf config, original *chatMessage, promptFiles map[string]io.Reader) bool {
+	return conf.ShortPromptMaxChars > 0 && original != nil && len(promptFiles) <= 0 &&
+		utf8.RuneCountInString(original.text) <= conf.ShortPromptMaxChars
+}
+
 // handle allowed message updates from telegram bot api
-func handleMessages(ctx context.Context, bot *tg.Bot, conf config, db *Database, gtc *gt.Client, updates []tg.Update, mediaGroupID *string) {
+func handleMessages(ctx context.Context, bot telegramClient, conf config, db *Database, gtc geminiClient, updates []tg.Update, mediaGroupID *string) {
 	if len(updates) <= 0 {
 		if mediaGroupID == nil {
 			log.Printf("failed to handle messages: no updates given")
@@ -399,14 +1490,63 @@ func handleMessages(ctx context.Context, bot *tg.Bot, conf config, db *Database,
 	userID := message.From.ID
 	messageID := message.MessageID
 
+	// remember media messages for resolving references to them later
+	rememberMediaMessage(*message)
+	for _, grouped := range otherGroupedMessages {
+		rememberMediaMessage(grouped)
+	}
+
 	var errMessage string
 	if msg := usableMessageFromUpdate(update); msg != nil {
+		downloadStartedAt := time.Now()
 		if parent, original, err := chatMessagesFromTGMessage(bot, *msg, otherGroupedMessages...); err == nil {
 			if original != nil {
+				// resolve references to telegram files in the prompt
+				var files [][]byte
+				original.text, files = convertPromptWithTelegramFileReferences(bot, conf, original.text, chatID, userID, isAdmin(update, conf))
+				original.files = append(original.files, files...)
+				original.downloaded = time.Since(downloadStartedAt)
+
+				// decode data urls and fenced base64 blocks in the prompt
+				original.text, files = convertPromptWithEmbeddedData(conf, original.text, len(original.files))
+				original.files = append(original.files, files...)
+
 				ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second)
 				defer cancel()
 
-				answer(ctx, bot, conf, db, gtc, parent, original, chatID, userID, userNameFromUpdate(update), messageID)
+				// voice notes replying to (or grouped with) photos: transcripts as prompts, with the photos attached
+				if isVoicePromptForPhotos(*msg, otherGroupedMessages...) {
+					if prompt, err := voicePromptForPhotos(ctx, bot, conf, gtc, *msg, otherGroupedMessages...); err == nil {
+						original = prompt
+						parent = nil // (the replied photo is already attached to the prompt)
+					} else {
+						log.Printf("failed to convert voice note to a prompt: %s", redact(conf, err))
+					}
+				}
+
+				// remember the user's turn, and build a history from the reply chain
+				var history []chatMessage
+				var parentMessageID *int64
+				if replied := repliedToMessage(*msg); replied != nil {
+					parentMessageID = &replied.MessageID
+
+					history = threadHistoryBefore(chatID, *parentMessageID, conf.MaxReplyChainDepth)
+					if stored, exists := threadMessageFor(chatID, *parentMessageID); !exists || stored.text != "" { // skip branch points
+						if parent != nil {
+							history = append(history, *parent)
+						}
+					}
+				}
+				rememberThreadMessage(threadMessage{
+					chatID:          chatID,
+					messageID:       messageID,
+					parentMessageID: parentMessageID,
+					role:            chatMessageRoleUser,
+					text:            original.text,
+					numFiles:        len(original.files),
+				})
+
+				answer(ctx, bot, conf, db, gtc, responseModeStreamed, history, original, chatID, userID, userNameFromUpdate(update), isAdmin(update, conf), messageID)
 
 				if err = ctx.Err(); err == nil {
 					return
@@ -435,21 +1575,15 @@ func handleMessages(ctx context.Context, bot *tg.Bot, conf config, db *Database,
 }
 
 // send given text to the chat
-func sendMessage(bot *tg.Bot, conf config, message string, chatID int64, messageID *int64) (sentMessageID int64, err error) {
-	_ = bot.SendChatAction(chatID, tg.ChatActionTyping, nil)
+func sendMessage(bot telegramClient, conf config, message string, chatID int64, messageID *int64) (sentMessageID int64, err error) {
+	_ = bot.SendChatAction(chatID, tg.ChatActionTyping, chatActionOptions(chatID, messageID))
 
-	if conf.Verbose {
-		log.Printf("[verbose] sending message to chat(%d): '%s'", chatID, message)
-	}
+	message = filterOutgoingText(conf, message)
 
-	options := tg.OptionsSendMessage{}
-	if messageID != nil {
-		options.SetReplyParameters(tg.ReplyParameters{
-			MessageID: *messageID,
-		})
-	}
+	logVerbose(verboseTelegram, "sending message to chat(%d): '%s'", chatID, message)
 
-	if res := bot.SendMessage(chatID, message, options); res.Ok {
+	if res := withRetries(bot).SendMessage(chatID, message, messageOptions(chatID, messageID)); res.Ok {
+		rememberMessageTopic(*res.Result)
 		sentMessageID = res.Result.MessageID
 	} else {
 		err = fmt.Errorf("failed to send message: %s (requested message: %s)", *res.Description, message)
@@ -459,41 +1593,83 @@ func sendMessage(bot *tg.Bot, conf config, message string, chatID int64, message
 }
 
 // update a message in the chat
-func updateMessage(bot *tg.Bot, conf config, message string, chatID int64, messageID int64) (err error) {
-	_ = bot.SendChatAction(chatID, tg.ChatActionTyping, nil)
+func updateMessage(bot telegramClient, conf config, message string, chatID int64, messageID int64) (err error) {
+	_ = bot.SendChatAction(chatID, tg.ChatActionTyping, chatActionOptions(chatID, &messageID))
 
-	if conf.Verbose {
-		log.Printf("[verbose] updating message in chat(%d): '%s'", chatID, message)
-	}
+	message = filterOutgoingText(conf, message)
+
+	logVerbose(verboseTelegram, "updating message in chat(%d): '%s'", chatID, message)
 
 	options := tg.OptionsEditMessageText{}.
 		SetIDs(chatID, messageID)
 
-	if res := bot.EditMessageText(message, options); !res.Ok {
+	if res := withRetries(bot).EditMessageText(message, options); !res.Ok {
 		err = fmt.Errorf("failed to send message: %s (requested message: %s)", *res.Description, message)
 	}
 
 	return err
 }
 
-// send given blob data as a document to the chat
-func sendFile(bot *tg.Bot, conf config, data []byte, chatID int64, messageID *int64, caption *string) (sentMessageID int64, err error) {
-	_ = bot.SendChatAction(chatID, tg.ChatActionTyping, nil)
+// replace the draft messages of a streamed answer with final ones (with a footer), and return the id of the first one
+//
+// (the footer is omitted for truncated answers, as they will be continued with a button;
+// with `split_long_answers`, long answers are sent as multiple messages)
+func replaceDraftMessage(bot telegramClient, conf config, text string, truncated bool, numTokens int32, chatID, messageID int64, draftMessageIDs []int64) (finalMessageID int64, err error) {
+	if truncated {
+		text, _ = firstChunk(text)
+	} else {
+		text += fmt.Sprintf(msgDraftFooterFormat, *conf.GoogleGenerativeModel, numTokens)
+	}
+
+	chunks := []string{text}
+	if conf.SplitLongAnswers {
+		chunks = splitIntoChunks(text, maxMessageLength)
+	}
+
+	replyTo := messageID
+	for i, chunk := range chunks {
+		var sentMessageID int64
+		if sentMessageID, err = sendFormattedMessage(bot, conf, chunk, chatID, &replyTo); err != nil {
+			if i == 0 {
+				return draftMessageIDs[0], err
+			}
+			return finalMessageID, err // (keep the drafts, as the final messages are not complete)
+		}
+		if i == 0 {
+			finalMessageID = sentMessageID
+		}
+		replyTo = sentMessageID
+	}
 
-	if conf.Verbose {
-		log.Printf("[verbose] sending document to chat(%d): %d bytes of data", chatID, len(data))
+	for _, draftMessageID := range draftMessageIDs {
+		if res := withRetries(bot).DeleteMessage(chatID, draftMessageID); !res.Ok {
+			log.Printf("failed to delete draft message: %s", *res.Description)
+		}
 	}
 
+	return finalMessageID, nil
+}
+
+// send given blob data as a document to the chat
+func sendFile(bot telegramClient, conf config, data []byte, chatID int64, messageID *int64, caption *string) (sentMessageID int64, err error) {
+	_ = bot.SendChatAction(chatID, tg.ChatActionTyping, chatActionOptions(chatID, messageID))
+
+	logVerbose(verboseTelegram, "sending document to chat(%d): %d bytes of data", chatID, len(data))
+
 	options := tg.OptionsSendDocument{}
 	if messageID != nil {
 		options.SetReplyParameters(tg.ReplyParameters{
 			MessageID: *messageID,
 		})
 	}
+	if threadID, exists := topicOfMessage(chatID, messageID); exists {
+		options.SetMessageThreadID(threadID)
+	}
 	if caption != nil {
-		options.SetCaption(*caption)
+		options.SetCaption(filterOutgoingText(conf, *caption))
 	}
-	if res := bot.SendDocument(chatID, tg.NewInputFileFromBytes(data), options); res.Ok {
+	if res := withRetries(bot).SendDocument(chatID, tg.NewInputFileFromBytes(data), options); res.Ok {
+		rememberMessageTopic(*res.Result)
 		sentMessageID = res.Result.MessageID
 	} else {
 		err = fmt.Errorf("failed to send document: %s", *res.Description)
@@ -502,15 +1678,98 @@ func sendFile(bot *tg.Bot, conf config, data []byte, chatID int64, messageID *in
 	return sentMessageID, err
 }
 
-// generate an answer to given message and send it to the chat
-func answer(ctx context.Context, bot *tg.Bot, conf config, db *Database, gtc *gt.Client, parent, original *chatMessage, chatID, userID int64, username string, messageID int64) {
+// send given image data as a photo to the chat
+func sendPhoto(bot telegramClient, conf config, data []byte, chatID int64, messageID *int64, caption *string) (sentMessageID int64, err error) {
+	_ = bot.SendChatAction(chatID, tg.ChatActionUploadPhoto, chatActionOptions(chatID, messageID))
+
+	logVerbose(verboseTelegram, "sending photo to chat(%d): %d bytes of data", chatID, len(data))
+
+	options := tg.OptionsSendPhoto{}
+	if messageID != nil {
+		options.SetReplyParameters(tg.ReplyParameters{
+			MessageID: *messageID,
+		})
+	}
+	if threadID, exists := topicOfMessage(chatID, messageID); exists {
+		options.SetMessageThreadID(threadID)
+	}
+	if caption != nil {
+		options.SetCaption(filterOutgoingText(conf, *caption))
+	}
+	if res := withRetries(bot).SendPhoto(chatID, tg.NewInputFileFromBytes(data), options); res.Ok {
+		rememberMessageTopic(*res.Result)
+		sentMessageID = res.Result.MessageID
+	} else {
+		err = fmt.Errorf("failed to send photo: %s", *res.Description)
+	}
+
+	return sentMessageID, err
+}
+
+// generate an answer to given message and send it to the chat, and return the ids of the sent messages of the answer
+func answer(ctx context.Context, bot telegramClient, conf config, db *Database, gtc geminiClient, mode responseMode, history []chatMessage, original *chatMessage, chatID, userID int64, username string, admin bool, messageID int64) (answerMessageIDs []int64) {
+	// mark it as an interactive request, for delaying low priority jobs
+	ctx, end := beginInteractiveRequest(ctx, "answer", chatID, userID, username)
+	defer end()
+
+	// user's own api key (requests with it are not limited by the budget and quotas of the bot)
+	apiKey, withOwnKey := userAPIKey(conf, db, userID)
+
+	if !withOwnKey &&
+		(exceedsMonthlyBudgetCap(bot, conf, db, chatID, admin, messageID) ||
+			exceedsDailyTokenQuota(bot, conf, db, chatID, userID, admin, messageID)) {
+		return
+	}
+
+	requestedAt := time.Now()
+
+	// latencies of the stages
+	var latencies stageLatencies
+	if original != nil {
+		latencies.download = original.downloaded
+	}
+
+	// model of the chat-level settings (or the fallback one when the daily token budget is nearly used up)
+	var downgraded bool
+	if mode != responseModeFastModel {
+		conf, gtc, downgraded = clientForChat(conf, db, gtc, chatID, admin || withOwnKey)
+	}
+	if withOwnKey {
+		var release func()
+		conf, gtc, release = clientForUserAPIKey(conf, gtc, userID, apiKey)
+		defer release()
+	}
+
+	// banned words of the chat (applied to all outgoing texts of the answer)
+	conf = withChatOutputFilters(conf, db, chatID)
+
 	// leave a reaction on the original message for confirmation
-	_ = bot.SetMessageReaction(chatID, messageID, tg.NewMessageReactionWithEmoji("👌"))
+	_ = withRetries(bot).SetMessageReaction(chatID, messageID, tg.NewMessageReactionWithEmoji("👌"))
 
 	opts := &gt.GenerationOptions{
 		HarmBlockThreshold: conf.GoogleAIHarmBlockThreshold,
 	}
 
+	// calendar tools (only for the owner of the calendar)
+	if isCalendarOwner(conf, userID) && mode != responseModeRewrite {
+		opts.Tools = calendarTools(conf)
+	}
+
+	// low temperature for rewrites
+	if mode == responseModeRewrite {
+		opts.Config = &genai.GenerationConfig{
+			Temperature: ptr[float32](rewriteTemperature),
+		}
+	}
+
+	// stop sequences of the chat (or the global ones)
+	if stops := stopSequences(conf, db, chatID); len(stops) > 0 {
+		if opts.Config == nil {
+			opts.Config = &genai.GenerationConfig{}
+		}
+		opts.Config.StopSequences = stops
+	}
+
 	// prompt
 	var promptText string
 	promptFiles := map[string]io.Reader{}
@@ -530,130 +1789,530 @@ func answer(ctx context.Context, bot *tg.Bot, conf config, db *Database, gtc *gt
 			promptFiles[fmt.Sprintf("file %d", i+1)] = bytes.NewReader(file)
 		}
 
-		if conf.Verbose {
-			log.Printf("[verbose] will process prompt text '%s' with %d files", promptText, len(promptFiles))
-		}
+		logVerbose(verboseGemini, "will process prompt text '%s' with %d files", promptText, len(promptFiles))
 	}
 
 	// histories
-	if parent != nil {
+	history = trimHistoryToTokenBudget(ctx, conf, mergeConsecutiveRoles(history))
+	if len(history) > 0 && history[len(history)-1].role == chatMessageRoleUser {
+		// fold the last user turn into the prompt, as turns should alternate between roles
+		last := history[len(history)-1]
+		history = history[:len(history)-1]
+
+		promptText = last.text + "\n\n" + promptText
+		for i, file := range last.files {
+			promptFiles[fmt.Sprintf("replied file %d", i+1)] = bytes.NewReader(file)
+		}
+	}
+	if instruction := settingsInstruction(db, chatID, userID); instruction != "" {
+		promptText = instruction + promptText
+	}
+	// (files uploaded with the bot's key are not accessible with the user's own key, so they are not reused)
+	uploadsDB := db
+	if withOwnKey {
+		uploadsDB = nil
+	}
+	contexts := append(pinnedContextMessages(bot, conf, db, chatID), spaceContextMessages(bot, conf, db, chatID)...)
+	for _, message := range mergeConsecutiveRoles(append(contexts, history...)) { // (with the pinned context and joined spaces first)
 		// text
-		parentText := parent.text
 		parts := []genai.Part{
-			genai.Text(parentText),
+			genai.Text(message.text),
 		}
 
-		// parentFiles
-		parentFiles := map[string]io.Reader{}
-		for i, file := range parent.files {
-			parentFiles[fmt.Sprintf("file %d", i+1)] = bytes.NewReader(file)
-		}
-		client, err := genai.NewClient(ctx, option.WithAPIKey(*conf.GoogleAIAPIKey))
-		if err == nil {
-			defer client.Close()
-
-			// upload files and wait
-			if uploaded, err := gtc.UploadFilesAndWait(ctx, parentFiles); err == nil {
+		// files (identical ones which were uploaded before are reused)
+		if len(message.files) > 0 {
+			uploadStartedAt := time.Now()
+			uploaded, err := uploadFilesDeduplicated(ctx, conf, uploadsDB, gtc, message.files)
+			latencies.upload += time.Since(uploadStartedAt)
+			if err == nil {
 				for _, upload := range uploaded {
 					parts = append(parts, upload)
 				}
+			} else {
+				log.Printf("failed to upload files of history: %s", redact(conf, err))
 			}
 		}
 
-		// set history for generation options
-		opts.History = []*genai.Content{
-			{
-				Role:  string(chatMessageRoleModel),
-				Parts: parts,
-			},
-		}
+		// append to the history of generation options
+		opts.History = append(opts.History, &genai.Content{
+			Role:  string(message.role),
+			Parts: parts,
+		})
 	}
 
-	// number of tokens for logging
+	// number of tokens and finish reason for logging
 	var numTokensInput int32 = 0
 	var numTokensOutput int32 = 0
+	var finishReason string
 
-	// generate
+	// watch the latency of the first token
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watch := watchFirstToken(conf, cancel, func() (int64, error) {
+		return sendMessage(bot, conf, msgStillThinking, chatID, &messageID)
+	})
+	defer watch.stop()
+
+	// send or update the streamed message
 	var firstMessageID *int64 = nil
+	var firstMessageText string
+	var following followingMessages
 	mergedText := ""
-	if err := gtc.GenerateStreamed(
-		ctx,
-		promptText,
-		promptFiles,
-		func(data gt.StreamCallbackData) {
-			if conf.Verbose {
-				log.Printf("[verbose] streaming answer to chat(%d): %+v", chatID, data)
-			}
-
-			if data.TextDelta != nil {
-				generatedText := *data.TextDelta
-				mergedText += generatedText
-
-				if firstMessageID == nil { // send the first message
-					if sentMessageID, err := sendMessage(bot, conf, generatedText, chatID, &messageID); err == nil {
-						firstMessageID = &sentMessageID
-					} else {
-						log.Printf("failed to send stream messages [%+v + %+v] with '%+v': %s", parent, original, data, redact(conf, err))
-					}
-				} else { // update the first message
-					// update the first message (append text)
-					if err := updateMessage(bot, conf, mergedText, chatID, *firstMessageID); err != nil {
-						log.Printf("failed to update stream messages [%+v + %+v] with '%+v': %s", parent, original, data, redact(conf, err))
-					}
+	truncated := false
+	var functionCall *genai.FunctionCall
+	display := func(data gt.StreamCallbackData, text string) {
+		// show only the first chunk when it gets longer than the limit
+		// (the rest will be offered with a continue button, or sent as following messages with `split_long_answers`)
+		if truncated {
+			return
+		}
+		displayStartedAt := time.Now()
+		defer func() {
+			latencies.delivery += time.Since(displayStartedAt)
+		}()
+
+		var displayedText string
+		var followingChunks []string
+		if conf.SplitLongAnswers {
+			if chunks := splitIntoChunks(text, maxMessageLength); len(chunks) > 0 {
+				displayedText, followingChunks = chunks[0], chunks[1:]
+			}
+		} else {
+			displayedText, truncated = firstChunk(text)
+		}
+
+		if firstMessageID == nil {
+			if noticeMessageID := watch.markArrived(); noticeMessageID != nil { // replace the notice message
+				firstMessageID = noticeMessageID
+
+				if err := updateFormattedMessage(bot, conf, displayedText, chatID, *firstMessageID); err != nil {
+					log.Printf("failed to update stream messages [%d history + %+v] with '%+v': %s", len(history), original, data, redact(conf, err))
 				}
-			} else if data.FinishReason != nil {
-				generatedText := fmt.Sprintf("<<<%s>>>", data.FinishReason.String())
-				mergedText += generatedText
+			} else { // send the first message
+				if sentMessageID, err := sendFormattedMessage(bot, conf, displayedText, chatID, &messageID); err == nil {
+					firstMessageID = &sentMessageID
+				} else {
+					log.Printf("failed to send stream messages [%d history + %+v] with '%+v': %s", len(history), original, data, redact(conf, err))
+				}
+			}
+		} else if displayedText != firstMessageText { // update the first message (append text)
+			if err := updateFormattedMessage(bot, conf, displayedText, chatID, *firstMessageID); err != nil {
+				log.Printf("failed to update stream messages [%d history + %+v] with '%+v': %s", len(history), original, data, redact(conf, err))
+			}
+		} else {
+			logVerbose(verboseStream, "skipping edit of message(%d) in chat(%d): not changed", *firstMessageID, chatID)
+		}
+		firstMessageText = displayedText
 
-				if firstMessageID == nil { // send the first message
-					if sentMessageID, err := sendMessage(bot, conf, generatedText, chatID, &messageID); err == nil {
-						firstMessageID = &sentMessageID
-					} else {
-						log.Printf("failed to send stream messages [%+v + %+v] with '%+v': %s", parent, original, data, redact(conf, err))
+		// continue in the following messages
+		if firstMessageID != nil && len(followingChunks) > 0 {
+			following.deliver(bot, conf, followingChunks, chatID, *firstMessageID)
+		}
+	}
+	var lastDisplayedAt, generationStartedAt time.Time
+	numPendingChars := 0
+	deliver := func(data gt.StreamCallbackData, generatedText string) {
+		if latencies.firstToken == 0 {
+			latencies.firstToken = time.Since(generationStartedAt)
+		}
+		mergedText += generatedText
+		numPendingChars += utf8.RuneCountInString(generatedText)
+
+		// coalesce edits for avoiding flood limits (the first message is sent immediately)
+		if firstMessageID != nil &&
+			time.Since(lastDisplayedAt) < time.Duration(conf.StreamEditIntervalMilliseconds)*time.Millisecond &&
+			numPendingChars < conf.StreamEditMinChars {
+			return
+		}
+
+		// skip tiny edits (the rest will be shown when the stream ends)
+		if firstMessageID != nil && numPendingChars < conf.StreamEditMinDeltaChars {
+			return
+		}
+
+		display(data, mergedText)
+		lastDisplayedAt, numPendingChars = time.Now(), 0
+	}
+
+	// generate without streaming
+	generateNonStreamed := func(ctx context.Context) error {
+		rewindFiles(promptFiles)
+		res, err := gtc.Generate(ctx, promptText, promptFiles, opts)
+		if err != nil {
+			return err
+		}
+		if res.UsageMetadata != nil {
+			numTokensInput = res.UsageMetadata.PromptTokenCount
+			numTokensOutput = res.UsageMetadata.CandidatesTokenCount
+		}
+		if len(res.Candidates) > 0 {
+			finishReason = res.Candidates[0].FinishReason.String()
+		}
+
+		if fc := functionCallFromResponse(res); fc != nil {
+			functionCall = fc
+		} else if text, err := textFromResponse(res); err == nil {
+			deliver(gt.StreamCallbackData{}, text)
+		} else {
+			return err
+		}
+		return nil
+	}
+	generateNonStreamedOrNotify := func() {
+		if err := generateNonStreamed(ctx); err != nil {
+			log.Printf("failed to generate a non-streamed answer: %s", errorString(conf, err))
+
+			_, _ = sendMessage(bot, conf, fmt.Sprintf("Failed to generate an answer: %s", errorString(conf, err)), chatID, &messageID)
+		}
+	}
+
+	generationStartedAt = time.Now()
+
+	// answer short prompts with one message, without streaming (nor edits)
+	shortPrompt := false
+	if isStreamingEnabled(db, chatID) && isShortPrompt(conf, original, promptFiles) {
+		logVerbose(verboseGemini, "generating short prompt non-streamed [%d history + %+v] ...", len(history), original)
+
+		shortCtx, cancelShort := context.WithTimeout(ctx, time.Duration(conf.ShortPromptTimeoutSeconds)*time.Second)
+		if err := generateNonStreamed(shortCtx); err == nil {
+			shortPrompt = true
+		} else {
+			log.Printf("falling back to a streamed answer of short prompt: %s", errorString(conf, err))
+		}
+		cancelShort()
+	}
+
+	// generate
+	if !isStreamingEnabled(db, chatID) { // streaming is turned off for this chat
+		logVerbose(verboseGemini, "generating non-streamed [%d history + %+v] ...", len(history), original)
+
+		generateNonStreamedOrNotify()
+	} else if !shortPrompt {
+		var streamErr error
+		numDeltas := 0
+		if err := gtc.GenerateStreamed(
+			ctx,
+			promptText,
+			promptFiles,
+			func(data gt.StreamCallbackData) {
+				if data.TextDelta != nil {
+					numDeltas++
+				}
+				logVerboseStream(conf, chatID, numDeltas, data)
+
+				if data.TextDelta != nil {
+					deliver(data, *data.TextDelta)
+				} else if data.FunctionCall != nil {
+					functionCall = data.FunctionCall
+				} else if data.FinishReason != nil {
+					finishReason = data.FinishReason.String()
+
+					deliver(data, fmt.Sprintf("<<<%s>>>", finishReason))
+				} else if data.NumTokens != nil {
+					if numTokensInput < data.NumTokens.Input {
+						numTokensInput = data.NumTokens.Input
 					}
-				} else { // update the first message
-					// update the first message (append text)
-					if err := updateMessage(bot, conf, mergedText, chatID, *firstMessageID); err != nil {
-						log.Printf("failed to update stream messages [%+v + %+v] with '%+v': %s", parent, original, data, redact(conf, err))
+					if numTokensOutput < data.NumTokens.Output {
+						numTokensOutput = data.NumTokens.Output
 					}
+				} else if data.Error != nil {
+					error := errorString(conf, data.Error)
+
+					log.Printf("error from stream: %s", error)
+
+					if firstMessageID != nil {
+						_, _ = sendMessage(bot, conf, fmt.Sprintf("Failed to iterate stream: %s", error), chatID, nil)
+					} else { // will fall back to a non-streamed answer
+						streamErr = data.Error
+					}
+				} else {
+					log.Printf("unsupported type from stream: %+v", data)
 				}
-			} else if data.NumTokens != nil {
-				if numTokensInput < data.NumTokens.Input {
-					numTokensInput = data.NumTokens.Input
-				}
-				if numTokensOutput < data.NumTokens.Output {
-					numTokensOutput = data.NumTokens.Output
-				}
-			} else if data.Error != nil {
-				error := errorString(conf, data.Error)
+			},
+			opts,
+		); err == nil {
+			logVerbose(verboseGemini, "streaming [%d history + %+v] ...", len(history), original)
+		} else {
+			log.Printf("failed to generate stream: %s", err)
+
+			streamErr = err
+		}
+
+		// fall back to a non-streamed answer if the stream failed before delivering anything
+		if streamErr != nil && firstMessageID == nil && !watch.isTimedOut() && ctx.Err() == nil {
+			log.Printf("falling back to a non-streamed answer: %s", redact(conf, streamErr))
+
+			mode = responseModeNonStreamed
+
+			generateNonStreamedOrNotify()
+		}
+
+		// show the rest of coalesced texts
+		if firstMessageID != nil && numPendingChars > 0 {
+			display(gt.StreamCallbackData{}, mergedText)
+		}
+	}
+
+	latencies.generation = time.Since(generationStartedAt)
+
+	// handle a function call of calendar tools
+	if functionCall != nil && firstMessageID == nil {
+		logVerbose(verboseTools, "handling function call in chat(%d): %+v", chatID, functionCall)
 
-				log.Printf("error from stream: %s", error)
+		switch functionCall.Name {
+		case fnNameListCalendarEvents:
+			if events, err := listCalendarEventsWithArgs(ctx, conf, functionCall.Args); err == nil {
+				// answer again with the events, without tools
+				promptText = events + promptText
+				opts.Tools = nil
 
-				_, _ = sendMessage(bot, conf, fmt.Sprintf("Failed to iterate stream: %s", error), chatID, nil)
+				generateNonStreamedOrNotify()
 			} else {
-				log.Printf("unsupported type from stream: %+v", data)
+				_, _ = sendMessage(bot, conf, fmt.Sprintf("Failed to list calendar events: %s", redact(conf, err)), chatID, &messageID)
 			}
-		},
-		opts,
-	); err == nil {
-		if conf.Verbose {
-			log.Printf("[verbose] streaming [%+v + %+v] ...", parent, original)
+		case fnNameAddCalendarEvent:
+			if sentMessageID, text, err := offerCalendarEvent(bot, conf, functionCall.Args, chatID, messageID); err == nil {
+				firstMessageID = &sentMessageID
+				mergedText = text
+			} else {
+				_, _ = sendMessage(bot, conf, fmt.Sprintf("Failed to add a calendar event: %s", redact(conf, err)), chatID, &messageID)
+			}
+		default:
+			log.Printf("unsupported function call: %s", functionCall.Name)
 		}
-	} else {
-		log.Printf("failed to generate stream: %s", err)
+	}
+
+	// offer a retry with the faster model if the first token did not arrive in time
+	if watch.isTimedOut() {
+		log.Printf("first token did not arrive in %d seconds", conf.FirstTokenDeadlineSeconds)
+
+		offerRetryWithFastModel(bot, conf, history, original, chatID, userID, username, admin, messageID)
+	}
+
+	// notice for answers with the fallback model
+	var footer string
+	if downgraded {
+		footer = fmt.Sprintf(msgDowngradedFooterFormat, *conf.GoogleGenerativeModel)
+	}
+
+	// replace the streamed draft with one final message
+	if firstMessageID != nil && functionCall == nil && mode != responseModeNonStreamed && !shortPrompt && isStreamingEnabled(db, chatID) && isDraftModeEnabled(db, chatID) {
+		replaceStartedAt := time.Now()
+		finalMessageID, err := replaceDraftMessage(bot, conf, mergedText+footer, truncated, numTokensOutput, chatID, messageID, append([]int64{*firstMessageID}, following.ids...))
+		latencies.delivery += time.Since(replaceStartedAt)
+		if err == nil {
+			firstMessageID = &finalMessageID
+			following = followingMessages{}
+		} else {
+			log.Printf("failed to replace draft message: %s", redact(conf, err))
+		}
+	} else if footer != "" && firstMessageID != nil && functionCall == nil && !truncated {
+		display(gt.StreamCallbackData{}, mergedText+footer)
+	}
+
+	// share button for code-heavy answers (with `paste`)
+	var buttons []tg.InlineKeyboardButton
+	if firstMessageID != nil && functionCall == nil {
+		buttons = shareButtons(conf, mergedText, chatID, userID, *firstMessageID)
+	}
+
+	// offer the rest of a long answer with a continue button
+	if truncated && firstMessageID != nil {
+		offerContinuation(bot, conf, mergedText, chatID, *firstMessageID, buttons...)
+	} else if len(buttons) > 0 {
+		putAnswerButtons(bot, chatID, *firstMessageID, buttons)
+	}
+
+	// render formulas in the answer
+	if conf.RenderLatex && firstMessageID != nil && functionCall == nil {
+		sendLatexFormulasIn(ctx, bot, conf, mergedText, chatID, *firstMessageID)
 	}
 
 	// log if it was successful or not
 	successful := (func() bool {
 		if firstMessageID != nil {
-			// leave a reaction on the first message for notifying the termination of the stream
-			_ = bot.SetMessageReaction(chatID, *firstMessageID, tg.NewMessageReactionWithEmoji("👌"))
+			// remember the model's turn for following replies
+			rememberThreadMessage(threadMessage{
+				chatID:          chatID,
+				messageID:       *firstMessageID,
+				parentMessageID: &messageID,
+				role:            chatMessageRoleModel,
+				text:            mergedText,
+			})
+			for _, followingMessageID := range following.ids { // (replies to the following messages continue the same thread)
+				rememberThreadMessage(threadMessage{
+					chatID:          chatID,
+					messageID:       followingMessageID,
+					parentMessageID: &messageID,
+					role:            chatMessageRoleModel,
+					text:            mergedText,
+				})
+			}
+
+			// leave a reaction on the first message for notifying the termination of the stream (differently for fallbacks)
+			_ = withRetries(bot).SetMessageReaction(chatID, *firstMessageID, tg.NewMessageReactionWithEmoji(mode.reaction()))
+			if status := mode.statusMessage(conf); status != "" {
+				_, _ = sendMessage(bot, conf, status, chatID, firstMessageID)
+			}
 
 			return true
 		}
 		return false
 	})()
-	savePromptAndResult(db, chatID, userID, username, messagesToPrompt(parent, original), uint(numTokensInput), mergedText, uint(numTokensOutput), successful)
+	logVerbose(verboseGemini, "answered to chat(%d) in response mode: %s", chatID, mode)
+
+	logVerbose(verboseGemini, "latencies of answer to chat(%d): %s", chatID, latencies)
+
+	// (requests with the user's own key cost nothing to the bot)
+	cost := requestCost(conf, *conf.GoogleGenerativeModel, uint(numTokensInput), uint(numTokensOutput))
+	if withOwnKey {
+		cost = 0
+	}
+	savePromptAndResult(db, chatID, userID, username, messagesToPrompt(history, original), uint(numTokensInput), mergedText, uint(numTokensOutput), successful, finishReason, *conf.GoogleGenerativeModel, time.Since(requestedAt), latencies, cost)
+
+	if firstMessageID != nil {
+		answerMessageIDs = append([]int64{*firstMessageID}, following.ids...)
+	}
+	return answerMessageIDs
+}
+
+// watch for the first token of a streamed answer
+type firstTokenWatch struct {
+	sync.Mutex
+
+	arrived         bool
+	timedOut        bool
+	noticeMessageID *int64
+	noticeSent      chan struct{} // closed when the notice is sent (or failed), nil if not being sent
+
+	timers []*time.Timer
+}
+
+// start watching the first token of a streamed answer
+//
+// `notify` will be called when `max_first_token_seconds` passes, and `cancel` will be called when `first_token_deadline_seconds` passes.
+func watchFirstToken(conf config, cancel context.CancelFunc, notify func() (int64, error)) *firstTokenWatch {
+	watch := &firstTokenWatch{}
+
+	if conf.MaxFirstTokenSeconds > 0 {
+		watch.timers = append(watch.timers, time.AfterFunc(time.Duration(conf.MaxFirstTokenSeconds)*time.Second, func() {
+			watch.Lock()
+			if watch.arrived || watch.timedOut {
+				watch.Unlock()
+				return
+			}
+			noticeSent := make(chan struct{})
+			watch.noticeSent = noticeSent
+			watch.Unlock()
+
+			// (send the notice without holding the lock)
+			defer close(noticeSent)
+			sentMessageID, err := notify()
+			if err != nil {
+				log.Printf("failed to send notice for the delayed first token: %s", redact(conf, err))
+				return
+			}
+
+			watch.Lock()
+			watch.noticeMessageID = &sentMessageID
+			watch.Unlock()
+		}))
+	}
+	if conf.FirstTokenDeadlineSeconds > 0 {
+		watch.timers = append(watch.timers, time.AfterFunc(time.Duration(conf.FirstTokenDeadlineSeconds)*time.Second, func() {
+			watch.Lock()
+			defer watch.Unlock()
+
+			if !watch.arrived {
+				watch.timedOut = true
+
+				cancel()
+			}
+		}))
+	}
+
+	return watch
+}
+
+// mark the arrival of the first token, and return the id of the notice message (if it was sent)
+//
+// (waits for the notice if it is being sent)
+func (w *firstTokenWatch) markArrived() (noticeMessageID *int64) {
+	w.Lock()
+	if w.arrived {
+		w.Unlock()
+		return nil
+	}
+	w.arrived = true
+	noticeSent := w.noticeSent
+	w.Unlock()
+
+	if noticeSent != nil {
+		<-noticeSent
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	return w.noticeMessageID
+}
+
+// check if the first token did not arrive before the deadline
+func (w *firstTokenWatch) isTimedOut() bool {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.timedOut
+}
+
+// stop all timers of the watch
+func (w *firstTokenWatch) stop() {
+	for _, timer := range w.timers {
+		timer.Stop()
+	}
+}
+
+// request which can be retried with the faster model
+type retryableRequest struct {
+	history  []chatMessage
+	original *chatMessage
+
+	chatID, userID int64
+	username       string
+	admin          bool
+	messageID      int64
+}
+
+// send a message with an inline button for retrying with the faster model
+func offerRetryWithFastModel(bot telegramClient, conf config, history []chatMessage, original *chatMessage, chatID, userID int64, username string, admin bool, messageID int64) {
+	message := fmt.Sprintf(msgFirstTokenTimedOut, conf.FirstTokenDeadlineSeconds)
+
+	if conf.GoogleGenerativeModelFast == nil {
+		_, _ = sendMessage(bot, conf, message, chatID, &messageID)
+		return
+	}
+
+	data := fmt.Sprintf("%s%d/%d", callbackDataPrefixRetryFast, chatID, messageID)
+
+	putCallbackValue(data, retryableRequest{
+		history:   history,
+		original:  original,
+		chatID:    chatID,
+		userID:    userID,
+		username:  username,
+		admin:     admin,
+		messageID: messageID,
+	})
+
+	options := messageOptions(chatID, &messageID).
+		SetReplyMarkup(tg.NewInlineKeyboardMarkup([][]tg.InlineKeyboardButton{
+			tg.NewInlineKeyboardButtonsWithCallbackData(map[string]string{
+				fmt.Sprintf(msgRetryWithFasterModel, *conf.GoogleGenerativeModelFast): data,
+			}),
+		}))
+	if res := withRetries(bot).SendMessage(chatID, filterOutgoingText(conf, message), options); !res.Ok {
+		log.Printf("failed to send retry button: %s", *res.Description)
+	}
 }
 
 // generate a default system instruction with given configuration
@@ -0,0 +1,179 @@
+// bot_test.go
+//
+// golden tests of handling messages and answering them, with fake clients
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+var updateGoldens = flag.Bool("update", false, "update golden files in testdata/")
+
+// load the config for tests
+func testConfig(t *testing.T) config {
+	t.Helper()
+
+	conf, err := loadConfig(filepath.Join("testdata", "config.json"))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	return conf
+}
+
+// compare given transcript with the golden file of given name (or update it with `-update`)
+func assertGolden(t *testing.T, name string, got string) {
+	t.Helper()
+
+	fpath := filepath.Join("testdata", name+".golden")
+	if *updateGoldens {
+		if err := os.WriteFile(fpath, []byte(got), 0o644); err != nil {
+			t.Fatalf("failed to update golden file: %s", err)
+		}
+		return
+	}
+
+	expected, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatalf("failed to read golden file (run with -update for creating it): %s", err)
+	}
+	if got != string(expected) {
+		t.Errorf("transcript does not match %s\n--- expected:\n%s\n--- got:\n%s", fpath, expected, got)
+	}
+}
+
+// get an update of a text message from a user in a private chat
+func textMessageUpdate(chatID, messageID int64, text string) tg.Update {
+	return tg.Update{
+		UpdateID: messageID,
+		Message: &tg.Message{
+			MessageID: messageID,
+			From: &tg.User{
+				ID:        chatID,
+				FirstName: "Tester",
+				Username:  ptr("tester"),
+			},
+			Chat: tg.Chat{ID: chatID, Type: tg.ChatTypePrivate},
+			Text: ptr(text),
+		},
+	}
+}
+
+func TestHandleMessages(t *testing.T) {
+	conf := testConfig(t)
+
+	tests := []struct {
+		name    string
+		gemini  fakeGeminiClient
+		updates func() []tg.Update
+	}{
+		{
+			name: "handle_messages_streamed",
+			gemini: fakeGeminiClient{
+				deltas: []string{"Hello", ", tester!"},
+			},
+			updates: func() []tg.Update {
+				return []tg.Update{textMessageUpdate(101, 1, "hello there")}
+			},
+		},
+		{
+			name: "handle_messages_stream_error_fallback",
+			gemini: fakeGeminiClient{
+				streamErr: errors.New("stream unavailable"),
+				text:      "Fallback answer.",
+			},
+			updates: func() []tg.Update {
+				return []tg.Update{textMessageUpdate(102, 1, "hello again")}
+			},
+		},
+		{
+			name: "handle_messages_reply_chain",
+			gemini: fakeGeminiClient{
+				deltas: []string{"The answer ", "is 42."},
+			},
+			updates: func() []tg.Update {
+				update := textMessageUpdate(103, 2, "why?")
+				update.Message.ReplyToMessage = &tg.Message{
+					MessageID: 1001, // (the first answer of the fake client)
+					From:      &tg.User{ID: 1, IsBot: true, FirstName: "Bot"},
+					Chat:      tg.Chat{ID: 103, Type: tg.ChatTypePrivate},
+					Text:      ptr("The answer is 42."),
+				}
+				return []tg.Update{textMessageUpdate(103, 1, "what is the answer?"), update}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := &transcript{}
+			bot := newFakeTelegramClient(record)
+			gtc := test.gemini
+			gtc.transcript = record
+
+			for _, update := range test.updates() {
+				handleMessages(context.Background(), bot, conf, nil, &gtc, []tg.Update{update}, nil)
+			}
+
+			assertGolden(t, test.name, record.String())
+		})
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	conf := testConfig(t)
+
+	tests := []struct {
+		name     string
+		chatID   int64
+		mode     responseMode
+		history  []chatMessage
+		original *chatMessage
+		gemini   fakeGeminiClient
+	}{
+		{
+			name:   "answer_with_history",
+			chatID: 201,
+			mode:   responseModeStreamed,
+			history: []chatMessage{
+				{role: chatMessageRoleUser, text: "first question"},
+				{role: chatMessageRoleModel, text: "first answer"},
+				{role: chatMessageRoleUser, text: "replied question"},
+			},
+			original: &chatMessage{role: chatMessageRoleUser, text: "follow-up question"},
+			gemini: fakeGeminiClient{
+				deltas: []string{"Follow-up ", "answer."},
+			},
+		},
+		{
+			name:     "answer_with_files",
+			chatID:   202,
+			mode:     responseModeStreamed,
+			original: &chatMessage{role: chatMessageRoleUser, text: "what is in this file?", files: [][]byte{[]byte("file content")}},
+			gemini: fakeGeminiClient{
+				deltas: []string{"It is a text file."},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := &transcript{}
+			bot := newFakeTelegramClient(record)
+			gtc := test.gemini
+			gtc.transcript = record
+
+			answerMessageIDs := answer(context.Background(), bot, conf, nil, &gtc, test.mode, test.history, test.original, test.chatID, test.chatID, "tester", false, 1)
+			record.record("answered: %v", answerMessageIDs)
+
+			assertGolden(t, test.name, record.String())
+		})
+	}
+}
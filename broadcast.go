@@ -0,0 +1,135 @@
+// broadcast.go
+//
+// generated answers which are broadcasted to multiple chats
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	// my libraries
+	gt "github.com/meinside/gemini-things-go"
+)
+
+const (
+	broadcastIntervalMilliseconds = 100 // for respecting the rate limits of telegram bot api
+
+	broadcastGroupPrefix = "group:"
+)
+
+// a chat which will receive a broadcast
+type broadcastTarget struct {
+	chatID    int64
+	chatTitle string
+}
+
+// split the arguments of a broadcast command into the (optional) name of a chat group and the prompt
+//
+// eg. "group:team summarize this week's news" => "team", "summarize this week's news"
+func parseBroadcastArgs(args string) (group, prompt string) {
+	args = strings.TrimSpace(args)
+	if first, rest, _ := strings.Cut(args, " "); strings.HasPrefix(first, broadcastGroupPrefix) {
+		return strings.TrimPrefix(first, broadcastGroupPrefix), strings.TrimSpace(rest)
+	}
+
+	return "", args
+}
+
+// get the target chats of a broadcast: chats in the named chat group, or all opted-in chats
+func broadcastTargets(conf config, db *Database, group string) (targets []broadcastTarget, err error) {
+	var subscriptions []BroadcastSubscription
+	if subscriptions, err = db.loadBroadcastSubscriptions(); err != nil {
+		return nil, err
+	}
+
+	if group == "" {
+		for _, subscription := range subscriptions {
+			targets = append(targets, broadcastTarget{
+				chatID:    subscription.ChatID,
+				chatTitle: subscription.ChatTitle,
+			})
+		}
+		return targets, nil
+	}
+
+	chatIDs, exists := conf.BroadcastChatGroups[group]
+	if !exists {
+		return nil, fmt.Errorf("no such chat group: '%s'", group)
+	}
+
+	titles := map[int64]string{}
+	for _, subscription := range subscriptions {
+		titles[subscription.ChatID] = subscription.ChatTitle
+	}
+	for _, chatID := range chatIDs {
+		targets = append(targets, broadcastTarget{
+			chatID:    chatID,
+			chatTitle: titles[chatID],
+		})
+	}
+	return targets, nil
+}
+
+// replace personalization placeholders in given text for the target chat
+func personalizeBroadcast(text string, target broadcastTarget, now time.Time) string {
+	return strings.NewReplacer(
+		"{{chat_title}}", target.chatTitle,
+		"{{chat_id}}", strconv.FormatInt(target.chatID, 10),
+		"{{date}}", now.Format("2006-01-02"),
+	).Replace(text)
+}
+
+// generate an answer to given prompt, and deliver it to the target chats with throttling
+func runBroadcast(ctx context.Context, bot telegramClient, conf config, db *Database, gtc geminiClient, userID int64, prompt string, targets []broadcastTarget) (delivered, failed int, err error) {
+	var generated string
+	if generated, err = generateText(ctx, gtc, fmt.Sprintf(broadcastPromptFormat, prompt), nil, &gt.GenerationOptions{
+		HarmBlockThreshold: conf.GoogleAIHarmBlockThreshold,
+	}); err != nil {
+		return 0, 0, err
+	}
+
+	broadcast := Broadcast{
+		UserID: userID,
+		Prompt: prompt,
+		Text:   generated,
+	}
+	if err = db.saveBroadcast(&broadcast); err != nil {
+		return 0, 0, err
+	}
+
+	ticker := time.NewTicker(broadcastIntervalMilliseconds * time.Millisecond)
+	defer ticker.Stop()
+
+	now := time.Now()
+	for _, target := range targets {
+		select {
+		case <-ctx.Done():
+			return delivered, failed, ctx.Err()
+		case <-ticker.C:
+		}
+
+		delivery := BroadcastDelivery{
+			BroadcastID: broadcast.ID,
+			ChatID:      target.chatID,
+		}
+		if _, err := sendMessage(bot, conf, personalizeBroadcast(generated, target, now), target.chatID, nil); err == nil {
+			delivery.Delivered = true
+			delivered++
+		} else {
+			log.Printf("failed to deliver broadcast(%d) to chat(%d): %s", broadcast.ID, target.chatID, redact(conf, err))
+
+			delivery.Error = redact(conf, err)
+			failed++
+		}
+		if err := db.saveBroadcastDelivery(delivery); err != nil {
+			log.Printf("failed to save delivery of broadcast(%d): %s", broadcast.ID, err)
+		}
+	}
+
+	return delivered, failed, nil
+}
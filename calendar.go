@@ -0,0 +1,518 @@
+// calendar.go
+//
+// calendar tools (function calls) with a CalDAV calendar
+
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	// google ai
+	"github.com/google/generative-ai-go/genai"
+
+	// my libraries
+	gt "github.com/meinside/gemini-things-go"
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+// names of calendar functions
+const (
+	fnNameListCalendarEvents = "list_calendar_events"
+	fnNameAddCalendarEvent   = "add_calendar_event"
+)
+
+const (
+	icalUTCLayout   = "20060102T150405Z"
+	icalLocalLayout = "20060102T150405"
+	icalDateLayout  = "20060102"
+
+	maxICalendarLineOctets = 75 // content lines longer than this are folded
+
+	defaultCalendarEventDuration = time.Hour
+	calendarTimeoutSeconds       = 10
+)
+
+// calendar setting struct
+type calendarSetting struct {
+	CalDAVURL string `json:"caldav_url"` // url of the calendar collection
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	Timezone  string `json:"timezone,omitempty"` // IANA timezone name (default: local timezone)
+
+	OwnerTelegramUserID int64 `json:"owner_telegram_user_id"` // only the owner can use the calendar tools
+}
+
+// location of the calendar
+func (s calendarSetting) location() *time.Location {
+	if s.Timezone != "" {
+		if loc, err := time.LoadLocation(s.Timezone); err == nil {
+			return loc
+		} else {
+			log.Printf("failed to load timezone '%s' of calendar: %s", s.Timezone, err)
+		}
+	}
+	return time.Local
+}
+
+// an event of the calendar
+type calendarEvent struct {
+	Summary  string
+	Location string
+	Start    time.Time
+	End      time.Time
+	AllDay   bool
+}
+
+// format the event for displaying
+func (e calendarEvent) String() string {
+	var when string
+	if e.AllDay {
+		when = fmt.Sprintf("%s (all day)", e.Start.Format("2006-01-02 Mon"))
+	} else {
+		when = fmt.Sprintf("%s ~ %s", e.Start.Format("2006-01-02 Mon 15:04"), e.End.Format("15:04"))
+		if e.End.YearDay() != e.Start.YearDay() || e.End.Year() != e.Start.Year() {
+			when = fmt.Sprintf("%s ~ %s", e.Start.Format("2006-01-02 Mon 15:04"), e.End.Format("2006-01-02 Mon 15:04"))
+		}
+	}
+	if e.Location != "" {
+		return fmt.Sprintf("%s: %s (at %s)", when, e.Summary, e.Location)
+	}
+	return fmt.Sprintf("%s: %s", when, e.Summary)
+}
+
+// check if given user can use the calendar tools
+func isCalendarOwner(conf config, userID int64) bool {
+	return conf.Calendar != nil && conf.Calendar.OwnerTelegramUserID == userID
+}
+
+// function declarations of calendar tools
+//
+// (current time is included in the descriptions, for resolving relative dates like 'tomorrow')
+func calendarTools(conf config) []*genai.Tool {
+	now := time.Now().In(conf.Calendar.location()).Format(time.RFC3339 + " Mon")
+
+	return []*genai.Tool{
+		{
+			FunctionDeclarations: []*genai.FunctionDeclaration{
+				{
+					Name:        fnNameListCalendarEvents,
+					Description: fmt.Sprintf("List events in the calendar of the user, between `from` and `to`. Current time is %s.", now),
+					Parameters: &genai.Schema{
+						Type: genai.TypeObject,
+						Properties: map[string]*genai.Schema{
+							"from": {Type: genai.TypeString, Description: "Start of the range, in RFC3339 format with a timezone offset."},
+							"to":   {Type: genai.TypeString, Description: "End of the range, in RFC3339 format with a timezone offset."},
+						},
+						Required: []string{"from", "to"},
+					},
+				},
+				{
+					Name:        fnNameAddCalendarEvent,
+					Description: fmt.Sprintf("Add an event to the calendar of the user. The user will be asked to confirm it before it is added. Current time is %s.", now),
+					Parameters: &genai.Schema{
+						Type: genai.TypeObject,
+						Properties: map[string]*genai.Schema{
+							"title":    {Type: genai.TypeString, Description: "Title of the event."},
+							"start":    {Type: genai.TypeString, Description: "Start of the event, in RFC3339 format with a timezone offset."},
+							"end":      {Type: genai.TypeString, Description: "End of the event, in RFC3339 format with a timezone offset. (optional, 1 hour after the start if not given)"},
+							"location": {Type: genai.TypeString, Description: "Location of the event. (optional)"},
+						},
+						Required: []string{"title", "start"},
+					},
+				},
+			},
+		},
+	}
+}
+
+// get a time argument of a function call
+func timeArg(args map[string]any, key string, loc *time.Location) (time.Time, error) {
+	value, err := gt.FuncArg[string](args, key)
+	if err != nil || value == nil {
+		return time.Time{}, fmt.Errorf("missing argument '%s'", key)
+	}
+	t, err := time.Parse(time.RFC3339, *value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse argument '%s': %s", key, err)
+	}
+	return t.In(loc), nil
+}
+
+// list events of the calendar with the arguments of given function call, and format them for the prompt
+func listCalendarEventsWithArgs(ctx context.Context, conf config, args map[string]any) (string, error) {
+	loc := conf.Calendar.location()
+
+	from, err := timeArg(args, "from", loc)
+	if err != nil {
+		return "", err
+	}
+	to, err := timeArg(args, "to", loc)
+	if err != nil {
+		return "", err
+	}
+
+	events, err := fetchCalendarEvents(ctx, conf, from, to)
+	if err != nil {
+		return "", err
+	}
+
+	lines := []string{}
+	for _, event := range events {
+		lines = append(lines, "- "+event.String())
+	}
+	if len(lines) <= 0 {
+		lines = append(lines, "(no events)")
+	}
+
+	return fmt.Sprintf(calendarEventsPromptFormat, from.Format(time.RFC3339), to.Format(time.RFC3339), strings.Join(lines, "\n")), nil
+}
+
+// ask for a confirmation of adding an event with the arguments of given function call,
+// and return the id and text of the sent message
+func offerCalendarEvent(bot telegramClient, conf config, args map[string]any, chatID, messageID int64) (sentMessageID int64, text string, err error) {
+	loc := conf.Calendar.location()
+
+	event := calendarEvent{}
+	if title, _ := gt.FuncArg[string](args, "title"); title != nil {
+		event.Summary = *title
+	}
+	if event.Summary == "" {
+		return 0, "", fmt.Errorf("missing argument 'title'")
+	}
+	if location, _ := gt.FuncArg[string](args, "location"); location != nil {
+		event.Location = *location
+	}
+	if event.Start, err = timeArg(args, "start", loc); err != nil {
+		return 0, "", err
+	}
+	if event.End, err = timeArg(args, "end", loc); err != nil {
+		event.End = event.Start.Add(defaultCalendarEventDuration)
+	}
+
+	key := fmt.Sprintf("%s%d/%d", callbackDataPrefixCalendar, chatID, messageID)
+	putCallbackValue(key, event)
+
+	button := func(text, action string) tg.InlineKeyboardButton {
+		return tg.InlineKeyboardButton{
+			Text:         text,
+			CallbackData: ptr(key + "/" + action),
+		}
+	}
+	text = fmt.Sprintf(msgCalendarConfirmFormat, event)
+	options := messageOptions(chatID, &messageID).
+		SetReplyMarkup(tg.NewInlineKeyboardMarkup([][]tg.InlineKeyboardButton{
+			{button(msgCalendarAdd, "add"), button(msgCancel, "cancel")},
+		}))
+	if res := withRetries(bot).SendMessage(chatID, filterOutgoingText(conf, text), options); res.Ok {
+		return res.Result.MessageID, text, nil
+	} else {
+		return 0, "", fmt.Errorf("failed to send calendar event confirmation: %s", *res.Description)
+	}
+}
+
+// add (or cancel) a calendar event with given callback query
+func handleCalendarCallback(ctx context.Context, b *tg.Bot, conf config, callbackQuery tg.CallbackQuery, data string) {
+	idx := strings.LastIndex(data, "/")
+	key, action := data[:idx], data[idx+1:]
+
+	event, exists := popCallbackValue[calendarEvent](key)
+	if !exists {
+		_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgCalendarExpired))
+		return
+	}
+	if !isCalendarOwner(conf, callbackQuery.From.ID) {
+		putCallbackValue(key, event) // put it back for the owner
+
+		_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgCalendarNotOwner))
+		return
+	}
+
+	text := msgCalendarEventCanceled
+	if action == "add" {
+		ctx, cancel := context.WithTimeout(ctx, calendarTimeoutSeconds*time.Second)
+		defer cancel()
+
+		if err := putCalendarEvent(ctx, conf, event); err == nil {
+			text = msgCalendarEventAdded
+		} else {
+			log.Printf("failed to add calendar event: %s", redact(conf, err))
+
+			text = fmt.Sprintf("Failed to add the event: %s", redact(conf, err))
+		}
+	}
+	_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(text))
+}
+
+// find a function call in given response
+func functionCallFromResponse(res *genai.GenerateContentResponse) *genai.FunctionCall {
+	for _, candidate := range res.Candidates {
+		if candidate.Content == nil {
+			continue
+		}
+		for _, part := range candidate.Content.Parts {
+			if fc, ok := part.(genai.FunctionCall); ok {
+				return &fc
+			}
+		}
+		break // use the first candidate only
+	}
+	return nil
+}
+
+// send a CalDAV request to the calendar
+func calendarRequest(ctx context.Context, conf config, method, url string, headers map[string]string, body string) (status int, respBody []byte, err error) {
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, method, url, strings.NewReader(body)); err != nil {
+		return 0, nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if conf.Calendar.Username != "" {
+		req.SetBasicAuth(conf.Calendar.Username, conf.Calendar.Password)
+	}
+
+	logVerbose(verboseTools, "sending %s request to calendar: %s", method, url)
+
+	var resp *http.Response
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err = io.ReadAll(resp.Body)
+
+	return resp.StatusCode, respBody, err
+}
+
+// CalDAV calendar-query for events in a time range (with recurring ones expanded)
+const calendarQueryFormat = `<?xml version="1.0" encoding="utf-8"?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop>
+    <C:calendar-data>
+      <C:expand start="%[1]s" end="%[2]s"/>
+    </C:calendar-data>
+  </D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="VEVENT">
+        <C:time-range start="%[1]s" end="%[2]s"/>
+      </C:comp-filter>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>`
+
+// multistatus response of CalDAV
+type calDAVMultistatus struct {
+	Responses []struct {
+		Propstats []struct {
+			CalendarData string `xml:"prop>calendar-data"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// fetch events of the calendar between `from` and `to`
+func fetchCalendarEvents(ctx context.Context, conf config, from, to time.Time) (events []calendarEvent, err error) {
+	body := fmt.Sprintf(calendarQueryFormat, from.UTC().Format(icalUTCLayout), to.UTC().Format(icalUTCLayout))
+
+	status, respBody, err := calendarRequest(ctx, conf, "REPORT", conf.Calendar.CalDAVURL, map[string]string{
+		"Content-Type": "application/xml; charset=utf-8",
+		"Depth":        "1",
+	}, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query calendar: %s", err)
+	}
+	if status != http.StatusMultiStatus {
+		return nil, fmt.Errorf("failed to query calendar: HTTP %d", status)
+	}
+
+	var multistatus calDAVMultistatus
+	if err = xml.Unmarshal(respBody, &multistatus); err != nil {
+		return nil, fmt.Errorf("failed to parse calendar response: %s", err)
+	}
+
+	loc := conf.Calendar.location()
+	for _, response := range multistatus.Responses {
+		for _, propstat := range response.Propstats {
+			events = append(events, parseICalendarEvents(propstat.CalendarData, loc)...)
+		}
+	}
+	slices.SortFunc(events, func(a, b calendarEvent) int {
+		return a.Start.Compare(b.Start)
+	})
+
+	return events, nil
+}
+
+// add an event to the calendar
+func putCalendarEvent(ctx context.Context, conf config, event calendarEvent) error {
+	uid := fmt.Sprintf("%d@telegram-gemini-bot", time.Now().UnixNano())
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//meinside//telegram-gemini-bot//EN",
+		"BEGIN:VEVENT",
+		"UID:" + uid,
+		"DTSTAMP:" + time.Now().UTC().Format(icalUTCLayout),
+		"DTSTART:" + event.Start.UTC().Format(icalUTCLayout),
+		"DTEND:" + event.End.UTC().Format(icalUTCLayout),
+		"SUMMARY:" + escapeICalendarText(event.Summary),
+	}
+	if event.Location != "" {
+		lines = append(lines, "LOCATION:"+escapeICalendarText(event.Location))
+	}
+	lines = append(lines, "END:VEVENT", "END:VCALENDAR", "")
+	for i, line := range lines {
+		lines[i] = foldICalendarLine(line)
+	}
+
+	url := strings.TrimSuffix(conf.Calendar.CalDAVURL, "/") + "/" + uid + ".ics"
+	status, _, err := calendarRequest(ctx, conf, http.MethodPut, url, map[string]string{
+		"Content-Type":  "text/calendar; charset=utf-8",
+		"If-None-Match": "*",
+	}, strings.Join(lines, "\r\n"))
+	if err != nil {
+		return err
+	}
+	if status != http.StatusCreated && status != http.StatusNoContent && status != http.StatusOK {
+		return fmt.Errorf("HTTP %d", status)
+	}
+
+	return nil
+}
+
+// parse VEVENTs in given iCalendar data
+//
+// (times without timezones are interpreted in `loc`)
+func parseICalendarEvents(data string, loc *time.Location) (events []calendarEvent) {
+	// unfold lines
+	lines := []string{}
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+		} else {
+			lines = append(lines, line)
+		}
+	}
+
+	var event *calendarEvent
+	depth := 0 // depth of components nested in a VEVENT (eg. VALARM)
+	for _, line := range lines {
+		nameWithParams, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		name, params, _ := strings.Cut(nameWithParams, ";")
+
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			event = &calendarEvent{}
+		case event == nil:
+			continue
+		case name == "BEGIN":
+			depth++
+		case name == "END" && depth > 0:
+			depth--
+		case name == "END" && value == "VEVENT":
+			if event.End.IsZero() {
+				if event.AllDay {
+					event.End = event.Start.AddDate(0, 0, 1)
+				} else {
+					event.End = event.Start
+				}
+			}
+			events = append(events, *event)
+			event = nil
+		case depth > 0:
+			continue
+		case name == "SUMMARY":
+			event.Summary = unescapeICalendarText(value)
+		case name == "LOCATION":
+			event.Location = unescapeICalendarText(value)
+		case name == "DTSTART":
+			if t, allDay, err := parseICalendarTime(value, params, loc); err == nil {
+				event.Start, event.AllDay = t, allDay
+			}
+		case name == "DTEND":
+			if t, _, err := parseICalendarTime(value, params, loc); err == nil {
+				event.End = t
+			}
+		}
+	}
+
+	return events
+}
+
+// parse a DATE or DATE-TIME value of iCalendar
+func parseICalendarTime(value, params string, loc *time.Location) (t time.Time, allDay bool, err error) {
+	for _, param := range strings.Split(params, ";") {
+		if k, v, _ := strings.Cut(param, "="); k == "TZID" {
+			if tz, err := time.LoadLocation(strings.Trim(v, `"`)); err == nil {
+				loc = tz
+			}
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(value, "Z"):
+		t, err = time.Parse(icalUTCLayout, value)
+		return t.In(loc), false, err
+	case len(value) == len(icalDateLayout):
+		t, err = time.ParseInLocation(icalDateLayout, value, loc)
+		return t, true, err
+	default:
+		t, err = time.ParseInLocation(icalLocalLayout, value, loc)
+		return t, false, err
+	}
+}
+
+// escape a TEXT value of iCalendar
+//
+// (line breaks of any kind are escaped, and other control characters except tabs are removed)
+func escapeICalendarText(text string) string {
+	text = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(text)
+
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\t' {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// fold a content line of iCalendar into lines of at most 75 octets (RFC 5545, 3.1)
+//
+// (multi-byte characters are not split, and following lines start with a space)
+func foldICalendarLine(line string) string {
+	var folded strings.Builder
+	limit := maxICalendarLineOctets
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		folded.WriteString(line[:cut])
+		folded.WriteString("\r\n ")
+		line = line[cut:]
+		limit = maxICalendarLineOctets - 1 // (for the leading space)
+	}
+	folded.WriteString(line)
+
+	return folded.String()
+}
+
+// unescape a TEXT value of iCalendar
+func unescapeICalendarText(text string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(text)
+}
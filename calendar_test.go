@@ -0,0 +1,56 @@
+// calendar_test.go
+//
+// tests of escaping and folding iCalendar texts
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscapeICalendarText(t *testing.T) {
+	tests := map[string]string{
+		"plain":                  "plain",
+		"a;b,c\\d":               `a\;b\,c\\d`,
+		"line 1\r\nline 2\rline": `line 1\nline 2\nline`,
+		"tab\tbell\a":            "tab\tbell",
+	}
+
+	for text, expected := range tests {
+		if escaped := escapeICalendarText(text); escaped != expected {
+			t.Errorf("expected %q for %q, got %q", expected, text, escaped)
+		}
+	}
+}
+
+func TestFoldICalendarLine(t *testing.T) {
+	summary := strings.Repeat("긴 일정 제목 ", 20) + "\r\nand more"
+	folded := foldICalendarLine("SUMMARY:" + escapeICalendarText(summary))
+
+	if !strings.Contains(folded, "\r\n ") {
+		t.Errorf("expected folded lines, got %q", folded)
+	}
+	for _, line := range strings.Split(folded, "\r\n") {
+		if len(line) > maxICalendarLineOctets {
+			t.Errorf("expected lines of at most %d octets, got %d: %q", maxICalendarLineOctets, len(line), line)
+		}
+	}
+
+	data := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"BEGIN:VEVENT",
+		"DTSTART:20261016T090000Z",
+		folded,
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+	events := parseICalendarEvents(data, time.UTC)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if expected := strings.ReplaceAll(summary, "\r\n", "\n"); events[0].Summary != expected {
+		t.Errorf("expected summary %q, got %q", expected, events[0].Summary)
+	}
+}
@@ -0,0 +1,185 @@
+// chats.go
+//
+// per-chat loops (actors) which handle messages of each chat one by one
+
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	chatLoopInboxSize     = 32                     // number of messages which can be waiting in a chat loop
+	chatLoopIdleDuration  = 10 * time.Minute       // chat loops will stop after being idle for this duration
+	chatLoopReorderWindow = 100 * time.Millisecond // handlings dispatched within this window are reordered by their update ids
+)
+
+// a handling of an update, dispatched to a chat loop
+type chatHandling struct {
+	updateID int64
+	handle   func(ctx context.Context)
+}
+
+// a loop which handles messages of a chat sequentially, in the order of their updates
+//
+// (histories and settings are kept in their own stores; this loop only keeps them from being touched concurrently)
+type chatLoop struct {
+	chatID int64
+	inbox  chan chatHandling
+
+	pending int // number of messages dispatched but not received yet (guarded by `chatLoops`)
+
+	waiting []chatHandling // received but not handled yet, ordered by update ids (owned by the loop goroutine)
+}
+
+// running chat loops, keyed by chat ids
+var chatLoops = struct {
+	sync.Mutex
+
+	loops map[int64]*chatLoop
+}{
+	loops: map[int64]*chatLoop{},
+}
+
+// dispatch given handling of an update to the loop of given chat
+//
+// handlings in the same chat will be run one at a time, in the order of their update ids
+// (updates are handled in their own goroutines, so they may be dispatched out of order)
+func dispatchToChat(ctx context.Context, chatID, updateID int64, handle func(ctx context.Context)) {
+	chatLoops.Lock()
+	loop, exists := chatLoops.loops[chatID]
+	if !exists {
+		loop = &chatLoop{
+			chatID: chatID,
+			inbox:  make(chan chatHandling, chatLoopInboxSize),
+		}
+		chatLoops.loops[chatID] = loop
+
+		go loop.run(ctx)
+	}
+	loop.pending++
+	chatLoops.Unlock()
+
+	select {
+	case loop.inbox <- chatHandling{updateID: updateID, handle: handle}:
+	case <-ctx.Done():
+		chatLoops.Lock()
+		loop.pending--
+		chatLoops.Unlock()
+	}
+}
+
+// run the loop until it gets idle, or `ctx` is done
+func (l *chatLoop) run(ctx context.Context) {
+	timer := time.NewTimer(chatLoopIdleDuration)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			l.stop()
+			return
+		case handling := <-l.inbox:
+			l.receive(handling)
+
+			// wait for handlings of the updates which were received around the same time
+			if !l.gather(ctx) {
+				l.stop()
+				return
+			}
+			for len(l.waiting) > 0 {
+				handling, l.waiting = l.waiting[0], l.waiting[1:]
+				l.handle(ctx, handling.handle)
+
+				l.drain()
+			}
+
+			timer.Reset(chatLoopIdleDuration)
+		case <-timer.C:
+			// stop only when nothing is on the way
+			chatLoops.Lock()
+			if l.pending == 0 {
+				delete(chatLoops.loops, l.chatID)
+				chatLoops.Unlock()
+
+				logVerbose(verboseTelegram, "stopping idle loop of chat(%d)", l.chatID)
+				return
+			}
+			chatLoops.Unlock()
+
+			timer.Reset(chatLoopIdleDuration)
+		}
+	}
+}
+
+// put given handling in the waiting ones, ordered by update ids
+func (l *chatLoop) receive(handling chatHandling) {
+	index, _ := slices.BinarySearchFunc(l.waiting, handling.updateID, func(h chatHandling, updateID int64) int {
+		switch {
+		case h.updateID < updateID:
+			return -1
+		case h.updateID > updateID:
+			return 1
+		}
+		return 0
+	})
+	l.waiting = slices.Insert(l.waiting, index, handling)
+}
+
+// receive handlings for the reorder window, and return false if `ctx` is done meanwhile
+func (l *chatLoop) gather(ctx context.Context) bool {
+	window := time.NewTimer(chatLoopReorderWindow)
+	defer window.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case handling := <-l.inbox:
+			l.receive(handling)
+		case <-window.C:
+			return true
+		}
+	}
+}
+
+// receive handlings which are already in the inbox, without waiting
+func (l *chatLoop) drain() {
+	for {
+		select {
+		case handling := <-l.inbox:
+			l.receive(handling)
+		default:
+			return
+		}
+	}
+}
+
+// run given handling, recovering from panics so that the loop keeps running
+func (l *chatLoop) handle(ctx context.Context, handle func(ctx context.Context)) {
+	chatLoops.Lock()
+	l.pending--
+	chatLoops.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("recovered from panic while handling a message in chat(%d): %v", l.chatID, r)
+		}
+	}()
+
+	handle(ctx)
+}
+
+// remove the loop from running ones
+func (l *chatLoop) stop() {
+	chatLoops.Lock()
+	defer chatLoops.Unlock()
+
+	if chatLoops.loops[l.chatID] == l {
+		delete(chatLoops.loops, l.chatID)
+	}
+}
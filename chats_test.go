@@ -0,0 +1,58 @@
+// chats_test.go
+//
+// tests of handling messages of each chat one by one
+
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDispatchToChatNeverOverlaps(t *testing.T) {
+	ctx := context.Background()
+
+	const chatID, numDispatches = 401, 10
+
+	var running, maxRunning atomic.Int32
+	var mu sync.Mutex
+	var handled []int64
+
+	var wg sync.WaitGroup
+	wg.Add(numDispatches)
+
+	// (dispatched concurrently and in reverse, as updates are handled in their own goroutines)
+	for i := numDispatches; i > 0; i-- {
+		go dispatchToChat(ctx, chatID, int64(i), func(ctx context.Context) {
+			defer wg.Done()
+
+			now := running.Add(1)
+			for {
+				if highest := maxRunning.Load(); now <= highest || maxRunning.CompareAndSwap(highest, now) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			handled = append(handled, int64(i))
+			mu.Unlock()
+
+			running.Add(-1)
+		})
+	}
+	wg.Wait()
+
+	if maxRunning.Load() != 1 {
+		t.Errorf("expected dispatches to one chat never to overlap, got %d running at once", maxRunning.Load())
+	}
+	for i, updateID := range handled {
+		if updateID != int64(i+1) {
+			t.Errorf("expected dispatches to be handled in the order of update ids, got %v", handled)
+			break
+		}
+	}
+}
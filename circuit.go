@@ -0,0 +1,220 @@
+// circuit.go
+//
+// circuit breaker for outgoing requests to telegram bot api
+//
+// When most of the recent requests fail to reach the api (eg. network outages), the circuit opens:
+// sends are queued (in memory) and edits fail fast without hammering the api.
+// After `circuitOpenDuration`, one request is let through for probing, and the circuit closes on its success,
+// delivering the queued sends.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	circuitWindowSize      = 20               // number of recent requests for calculating the failure rate
+	circuitMinRequests     = 10               // minimum number of recent requests for opening the circuit
+	circuitFailureRatio    = 0.5              // the circuit opens when this ratio of recent requests failed
+	circuitOpenDuration    = 30 * time.Second // duration before probing again
+	maxCircuitQueuedSends  = 100              // number of sends which can be queued while the circuit is open
+	errorDescriptionQueued = "telegram api is unreachable, queued for delivery"
+	errorDescriptionOpen   = "telegram api is unreachable, not requested"
+)
+
+// a request to telegram bot api, which returns if it was successful (and its description)
+type telegramRequest func(client telegramClient) (ok bool, description *string)
+
+// states of the circuit breaker
+type circuitState string
+
+const (
+	circuitStateClosed circuitState = "closed"
+	circuitStateOpen   circuitState = "open"
+)
+
+// circuit breaker for outgoing requests to telegram bot api
+var telegramCircuit = struct {
+	sync.Mutex
+
+	state    circuitState
+	outcomes []bool // results of recent requests (true for failures)
+	openedAt time.Time
+	probedAt time.Time
+	probing  bool
+
+	queued []telegramRequest
+
+	notify func(client telegramClient, message string) // for notifying admins
+}{
+	state: circuitStateClosed,
+}
+
+// set up the circuit breaker with given config
+func initTelegramCircuit(conf config) {
+	telegramCircuit.Lock()
+	defer telegramCircuit.Unlock()
+
+	telegramCircuit.notify = func(client telegramClient, message string) {
+		if conf.AdminNotificationsChatID == nil {
+			return
+		}
+		if res := client.SendMessage(*conf.AdminNotificationsChatID, filterOutgoingText(conf, message), nil); !res.Ok {
+			log.Printf("failed to notify admins: %s", *res.Description)
+		}
+	}
+}
+
+// check if given failure means that the api was not reachable
+// (not for errors returned from the api, like bad requests)
+func isUnreachable(ok bool, description *string) bool {
+	return !ok && description != nil &&
+		(strings.Contains(*description, " failed with error: ") || strings.Contains(*description, " failed to parse json: "))
+}
+
+// run given request through the circuit breaker, and return if it was requested (or queued)
+//
+// (when the circuit is open, queueable requests are queued and others are dropped)
+func requestThroughCircuit(client telegramClient, queueable bool, request telegramRequest) (requested, queued bool) {
+	allowed, probe := allowTelegramRequest()
+	if !allowed {
+		if queueable {
+			return false, queueTelegramRequest(request)
+		}
+		return false, false
+	}
+
+	ok, description := request(client)
+	recordTelegramRequest(client, !isUnreachable(ok, description), probe)
+
+	return true, false
+}
+
+// check if a request can be sent now, and if it is the one for probing
+func allowTelegramRequest() (allowed, probe bool) {
+	telegramCircuit.Lock()
+	defer telegramCircuit.Unlock()
+
+	if telegramCircuit.state == circuitStateClosed {
+		return true, false
+	}
+
+	// let one request through for probing
+	if !telegramCircuit.probing && time.Since(telegramCircuit.probedAt) >= circuitOpenDuration {
+		telegramCircuit.probing = true
+		return true, true
+	}
+	return false, false
+}
+
+// queue given request for delivering it when the circuit closes
+func queueTelegramRequest(request telegramRequest) bool {
+	telegramCircuit.Lock()
+	defer telegramCircuit.Unlock()
+
+	if len(telegramCircuit.queued) >= maxCircuitQueuedSends {
+		log.Printf("dropping a send, as too many sends are queued while telegram api is unreachable")
+		return false
+	}
+	telegramCircuit.queued = append(telegramCircuit.queued, request)
+
+	return true
+}
+
+// record the result of a request, and open or close the circuit
+//
+// (while the circuit is open, only the result of the probe counts;
+// results of the requests which were in flight when it opened are ignored)
+func recordTelegramRequest(client telegramClient, reachable, probe bool) {
+	telegramCircuit.Lock()
+	defer telegramCircuit.Unlock()
+
+	if telegramCircuit.state == circuitStateOpen {
+		if !probe {
+			return
+		}
+
+		telegramCircuit.probing = false
+		if reachable {
+			closeTelegramCircuit(client)
+		} else {
+			telegramCircuit.probedAt = time.Now()
+		}
+		return
+	}
+
+	telegramCircuit.outcomes = append(telegramCircuit.outcomes, !reachable)
+	if len(telegramCircuit.outcomes) > circuitWindowSize {
+		telegramCircuit.outcomes = telegramCircuit.outcomes[len(telegramCircuit.outcomes)-circuitWindowSize:]
+	}
+
+	failures := 0
+	for _, failed := range telegramCircuit.outcomes {
+		if failed {
+			failures++
+		}
+	}
+	if len(telegramCircuit.outcomes) >= circuitMinRequests && float64(failures)/float64(len(telegramCircuit.outcomes)) >= circuitFailureRatio {
+		openTelegramCircuit(failures, len(telegramCircuit.outcomes))
+	}
+}
+
+// open the circuit (should be called with the lock held)
+func openTelegramCircuit(failures, requests int) {
+	log.Printf("telegram api is unreachable (%d of %d recent requests failed), opening the circuit", failures, requests)
+
+	telegramCircuit.state = circuitStateOpen
+	telegramCircuit.openedAt = time.Now()
+	telegramCircuit.probedAt = telegramCircuit.openedAt
+	telegramCircuit.outcomes = nil
+
+	// notify admins first when it closes
+	if notify := telegramCircuit.notify; notify != nil {
+		message := fmt.Sprintf(msgCircuitOpenedFormat, telegramCircuit.openedAt.Format(time.RFC3339), failures, requests)
+		telegramCircuit.queued = append([]telegramRequest{func(client telegramClient) (bool, *string) {
+			notify(client, message)
+			return true, nil
+		}}, telegramCircuit.queued...)
+	}
+}
+
+// close the circuit, and deliver the queued requests (should be called with the lock held)
+func closeTelegramCircuit(client telegramClient) {
+	downtime := time.Since(telegramCircuit.openedAt).Round(time.Second)
+	queued := telegramCircuit.queued
+
+	log.Printf("telegram api is reachable again after %s, closing the circuit and delivering %d queued requests", downtime, len(queued))
+
+	telegramCircuit.state = circuitStateClosed
+	telegramCircuit.queued = nil
+	notify := telegramCircuit.notify
+
+	go func() {
+		// (when the circuit opens again while delivering, the rest will be queued again)
+		for _, request := range queued {
+			_, _ = requestThroughCircuit(client, true, request)
+		}
+		if notify != nil {
+			message := fmt.Sprintf(msgCircuitClosedFormat, downtime, len(queued)-1) // (except the notification of opening)
+			_, _ = requestThroughCircuit(client, true, func(client telegramClient) (bool, *string) {
+				notify(client, message)
+				return true, nil
+			})
+		}
+	}()
+}
+
+// response of a send which was not requested, as the circuit is open
+func circuitOpenResponse[T any](queued bool) tg.APIResponse[T] {
+	if queued {
+		return tg.APIResponse[T]{Ok: false, Description: ptr(errorDescriptionQueued)}
+	}
+	return tg.APIResponse[T]{Ok: false, Description: ptr(errorDescriptionOpen)}
+}
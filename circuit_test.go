@@ -0,0 +1,168 @@
+// circuit_test.go
+//
+// tests of the circuit breaker for outgoing requests to telegram bot api
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+// reset the circuit breaker to its initial state
+func resetTelegramCircuit() {
+	telegramCircuit.Lock()
+	defer telegramCircuit.Unlock()
+
+	telegramCircuit.state = circuitStateClosed
+	telegramCircuit.outcomes = nil
+	telegramCircuit.openedAt = time.Time{}
+	telegramCircuit.probedAt = time.Time{}
+	telegramCircuit.probing = false
+	telegramCircuit.queued = nil
+	telegramCircuit.notify = nil
+}
+
+// get the state of the circuit breaker, and the number of queued requests
+func telegramCircuitState() (state circuitState, probing bool, numQueued int) {
+	telegramCircuit.Lock()
+	defer telegramCircuit.Unlock()
+
+	return telegramCircuit.state, telegramCircuit.probing, len(telegramCircuit.queued)
+}
+
+// count the requests of given method in given transcript
+func countRequests(record *transcript, method string) (count int) {
+	record.Lock()
+	defer record.Unlock()
+
+	for _, line := range record.lines {
+		if strings.HasPrefix(line, "telegram: "+method+"(") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestTelegramCircuit(t *testing.T) {
+	const numQueuedSends = 2
+
+	tests := []struct {
+		name string
+
+		inFlightResult bool // record a result of a request which was in flight when the circuit opened
+		probe          bool // send a probe after `circuitOpenDuration`
+		probeReachable bool // result of the probe
+
+		expectedState   circuitState
+		expectedQueued  int
+		expectedReplays int // queued sends delivered after the circuit closed
+	}{
+		{
+			name:           "opens_and_queues",
+			expectedState:  circuitStateOpen,
+			expectedQueued: numQueuedSends,
+		},
+		{
+			name:           "in_flight_result_ignored",
+			inFlightResult: true,
+			expectedState:  circuitStateOpen,
+			expectedQueued: numQueuedSends,
+		},
+		{
+			name:           "probe_failure",
+			probe:          true,
+			probeReachable: false,
+			expectedState:  circuitStateOpen,
+			expectedQueued: numQueuedSends + 1, // (with the one sent after the failed probe)
+		},
+		{
+			name:            "closes_and_replays",
+			probe:           true,
+			probeReachable:  true,
+			expectedState:   circuitStateClosed,
+			expectedQueued:  0,
+			expectedReplays: numQueuedSends,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetTelegramCircuit()
+			defer resetTelegramCircuit()
+
+			record := &transcript{}
+			fake := newFakeTelegramClient(record)
+			bot := withRetries(fake)
+
+			// open the circuit with failures
+			fake.setUnreachable(true)
+			for range circuitMinRequests {
+				_ = bot.SendMessage(int64(501), "unreachable", tg.OptionsSendMessage{})
+			}
+			if state, _, _ := telegramCircuitState(); state != circuitStateOpen {
+				t.Fatalf("expected the circuit to be open after %d failures, got %s", circuitMinRequests, state)
+			}
+
+			// sends are queued, and edits fail fast
+			for range numQueuedSends {
+				if res := bot.SendMessage(int64(501), "queued", tg.OptionsSendMessage{}); res.Ok || *res.Description != errorDescriptionQueued {
+					t.Errorf("expected the send to be queued, got %+v", res)
+				}
+			}
+			if res := bot.EditMessageText("edited", tg.OptionsEditMessageText{}); res.Ok || *res.Description != errorDescriptionOpen {
+				t.Errorf("expected the edit to fail fast, got %+v", res)
+			}
+
+			if test.inFlightResult {
+				recordTelegramRequest(fake, true, false)
+			}
+
+			if test.probe {
+				telegramCircuit.Lock()
+				telegramCircuit.probedAt = time.Now().Add(-circuitOpenDuration)
+				telegramCircuit.Unlock()
+
+				fake.setUnreachable(!test.probeReachable)
+				res := bot.SendMessage(int64(501), "probe", tg.OptionsSendMessage{})
+				if res.Ok != test.probeReachable {
+					t.Errorf("expected the probe to be ok: %t, got %+v", test.probeReachable, res)
+				}
+
+				// (no more probes until `circuitOpenDuration` passes again)
+				if !test.probeReachable {
+					if res := bot.SendMessage(int64(501), "not a probe", tg.OptionsSendMessage{}); *res.Description != errorDescriptionQueued {
+						t.Errorf("expected the send after a failed probe to be queued, got %+v", res)
+					}
+				}
+			}
+
+			state, probing, numQueued := telegramCircuitState()
+			if state != test.expectedState {
+				t.Errorf("expected the circuit to be %s, got %s", test.expectedState, state)
+			}
+			if probing {
+				t.Errorf("expected no probes to be in flight")
+			}
+			if numQueued != test.expectedQueued {
+				t.Errorf("expected %d queued requests, got %d", test.expectedQueued, numQueued)
+			}
+
+			// (queued sends are delivered in the background)
+			replayed := func() int {
+				return countRequests(record, "SendMessage") - 1 // (except the probe)
+			}
+			if test.expectedReplays > 0 {
+				for deadline := time.Now().Add(time.Second); replayed() < test.expectedReplays && time.Now().Before(deadline); {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			if test.probe && test.probeReachable && replayed() != test.expectedReplays {
+				t.Errorf("expected %d queued sends to be replayed, got %d", test.expectedReplays, replayed())
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+// clients.go
+//
+// interfaces of telegram bot api and gemini api clients,
+// which are the seams for replacing them with fake ones (eg. in tests)
+
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"time"
+
+	// google ai
+	"github.com/google/generative-ai-go/genai"
+
+	// my libraries
+	gt "github.com/meinside/gemini-things-go"
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+// telegram bot api client which is used for handling messages
+type telegramClient interface {
+	SendMessage(chatID tg.ChatID, text string, options tg.OptionsSendMessage) tg.APIResponse[tg.Message]
+	EditMessageText(text string, options tg.OptionsEditMessageText) tg.APIResponseMessageOrBool
+	EditMessageReplyMarkup(options tg.OptionsEditMessageReplyMarkup) tg.APIResponseMessageOrBool
+	DeleteMessage(chatID tg.ChatID, messageID int64) tg.APIResponse[bool]
+	SendDocument(chatID tg.ChatID, document tg.InputFile, options tg.OptionsSendDocument) tg.APIResponse[tg.Message]
+	SendPhoto(chatID tg.ChatID, photo tg.InputFile, options tg.OptionsSendPhoto) tg.APIResponse[tg.Message]
+	SendPoll(chatID tg.ChatID, question string, pollOptions []tg.InputPollOption, options tg.OptionsSendPoll) tg.APIResponse[tg.Message]
+	SendChatAction(chatID tg.ChatID, action tg.ChatAction, options tg.OptionsSendChatAction) tg.APIResponse[bool]
+	SetMessageReaction(chatID tg.ChatID, messageID int64, options tg.OptionsSetMessageReaction) tg.APIResponse[bool]
+	AnswerCallbackQuery(callbackQueryID string, options tg.OptionsAnswerCallbackQuery) tg.APIResponse[bool]
+	GetChatMember(chatID tg.ChatID, userID int64) tg.APIResponse[tg.ChatMember]
+	GetFile(fileID string) tg.APIResponse[tg.File]
+	GetFileURL(file tg.File) string
+}
+
+const (
+	maxTelegramRetries           = 3  // max number of retries for rate limited (429 Too Many Requests) requests
+	maxTelegramRetryAfterSeconds = 60 // requests will not be retried if `retry_after` is longer than this
+)
+
+// telegram bot api client which retries sending, editing, and deleting messages (and reacting to them) after `retry_after` seconds,
+// when they are rate limited (429 Too Many Requests)
+type retryingTelegramClient struct {
+	telegramClient
+}
+
+// wrap given client for retrying rate limited requests
+func withRetries(bot telegramClient) telegramClient {
+	if _, retrying := bot.(retryingTelegramClient); retrying {
+		return bot
+	}
+	return retryingTelegramClient{bot}
+}
+
+// wait for `retry_after` of given response parameters, and return if the request should be retried
+func waitForRetry(ok bool, params *tg.APIResponseParameters, attempt int) bool {
+	if ok || params == nil || params.RetryAfter == nil || attempt >= maxTelegramRetries || *params.RetryAfter > maxTelegramRetryAfterSeconds {
+		return false
+	}
+
+	log.Printf("rate limited by telegram, retrying after %d seconds (attempt %d/%d)", *params.RetryAfter, attempt+1, maxTelegramRetries)
+
+	time.Sleep(time.Duration(*params.RetryAfter) * time.Second)
+
+	return true
+}
+
+// SendMessage sends a message, with retries.
+//
+// (queued when the circuit is open)
+func (c retryingTelegramClient) SendMessage(chatID tg.ChatID, text string, options tg.OptionsSendMessage) (res tg.APIResponse[tg.Message]) {
+	if requested, queued := requestThroughCircuit(c.telegramClient, true, func(client telegramClient) (bool, *string) {
+		for attempt := 0; ; attempt++ {
+			if res = client.SendMessage(chatID, text, options); !waitForRetry(res.Ok, res.Parameters, attempt) {
+				return res.Ok, res.Description
+			}
+		}
+	}); !requested {
+		return circuitOpenResponse[tg.Message](queued)
+	}
+	return res
+}
+
+// EditMessageText edits the text of a message, with retries.
+//
+// (fails fast when the circuit is open)
+func (c retryingTelegramClient) EditMessageText(text string, options tg.OptionsEditMessageText) (res tg.APIResponseMessageOrBool) {
+	if requested, _ := requestThroughCircuit(c.telegramClient, false, func(client telegramClient) (bool, *string) {
+		for attempt := 0; ; attempt++ {
+			if res = client.EditMessageText(text, options); !waitForRetry(res.Ok, res.Parameters, attempt) {
+				return res.Ok, res.Description
+			}
+		}
+	}); !requested {
+		return tg.APIResponseMessageOrBool{Ok: false, Description: ptr(errorDescriptionOpen)}
+	}
+	return res
+}
+
+// EditMessageReplyMarkup edits the reply markup of a message, with retries.
+//
+// (fails fast when the circuit is open)
+func (c retryingTelegramClient) EditMessageReplyMarkup(options tg.OptionsEditMessageReplyMarkup) (res tg.APIResponseMessageOrBool) {
+	if requested, _ := requestThroughCircuit(c.telegramClient, false, func(client telegramClient) (bool, *string) {
+		for attempt := 0; ; attempt++ {
+			if res = client.EditMessageReplyMarkup(options); !waitForRetry(res.Ok, res.Parameters, attempt) {
+				return res.Ok, res.Description
+			}
+		}
+	}); !requested {
+		return tg.APIResponseMessageOrBool{Ok: false, Description: ptr(errorDescriptionOpen)}
+	}
+	return res
+}
+
+// DeleteMessage deletes a message, with retries.
+//
+// (fails fast when the circuit is open)
+func (c retryingTelegramClient) DeleteMessage(chatID tg.ChatID, messageID int64) (res tg.APIResponse[bool]) {
+	if requested, _ := requestThroughCircuit(c.telegramClient, false, func(client telegramClient) (bool, *string) {
+		for attempt := 0; ; attempt++ {
+			if res = client.DeleteMessage(chatID, messageID); !waitForRetry(res.Ok, res.Parameters, attempt) {
+				return res.Ok, res.Description
+			}
+		}
+	}); !requested {
+		return circuitOpenResponse[bool](false)
+	}
+	return res
+}
+
+// SetMessageReaction sets a reaction on a message, with retries.
+//
+// (fails fast when the circuit is open)
+func (c retryingTelegramClient) SetMessageReaction(chatID tg.ChatID, messageID int64, options tg.OptionsSetMessageReaction) (res tg.APIResponse[bool]) {
+	if requested, _ := requestThroughCircuit(c.telegramClient, false, func(client telegramClient) (bool, *string) {
+		for attempt := 0; ; attempt++ {
+			if res = client.SetMessageReaction(chatID, messageID, options); !waitForRetry(res.Ok, res.Parameters, attempt) {
+				return res.Ok, res.Description
+			}
+		}
+	}); !requested {
+		return circuitOpenResponse[bool](false)
+	}
+	return res
+}
+
+// SendDocument sends a document, with retries.
+//
+// (queued when the circuit is open)
+func (c retryingTelegramClient) SendDocument(chatID tg.ChatID, document tg.InputFile, options tg.OptionsSendDocument) (res tg.APIResponse[tg.Message]) {
+	if requested, queued := requestThroughCircuit(c.telegramClient, true, func(client telegramClient) (bool, *string) {
+		for attempt := 0; ; attempt++ {
+			if res = client.SendDocument(chatID, document, options); !waitForRetry(res.Ok, res.Parameters, attempt) {
+				return res.Ok, res.Description
+			}
+		}
+	}); !requested {
+		return circuitOpenResponse[tg.Message](queued)
+	}
+	return res
+}
+
+// SendPhoto sends a photo, with retries.
+//
+// (queued when the circuit is open)
+func (c retryingTelegramClient) SendPhoto(chatID tg.ChatID, photo tg.InputFile, options tg.OptionsSendPhoto) (res tg.APIResponse[tg.Message]) {
+	if requested, queued := requestThroughCircuit(c.telegramClient, true, func(client telegramClient) (bool, *string) {
+		for attempt := 0; ; attempt++ {
+			if res = client.SendPhoto(chatID, photo, options); !waitForRetry(res.Ok, res.Parameters, attempt) {
+				return res.Ok, res.Description
+			}
+		}
+	}); !requested {
+		return circuitOpenResponse[tg.Message](queued)
+	}
+	return res
+}
+
+// SendPoll sends a poll, with retries.
+//
+// (fails fast when the circuit is open, as quiz sessions are kept with the ids of sent polls)
+func (c retryingTelegramClient) SendPoll(chatID tg.ChatID, question string, pollOptions []tg.InputPollOption, options tg.OptionsSendPoll) (res tg.APIResponse[tg.Message]) {
+	if requested, _ := requestThroughCircuit(c.telegramClient, false, func(client telegramClient) (bool, *string) {
+		for attempt := 0; ; attempt++ {
+			if res = client.SendPoll(chatID, question, pollOptions, options); !waitForRetry(res.Ok, res.Parameters, attempt) {
+				return res.Ok, res.Description
+			}
+		}
+	}); !requested {
+		return circuitOpenResponse[tg.Message](false)
+	}
+	return res
+}
+
+// gemini api client which is used for generating answers
+type geminiClient interface {
+	GenerateStreamed(ctx context.Context, promptText string, promptFiles map[string]io.Reader, fnStreamCallback gt.FnStreamCallback, options ...*gt.GenerationOptions) error
+	Generate(ctx context.Context, promptText string, promptFiles map[string]io.Reader, options ...*gt.GenerationOptions) (*genai.GenerateContentResponse, error)
+	UploadFilesAndWait(ctx context.Context, files map[string]io.Reader) ([]genai.FileData, error)
+}
+
+// check if the real clients satisfy the interfaces
+var (
+	_ telegramClient = (*tg.Bot)(nil)
+	_ telegramClient = retryingTelegramClient{}
+	_ geminiClient   = (*gt.Client)(nil)
+)
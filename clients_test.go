@@ -0,0 +1,279 @@
+// clients_test.go
+//
+// fake telegram bot api and gemini api clients, which record the requests to them for golden tests
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	// google ai
+	"github.com/google/generative-ai-go/genai"
+
+	// my libraries
+	gt "github.com/meinside/gemini-things-go"
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+// requests to the fake clients, in the order of being requested
+type transcript struct {
+	sync.Mutex
+
+	lines []string
+}
+
+// record a request
+func (t *transcript) record(format string, a ...any) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.lines = append(t.lines, fmt.Sprintf(format, a...))
+}
+
+// get the recorded requests as a string
+func (t *transcript) String() string {
+	t.Lock()
+	defer t.Unlock()
+
+	return strings.Join(t.lines, "\n") + "\n"
+}
+
+// marshal given value (eg. options of requests) for recording it
+func marshalled(v any) string {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("(failed to marshal: %s)", err)
+	}
+	return string(bytes)
+}
+
+// fake telegram bot api client
+//
+// (sent messages get sequential ids starting from `nextMessageID`)
+type fakeTelegramClient struct {
+	sync.Mutex
+
+	transcript    *transcript
+	nextMessageID int64
+	unreachable   bool // if true, sending and editing messages fail as if the api was not reachable
+}
+
+// description of failures when the api is not reachable (as the one of the real client)
+const fakeUnreachableDescription = "http request failed with error: connection refused"
+
+// check if the fake api is not reachable
+func (c *fakeTelegramClient) isUnreachable() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.unreachable
+}
+
+// make the fake api (un)reachable
+func (c *fakeTelegramClient) setUnreachable(unreachable bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.unreachable = unreachable
+}
+
+// create a new fake telegram bot api client which records requests to given transcript
+func newFakeTelegramClient(t *transcript) *fakeTelegramClient {
+	return &fakeTelegramClient{
+		transcript:    t,
+		nextMessageID: 1000,
+	}
+}
+
+// get a message with a new id
+func (c *fakeTelegramClient) newMessage(chatID tg.ChatID, text string) *tg.Message {
+	c.Lock()
+	defer c.Unlock()
+
+	c.nextMessageID++
+
+	id, _ := chatID.(int64)
+	return &tg.Message{
+		MessageID: c.nextMessageID,
+		Chat:      tg.Chat{ID: id, Type: tg.ChatTypePrivate},
+		Text:      &text,
+	}
+}
+
+func (c *fakeTelegramClient) SendMessage(chatID tg.ChatID, text string, options tg.OptionsSendMessage) tg.APIResponse[tg.Message] {
+	if c.isUnreachable() {
+		return tg.APIResponse[tg.Message]{Ok: false, Description: ptr(fakeUnreachableDescription)}
+	}
+
+	message := c.newMessage(chatID, text)
+	c.transcript.record("telegram: SendMessage(%v, %q, %s) => %d", chatID, text, marshalled(options), message.MessageID)
+	return tg.APIResponse[tg.Message]{Ok: true, Result: message}
+}
+
+func (c *fakeTelegramClient) EditMessageText(text string, options tg.OptionsEditMessageText) tg.APIResponseMessageOrBool {
+	if c.isUnreachable() {
+		return tg.APIResponseMessageOrBool{Ok: false, Description: ptr(fakeUnreachableDescription)}
+	}
+
+	c.transcript.record("telegram: EditMessageText(%q, %s)", text, marshalled(options))
+	return tg.APIResponseMessageOrBool{Ok: true, ResultBool: ptr(true)}
+}
+
+func (c *fakeTelegramClient) EditMessageReplyMarkup(options tg.OptionsEditMessageReplyMarkup) tg.APIResponseMessageOrBool {
+	c.transcript.record("telegram: EditMessageReplyMarkup(%s)", marshalled(options))
+	return tg.APIResponseMessageOrBool{Ok: true, ResultBool: ptr(true)}
+}
+
+func (c *fakeTelegramClient) DeleteMessage(chatID tg.ChatID, messageID int64) tg.APIResponse[bool] {
+	c.transcript.record("telegram: DeleteMessage(%v, %d)", chatID, messageID)
+	return tg.APIResponse[bool]{Ok: true, Result: ptr(true)}
+}
+
+func (c *fakeTelegramClient) SendDocument(chatID tg.ChatID, document tg.InputFile, options tg.OptionsSendDocument) tg.APIResponse[tg.Message] {
+	message := c.newMessage(chatID, "")
+	c.transcript.record("telegram: SendDocument(%v, %d bytes, %s) => %d", chatID, len(document.Bytes), marshalled(options), message.MessageID)
+	return tg.APIResponse[tg.Message]{Ok: true, Result: message}
+}
+
+func (c *fakeTelegramClient) SendPhoto(chatID tg.ChatID, photo tg.InputFile, options tg.OptionsSendPhoto) tg.APIResponse[tg.Message] {
+	message := c.newMessage(chatID, "")
+	c.transcript.record("telegram: SendPhoto(%v, %d bytes, %s) => %d", chatID, len(photo.Bytes), marshalled(options), message.MessageID)
+	return tg.APIResponse[tg.Message]{Ok: true, Result: message}
+}
+
+func (c *fakeTelegramClient) SendPoll(chatID tg.ChatID, question string, pollOptions []tg.InputPollOption, options tg.OptionsSendPoll) tg.APIResponse[tg.Message] {
+	message := c.newMessage(chatID, question)
+	c.transcript.record("telegram: SendPoll(%v, %q, %s, %s) => %d", chatID, question, marshalled(pollOptions), marshalled(options), message.MessageID)
+	return tg.APIResponse[tg.Message]{Ok: true, Result: message}
+}
+
+func (c *fakeTelegramClient) SendChatAction(chatID tg.ChatID, action tg.ChatAction, options tg.OptionsSendChatAction) tg.APIResponse[bool] {
+	c.transcript.record("telegram: SendChatAction(%v, %s)", chatID, action)
+	return tg.APIResponse[bool]{Ok: true, Result: ptr(true)}
+}
+
+func (c *fakeTelegramClient) SetMessageReaction(chatID tg.ChatID, messageID int64, options tg.OptionsSetMessageReaction) tg.APIResponse[bool] {
+	c.transcript.record("telegram: SetMessageReaction(%v, %d, %s)", chatID, messageID, marshalled(options))
+	return tg.APIResponse[bool]{Ok: true, Result: ptr(true)}
+}
+
+func (c *fakeTelegramClient) AnswerCallbackQuery(callbackQueryID string, options tg.OptionsAnswerCallbackQuery) tg.APIResponse[bool] {
+	c.transcript.record("telegram: AnswerCallbackQuery(%q, %s)", callbackQueryID, marshalled(options))
+	return tg.APIResponse[bool]{Ok: true, Result: ptr(true)}
+}
+
+func (c *fakeTelegramClient) GetChatMember(chatID tg.ChatID, userID int64) tg.APIResponse[tg.ChatMember] {
+	c.transcript.record("telegram: GetChatMember(%v, %d)", chatID, userID)
+	return tg.APIResponse[tg.ChatMember]{Ok: true, Result: &tg.ChatMember{Status: tg.ChatMemberStatusMember}}
+}
+
+func (c *fakeTelegramClient) GetFile(fileID string) tg.APIResponse[tg.File] {
+	c.transcript.record("telegram: GetFile(%q)", fileID)
+	return tg.APIResponse[tg.File]{Ok: false, Description: ptr("files are not supported by the fake client")}
+}
+
+func (c *fakeTelegramClient) GetFileURL(file tg.File) string {
+	return ""
+}
+
+// fake gemini api client
+//
+// (streams `deltas`, or fails with `streamErr`; non-streamed requests are answered with `text`)
+type fakeGeminiClient struct {
+	transcript *transcript
+
+	deltas    []string
+	streamErr error
+	text      string
+}
+
+// record the prompt and options of a generation request
+func (c *fakeGeminiClient) recordGeneration(method, promptText string, promptFiles map[string]io.Reader, options []*gt.GenerationOptions) {
+	files := []string{}
+	for name := range promptFiles {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+
+	history := []string{}
+	for _, opts := range options {
+		if opts == nil {
+			continue
+		}
+		for _, content := range opts.History {
+			texts := []string{}
+			for _, part := range content.Parts {
+				if text, ok := part.(genai.Text); ok {
+					texts = append(texts, string(text))
+				}
+			}
+			history = append(history, fmt.Sprintf("%s: %s", content.Role, strings.Join(texts, " ")))
+		}
+	}
+
+	c.transcript.record("gemini: %s(%q, files: %s, history: %s)", method, promptText, marshalled(files), marshalled(history))
+}
+
+func (c *fakeGeminiClient) GenerateStreamed(ctx context.Context, promptText string, promptFiles map[string]io.Reader, fnStreamCallback gt.FnStreamCallback, options ...*gt.GenerationOptions) error {
+	c.recordGeneration("GenerateStreamed", promptText, promptFiles, options)
+
+	if c.streamErr != nil {
+		return c.streamErr
+	}
+
+	var output int32
+	for _, delta := range c.deltas {
+		fnStreamCallback(gt.StreamCallbackData{TextDelta: ptr(delta)})
+		output += int32(len(strings.Fields(delta)))
+	}
+	fnStreamCallback(gt.StreamCallbackData{NumTokens: &gt.NumTokens{Input: int32(len(strings.Fields(promptText))), Output: output}})
+
+	return nil
+}
+
+func (c *fakeGeminiClient) Generate(ctx context.Context, promptText string, promptFiles map[string]io.Reader, options ...*gt.GenerationOptions) (*genai.GenerateContentResponse, error) {
+	c.recordGeneration("Generate", promptText, promptFiles, options)
+
+	return &genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{
+			{
+				Content: &genai.Content{
+					Role:  string(chatMessageRoleModel),
+					Parts: []genai.Part{genai.Text(c.text)},
+				},
+				FinishReason: genai.FinishReasonStop,
+			},
+		},
+		UsageMetadata: &genai.UsageMetadata{
+			PromptTokenCount:     int32(len(strings.Fields(promptText))),
+			CandidatesTokenCount: int32(len(strings.Fields(c.text))),
+		},
+	}, nil
+}
+
+func (c *fakeGeminiClient) UploadFilesAndWait(ctx context.Context, files map[string]io.Reader) (uploaded []genai.FileData, err error) {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	c.transcript.record("gemini: UploadFilesAndWait(%s)", marshalled(names))
+
+	for _, name := range names {
+		uploaded = append(uploaded, genai.FileData{MIMEType: "application/octet-stream", URI: "fake://" + name})
+	}
+	return uploaded, nil
+}
+
+// check if the fake clients satisfy the interfaces
+var (
+	_ telegramClient = (*fakeTelegramClient)(nil)
+	_ geminiClient   = (*fakeGeminiClient)(nil)
+)
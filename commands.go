@@ -0,0 +1,172 @@
+// commands.go
+//
+// bot commands shown in the menu of telegram apps, generated from the enabled features and roles
+
+package main
+
+import (
+	"log"
+	"os/exec"
+	"sync"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+// roles of users who can run commands
+type commandRole int
+
+const (
+	commandRoleEveryone   commandRole = iota // all allowed users
+	commandRoleGroupAdmin                    // admins of group chats
+	commandRoleAdmin                         // users in `admin_telegram_users`
+)
+
+// a bot command shown in the menu
+type menuCommand struct {
+	command     string
+	description string
+	role        commandRole
+
+	enabled func(conf config, db *Database) bool // nil if always enabled
+}
+
+// check if the database is available
+func withDatabase(_ config, db *Database) bool {
+	return db != nil
+}
+
+// check if LaTeX formulas can be rendered
+func withLatex(_ config, _ *Database) bool {
+	for _, tool := range []string{"latex", "dvipng"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// check if the scribe mode is enabled
+func withScribe(conf config, db *Database) bool {
+	return db != nil && len(conf.ScribeChatIDs) > 0
+}
+
+// check if bring-your-own-key mode is enabled
+func withUserAPIKeys(conf config, db *Database) bool {
+	return db != nil && conf.UserAPIKeysSecret != nil
+}
+
+// all commands for the menu (aliases are left out)
+var menuCommands = []menuCommand{
+	{cmdStats, descStats, commandRoleEveryone, withDatabase},
+	{cmdMyStats, descMyStats, commandRoleEveryone, withDatabase},
+	{cmdPrivacy, descPrivacy, commandRoleEveryone, nil},
+	{cmdHelp, descHelp, commandRoleEveryone, nil},
+	{cmdAnalyze, descAnalyze, commandRoleEveryone, nil},
+	{cmdTranscribe, descTranscribe, commandRoleEveryone, nil},
+	{cmdQuiz, descQuiz, commandRoleEveryone, nil},
+	{cmdLatex, descLatex, commandRoleEveryone, withLatex},
+	{cmdEphemeral, descEphemeral, commandRoleEveryone, nil},
+	{cmdShorten, descShorten, commandRoleEveryone, nil},
+	{cmdExpand, descExpand, commandRoleEveryone, nil},
+	{cmdFormal, descFormal, commandRoleEveryone, nil},
+	{cmdCasual, descCasual, commandRoleEveryone, nil},
+	{cmdBulletize, descBulletize, commandRoleEveryone, nil},
+	{cmdSummarize, descSummarize, commandRoleEveryone, nil},
+	{cmdBranch, descBranch, commandRoleEveryone, nil},
+	{cmdQueue, descQueue, commandRoleEveryone, nil},
+	{cmdExport, descExport, commandRoleEveryone, withDatabase},
+	{cmdMySettings, descMySettings, commandRoleEveryone, withDatabase},
+	{cmdSetKey, descSetKey, commandRoleEveryone, withUserAPIKeys},
+	{cmdWatch, descWatch, commandRoleEveryone, withDatabase},
+	{cmdWatches, descWatches, commandRoleEveryone, withDatabase},
+	{cmdUnwatch, descUnwatch, commandRoleEveryone, withDatabase},
+	{cmdLeaderboard, descLeaderboard, commandRoleEveryone, withDatabase},
+	{cmdScribe, descScribe, commandRoleEveryone, withScribe},
+	{cmdSpace, descSpace, commandRoleEveryone, withDatabase},
+
+	{cmdChatSettings, descChatSettings, commandRoleGroupAdmin, withDatabase},
+	{cmdRespondIn, descRespondIn, commandRoleGroupAdmin, withDatabase},
+	{cmdSuggestTitle, descSuggestTitle, commandRoleGroupAdmin, withDatabase},
+	{cmdContext, descContext, commandRoleGroupAdmin, withDatabase},
+	{cmdBroadcast, descBroadcast, commandRoleGroupAdmin, withDatabase},
+
+	{cmdQuery, descQuery, commandRoleAdmin, withDatabase},
+	{cmdAB, descAB, commandRoleAdmin, nil},
+	{cmdConfig, descConfig, commandRoleAdmin, nil},
+	{cmdVerbose, descVerbose, commandRoleAdmin, nil},
+	{cmdDBCheck, descDBCheck, commandRoleAdmin, withDatabase},
+	{cmdDebug, descDebug, commandRoleAdmin, withDatabase},
+	{cmdHarmReport, descHarmReport, commandRoleAdmin, withDatabase},
+	{cmdAllow, descAllow, commandRoleAdmin, withDatabase},
+	{cmdDeny, descDeny, commandRoleAdmin, withDatabase},
+	{cmdExportLogs, descExportLogs, commandRoleAdmin, withDatabase},
+	{cmdBroadcastGen, descBroadcastGen, commandRoleAdmin, withDatabase},
+}
+
+// generate the menu of enabled commands for given roles
+func menuFor(conf config, db *Database, roles ...commandRole) (commands []tg.BotCommand) {
+	for _, command := range menuCommands {
+		if command.enabled != nil && !command.enabled(conf, db) {
+			continue
+		}
+		for _, role := range roles {
+			if command.role == role {
+				commands = append(commands, tg.BotCommand{
+					Command:     command.command,
+					Description: command.description,
+				})
+				break
+			}
+		}
+	}
+	return commands
+}
+
+// set the menus of commands for all users, and admins of group chats
+func setMenuCommands(bot *tg.Bot, conf config, db *Database) {
+	if res := bot.SetMyCommands(menuFor(conf, db, commandRoleEveryone), tg.OptionsSetMyCommands{}); !res.Ok {
+		log.Printf("failed to set bot commands: %s", *res.Description)
+	}
+	if res := bot.SetMyCommands(menuFor(conf, db, commandRoleEveryone, commandRoleGroupAdmin), tg.OptionsSetMyCommands{}.
+		SetScope(tg.BotCommandScopeAllChatAdministrators{Type: tg.BotCommandScopeTypeAllChatAdministrators})); !res.Ok {
+		log.Printf("failed to set bot commands for chat administrators: %s", *res.Description)
+	}
+}
+
+// private chats of admins which have the menu of admin commands
+var adminMenuChats = struct {
+	sync.Mutex
+
+	chatIDs map[int64]bool
+}{
+	chatIDs: map[int64]bool{},
+}
+
+// set the menu of admin commands in the private chat of an admin (once per chat)
+//
+// (admins are configured with their usernames, so their chats are known only when they send something)
+func setAdminMenuCommands(bot *tg.Bot, conf config, db *Database, update tg.Update) {
+	message := usableMessageFromUpdate(update)
+	if message == nil || !isAdmin(update, conf) || message.Chat.Type != tg.ChatTypePrivate {
+		return
+	}
+
+	chatID := message.Chat.ID
+
+	adminMenuChats.Lock()
+	defer adminMenuChats.Unlock()
+
+	if adminMenuChats.chatIDs[chatID] {
+		return
+	}
+
+	if res := bot.SetMyCommands(menuFor(conf, db, commandRoleEveryone, commandRoleGroupAdmin, commandRoleAdmin), tg.OptionsSetMyCommands{}.
+		SetScope(tg.BotCommandScopeChat{
+			BotCommandScopeDefault: tg.BotCommandScopeDefault{Type: tg.BotCommandScopeTypeChat},
+			ChatID:                 chatID,
+		})); res.Ok {
+		adminMenuChats.chatIDs[chatID] = true
+	} else {
+		log.Printf("failed to set bot commands for admin chat(%d): %s", chatID, *res.Description)
+	}
+}
@@ -0,0 +1,414 @@
+// console.go
+//
+// web-based admin console (optional): browsing request logs, managing the allowlist,
+// toggling the maintenance mode, and viewing live metrics
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	consoleLogsPageSize          = 50
+	consoleLogTextLength         = 200 // max number of runes of prompts and results in the logs page
+	consoleMetricsRefreshSeconds = 5
+	consoleShutdownTimeout       = 5 * time.Second
+)
+
+// admin console setting struct
+type adminConsoleSetting struct {
+	ListenAddress string `json:"listen_address"` // eg. "127.0.0.1:8080"
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+}
+
+// maintenance mode: messages of non-admin users are answered with a notice, without being processed
+var maintenanceMode atomic.Bool
+
+// reply with the maintenance notice if in the maintenance mode, and given update is not from an admin
+func replyUnderMaintenance(bot telegramClient, conf config, update tg.Update, message tg.Message) bool {
+	if !maintenanceMode.Load() || isAdmin(update, conf) {
+		return false
+	}
+
+	messageID := message.MessageID
+	_, _ = sendMessage(bot, conf, msgUnderMaintenance, message.Chat.ID, &messageID)
+
+	return true
+}
+
+// admin console with its dependencies
+type adminConsole struct {
+	conf         config
+	db           *Database
+	allowedUsers map[string]bool
+	startedAt    time.Time
+
+	csrfToken string // for forms, generated on each launch
+}
+
+// run the admin console until `ctx` is done
+func runAdminConsole(ctx context.Context, conf config, db *Database, allowedUsers map[string]bool, startedAt time.Time) {
+	setting := conf.AdminConsole
+	if setting.Username == "" || setting.Password == "" {
+		log.Printf("admin console is not started: `username` and `password` of `admin_console` are required")
+		return
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		log.Printf("admin console is not started: failed to generate csrf token: %s", err)
+		return
+	}
+
+	console := &adminConsole{
+		conf:         conf,
+		db:           db,
+		allowedUsers: allowedUsers,
+		startedAt:    startedAt,
+		csrfToken:    hex.EncodeToString(token),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", console.handleMetrics)
+	mux.HandleFunc("GET /logs", console.handleLogs)
+	mux.HandleFunc("GET /allowlist", console.handleAllowlist)
+	mux.HandleFunc("POST /allowlist", console.handleAllowlistChange)
+	mux.HandleFunc("POST /maintenance", console.handleMaintenance)
+
+	server := &http.Server{
+		Addr:              setting.ListenAddress,
+		Handler:           console.authenticated(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		log.Printf("admin console listening on %s", setting.ListenAddress)
+
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("admin console stopped: %s", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), consoleShutdownTimeout)
+		defer cancel()
+
+		_ = server.Shutdown(shutdownCtx)
+	}()
+}
+
+// wrap given handler with basic authentication (and csrf checks of posted forms)
+func (c *adminConsole) authenticated(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(c.conf.AdminConsole.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(c.conf.AdminConsole.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin console", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method == http.MethodPost &&
+			subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(c.csrfToken)) != 1 {
+			http.Error(w, "invalid csrf token", http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// render a page with given template and data
+func (c *adminConsole) render(w http.ResponseWriter, page *template.Template, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := page.ExecuteTemplate(w, "layout", data); err != nil {
+		log.Printf("failed to render admin console: %s", err)
+	}
+}
+
+// a tracked job in the metrics page
+type consoleJob struct {
+	Name     string
+	State    string
+	Username string
+	Elapsed  string
+}
+
+// live metrics
+func (c *adminConsole) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	f := newFormatter(defaultLocale)
+
+	metrics := [][2]string{
+		{"Uptime", time.Since(c.startedAt).Round(time.Second).String()},
+		{"Maintenance mode", strconv.FormatBool(maintenanceMode.Load())},
+		{"Interactive requests in flight", f.number(numInteractiveRequests.Load())},
+	}
+	if wait, estimated := estimatedWait(); estimated {
+		metrics = append(metrics, [2]string{"Estimated wait", wait.Round(time.Second).String()})
+	}
+
+	telegramCircuit.Lock()
+	metrics = append(metrics,
+		[2]string{"Telegram API", string(telegramCircuit.state)},
+		[2]string{"Queued sends", f.number(int64(len(telegramCircuit.queued)))},
+	)
+	telegramCircuit.Unlock()
+
+	if c.db != nil {
+		now := time.Now()
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		if tokens, err := c.db.sumTokensSince(midnight); err == nil {
+			metrics = append(metrics, [2]string{"Tokens today", f.number(tokens)})
+		}
+		if len(c.conf.ModelPricing) > 0 {
+			if costs, err := c.db.sumCostsSince(beginningOfMonth()); err == nil {
+				metrics = append(metrics, [2]string{"Costs this month", f.cost(costs)})
+			}
+		}
+		metrics = append(metrics, averageLatenciesMetrics(c.db)...)
+	}
+
+	jobs := []consoleJob{}
+	for _, job := range listJobs(nil) {
+		jobs = append(jobs, consoleJob{
+			Name:     job.name,
+			State:    string(job.state),
+			Username: job.username,
+			Elapsed:  time.Since(job.since).Round(time.Second).String(),
+		})
+	}
+
+	c.render(w, consoleMetricsPage, map[string]any{
+		"Refresh":     consoleMetricsRefreshSeconds,
+		"Metrics":     metrics,
+		"Jobs":        jobs,
+		"Maintenance": maintenanceMode.Load(),
+		"CSRF":        c.csrfToken,
+	})
+}
+
+// a request log in the logs page
+type consoleLog struct {
+	Time       string
+	ChatID     int64
+	Username   string
+	Prompt     string
+	Result     string
+	Tokens     uint
+	Successful bool
+	Model      string
+}
+
+// recent request logs
+func (c *adminConsole) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if c.db == nil {
+		http.Error(w, databaseUnavailableMessage(c.conf), http.StatusServiceUnavailable)
+		return
+	}
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	page = max(page, 0)
+
+	prompts, err := c.db.loadRecentPrompts(page*consoleLogsPageSize, consoleLogsPageSize)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to load request logs: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	f := newFormatter(defaultLocale)
+	logs := []consoleLog{}
+	for _, prompt := range prompts {
+		logs = append(logs, consoleLog{
+			Time:       f.dateTime(prompt.CreatedAt),
+			ChatID:     prompt.ChatID,
+			Username:   prompt.Username,
+			Prompt:     truncateRunes(prompt.Text, consoleLogTextLength),
+			Result:     truncateRunes(prompt.Result.Text, consoleLogTextLength),
+			Tokens:     prompt.Tokens + prompt.Result.Tokens,
+			Successful: prompt.Result.Successful,
+			Model:      prompt.Result.GenerativeModel,
+		})
+	}
+
+	c.render(w, consoleLogsPage, map[string]any{
+		"Logs":     logs,
+		"Page":     page,
+		"Previous": page - 1,
+		"Next":     page + 1,
+		"HasNext":  len(logs) >= consoleLogsPageSize,
+	})
+}
+
+// users in the config, and the ones allowed by admins
+func (c *adminConsole) handleAllowlist(w http.ResponseWriter, r *http.Request) {
+	configured := []string{}
+	for username := range c.allowedUsers {
+		configured = append(configured, username)
+	}
+	for _, userID := range c.conf.AllowedTelegramUserIDs {
+		configured = append(configured, strconv.FormatInt(userID, 10))
+	}
+	slices.Sort(configured)
+
+	approved := []string{}
+	if c.db != nil {
+		if users, err := c.db.loadAllowedUsers(); err == nil {
+			for _, user := range users {
+				approved = append(approved, strconv.FormatInt(user.UserID, 10))
+			}
+		}
+		if usernames, err := c.db.loadAllowedUsernames(); err == nil {
+			for _, allowed := range usernames {
+				approved = append(approved, allowed.Username)
+			}
+		}
+	}
+
+	c.render(w, consoleAllowlistPage, map[string]any{
+		"Configured": configured,
+		"Approved":   approved,
+		"Database":   c.db != nil,
+		"Result":     r.URL.Query().Get("result"),
+		"CSRF":       c.csrfToken,
+	})
+}
+
+// allow or deny a user (just like /allow and /deny)
+func (c *adminConsole) handleAllowlistChange(w http.ResponseWriter, r *http.Request) {
+	if c.db == nil {
+		http.Error(w, databaseUnavailableMessage(c.conf), http.StatusServiceUnavailable)
+		return
+	}
+
+	target := r.PostFormValue("target")
+	userID, username := parseUserTarget(target)
+	if userID == 0 && username == "" {
+		http.Error(w, "no user was given", http.StatusBadRequest)
+		return
+	}
+
+	var result string
+	switch r.PostFormValue("action") {
+	case "allow":
+		if err := allowUserTarget(c.db, userID, username); err != nil {
+			result = fmt.Sprintf("Failed to allow: %s", err)
+		} else {
+			result = fmt.Sprintf(msgAllowedFormat, target)
+		}
+	case "deny":
+		if isAllowedInConfig(c.conf, userID, username) {
+			result = fmt.Sprintf(msgDenyInConfigFormat, target)
+		} else if deleted, err := denyUserTarget(c.db, userID, username); err != nil {
+			result = fmt.Sprintf("Failed to deny: %s", err)
+		} else if !deleted {
+			result = fmt.Sprintf(msgDenyNotFoundFormat, target)
+		} else {
+			result = fmt.Sprintf(msgDeniedFormat, target)
+		}
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("admin console: %s", result)
+
+	http.Redirect(w, r, "/allowlist?result="+url.QueryEscape(result), http.StatusSeeOther)
+}
+
+// turn on/off the maintenance mode
+func (c *adminConsole) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	enabled := r.PostFormValue("enabled") == "true"
+	maintenanceMode.Store(enabled)
+
+	log.Printf("admin console: maintenance mode: %t", enabled)
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// layout of admin console pages
+const consoleLayout = `{{define "layout"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Admin Console</title>
+{{block "head" .}}{{end}}
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+nav a { margin-right: 1em; }
+</style>
+</head>
+<body>
+<nav><a href="/">Metrics</a><a href="/logs">Logs</a><a href="/allowlist">Allowlist</a></nav>
+{{template "content" .}}
+</body>
+</html>{{end}}`
+
+// admin console pages
+var (
+	consoleMetricsPage = template.Must(template.New("metrics").Parse(consoleLayout + `
+{{define "head"}}<meta http-equiv="refresh" content="{{.Refresh}}">{{end}}
+{{define "content"}}
+<h1>Metrics</h1>
+<table>
+{{range .Metrics}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>
+{{end}}</table>
+<form method="post" action="/maintenance">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+{{if .Maintenance}}<input type="hidden" name="enabled" value="false"><button>Turn off maintenance mode</button>
+{{else}}<input type="hidden" name="enabled" value="true"><button>Turn on maintenance mode</button>{{end}}
+</form>
+<h2>Jobs</h2>
+{{if .Jobs}}<table>
+<tr><th>Name</th><th>State</th><th>User</th><th>Elapsed</th></tr>
+{{range .Jobs}}<tr><td>{{.Name}}</td><td>{{.State}}</td><td>{{.Username}}</td><td>{{.Elapsed}}</td></tr>
+{{end}}</table>{{else}}<p>No jobs.</p>{{end}}
+{{end}}`))
+
+	consoleLogsPage = template.Must(template.New("logs").Parse(consoleLayout + `
+{{define "content"}}
+<h1>Logs</h1>
+<table>
+<tr><th>Time</th><th>Chat</th><th>User</th><th>Prompt</th><th>Result</th><th>Tokens</th><th>Successful</th><th>Model</th></tr>
+{{range .Logs}}<tr><td>{{.Time}}</td><td>{{.ChatID}}</td><td>{{.Username}}</td><td>{{.Prompt}}</td><td>{{.Result}}</td><td>{{.Tokens}}</td><td>{{.Successful}}</td><td>{{.Model}}</td></tr>
+{{end}}</table>
+<p>{{if gt .Page 0}}<a href="/logs?page={{.Previous}}">&laquo; Newer</a> {{end}}{{if .HasNext}}<a href="/logs?page={{.Next}}">Older &raquo;</a>{{end}}</p>
+{{end}}`))
+
+	consoleAllowlistPage = template.Must(template.New("allowlist").Parse(consoleLayout + `
+{{define "content"}}
+<h1>Allowlist</h1>
+{{if .Result}}<p><strong>{{.Result}}</strong></p>{{end}}
+<h2>In the config</h2>
+<ul>{{range .Configured}}<li>{{.}}</li>{{end}}</ul>
+<h2>Allowed by admins</h2>
+{{if .Database}}<ul>{{range .Approved}}<li>{{.}}</li>{{else}}<li>None.</li>{{end}}</ul>
+<form method="post" action="/allowlist">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input name="target" placeholder="username or user id">
+<button name="action" value="allow">Allow</button>
+<button name="action" value="deny">Deny</button>
+</form>{{else}}<p>Not available without the database.</p>{{end}}
+{{end}}`))
+)
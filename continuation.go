@@ -0,0 +1,182 @@
+// continuation.go
+//
+// answers which are longer than the length limit of telegram messages
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	maxMessageLength = 4000 // a bit less than the limit of telegram (4096), for safety
+)
+
+// remaining chunks of a long answer, which will be posted on demand
+type continuation struct {
+	chatID    int64
+	messageID int64 // id of the message which has the continue button
+
+	chunks  []string
+	filters []outputFilter // output filters of the answer (with the chat-level ones)
+}
+
+// split given text into chunks which are not longer than `maxLength` runes,
+// (preferably at line breaks)
+func splitIntoChunks(text string, maxLength int) (chunks []string) {
+	for utf8.RuneCountInString(text) > maxLength {
+		runes := []rune(text)
+		cut := maxLength
+		if idx := strings.LastIndex(string(runes[:maxLength]), "\n"); idx > 0 {
+			cut = utf8.RuneCountInString(string(runes[:maxLength])[:idx]) + 1
+		}
+
+		chunks = append(chunks, string(runes[:cut]))
+		text = string(runes[cut:])
+	}
+	if len(text) > 0 {
+		chunks = append(chunks, text)
+	}
+
+	return chunks
+}
+
+// get the first chunk of given text, and whether it was truncated or not
+func firstChunk(text string) (chunk string, truncated bool) {
+	if utf8.RuneCountInString(text) <= maxMessageLength {
+		return text, false
+	}
+
+	return splitIntoChunks(text, maxMessageLength)[0], true
+}
+
+// following messages of a streamed answer which is split into chunks (with `split_long_answers`)
+type followingMessages struct {
+	ids   []int64
+	texts []string // last displayed texts of `ids`
+}
+
+// send or update the following messages with given chunks (after the first one),
+// each of them as a reply to the previous one
+func (f *followingMessages) deliver(bot telegramClient, conf config, chunks []string, chatID, firstMessageID int64) {
+	for i, chunk := range chunks {
+		if i < len(f.ids) { // update the existing one (only when changed)
+			if f.texts[i] == chunk {
+				continue
+			}
+			if err := updateFormattedMessage(bot, conf, chunk, chatID, f.ids[i]); err != nil {
+				log.Printf("failed to update following message: %s", redact(conf, err))
+				continue
+			}
+			f.texts[i] = chunk
+		} else { // send a new one
+			replyTo := firstMessageID
+			if i > 0 {
+				replyTo = f.ids[i-1]
+			}
+			sentMessageID, err := sendFormattedMessage(bot, conf, chunk, chatID, &replyTo)
+			if err != nil {
+				log.Printf("failed to send following message: %s", redact(conf, err))
+				return
+			}
+			f.ids = append(f.ids, sentMessageID)
+			f.texts = append(f.texts, chunk)
+		}
+	}
+}
+
+// generate an inline keyboard with a continue button for given key (and other buttons next to it)
+func continueButtonMarkup(key string, others ...tg.InlineKeyboardButton) tg.InlineKeyboardMarkup {
+	return tg.NewInlineKeyboardMarkup([][]tg.InlineKeyboardButton{
+		append([]tg.InlineKeyboardButton{
+			{
+				Text:         msgContinue,
+				CallbackData: ptr(key),
+			},
+		}, others...),
+	})
+}
+
+// put a continue button (and other buttons next to it) on the message which has the first chunk of a long answer
+func offerContinuation(bot telegramClient, conf config, text string, chatID, messageID int64, others ...tg.InlineKeyboardButton) {
+	chunks := splitIntoChunks(text, maxMessageLength)
+	if len(chunks) <= 1 {
+		return
+	}
+
+	key := fmt.Sprintf("%s%d/%d", callbackDataPrefixContinue, chatID, messageID)
+	putCallbackValue(key, continuation{
+		chatID:    chatID,
+		messageID: messageID,
+		chunks:    chunks[1:],
+		filters:   conf.outputFilters,
+	})
+
+	formatted, parseMode := formatOutgoingText(conf, chunks[0])
+	options := tg.OptionsEditMessageText{}.
+		SetIDs(chatID, messageID).
+		SetReplyMarkup(continueButtonMarkup(key, others...))
+	if parseMode != nil {
+		options.SetParseMode(*parseMode)
+	}
+	res := withRetries(bot).EditMessageText(formatted, options)
+	if !res.Ok && parseMode != nil && isParseEntitiesError(res.Description) { // fall back to a plain text
+		delete(options, "parse_mode")
+		res = withRetries(bot).EditMessageText(filterOutgoingText(conf, chunks[0]), options)
+	}
+	if !res.Ok {
+		log.Printf("failed to put continue button: %s", *res.Description)
+	}
+}
+
+// post the next chunk of a long answer with given callback query
+func handleContinueCallback(b telegramClient, conf config, callbackQuery tg.CallbackQuery, data string) {
+	cont, exists := popCallbackValue[continuation](data)
+	if !exists {
+		_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgContinueExpired))
+		return
+	}
+	_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{})
+
+	conf.outputFilters = cont.filters
+
+	options := messageOptions(cont.chatID, &cont.messageID)
+
+	// more chunks remain: put a continue button on the next one too
+	var key string
+	if len(cont.chunks) > 1 {
+		key = fmt.Sprintf("%s%d/%d/%d", callbackDataPrefixContinue, cont.chatID, cont.messageID, len(cont.chunks))
+		options = options.SetReplyMarkup(continueButtonMarkup(key))
+	}
+
+	formatted, parseMode := formatOutgoingText(conf, cont.chunks[0])
+	if parseMode != nil {
+		options.SetParseMode(*parseMode)
+	}
+	res := withRetries(b).SendMessage(cont.chatID, formatted, options)
+	if !res.Ok && parseMode != nil && isParseEntitiesError(res.Description) { // fall back to a plain text
+		delete(options, "parse_mode")
+		res = withRetries(b).SendMessage(cont.chatID, filterOutgoingText(conf, cont.chunks[0]), options)
+	}
+	if res.Ok {
+		rememberMessageTopic(*res.Result)
+
+		if key != "" {
+			putCallbackValue(key, continuation{
+				chatID:    cont.chatID,
+				messageID: res.Result.MessageID,
+				chunks:    cont.chunks[1:],
+				filters:   cont.filters,
+			})
+		}
+	} else {
+		log.Printf("failed to send the next chunk: %s", *res.Description)
+
+		putCallbackValue(data, cont) // put it back for retrying
+	}
+}
@@ -3,12 +3,20 @@
 package main
 
 import (
+	"cmp"
+	"database/sql"
 	"fmt"
 	"log"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"golang.org/x/text/language"
-	"golang.org/x/text/message"
+	"github.com/google/generative-ai-go/genai"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -31,9 +39,21 @@ type Prompt struct {
 type Generated struct {
 	gorm.Model
 
-	Successful bool `gorm:"index"`
-	Text       string
-	Tokens     uint `gorm:"index"`
+	Successful   bool `gorm:"index"`
+	Text         string
+	Tokens       uint   `gorm:"index"`
+	FinishReason string `gorm:"index"`
+
+	GenerativeModel      string  `gorm:"index"`
+	DurationMilliseconds int64   // time taken for generating the result
+	Cost                 float64 // in USD, calculated with `model_pricing` (0 if not priced)
+
+	// latencies of the stages of the answer (in milliseconds)
+	DownloadMilliseconds   int64
+	UploadMilliseconds     int64
+	FirstTokenMilliseconds int64
+	GenerationMilliseconds int64
+	DeliveryMilliseconds   int64
 
 	PromptID int64 // foreign key
 }
@@ -41,12 +61,71 @@ type Generated struct {
 // Database struct
 type Database struct {
 	db *gorm.DB
+
+	settings settingsCache
+	writer   *promptWriter // nil if prompts are written synchronously
+}
+
+// sqlite setting struct
+//
+// (pragmas are applied to every connection, as parameters of the data source name)
+type sqliteSetting struct {
+	JournalMode             string `json:"journal_mode,omitempty"`              // eg. "WAL" (default), "DELETE"
+	BusyTimeoutMilliseconds int    `json:"busy_timeout_milliseconds,omitempty"` // default: 5000
+	Synchronous             string `json:"synchronous,omitempty"`               // eg. "NORMAL" (default), "FULL"
+}
+
+// data source name of the database at given path, with the pragmas
+func (s sqliteSetting) dsn(dbPath string) string {
+	params := url.Values{}
+	if s.JournalMode != "" {
+		params.Set("_journal_mode", s.JournalMode)
+	}
+	if s.BusyTimeoutMilliseconds > 0 {
+		params.Set("_busy_timeout", strconv.Itoa(s.BusyTimeoutMilliseconds))
+	}
+	if s.Synchronous != "" {
+		params.Set("_synchronous", s.Synchronous)
+	}
+	if len(params) <= 0 {
+		return dbPath
+	}
+
+	separator := "?"
+	if strings.Contains(dbPath, "?") {
+		separator = "&"
+	}
+	return dbPath + separator + params.Encode()
+}
+
+// data source name of the configured database (empty if not configured)
+//
+// (`db_filepath` for sqlite, and `db_dsn` for other drivers)
+func databaseDSN(conf config) string {
+	if conf.DBDriver == "" || conf.DBDriver == dbDriverSQLite {
+		return conf.RequestLogsDBFilepath
+	}
+	return conf.DBDSN
 }
 
-// open and return a database at given path: `dbPath`.
-func openDatabase(dbPath string) (database *Database, err error) {
+// open and return a database with given driver and data source name: `dsn`,
+//
+// (for sqlite, `dsn` is the path of the database file, and the pragmas of `setting` are applied to it)
+func openDatabase(driver, dsn string, setting sqliteSetting) (database *Database, err error) {
+	var dialector gorm.Dialector
+	switch driver {
+	case "", dbDriverSQLite:
+		dialector = sqlite.Open(setting.dsn(dsn))
+	case dbDriverPostgres:
+		dialector = postgres.Open(dsn)
+	case dbDriverMySQL:
+		dialector = mysql.Open(dsn)
+	default:
+		return nil, fmt.Errorf("not supported database driver: '%s'", driver)
+	}
+
 	var db *gorm.DB
-	db, err = gorm.Open(sqlite.Open(dbPath), &gorm.Config{
+	db, err = gorm.Open(dialector, &gorm.Config{
 		PrepareStmt: true,
 	})
 
@@ -55,37 +134,176 @@ func openDatabase(dbPath string) (database *Database, err error) {
 		if err := db.AutoMigrate(
 			&Prompt{},
 			&Generated{},
+			&ScribedMessage{},
+			&ScribeOptOut{},
+			&Setting{},
+			&BroadcastSubscription{},
+			&Broadcast{},
+			&BroadcastDelivery{},
+			&Watch{},
+			&AllowedUser{},
+			&AllowedUsername{},
+			&UploadedFile{},
+			&AccessRequest{},
+			&UserAPIKey{},
+			&Space{},
+			&SpaceMember{},
+			&SpaceSubscription{},
+			&SpaceItem{},
+			&ModerationLog{},
+			&ScheduledDeletion{},
 		); err != nil {
 			log.Printf("failed to migrate databases: %s", err)
 		}
 
-		return &Database{db: db}, nil
+		database = &Database{db: db}
+		if err := database.migrateLegacySettings(); err != nil {
+			log.Printf("failed to migrate legacy settings: %s", err)
+		}
+
+		return database, nil
 	}
 
 	return nil, err
 }
 
+// generate a message for the unavailable database
+func databaseUnavailableMessage(conf config) string {
+	if conf.DisableRequestLogging {
+		return msgRequestLoggingDisabled
+	}
+
+	return msgDatabaseNotConfigured
+}
+
 // save `prompt`.
 func (d *Database) savePrompt(prompt Prompt) (err error) {
 	tx := d.db.Save(&prompt)
 	return tx.Error
 }
 
+const (
+	promptWriteQueueSize = 1000 // prompts are written synchronously when the queue is full
+	promptWriteBatchSize = 50
+)
+
+// buffered writer of prompts (and their results) running in the background,
+// for not delaying replies with slow disk i/o
+type promptWriter struct {
+	sync.RWMutex
+
+	queue  chan Prompt
+	closed bool
+	done   chan struct{}
+}
+
+// start writing prompts in the background, in batches
+func (d *Database) startPromptWriter() {
+	writer := &promptWriter{
+		queue: make(chan Prompt, promptWriteQueueSize),
+		done:  make(chan struct{}),
+	}
+	d.writer = writer
+
+	go func() {
+		defer close(writer.done)
+
+		for prompt := range writer.queue {
+			// take all queued ones (up to the batch size)
+			batch := []Prompt{prompt}
+		collect:
+			for len(batch) < promptWriteBatchSize {
+				select {
+				case prompt, ok := <-writer.queue:
+					if !ok {
+						break collect
+					}
+					batch = append(batch, prompt)
+				default:
+					break collect
+				}
+			}
+
+			if tx := d.db.Create(&batch); tx.Error != nil {
+				log.Printf("failed to save %d prompt(s) & result(s) to database: %s", len(batch), tx.Error)
+			} else {
+				logVerbose(verboseDB, "saved %d prompt(s) & result(s)", len(batch))
+			}
+		}
+	}()
+}
+
+// queue given prompt for the background writer (false if it was not queued)
+func (d *Database) queuePrompt(prompt Prompt) bool {
+	if d.writer == nil {
+		return false
+	}
+
+	d.writer.RLock()
+	defer d.writer.RUnlock()
+
+	if d.writer.closed {
+		return false
+	}
+	select {
+	case d.writer.queue <- prompt:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop the background writer, and wait until all queued prompts are written
+func (d *Database) flushPromptWriter() {
+	if d.writer == nil {
+		return
+	}
+
+	d.writer.Lock()
+	if !d.writer.closed {
+		d.writer.closed = true
+		close(d.writer.queue)
+	}
+	d.writer.Unlock()
+
+	<-d.writer.done
+}
+
 // save `prompt` and its result to logs database
-func savePromptAndResult(db *Database, chatID, userID int64, username string, prompt string, promptTokens uint, result string, resultTokens uint, resultSuccessful bool) {
+//
+// (queued for the background writer if it is running)
+func savePromptAndResult(db *Database, chatID, userID int64, username string, prompt string, promptTokens uint, result string, resultTokens uint, resultSuccessful bool, finishReason string, model string, duration time.Duration, latencies stageLatencies, cost float64) {
 	if db != nil {
-		if err := db.savePrompt(Prompt{
+		logVerbose(verboseDB, "saving prompt & result of chat(%d) (successful: %t)", chatID, resultSuccessful)
+
+		prompt := Prompt{
 			ChatID:   chatID,
 			UserID:   userID,
 			Username: username,
 			Text:     prompt,
 			Tokens:   promptTokens,
 			Result: Generated{
-				Successful: resultSuccessful,
-				Text:       result,
-				Tokens:     resultTokens,
+				Successful:   resultSuccessful,
+				Text:         result,
+				Tokens:       resultTokens,
+				FinishReason: finishReason,
+
+				GenerativeModel:      model,
+				DurationMilliseconds: duration.Milliseconds(),
+				Cost:                 cost,
+
+				DownloadMilliseconds:   latencies.download.Milliseconds(),
+				UploadMilliseconds:     latencies.upload.Milliseconds(),
+				FirstTokenMilliseconds: latencies.firstToken.Milliseconds(),
+				GenerationMilliseconds: latencies.generation.Milliseconds(),
+				DeliveryMilliseconds:   latencies.delivery.Milliseconds(),
 			},
-		}); err != nil {
+		}
+		if db.queuePrompt(prompt) {
+			return
+		}
+
+		if err := db.savePrompt(prompt); err != nil {
 			log.Printf("failed to save prompt & result to database: %s", err)
 		}
 	}
@@ -106,6 +324,86 @@ func (d *Database) loadSuccessfulPrompts(userID int64) (result []Prompt, err err
 	return result, tx.Error
 }
 
+// load recent `prompt`s of given chat and their results.
+func (d *Database) loadRecentChatPrompts(chatID int64, limit int) (result []Prompt, err error) {
+	tx := d.db.Model(&Prompt{}).
+		Preload("Result").
+		Where("chat_id = ?", chatID).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&result)
+	return result, tx.Error
+}
+
+// iterate over `prompt`s (and their results) since given time, in batches of given size
+func (d *Database) eachPromptsSince(since time.Time, batchSize int, fn func(prompts []Prompt) error) error {
+	var prompts []Prompt
+	tx := d.db.Model(&Prompt{}).
+		Preload("Result").
+		Where("created_at >= ?", since).
+		FindInBatches(&prompts, batchSize, func(_ *gorm.DB, _ int) error {
+			return fn(prompts)
+		})
+	return tx.Error
+}
+
+// calculate average latencies of the stages of recent (up to `limit`) generated results, and return them with the number of results
+func (d *Database) averageLatencies(limit int) (average stageLatencies, count int64, err error) {
+	var avg struct {
+		Count      int64
+		Download   float64
+		Upload     float64
+		FirstToken float64
+		Generation float64
+		Delivery   float64
+	}
+	if tx := d.db.Raw(`SELECT
+	COUNT(*) AS count,
+	COALESCE(AVG(download_milliseconds), 0) AS download,
+	COALESCE(AVG(upload_milliseconds), 0) AS upload,
+	COALESCE(AVG(first_token_milliseconds), 0) AS first_token,
+	COALESCE(AVG(generation_milliseconds), 0) AS generation,
+	COALESCE(AVG(delivery_milliseconds), 0) AS delivery
+FROM (SELECT * FROM generateds WHERE deleted_at IS NULL AND generation_milliseconds > 0 ORDER BY id DESC LIMIT ?) AS recent`, limit).
+		Scan(&avg); tx.Error != nil {
+		return average, 0, tx.Error
+	}
+
+	ms := func(v float64) time.Duration {
+		return time.Duration(v * float64(time.Millisecond))
+	}
+	return stageLatencies{
+		download:   ms(avg.Download),
+		upload:     ms(avg.Upload),
+		firstToken: ms(avg.FirstToken),
+		generation: ms(avg.Generation),
+		delivery:   ms(avg.Delivery),
+	}, avg.Count, nil
+}
+
+// load recent `prompt`s (and their results), from the newest one
+func (d *Database) loadRecentPrompts(offset, limit int) (result []Prompt, err error) {
+	tx := d.db.Model(&Prompt{}).
+		Preload("Result").
+		Order("id DESC").
+		Offset(offset).
+		Limit(limit).
+		Find(&result)
+	return result, tx.Error
+}
+
+// iterate over `prompt`s (and their results) of given user, in batches of given size
+func (d *Database) eachPromptsOfUser(userID int64, batchSize int, fn func(prompts []Prompt) error) error {
+	var prompts []Prompt
+	tx := d.db.Model(&Prompt{}).
+		Preload("Result").
+		Where("user_id = ?", userID).
+		FindInBatches(&prompts, batchSize, func(_ *gorm.DB, _ int) error {
+			return fn(prompts)
+		})
+	return tx.Error
+}
+
 // retrieve successful prompts and their results
 func retrieveSuccessfulPrompts(db *Database, userID int64) (result []Prompt) {
 	result = []Prompt{}
@@ -121,23 +419,21 @@ func retrieveSuccessfulPrompts(db *Database, userID int64) (result []Prompt) {
 }
 
 // retrieve stats from database
-func retrieveStats(db *Database) string {
+func retrieveStats(conf config, db *Database, f formatter) string {
 	if db == nil {
-		return msgDatabaseNotConfigured
+		return databaseUnavailableMessage(conf)
 	} else {
 		lines := []string{}
 
 		var prompt Prompt
 		if tx := db.db.First(&prompt); tx.Error == nil {
-			lines = append(lines, fmt.Sprintf("Since %s", prompt.CreatedAt.Format("2006-01-02 15:04:05")))
+			lines = append(lines, fmt.Sprintf("Since %s", f.dateTime(prompt.CreatedAt)))
 			lines = append(lines, "")
 		}
 
-		printer := message.NewPrinter(language.English) // for adding commas to numbers
-
 		var count int64
 		if tx := db.db.Table("prompts").Select("count(distinct chat_id) as count").Scan(&count); tx.Error == nil {
-			lines = append(lines, fmt.Sprintf("Chats: %s", printer.Sprintf("%d", count)))
+			lines = append(lines, fmt.Sprintf("Chats: %s", f.number(count)))
 		}
 
 		var sumAndCount struct {
@@ -145,13 +441,20 @@ func retrieveStats(db *Database) string {
 			Count int64
 		}
 		if tx := db.db.Table("prompts").Select("sum(tokens) as sum, count(id) as count").Where("tokens > 0").Scan(&sumAndCount); tx.Error == nil {
-			lines = append(lines, fmt.Sprintf("Prompts: %s (Total tokens: %s)", printer.Sprintf("%d", sumAndCount.Count), printer.Sprintf("%d", sumAndCount.Sum)))
+			lines = append(lines, fmt.Sprintf("Prompts: %s (Total tokens: %s)", f.number(sumAndCount.Count), f.number(sumAndCount.Sum)))
 		}
 		if tx := db.db.Table("generateds").Select("sum(tokens) as sum, count(id) as count").Where("successful = 1").Scan(&sumAndCount); tx.Error == nil {
-			lines = append(lines, fmt.Sprintf("Completions: %s (Total tokens: %s)", printer.Sprintf("%d", sumAndCount.Count), printer.Sprintf("%d", sumAndCount.Sum)))
+			lines = append(lines, fmt.Sprintf("Completions: %s (Total tokens: %s)", f.number(sumAndCount.Count), f.number(sumAndCount.Sum)))
 		}
 		if tx := db.db.Table("generateds").Select("count(id) as count").Where("successful = 0").Scan(&count); tx.Error == nil {
-			lines = append(lines, fmt.Sprintf("Errors: %s", printer.Sprintf("%d", count)))
+			lines = append(lines, fmt.Sprintf("Errors: %s", f.number(count)))
+		}
+		if len(conf.ModelPricing) > 0 {
+			if total, err := db.sumCostsSince(time.Time{}); err == nil {
+				if monthly, err := db.sumCostsSince(beginningOfMonth()); err == nil {
+					lines = append(lines, fmt.Sprintf("Costs: %s (This month: %s)", f.cost(total), f.cost(monthly)))
+				}
+			}
 		}
 
 		if len(lines) > 0 {
@@ -161,3 +464,1116 @@ func retrieveStats(db *Database) string {
 		return msgDatabaseEmpty
 	}
 }
+
+// retrieve stats of given user from database
+func retrieveUserStats(conf config, db *Database, userID int64, f formatter) string {
+	if db == nil {
+		return databaseUnavailableMessage(conf)
+	}
+
+	var first, last Prompt
+	if tx := db.db.Where("user_id = ?", userID).First(&first); tx.Error != nil {
+		return msgNoUsage
+	}
+	if tx := db.db.Where("user_id = ?", userID).Last(&last); tx.Error != nil {
+		return msgNoUsage
+	}
+
+	lines := []string{
+		fmt.Sprintf("First used: %s", f.dateTime(first.CreatedAt)),
+		fmt.Sprintf("Last used: %s", f.dateTime(last.CreatedAt)),
+		"",
+	}
+
+	var sumAndCount struct {
+		Sum   int64
+		Count int64
+	}
+	if tx := db.db.Table("prompts").Select("sum(tokens) as sum, count(id) as count").Where("user_id = ? AND tokens > 0", userID).Scan(&sumAndCount); tx.Error == nil {
+		lines = append(lines, fmt.Sprintf("Prompts: %s (Total tokens: %s)", f.number(sumAndCount.Count), f.number(sumAndCount.Sum)))
+	}
+
+	var results struct {
+		Successful int64
+		Failed     int64
+		Tokens     int64
+		Cost       float64
+	}
+	if tx := db.db.Table("generateds").
+		Select("coalesce(sum(case when generateds.successful = 1 then 1 else 0 end), 0) as successful, "+
+			"coalesce(sum(case when generateds.successful = 0 then 1 else 0 end), 0) as failed, "+
+			"coalesce(sum(case when generateds.successful = 1 then generateds.tokens else 0 end), 0) as tokens, "+
+			"coalesce(sum(generateds.cost), 0) as cost").
+		Joins("JOIN prompts ON prompts.id = generateds.prompt_id").
+		Where("prompts.user_id = ? AND prompts.deleted_at IS NULL AND generateds.deleted_at IS NULL", userID).
+		Scan(&results); tx.Error == nil {
+		lines = append(lines, fmt.Sprintf("Completions: %s (Total tokens: %s)", f.number(results.Successful), f.number(results.Tokens)))
+		lines = append(lines, fmt.Sprintf("Errors: %s", f.number(results.Failed)))
+		if total := results.Successful + results.Failed; total > 0 {
+			lines = append(lines, fmt.Sprintf("Success rate: %s", f.percent(percent(results.Successful, total))))
+		}
+		if len(conf.ModelPricing) > 0 {
+			lines = append(lines, fmt.Sprintf("Costs: %s", f.cost(results.Cost)))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// sum tokens of prompts and their generated results since given time
+func (d *Database) sumTokensSince(since time.Time) (sum int64, err error) {
+	return d.sumTokens("prompts.created_at >= ? AND prompts.deleted_at IS NULL", since)
+}
+
+// sum tokens of prompts (and their generated results) of given user since given time
+func (d *Database) sumUserTokensSince(userID int64, since time.Time) (sum int64, err error) {
+	return d.sumTokens("prompts.user_id = ? AND prompts.created_at >= ? AND prompts.deleted_at IS NULL", userID, since)
+}
+
+// sum tokens of prompts and their generated results with given conditions
+func (d *Database) sumTokens(query string, args ...any) (sum int64, err error) {
+	var sums struct {
+		Prompts   int64
+		Generated int64
+	}
+	tx := d.db.Table("prompts").
+		Select("coalesce(sum(prompts.tokens), 0) AS prompts, coalesce(sum(generateds.tokens), 0) AS generated").
+		Joins("LEFT JOIN generateds ON generateds.prompt_id = prompts.id AND generateds.deleted_at IS NULL").
+		Where(query, args...).
+		Scan(&sums)
+	return sums.Prompts + sums.Generated, tx.Error
+}
+
+// sum costs of generated results since given time
+func (d *Database) sumCostsSince(since time.Time) (sum float64, err error) {
+	tx := d.db.Table("generateds").
+		Select("coalesce(sum(cost), 0)").
+		Where("created_at >= ? AND deleted_at IS NULL", since).
+		Scan(&sum)
+	return sum, tx.Error
+}
+
+const (
+	maxStatsQueryRows = 30
+)
+
+// columns which can be used in stats queries, and their SQL expressions
+//
+// (prompts are left-joined with their generated results)
+var statsQueryColumns = map[string]string{
+	"chat_id":       "prompts.chat_id",
+	"user_id":       "prompts.user_id",
+	"username":      "prompts.username",
+	"prompt_tokens": "prompts.tokens",
+	"result_tokens": "generateds.tokens",
+	"successful":    "generateds.successful",
+	"date":          "date(prompts.created_at)",
+	"created_at":    "prompts.created_at",
+}
+
+// aggregate functions which can be used in stats queries
+var statsQueryAggregates = []string{"count", "sum", "avg", "min", "max"}
+
+// operators which can be used in the filters of stats queries
+var statsQueryOperators = []string{"=", "!=", ">", ">=", "<", "<="}
+
+// stats query which is converted from a natural language question
+type statsQuery struct {
+	Columns    []string              `json:"columns,omitempty"`
+	Aggregates []statsQueryAggregate `json:"aggregates,omitempty"`
+	Filters    []statsQueryFilter    `json:"filters,omitempty"`
+	GroupBy    []string              `json:"group_by,omitempty"`
+	OrderBy    *statsQueryOrder      `json:"order_by,omitempty"`
+	Limit      int                   `json:"limit,omitempty"`
+}
+
+// aggregate of a stats query
+type statsQueryAggregate struct {
+	Function string `json:"function"`
+	Column   string `json:"column"`
+}
+
+// filter of a stats query
+type statsQueryFilter struct {
+	Column   string `json:"column"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+// order of a stats query
+type statsQueryOrder struct {
+	Column     string `json:"column"`
+	Descending bool   `json:"descending,omitempty"`
+}
+
+// build a parameterized SQL query from given stats query,
+//
+// every identifier is checked against the allowlists, and every value is passed as a parameter.
+func buildStatsQuery(q statsQuery) (query string, args []any, err error) {
+	column := func(name string) (string, error) {
+		if expr, exists := statsQueryColumns[name]; exists {
+			return expr, nil
+		}
+		return "", fmt.Errorf("column not allowed: '%s'", name)
+	}
+
+	selects := []string{}
+	for _, name := range q.Columns {
+		var expr string
+		if expr, err = column(name); err != nil {
+			return "", nil, err
+		}
+		selects = append(selects, fmt.Sprintf("%s AS %s", expr, name))
+	}
+	for _, aggregate := range q.Aggregates {
+		if !slices.Contains(statsQueryAggregates, aggregate.Function) {
+			return "", nil, fmt.Errorf("aggregate function not allowed: '%s'", aggregate.Function)
+		}
+		var expr string
+		if expr, err = column(aggregate.Column); err != nil {
+			return "", nil, err
+		}
+		selects = append(selects, fmt.Sprintf("%s(%s) AS %s_%s", aggregate.Function, expr, aggregate.Function, aggregate.Column))
+	}
+	if len(selects) <= 0 {
+		return "", nil, fmt.Errorf("no columns or aggregates to select")
+	}
+
+	wheres := []string{"prompts.deleted_at IS NULL"}
+	for _, filter := range q.Filters {
+		if !slices.Contains(statsQueryOperators, filter.Operator) {
+			return "", nil, fmt.Errorf("operator not allowed: '%s'", filter.Operator)
+		}
+		var expr string
+		if expr, err = column(filter.Column); err != nil {
+			return "", nil, err
+		}
+		wheres = append(wheres, fmt.Sprintf("%s %s ?", expr, filter.Operator))
+		args = append(args, filter.Value)
+	}
+
+	query = fmt.Sprintf("SELECT %s FROM prompts LEFT JOIN generateds ON generateds.prompt_id = prompts.id WHERE %s",
+		strings.Join(selects, ", "),
+		strings.Join(wheres, " AND "),
+	)
+
+	if len(q.GroupBy) > 0 {
+		groups := []string{}
+		for _, name := range q.GroupBy {
+			var expr string
+			if expr, err = column(name); err != nil {
+				return "", nil, err
+			}
+			groups = append(groups, expr)
+		}
+		query += " GROUP BY " + strings.Join(groups, ", ")
+	}
+
+	if q.OrderBy != nil {
+		// can be ordered by a selected column or aggregate
+		var order string
+		if _, exists := statsQueryColumns[q.OrderBy.Column]; exists {
+			order = q.OrderBy.Column
+		} else {
+			for _, aggregate := range q.Aggregates {
+				if q.OrderBy.Column == fmt.Sprintf("%s_%s", aggregate.Function, aggregate.Column) {
+					order = q.OrderBy.Column
+					break
+				}
+			}
+		}
+		if order == "" {
+			return "", nil, fmt.Errorf("order column not allowed: '%s'", q.OrderBy.Column)
+		}
+		if q.OrderBy.Descending {
+			order += " DESC"
+		}
+		query += " ORDER BY " + order
+	}
+
+	limit := q.Limit
+	if limit <= 0 || limit > maxStatsQueryRows {
+		limit = maxStatsQueryRows
+	}
+	query += fmt.Sprintf(" LIMIT %d", limit)
+
+	return query, args, nil
+}
+
+// run given stats query, and return the result as rows of strings (including the header row)
+func (d *Database) runStatsQuery(q statsQuery) (result [][]string, err error) {
+	var query string
+	var args []any
+	if query, args, err = buildStatsQuery(q); err != nil {
+		return nil, err
+	}
+
+	var rows *sql.Rows
+	if rows, err = d.db.Raw(query, args...).Rows(); err != nil {
+		return nil, fmt.Errorf("failed to run query: %s", err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	if columns, err = rows.Columns(); err != nil {
+		return nil, err
+	}
+	result = [][]string{columns}
+
+	for rows.Next() {
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err = rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		row := []string{}
+		for _, value := range values {
+			switch v := value.(type) {
+			case nil:
+				row = append(row, "-")
+			case []byte:
+				row = append(row, string(v))
+			default:
+				row = append(row, fmt.Sprintf("%v", v))
+			}
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+// ScribedMessage struct
+//
+// messages collected quietly in group chats for daily summaries
+type ScribedMessage struct {
+	gorm.Model
+
+	ChatID   int64 `gorm:"index"`
+	UserID   int64
+	Username string
+
+	Text string
+}
+
+// ScribeOptOut struct
+//
+// users who opted out from the scribe mode in group chats
+type ScribeOptOut struct {
+	gorm.Model
+
+	ChatID int64 `gorm:"uniqueIndex:idx_scribe_opt_outs_chat_user"`
+	UserID int64 `gorm:"uniqueIndex:idx_scribe_opt_outs_chat_user"`
+}
+
+// ScheduledDeletion struct
+//
+// messages which will be deleted at given time (eg. ephemeral answers)
+type ScheduledDeletion struct {
+	gorm.Model
+
+	ChatID    int64
+	MessageID int64
+	DeleteAt  time.Time `gorm:"index"`
+}
+
+// save scheduled deletions.
+func (d *Database) saveScheduledDeletions(deletions []ScheduledDeletion) (err error) {
+	tx := d.db.Create(&deletions)
+	return tx.Error
+}
+
+// load all scheduled deletions.
+func (d *Database) loadScheduledDeletions() (result []ScheduledDeletion, err error) {
+	tx := d.db.Model(&ScheduledDeletion{}).
+		Order("delete_at ASC").
+		Find(&result)
+	return result, tx.Error
+}
+
+// delete a scheduled deletion (when it is done).
+func (d *Database) deleteScheduledDeletion(id uint) (err error) {
+	tx := d.db.Unscoped().Delete(&ScheduledDeletion{}, id)
+	return tx.Error
+}
+
+// ModerationLog struct
+//
+// audit logs of messages flagged in the moderation mode
+type ModerationLog struct {
+	gorm.Model
+
+	ChatID    int64 `gorm:"index"`
+	MessageID int64
+	UserID    int64 `gorm:"index"`
+	Username  string
+	Text      string
+
+	Rule            string
+	Reason          string
+	SuggestedAction string
+	Deleted         bool
+}
+
+// save a moderation log.
+func (d *Database) saveModerationLog(moderationLog ModerationLog) (err error) {
+	tx := d.db.Save(&moderationLog)
+	return tx.Error
+}
+
+// save a scribed message.
+func (d *Database) saveScribedMessage(message ScribedMessage) (err error) {
+	tx := d.db.Save(&message)
+	return tx.Error
+}
+
+// load scribed messages of given chat.
+func (d *Database) loadScribedMessages(chatID int64) (result []ScribedMessage, err error) {
+	tx := d.db.Model(&ScribedMessage{}).
+		Where("chat_id = ?", chatID).
+		Order("created_at ASC").
+		Find(&result)
+	return result, tx.Error
+}
+
+// delete scribed messages of given chat, created before or at `until`.
+func (d *Database) deleteScribedMessages(chatID int64, until time.Time) (err error) {
+	tx := d.db.Unscoped().
+		Where("chat_id = ? AND created_at <= ?", chatID, until).
+		Delete(&ScribedMessage{})
+	return tx.Error
+}
+
+// set whether the user opted out from the scribe mode in given chat.
+func (d *Database) setScribeOptOut(chatID, userID int64, optOut bool) (err error) {
+	if optOut {
+		tx := d.db.Where(ScribeOptOut{ChatID: chatID, UserID: userID}).
+			FirstOrCreate(&ScribeOptOut{})
+		if tx.Error == nil {
+			// also delete the messages which were already collected
+			tx = d.db.Unscoped().
+				Where("chat_id = ? AND user_id = ?", chatID, userID).
+				Delete(&ScribedMessage{})
+		}
+		return tx.Error
+	}
+
+	tx := d.db.Unscoped().
+		Where("chat_id = ? AND user_id = ?", chatID, userID).
+		Delete(&ScribeOptOut{})
+	return tx.Error
+}
+
+// check if the user opted out from the scribe mode in given chat.
+func (d *Database) isScribeOptedOut(chatID, userID int64) bool {
+	var count int64
+	if tx := d.db.Model(&ScribeOptOut{}).
+		Where("chat_id = ? AND user_id = ?", chatID, userID).
+		Count(&count); tx.Error != nil {
+		log.Printf("failed to check scribe opt-out: %s", tx.Error)
+
+		return true // NOTE: treat as opted out when unsure
+	}
+	return count > 0
+}
+
+// count of finish reasons of a chat
+type finishReasonCount struct {
+	ChatID       int64
+	FinishReason string
+	Count        int64
+}
+
+// count finish reasons of generated results since given time, grouped by chats.
+func (d *Database) countFinishReasons(since time.Time) (result []finishReasonCount, err error) {
+	tx := d.db.Table("generateds").
+		Select("prompts.chat_id AS chat_id, generateds.finish_reason AS finish_reason, count(generateds.id) AS count").
+		Joins("JOIN prompts ON prompts.id = generateds.prompt_id").
+		Where("generateds.created_at >= ? AND generateds.deleted_at IS NULL", since).
+		Group("prompts.chat_id, generateds.finish_reason").
+		Order("count DESC").
+		Scan(&result)
+	return result, tx.Error
+}
+
+// usage of a user in a chat
+type userUsage struct {
+	UserID     int64
+	Username   string
+	NumPrompts int64
+	Tokens     int64 // prompt + result tokens
+}
+
+// aggregate usages of users in given chat since given time.
+func (d *Database) aggregateUserUsages(chatID int64, since time.Time) (result []userUsage, err error) {
+	tx := d.db.Table("prompts").
+		Select("prompts.user_id AS user_id, max(prompts.username) AS username, count(prompts.id) AS num_prompts, coalesce(sum(prompts.tokens), 0) + coalesce(sum(generateds.tokens), 0) AS tokens").
+		Joins("LEFT JOIN generateds ON generateds.prompt_id = prompts.id AND generateds.deleted_at IS NULL").
+		Where("prompts.chat_id = ? AND prompts.created_at >= ? AND prompts.deleted_at IS NULL", chatID, since).
+		Group("prompts.user_id").
+		Scan(&result)
+	return result, tx.Error
+}
+
+// count of safety blocks in a week
+type weeklySafetyBlockCount struct {
+	Week   string
+	Total  int64
+	Blocks int64
+}
+
+// count safety blocks weekly since given time.
+func (d *Database) countWeeklySafetyBlocks(since time.Time, safetyFinishReason string) (result []weeklySafetyBlockCount, err error) {
+	var week string
+	switch d.db.Dialector.Name() {
+	case dbDriverPostgres:
+		week = `to_char(generateds.created_at, 'IYYY-"W"IW')`
+	case dbDriverMySQL:
+		week = "DATE_FORMAT(generateds.created_at, '%x-W%v')"
+	default:
+		week = "strftime('%Y-W%W', generateds.created_at)"
+	}
+
+	tx := d.db.Table("generateds").
+		Select(week+" AS week, count(id) AS total, sum(CASE WHEN finish_reason = ? THEN 1 ELSE 0 END) AS blocks", safetyFinishReason).
+		Where("created_at >= ? AND deleted_at IS NULL", since).
+		Group("week").
+		Order("week ASC").
+		Scan(&result)
+	return result, tx.Error
+}
+
+// name of given harm block threshold
+func harmBlockThresholdName(threshold genai.HarmBlockThreshold) string {
+	switch threshold {
+	case genai.HarmBlockLowAndAbove:
+		return "BLOCK_LOW_AND_ABOVE"
+	case genai.HarmBlockMediumAndAbove:
+		return "BLOCK_MEDIUM_AND_ABOVE"
+	case genai.HarmBlockOnlyHigh:
+		return "BLOCK_ONLY_HIGH"
+	case genai.HarmBlockNone:
+		return "BLOCK_NONE"
+	default:
+		return "HARM_BLOCK_THRESHOLD_UNSPECIFIED"
+	}
+}
+
+// retrieve a report of safety blocks with suggestions of threshold adjustments
+func retrieveHarmReport(conf config, db *Database, days int, f formatter) string {
+	if db == nil {
+		return databaseUnavailableMessage(conf)
+	}
+
+	since := time.Now().AddDate(0, 0, -days)
+	safety := genai.FinishReasonSafety.String()
+	threshold := *conf.GoogleAIHarmBlockThreshold
+
+	counts, err := db.countFinishReasons(since)
+	if err != nil {
+		return fmt.Sprintf("Failed to count finish reasons: %s", err)
+	}
+
+	// aggregate by chats
+	var total, blocks int64
+	totalByChat, blocksByChat := map[int64]int64{}, map[int64]int64{}
+	for _, count := range counts {
+		total += count.Count
+		totalByChat[count.ChatID] += count.Count
+		if count.FinishReason == safety {
+			blocks += count.Count
+			blocksByChat[count.ChatID] += count.Count
+		}
+	}
+	if total <= 0 {
+		return fmt.Sprintf("No generated results in the last %d days.", days)
+	}
+
+	lines := []string{
+		fmt.Sprintf("Safety blocks in the last %d days (threshold: %s)", days, harmBlockThresholdName(threshold)),
+		"",
+		fmt.Sprintf("Results: %s, Safety blocks: %s (%s)", f.number(total), f.number(blocks), f.percent(percent(blocks, total))),
+	}
+
+	// weekly trend
+	if weekly, err := db.countWeeklySafetyBlocks(since, safety); err == nil && len(weekly) > 0 {
+		lines = append(lines, "", "Weekly:")
+		for _, week := range weekly {
+			lines = append(lines, fmt.Sprintf("- %s: %s / %s (%s)", week.Week, f.number(week.Blocks), f.number(week.Total), f.percent(percent(week.Blocks, week.Total))))
+		}
+	}
+
+	// chats with blocks
+	chatIDs := []int64{}
+	for chatID := range blocksByChat {
+		chatIDs = append(chatIDs, chatID)
+	}
+	slices.SortFunc(chatIDs, func(a, b int64) int {
+		return cmp.Compare(blocksByChat[b], blocksByChat[a])
+	})
+	if len(chatIDs) > 0 {
+		lines = append(lines, "", "Chats:")
+		for _, chatID := range chatIDs {
+			lines = append(lines, fmt.Sprintf("- %.0f%% of blocks were in chat %d (%.1f%% of its results)", percent(blocksByChat[chatID], blocks), chatID, percent(blocksByChat[chatID], totalByChat[chatID])))
+		}
+	}
+
+	// suggestions
+	suggestions := []string{}
+	ratio := percent(blocks, total)
+	if ratio >= harmReportRelaxRatio && threshold < genai.HarmBlockNone {
+		suggestions = append(suggestions, fmt.Sprintf("- %.1f%% of results were blocked; consider relaxing `google_ai_harm_block_threshold` to %d (%s).", ratio, threshold+1, harmBlockThresholdName(threshold+1)))
+	} else if ratio <= harmReportTightenRatio && threshold > genai.HarmBlockLowAndAbove {
+		suggestions = append(suggestions, fmt.Sprintf("- Only %.1f%% of results were blocked; current threshold looks fine, or can be tightened to %d (%s) if needed.", ratio, threshold-1, harmBlockThresholdName(threshold-1)))
+	}
+	for _, chatID := range chatIDs {
+		if totalByChat[chatID] >= harmReportMinResultsForChat && percent(blocksByChat[chatID], totalByChat[chatID]) >= harmReportChatRatio {
+			suggestions = append(suggestions, fmt.Sprintf("- Chat %d is blocked frequently; review its usage before changing the global threshold.", chatID))
+		}
+	}
+	if len(suggestions) > 0 {
+		lines = append(lines, "", "Suggestions:")
+		lines = append(lines, suggestions...)
+	}
+
+	lines = append(lines, "", "(Per-category safety ratings are not available from streamed answers, so only finish reasons are analyzed.)")
+
+	return strings.Join(lines, "\n")
+}
+
+// calculate the percentage of `n` in `total`
+func percent(n, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// Setting struct
+//
+// a key/value setting of a scope (global, chat, or user)
+type Setting struct {
+	gorm.Model
+
+	Scope   string `gorm:"uniqueIndex:idx_settings_scope_key"`
+	ScopeID int64  `gorm:"uniqueIndex:idx_settings_scope_key"` // chat id or user id (0 for global ones)
+	Key     string `gorm:"uniqueIndex:idx_settings_scope_key"`
+
+	Value string
+}
+
+// load the value of a setting.
+func (d *Database) loadSettingValue(scope settingScope, scopeID int64, key string) (value string, exists bool, err error) {
+	var settings []Setting
+	tx := d.db.Model(&Setting{}).
+		Where("scope = ? AND scope_id = ? AND key = ?", scope, scopeID, key).
+		Limit(1).
+		Find(&settings)
+	if tx.Error != nil {
+		return "", false, tx.Error
+	}
+	if len(settings) <= 0 {
+		return "", false, nil
+	}
+	return settings[0].Value, true, nil
+}
+
+// save the value of a setting, or delete it if the value is empty.
+func (d *Database) saveSettingValue(scope settingScope, scopeID int64, key, value string) (err error) {
+	if value == "" {
+		tx := d.db.Unscoped().
+			Where("scope = ? AND scope_id = ? AND key = ?", scope, scopeID, key).
+			Delete(&Setting{})
+		return tx.Error
+	}
+
+	tx := d.db.Where(Setting{Scope: string(scope), ScopeID: scopeID, Key: key}).
+		Assign(Setting{Value: value}).
+		FirstOrCreate(&Setting{})
+	return tx.Error
+}
+
+// migrate settings from the legacy tables (`user_settings` and `chat_settings`) to key/value settings.
+func (d *Database) migrateLegacySettings() (err error) {
+	migrator := d.db.Migrator()
+
+	if migrator.HasTable("user_settings") {
+		var rows []struct {
+			UserID   int64
+			Language string
+			Length   string
+			Voice    string
+		}
+		if tx := d.db.Raw("SELECT user_id, language, length, voice FROM user_settings WHERE deleted_at IS NULL").Scan(&rows); tx.Error != nil {
+			return tx.Error
+		}
+		for _, row := range rows {
+			for key, value := range map[string]string{"language": row.Language, "length": row.Length, "voice": row.Voice} {
+				if err = d.saveSettingValue(settingScopeUser, row.UserID, key, value); err != nil {
+					return err
+				}
+			}
+		}
+		if err = migrator.DropTable("user_settings"); err != nil {
+			return err
+		}
+	}
+
+	if migrator.HasTable("chat_settings") {
+		var rows []struct {
+			ChatID          int64
+			Persona         string
+			GenerativeModel string
+		}
+		if tx := d.db.Raw("SELECT chat_id, persona, generative_model FROM chat_settings WHERE deleted_at IS NULL").Scan(&rows); tx.Error != nil {
+			return tx.Error
+		}
+		for _, row := range rows {
+			for key, value := range map[string]string{"persona": row.Persona, "model": row.GenerativeModel} {
+				if err = d.saveSettingValue(settingScopeChat, row.ChatID, key, value); err != nil {
+					return err
+				}
+			}
+		}
+		if err = migrator.DropTable("chat_settings"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// BroadcastSubscription struct
+//
+// chats which opted in to generated broadcasts
+type BroadcastSubscription struct {
+	gorm.Model
+
+	ChatID    int64 `gorm:"uniqueIndex"`
+	ChatTitle string
+}
+
+// Broadcast struct
+//
+// a generated answer which was broadcasted to multiple chats
+type Broadcast struct {
+	gorm.Model
+
+	UserID int64
+	Prompt string
+	Text   string
+
+	Deliveries []BroadcastDelivery
+}
+
+// BroadcastDelivery struct
+//
+// delivery of a broadcast to a chat
+type BroadcastDelivery struct {
+	gorm.Model
+
+	BroadcastID uint `gorm:"index"` // foreign key
+	ChatID      int64
+	Delivered   bool
+	Error       string
+}
+
+// set whether given chat is subscribed to broadcasts.
+func (d *Database) setBroadcastSubscription(chatID int64, chatTitle string, subscribed bool) (err error) {
+	if subscribed {
+		tx := d.db.Where(BroadcastSubscription{ChatID: chatID}).
+			Assign(BroadcastSubscription{ChatTitle: chatTitle}).
+			FirstOrCreate(&BroadcastSubscription{})
+		return tx.Error
+	}
+
+	tx := d.db.Unscoped().
+		Where("chat_id = ?", chatID).
+		Delete(&BroadcastSubscription{})
+	return tx.Error
+}
+
+// load all chats which are subscribed to broadcasts.
+func (d *Database) loadBroadcastSubscriptions() (result []BroadcastSubscription, err error) {
+	tx := d.db.Model(&BroadcastSubscription{}).
+		Order("chat_id ASC").
+		Find(&result)
+	return result, tx.Error
+}
+
+// save a broadcast (with its deliveries).
+func (d *Database) saveBroadcast(broadcast *Broadcast) (err error) {
+	tx := d.db.Save(broadcast)
+	return tx.Error
+}
+
+// save a delivery of a broadcast.
+func (d *Database) saveBroadcastDelivery(delivery BroadcastDelivery) (err error) {
+	tx := d.db.Save(&delivery)
+	return tx.Error
+}
+
+// Watch struct
+//
+// a url which is watched for a condition
+type Watch struct {
+	gorm.Model
+
+	ChatID    int64 `gorm:"index"`
+	UserID    int64
+	URL       string
+	Condition string
+
+	LastContent   string
+	LastCheckedAt time.Time
+}
+
+// save a watch.
+func (d *Database) saveWatch(watch *Watch) (err error) {
+	tx := d.db.Save(watch)
+	return tx.Error
+}
+
+// load watches of given chat.
+func (d *Database) loadWatches(chatID int64) (result []Watch, err error) {
+	tx := d.db.Where("chat_id = ?", chatID).Order("id").Find(&result)
+	return result, tx.Error
+}
+
+// load all watches.
+func (d *Database) loadAllWatches() (result []Watch, err error) {
+	tx := d.db.Order("id").Find(&result)
+	return result, tx.Error
+}
+
+// delete a watch of given chat.
+func (d *Database) deleteWatch(chatID int64, id uint) (deleted bool, err error) {
+	tx := d.db.Where("chat_id = ? AND id = ?", chatID, id).Delete(&Watch{})
+	return tx.RowsAffected > 0, tx.Error
+}
+
+// Space struct
+//
+// a named collection of shared documents and memories, which multiple chats can join
+type Space struct {
+	gorm.Model
+
+	Name    string `gorm:"uniqueIndex"`
+	OwnerID int64
+}
+
+// SpaceMember struct
+//
+// a user who can manage and join a space (in addition to its owner)
+type SpaceMember struct {
+	gorm.Model
+
+	SpaceID uint  `gorm:"uniqueIndex:idx_space_member"`
+	UserID  int64 `gorm:"uniqueIndex:idx_space_member"`
+}
+
+// SpaceSubscription struct
+//
+// a chat which joined a space
+type SpaceSubscription struct {
+	gorm.Model
+
+	SpaceID uint  `gorm:"uniqueIndex:idx_space_subscription"`
+	ChatID  int64 `gorm:"uniqueIndex:idx_space_subscription"`
+}
+
+// SpaceItem struct
+//
+// a document (with its telegram file id and name) or a memory (text only) of a space
+type SpaceItem struct {
+	gorm.Model
+
+	SpaceID uint `gorm:"index"`
+	UserID  int64
+	FileID  string
+	Text    string
+}
+
+// save a space.
+func (d *Database) saveSpace(space *Space) (err error) {
+	tx := d.db.Save(space)
+	return tx.Error
+}
+
+// load the space with given name.
+func (d *Database) loadSpace(name string) (result Space, err error) {
+	tx := d.db.Where("name = ?", name).First(&result)
+	return result, tx.Error
+}
+
+// check if given user is a member of given space.
+func (d *Database) isSpaceMember(spaceID uint, userID int64) (member bool, err error) {
+	var count int64
+	tx := d.db.Model(&SpaceMember{}).Where("space_id = ? AND user_id = ?", spaceID, userID).Count(&count)
+	return count > 0, tx.Error
+}
+
+// add a member to given space.
+func (d *Database) addSpaceMember(spaceID uint, userID int64) (err error) {
+	member := SpaceMember{SpaceID: spaceID, UserID: userID}
+	tx := d.db.Where(member).FirstOrCreate(&member)
+	return tx.Error
+}
+
+// remove a member from given space, along with the subscription of the member's direct messages.
+func (d *Database) removeSpaceMember(spaceID uint, userID int64) (err error) {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Unscoped().Where("space_id = ? AND user_id = ?", spaceID, userID).Delete(&SpaceMember{}); res.Error != nil {
+			return res.Error
+		}
+		return tx.Unscoped().Where("space_id = ? AND chat_id = ?", spaceID, userID).Delete(&SpaceSubscription{}).Error
+	})
+}
+
+// subscribe given chat to given space.
+func (d *Database) joinSpace(spaceID uint, chatID int64) (err error) {
+	subscription := SpaceSubscription{SpaceID: spaceID, ChatID: chatID}
+	tx := d.db.Where(subscription).FirstOrCreate(&subscription)
+	return tx.Error
+}
+
+// unsubscribe given chat from given space.
+func (d *Database) leaveSpace(spaceID uint, chatID int64) (err error) {
+	tx := d.db.Unscoped().Where("space_id = ? AND chat_id = ?", spaceID, chatID).Delete(&SpaceSubscription{})
+	return tx.Error
+}
+
+// load spaces joined by given chat.
+func (d *Database) loadJoinedSpaces(chatID int64) (result []Space, err error) {
+	tx := d.db.Where("id IN (SELECT space_id FROM space_subscriptions WHERE chat_id = ? AND deleted_at IS NULL)", chatID).
+		Order("name").
+		Find(&result)
+	return result, tx.Error
+}
+
+// save an item of a space.
+func (d *Database) saveSpaceItem(item *SpaceItem) (err error) {
+	tx := d.db.Save(item)
+	return tx.Error
+}
+
+// load items of given space.
+func (d *Database) loadSpaceItems(spaceID uint) (result []SpaceItem, err error) {
+	tx := d.db.Where("space_id = ?", spaceID).Order("id").Find(&result)
+	return result, tx.Error
+}
+
+// delete an item of given space.
+func (d *Database) deleteSpaceItem(spaceID uint, id uint) (deleted bool, err error) {
+	tx := d.db.Where("space_id = ? AND id = ?", spaceID, id).Delete(&SpaceItem{})
+	return tx.RowsAffected > 0, tx.Error
+}
+
+// AllowedUser struct
+//
+// a user who was allowed by admins (in addition to `allowed_telegram_users`)
+type AllowedUser struct {
+	gorm.Model
+
+	UserID   int64 `gorm:"uniqueIndex"`
+	Username string
+}
+
+// save an allowed user.
+func (d *Database) saveAllowedUser(user AllowedUser) (err error) {
+	tx := d.db.Where("user_id = ?", user.UserID).Assign(AllowedUser{Username: user.Username}).FirstOrCreate(&user)
+	return tx.Error
+}
+
+// load all allowed users.
+func (d *Database) loadAllowedUsers() (result []AllowedUser, err error) {
+	tx := d.db.Order("id").Find(&result)
+	return result, tx.Error
+}
+
+// delete allowed users with given id.
+func (d *Database) deleteAllowedUser(userID int64) (deleted bool, err error) {
+	tx := d.db.Unscoped().Where("user_id = ?", userID).Delete(&AllowedUser{})
+	return tx.RowsAffected > 0, tx.Error
+}
+
+// AllowedUsername struct
+//
+// a username which was allowed by admins with `/allow` (in addition to `allowed_telegram_users`)
+type AllowedUsername struct {
+	gorm.Model
+
+	Username string `gorm:"uniqueIndex"`
+}
+
+// save an allowed username.
+func (d *Database) saveAllowedUsername(username string) (err error) {
+	allowed := AllowedUsername{Username: username}
+	tx := d.db.Where("username = ?", username).FirstOrCreate(&allowed)
+	return tx.Error
+}
+
+// load all allowed usernames.
+func (d *Database) loadAllowedUsernames() (result []AllowedUsername, err error) {
+	tx := d.db.Order("id").Find(&result)
+	return result, tx.Error
+}
+
+// delete given allowed username.
+func (d *Database) deleteAllowedUsername(username string) (deleted bool, err error) {
+	tx := d.db.Unscoped().Where("username = ?", username).Delete(&AllowedUsername{})
+	return tx.RowsAffected > 0, tx.Error
+}
+
+// UploadedFile struct
+//
+// a file which was uploaded to Gemini, for reusing it instead of uploading identical contents again
+type UploadedFile struct {
+	gorm.Model
+
+	Hash     string `gorm:"uniqueIndex"` // sha256 of the content
+	URI      string
+	MIMEType string
+}
+
+// save an uploaded file (or update the one with the same hash).
+func (d *Database) saveUploadedFile(file UploadedFile) (err error) {
+	tx := d.db.Where("hash = ?", file.Hash).Assign(UploadedFile{URI: file.URI, MIMEType: file.MIMEType}).FirstOrCreate(&file)
+	return tx.Error
+}
+
+// load the file with given hash which was uploaded after given time.
+func (d *Database) loadUploadedFile(hash string, after time.Time) (file UploadedFile, exists bool) {
+	tx := d.db.Where("hash = ? AND updated_at > ?", hash, after).First(&file)
+	return file, tx.Error == nil
+}
+
+// AccessRequest struct
+//
+// a request for access from a user who is not allowed
+type AccessRequest struct {
+	gorm.Model
+
+	UserID   int64 `gorm:"uniqueIndex"`
+	Username string
+	ChatID   int64
+	Preview  string // preview of the first message
+	Status   string // "pending", "approved", or "denied"
+}
+
+// save an access request.
+func (d *Database) saveAccessRequest(request *AccessRequest) (err error) {
+	tx := d.db.Save(request)
+	return tx.Error
+}
+
+// load the access request of given user.
+func (d *Database) loadAccessRequest(userID int64) (result AccessRequest, err error) {
+	tx := d.db.Where("user_id = ?", userID).First(&result)
+	return result, tx.Error
+}
+
+// check if given user has requested access before.
+func (d *Database) hasAccessRequest(userID int64) (exists bool, err error) {
+	var count int64
+	tx := d.db.Model(&AccessRequest{}).Where("user_id = ?", userID).Count(&count)
+	return count > 0, tx.Error
+}
+
+// UserAPIKey struct
+//
+// a user's own google ai api key (encrypted with `user_api_keys_secret`)
+type UserAPIKey struct {
+	gorm.Model
+
+	UserID       int64 `gorm:"uniqueIndex"`
+	EncryptedKey string
+}
+
+// save an api key of a user (or replace the existing one).
+func (d *Database) saveUserAPIKey(key UserAPIKey) (err error) {
+	tx := d.db.Where("user_id = ?", key.UserID).Assign(UserAPIKey{EncryptedKey: key.EncryptedKey}).FirstOrCreate(&key)
+	return tx.Error
+}
+
+// load the api key of given user.
+func (d *Database) loadUserAPIKey(userID int64) (result UserAPIKey, err error) {
+	tx := d.db.Where("user_id = ?", userID).First(&result)
+	return result, tx.Error
+}
+
+// delete the api key of given user.
+func (d *Database) deleteUserAPIKey(userID int64) (err error) {
+	tx := d.db.Unscoped().Where("user_id = ?", userID).Delete(&UserAPIKey{})
+	return tx.Error
+}
+
+// delete prompts (with their generated results) created before `until`, and return the number of deleted prompts.
+func (d *Database) deletePromptsBefore(until time.Time) (deleted int64, err error) {
+	err = d.db.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Unscoped().
+			Where("prompt_id IN (SELECT id FROM prompts WHERE created_at < ?)", until).
+			Delete(&Generated{}); res.Error != nil {
+			return res.Error
+		}
+
+		res := tx.Unscoped().
+			Where("created_at < ?", until).
+			Delete(&Prompt{})
+		deleted = res.RowsAffected
+		return res.Error
+	})
+	return deleted, err
+}
+
+// check the integrity of the database, repair what can be repaired, and return the findings.
+func (d *Database) checkIntegrity() (findings []string, err error) {
+	// orphaned generated results (without prompts)
+	tx := d.db.Unscoped().
+		Where("prompt_id NOT IN (SELECT id FROM prompts WHERE deleted_at IS NULL)").
+		Delete(&Generated{})
+	if tx.Error != nil {
+		return nil, fmt.Errorf("failed to delete orphaned generated results: %w", tx.Error)
+	}
+	findings = append(findings, fmt.Sprintf("Orphaned generated results: %d (deleted)", tx.RowsAffected))
+
+	// prompts without results
+	var count int64
+	if tx := d.db.Model(&Prompt{}).
+		Where("id NOT IN (SELECT prompt_id FROM generateds WHERE deleted_at IS NULL)").
+		Count(&count); tx.Error != nil {
+		return nil, fmt.Errorf("failed to count prompts without results: %w", tx.Error)
+	}
+	findings = append(findings, fmt.Sprintf("Prompts without results: %d", count))
+
+	// integrity of tables and indexes (only for sqlite; servers of other databases check it themselves)
+	if name := d.db.Dialector.Name(); name != dbDriverSQLite {
+		findings = append(findings, fmt.Sprintf("Integrity check: skipped (not supported for %s)", name))
+		return findings, nil
+	}
+	var results []string
+	if tx := d.db.Raw("PRAGMA integrity_check").Scan(&results); tx.Error != nil {
+		return nil, fmt.Errorf("failed to check integrity: %w", tx.Error)
+	}
+	if len(results) == 1 && results[0] == "ok" {
+		findings = append(findings, "Integrity check: ok")
+	} else {
+		findings = append(findings, fmt.Sprintf("Integrity check: %s", strings.Join(results, ", ")))
+
+		// rebuild indexes, and check again
+		if tx := d.db.Exec("REINDEX"); tx.Error != nil {
+			return nil, fmt.Errorf("failed to reindex: %w", tx.Error)
+		}
+		results = nil
+		if tx := d.db.Raw("PRAGMA integrity_check").Scan(&results); tx.Error != nil {
+			return nil, fmt.Errorf("failed to check integrity after reindexing: %w", tx.Error)
+		}
+		findings = append(findings, fmt.Sprintf("Integrity check after reindexing: %s", strings.Join(results, ", ")))
+	}
+
+	return findings, nil
+}
@@ -0,0 +1,145 @@
+// diagnostics.go
+//
+// diagnostics of the running bot, for debugging remotely
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	// google ai
+	"github.com/google/generative-ai-go/genai"
+
+	// my libraries
+	gt "github.com/meinside/gemini-things-go"
+)
+
+const (
+	modelReachabilityTimeoutSeconds = 10
+)
+
+// generate a diagnostics report of the effective configuration and its dependencies
+func configDiagnostics(ctx context.Context, conf config, db *Database, gtc, gtcFast geminiClient) string {
+	lines := []string{}
+
+	// effective configuration (with defaults applied, and secrets redacted)
+	if bytes, err := json.MarshalIndent(redactedConfig(conf), "", "  "); err == nil {
+		lines = append(lines, "Effective configuration:", string(bytes), "")
+	} else {
+		lines = append(lines, fmt.Sprintf("Failed to marshal configuration: %s", err), "")
+	}
+
+	// database
+	lines = append(lines, fmt.Sprintf("Database: %s", databaseStatus(conf, db)))
+
+	// external tools
+	for _, tool := range []string{"ffmpeg", "latex", "dvipng"} {
+		if path, err := exec.LookPath(tool); err == nil {
+			lines = append(lines, fmt.Sprintf("%s: %s", tool, path))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s: not found", tool))
+		}
+	}
+
+	// models
+	lines = append(lines, fmt.Sprintf("Model (%s): %s", *conf.GoogleGenerativeModel, modelReachability(ctx, conf, gtc)))
+	if conf.GoogleGenerativeModelFast != nil && gtcFast != nil {
+		lines = append(lines, fmt.Sprintf("Fast model (%s): %s", *conf.GoogleGenerativeModelFast, modelReachability(ctx, conf, gtcFast)))
+	}
+	if infos := formatModelInfos(conf, newFormatter(defaultLocale)); infos != "" {
+		lines = append(lines, "", infos)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// copy given config with its secrets redacted
+func redactedConfig(conf config) config {
+	redacted := conf
+
+	if redacted.TelegramBotToken != nil {
+		redacted.TelegramBotToken = ptr(redactedString)
+	}
+	if redacted.GoogleAIAPIKey != nil {
+		redacted.GoogleAIAPIKey = ptr(redactedString)
+	}
+	if redacted.DBDSN != "" {
+		redacted.DBDSN = redactedString
+	}
+	if redacted.UserAPIKeysSecret != nil {
+		redacted.UserAPIKeysSecret = ptr(redactedString)
+	}
+	if redacted.Infisical != nil {
+		infisical := *redacted.Infisical
+		infisical.ClientID = redactedString
+		infisical.ClientSecret = redactedString
+		redacted.Infisical = &infisical
+	}
+	if redacted.AdminConsole != nil {
+		console := *redacted.AdminConsole
+		console.Password = redactedString
+		redacted.AdminConsole = &console
+	}
+	if redacted.Paste != nil {
+		paste := *redacted.Paste
+		if paste.GitHubToken != "" {
+			paste.GitHubToken = redactedString
+		}
+		redacted.Paste = &paste
+	}
+	if redacted.Calendar != nil {
+		calendar := *redacted.Calendar
+		if calendar.Password != "" {
+			calendar.Password = redactedString
+		}
+		redacted.Calendar = &calendar
+	}
+
+	return redacted
+}
+
+// check the status of the database
+func databaseStatus(conf config, db *Database) string {
+	if db == nil {
+		if databaseDSN(conf) != "" && !conf.DisableRequestLogging {
+			return fmt.Sprintf("failed to open %s", databaseName(conf))
+		}
+		return databaseUnavailableMessage(conf)
+	}
+
+	var count int64
+	if tx := db.db.Model(&Prompt{}).Count(&count); tx.Error != nil {
+		return fmt.Sprintf("error (%s)", tx.Error)
+	}
+	return fmt.Sprintf("ok (%s, %d prompts)", databaseName(conf), count)
+}
+
+// name of the configured database for showing in diagnostics (without the data source name, which may have passwords)
+func databaseName(conf config) string {
+	if conf.DBDriver == "" || conf.DBDriver == dbDriverSQLite {
+		return fmt.Sprintf("'%s'", conf.RequestLogsDBFilepath)
+	}
+	return conf.DBDriver
+}
+
+// check if the model is reachable with a tiny generation
+func modelReachability(ctx context.Context, conf config, gtc geminiClient) string {
+	ctx, cancel := context.WithTimeout(ctx, modelReachabilityTimeoutSeconds*time.Second)
+	defer cancel()
+
+	started := time.Now()
+	if _, err := gtc.Generate(ctx, "ping", nil, &gt.GenerationOptions{
+		HarmBlockThreshold: conf.GoogleAIHarmBlockThreshold,
+		Config: &genai.GenerationConfig{
+			MaxOutputTokens: ptr(int32(1)),
+		},
+	}); err != nil {
+		return fmt.Sprintf("unreachable (%s)", errorString(conf, err))
+	}
+	return fmt.Sprintf("reachable (%s)", time.Since(started).Round(time.Millisecond))
+}
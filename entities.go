@@ -0,0 +1,86 @@
+// entities.go
+//
+// functions for converting texts with telegram message entities
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf16"
+
+	// my libraries
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+// apply message entities to given text, for better fidelity of prompts:
+//
+// - pre/code entities are converted to (fenced) code blocks,
+// - text_link entities are expanded to markdown links with their URLs,
+// - mentions of bots (eg. @this_bot) are stripped.
+func textWithEntities(text string, entities []tg.MessageEntity) string {
+	// entities which are handled here (in order of their offsets)
+	handled := []tg.MessageEntity{}
+	for _, entity := range entities {
+		switch entity.Type {
+		case tg.MessageEntityTypePre, tg.MessageEntityTypeCode, tg.MessageEntityTypeTextLink, tg.MessageEntityTypeMention:
+			handled = append(handled, entity)
+		}
+	}
+	if len(handled) <= 0 {
+		return text
+	}
+	slices.SortStableFunc(handled, func(a, b tg.MessageEntity) int {
+		return a.Offset - b.Offset
+	})
+
+	// offsets and lengths of entities are in UTF-16 code units
+	units := utf16.Encode([]rune(text))
+	substring := func(from, to int) string {
+		return string(utf16.Decode(units[from:to]))
+	}
+
+	var sb strings.Builder
+	cursor := 0
+	for _, entity := range handled {
+		from, to := entity.Offset, entity.Offset+entity.Length
+		if from < cursor || to > len(units) { // skip overlapping or invalid ones
+			continue
+		}
+		sb.WriteString(substring(cursor, from))
+
+		content := substring(from, to)
+		switch entity.Type {
+		case tg.MessageEntityTypePre:
+			var language string
+			if entity.Language != nil {
+				language = *entity.Language
+			}
+			sb.WriteString(fmt.Sprintf("\n```%s\n%s\n```\n", language, strings.Trim(content, "\n")))
+		case tg.MessageEntityTypeCode:
+			sb.WriteString("`" + content + "`")
+		case tg.MessageEntityTypeTextLink:
+			if entity.URL != nil {
+				sb.WriteString(fmt.Sprintf("[%s](%s)", content, *entity.URL))
+			} else {
+				sb.WriteString(content)
+			}
+		case tg.MessageEntityTypeMention:
+			if !isBotMention(content) {
+				sb.WriteString(content)
+			}
+		}
+		cursor = to
+	}
+	sb.WriteString(substring(cursor, len(units)))
+
+	return strings.TrimSpace(sb.String())
+}
+
+// check if given mention (eg. @some_bot) is for a bot
+//
+// (usernames of telegram bots always end with 'bot')
+func isBotMention(mention string) bool {
+	return strings.HasSuffix(strings.ToLower(mention), "bot")
+}
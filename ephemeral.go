@@ -0,0 +1,125 @@
+// ephemeral.go
+//
+// ephemeral answers which are deleted (with their questions) after given minutes
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	maxEphemeralMinutes = 24 * 60 // (messages older than 48 hours cannot be deleted by bots)
+)
+
+// parse arguments of /ephemeral: `<minutes> <prompt>`
+func parseEphemeralArgs(args string) (minutes int, prompt string, err error) {
+	first, rest, _ := strings.Cut(strings.TrimSpace(args), " ")
+	if minutes, err = strconv.Atoi(first); err != nil || minutes <= 0 || minutes > maxEphemeralMinutes {
+		return 0, "", fmt.Errorf("minutes should be between 1 and %d", maxEphemeralMinutes)
+	}
+	if prompt = strings.TrimSpace(rest); prompt == "" {
+		return 0, "", fmt.Errorf("no prompt was given")
+	}
+	return minutes, prompt, nil
+}
+
+// schedule deletions of given messages at given time
+//
+// (with the database, they are saved for being rescheduled after restarts)
+func scheduleDeletions(ctx context.Context, bot telegramClient, db *Database, chatID int64, messageIDs []int64, at time.Time) {
+	deletions := []ScheduledDeletion{}
+	for _, messageID := range messageIDs {
+		deletions = append(deletions, ScheduledDeletion{
+			ChatID:    chatID,
+			MessageID: messageID,
+			DeleteAt:  at,
+		})
+	}
+	if db != nil {
+		if err := db.saveScheduledDeletions(deletions); err != nil {
+			log.Printf("failed to save scheduled deletions: %s", err)
+		}
+	}
+
+	for _, deletion := range deletions {
+		runScheduledDeletion(ctx, bot, db, deletion)
+	}
+}
+
+// run given scheduled deletion at its time
+func runScheduledDeletion(ctx context.Context, bot telegramClient, db *Database, deletion ScheduledDeletion) {
+	runAt(ctx, deletion.DeleteAt, func(ctx context.Context) {
+		logVerbose(verboseTelegram, "deleting message(%d) in chat(%d) as scheduled", deletion.MessageID, deletion.ChatID)
+
+		if res := withRetries(bot).DeleteMessage(deletion.ChatID, deletion.MessageID); !res.Ok {
+			log.Printf("failed to delete message(%d) in chat(%d) as scheduled: %s", deletion.MessageID, deletion.ChatID, *res.Description)
+		}
+		if db != nil && deletion.ID > 0 {
+			if err := db.deleteScheduledDeletion(deletion.ID); err != nil {
+				log.Printf("failed to delete scheduled deletion: %s", err)
+			}
+		}
+	})
+}
+
+// reschedule the deletions which were saved before restarting (overdue ones are deleted right away)
+func restoreScheduledDeletions(ctx context.Context, bot telegramClient, db *Database) {
+	deletions, err := db.loadScheduledDeletions()
+	if err != nil {
+		log.Printf("failed to load scheduled deletions: %s", err)
+		return
+	}
+
+	for _, deletion := range deletions {
+		runScheduledDeletion(ctx, bot, db, deletion)
+	}
+}
+
+// return a /ephemeral command handler
+func ephemeralCommandHandler(ctx context.Context, conf config, db *Database, gtc geminiClient, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("ephemeral command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		minutes, prompt, err := parseEphemeralArgs(args)
+		if err != nil {
+			_, _ = sendMessage(b, conf, msgEphemeralUsage, chatID, &messageID)
+			return
+		}
+
+		dispatchToChat(ctx, chatID, update.UpdateID, func(loopCtx context.Context) {
+			answerCtx, cancel := context.WithTimeout(loopCtx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second)
+			defer cancel()
+
+			messageIDs := append([]int64{messageID}, answer(answerCtx, b, conf, db, gtc, responseModeStreamed, nil, &chatMessage{
+				role: chatMessageRoleUser,
+				text: prompt,
+			}, chatID, message.From.ID, userNameFromUpdate(update), isAdmin(update, conf), messageID)...)
+			if noticeMessageID, err := sendMessage(b, conf, fmt.Sprintf(msgEphemeralNoticeFormat, minutes), chatID, &messageID); err == nil {
+				messageIDs = append(messageIDs, noticeMessageID)
+			}
+
+			// (with the base context, not the one with timeout)
+			scheduleDeletions(ctx, b, db, chatID, messageIDs, time.Now().Add(time.Duration(minutes)*time.Minute))
+		})
+	}
+}
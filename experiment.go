@@ -0,0 +1,202 @@
+// experiment.go
+//
+// A/B experiments of prompts with two variants of models or system instructions (for admins)
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	// google ai
+	"github.com/google/generative-ai-go/genai"
+
+	// my libraries
+	gt "github.com/meinside/gemini-things-go"
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	experimentVariantModelPrefix = "model:"
+	experimentArgsSeparator      = "|"
+)
+
+// a variant of an experiment: a model, and/or a system instruction
+type experimentVariant struct {
+	model       string
+	instruction *string // nil for the default one
+}
+
+// describe the variant for labeling its output
+func (v experimentVariant) String() string {
+	if v.instruction == nil {
+		return v.model
+	}
+	return fmt.Sprintf("%s, instruction: %s", v.model, *v.instruction)
+}
+
+// parse a variant of an experiment
+//
+// (`model:NAME [instruction]`, or `instruction` with the model of the chat)
+func parseExperimentVariant(arg, defaultModel string) (variant experimentVariant) {
+	variant.model = defaultModel
+
+	arg = strings.TrimSpace(arg)
+	if rest, isModel := strings.CutPrefix(arg, experimentVariantModelPrefix); isModel {
+		model, instruction, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		variant.model = model
+		arg = strings.TrimSpace(instruction)
+	}
+	if arg != "" {
+		variant.instruction = &arg
+	}
+
+	return variant
+}
+
+// parse arguments of an experiment: `<variant A> | <variant B> | <prompt>`
+func parseExperimentArgs(args, defaultModel string) (a, b experimentVariant, prompt string, err error) {
+	splitted := strings.SplitN(args, experimentArgsSeparator, 3)
+	if len(splitted) < 3 || strings.TrimSpace(splitted[2]) == "" {
+		return a, b, "", fmt.Errorf("missing variants or prompt")
+	}
+
+	a, b = parseExperimentVariant(splitted[0], defaultModel), parseExperimentVariant(splitted[1], defaultModel)
+	if a.model == "" || b.model == "" {
+		return a, b, "", fmt.Errorf("missing model name")
+	}
+
+	return a, b, strings.TrimSpace(splitted[2]), nil
+}
+
+// generate an answer with given variant, on a snapshot of the history
+func runExperimentVariant(ctx context.Context, conf config, variant experimentVariant, history []chatMessage, prompt string) (text string, numTokensInput, numTokensOutput int32, err error) {
+	confModel := conf
+	confModel.GoogleGenerativeModel = ptr(variant.model)
+
+	var gtc *gt.Client
+	if gtc, err = gt.NewClient(*conf.GoogleAIAPIKey, variant.model); err != nil {
+		return "", 0, 0, fmt.Errorf("failed to initialize client with model '%s': %w", variant.model, err)
+	}
+	defer gtc.Close()
+	gtc.SetTimeout(conf.AnswerTimeoutSeconds)
+	gtc.SetSystemInstructionFunc(func() string {
+		if variant.instruction != nil {
+			return *variant.instruction
+		} else if confModel.SystemInstruction != nil {
+			return *confModel.SystemInstruction
+		}
+		return defaultSystemInstruction(confModel)
+	})
+
+	opts := &gt.GenerationOptions{
+		HarmBlockThreshold: conf.GoogleAIHarmBlockThreshold,
+	}
+	for _, message := range history {
+		opts.History = append(opts.History, &genai.Content{
+			Role:  string(message.role),
+			Parts: []genai.Part{genai.Text(message.text)},
+		})
+	}
+
+	var res *genai.GenerateContentResponse
+	if res, err = gtc.Generate(ctx, prompt, nil, opts); err != nil {
+		return "", 0, 0, err
+	}
+	if res.UsageMetadata != nil {
+		numTokensInput, numTokensOutput = res.UsageMetadata.PromptTokenCount, res.UsageMetadata.CandidatesTokenCount
+	}
+	text, err = textFromResponse(res)
+
+	return text, numTokensInput, numTokensOutput, err
+}
+
+// return a /ab command handler
+//
+// (as a reply to a message, the conversation until the replied message is used as a snapshot of the history;
+// the conversation itself is not changed by experiments)
+func experimentCommandHandler(ctx context.Context, conf config, db *Database) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		userID := message.From.ID
+		messageID := message.MessageID
+
+		if !isAdmin(update, conf) {
+			log.Printf("ab command not allowed: %s", userNameFromUpdate(update))
+
+			_, _ = sendMessage(b, conf, msgNotAdmin, chatID, &messageID)
+			return
+		}
+
+		defaultModel := *conf.GoogleGenerativeModel
+		if model := db.settingString(settingScopeChat, chatID, "model"); model != "" {
+			defaultModel = model
+		}
+		variantA, variantB, prompt, err := parseExperimentArgs(args, defaultModel)
+		if err != nil {
+			_, _ = sendMessage(b, conf, msgExperimentUsage, chatID, &messageID)
+			return
+		}
+
+		_ = withRetries(b).SetMessageReaction(chatID, messageID, tg.NewMessageReactionWithEmoji("👌"))
+
+		ctx, end := beginInteractiveRequest(ctx, "ab", chatID, userID, userNameFromUpdate(update))
+		defer end()
+
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second)
+		defer cancel()
+
+		// snapshot of the history (texts only) and settings
+		var history []chatMessage
+		if replied := repliedToMessage(*message); replied != nil {
+			history = threadHistoryBefore(chatID, replied.MessageID, conf.MaxReplyChainDepth)
+			if parent, err := convertMessage(b, *replied); err == nil {
+				history = append(history, chatMessage{role: parent.role, text: parent.text})
+			}
+		}
+		history = mergeConsecutiveRoles(history)
+		if len(history) > 0 && history[len(history)-1].role == chatMessageRoleUser {
+			// fold the last user turn into the prompt, as turns should alternate between roles
+			prompt = history[len(history)-1].text + "\n\n" + prompt
+			history = history[:len(history)-1]
+		}
+		prompt = settingsInstruction(db, chatID, userID) + prompt
+
+		// run both variants at once
+		variants := []experimentVariant{variantA, variantB}
+		results := make([]string, len(variants))
+		var wg sync.WaitGroup
+		for i, variant := range variants {
+			wg.Add(1)
+			go func(i int, variant experimentVariant) {
+				defer wg.Done()
+
+				requestedAt := time.Now()
+				text, numTokensInput, numTokensOutput, err := runExperimentVariant(ctx, conf, variant, history, prompt)
+				if err != nil {
+					text = fmt.Sprintf("Failed to generate: %s", errorString(conf, err))
+				}
+				results[i] = text
+
+				savePromptAndResult(db, chatID, userID, userNameFromUpdate(update), messagesToPrompt(history, &chatMessage{role: chatMessageRoleUser, text: prompt}), uint(numTokensInput), text, uint(numTokensOutput), err == nil, "", variant.model, time.Since(requestedAt), stageLatencies{generation: time.Since(requestedAt)}, requestCost(conf, variant.model, uint(numTokensInput), uint(numTokensOutput)))
+			}(i, variant)
+		}
+		wg.Wait()
+
+		for i, variant := range variants {
+			text, _ := firstChunk(fmt.Sprintf(msgExperimentResultFormat, string(rune('A'+i)), variant, results[i]))
+
+			_, _ = sendFormattedMessage(b, conf, text, chatID, &messageID)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// export.go
+//
+// exporting request logs in JSONL (for external analytics tools), and users' own histories in JSON or CSV
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	requestLogSchemaVersion = 1 // increase only when fields are changed or removed (not when added)
+
+	defaultExportLogsDays = 30
+	exportLogsBatchSize   = 500
+	exportLogsArgTexts    = "texts"
+
+	exportFormatJSON = "json"
+	exportFormatCSV  = "csv"
+)
+
+// a record of an exported request log (one line of JSONL)
+//
+// (keep the fields stable: external tools depend on them)
+type requestLogRecord struct {
+	SchemaVersion int `json:"schema_version"`
+
+	PromptID    uint      `json:"prompt_id"`
+	RequestedAt time.Time `json:"requested_at"`
+	CompletedAt time.Time `json:"completed_at"`
+
+	ChatID   int64   `json:"chat_id"`
+	UserID   int64   `json:"user_id"`
+	Username *string `json:"username"` // null when redacted
+
+	Model                string  `json:"model"` // empty for logs from older versions
+	PromptTokens         uint    `json:"prompt_tokens"`
+	ResultTokens         uint    `json:"result_tokens"`
+	Successful           bool    `json:"successful"`
+	FinishReason         string  `json:"finish_reason"`
+	DurationMilliseconds int64   `json:"duration_ms"` // 0 for logs from older versions
+	Cost                 float64 `json:"cost"`        // in USD, 0 for logs without pricing
+
+	Redacted   bool    `json:"redacted"`    // whether usernames and texts are left out
+	PromptText *string `json:"prompt_text"` // null when redacted
+	ResultText *string `json:"result_text"` // null when redacted
+}
+
+// convert given prompt (and its result) to a record
+func newRequestLogRecord(prompt Prompt, withTexts bool) requestLogRecord {
+	record := requestLogRecord{
+		SchemaVersion: requestLogSchemaVersion,
+
+		PromptID:    prompt.ID,
+		RequestedAt: prompt.CreatedAt,
+		CompletedAt: prompt.Result.CreatedAt,
+
+		ChatID: prompt.ChatID,
+		UserID: prompt.UserID,
+
+		Model:                prompt.Result.GenerativeModel,
+		PromptTokens:         prompt.Tokens,
+		ResultTokens:         prompt.Result.Tokens,
+		Successful:           prompt.Result.Successful,
+		FinishReason:         prompt.Result.FinishReason,
+		DurationMilliseconds: prompt.Result.DurationMilliseconds,
+		Cost:                 prompt.Result.Cost,
+
+		Redacted: !withTexts,
+	}
+	if withTexts {
+		record.Username = ptr(prompt.Username)
+		record.PromptText = ptr(prompt.Text)
+		record.ResultText = ptr(prompt.Result.Text)
+	}
+	return record
+}
+
+// write request logs since given time to `w` in JSONL, and return the number of written records
+//
+// (usernames and texts are included only when `withTexts` is true)
+func exportRequestLogs(db *Database, w io.Writer, since time.Time, withTexts bool) (numRecords int, err error) {
+	encoder := json.NewEncoder(w)
+
+	err = db.eachPromptsSince(since, exportLogsBatchSize, func(prompts []Prompt) error {
+		for _, prompt := range prompts {
+			if err := encoder.Encode(newRequestLogRecord(prompt, withTexts)); err != nil {
+				return err
+			}
+			numRecords++
+		}
+		return nil
+	})
+
+	return numRecords, err
+}
+
+// parse arguments of exporting request logs: `[days] [texts]`
+func parseExportLogsArgs(args []string) (days int, withTexts bool) {
+	days = defaultExportLogsDays
+	for _, arg := range args {
+		if d, err := strconv.Atoi(arg); err == nil && d > 0 {
+			days = d
+		} else if arg == exportLogsArgTexts {
+			withTexts = true
+		}
+	}
+	return days, withTexts
+}
+
+// export request logs to stdout (for `--export-logs` flag)
+func exportRequestLogsToStdout(conf config, args []string) {
+	if conf.DisableRequestLogging || databaseDSN(conf) == "" {
+		log.Printf("no database to export request logs from")
+		os.Exit(1)
+	}
+
+	db, err := openDatabase(conf.DBDriver, databaseDSN(conf), conf.SQLite)
+	if err != nil {
+		log.Printf("failed to open database: %s", err)
+		os.Exit(1)
+	}
+
+	days, withTexts := parseExportLogsArgs(args)
+	if numRecords, err := exportRequestLogs(db, os.Stdout, time.Now().AddDate(0, 0, -days), withTexts); err != nil {
+		log.Printf("failed to export request logs: %s", err)
+		os.Exit(1)
+	} else {
+		log.Printf("exported %d request logs of the last %d days", numRecords, days)
+	}
+}
+
+// return a /export_logs command handler
+func exportLogsCommandHandler(conf config, db *Database) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if !isAdmin(update, conf) {
+			log.Printf("export logs command not allowed: %s", userNameFromUpdate(update))
+
+			_, _ = sendMessage(b, conf, msgNotAdmin, chatID, &messageID)
+			return
+		}
+
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		days, withTexts := parseExportLogsArgs(strings.Fields(args))
+
+		var buf bytes.Buffer
+		numRecords, err := exportRequestLogs(db, &buf, time.Now().AddDate(0, 0, -days), withTexts)
+		if err != nil {
+			_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to export request logs: %s", err), chatID, &messageID)
+			return
+		}
+		if numRecords <= 0 {
+			_, _ = sendMessage(b, conf, fmt.Sprintf(msgNoRequestLogsFormat, days), chatID, &messageID)
+			return
+		}
+
+		if _, err := sendFile(b, conf, buf.Bytes(), chatID, &messageID, ptr(fmt.Sprintf(msgExportedLogsFormat, numRecords, days))); err != nil {
+			log.Printf("failed to send exported request logs: %s", err)
+		}
+	}
+}
+
+// serialize all request logs of given user in given format (`json` or `csv`), and return the number of records
+func exportUserHistory(db *Database, userID int64, format string) (data []byte, numRecords int, err error) {
+	records := []requestLogRecord{}
+	if err = db.eachPromptsOfUser(userID, exportLogsBatchSize, func(prompts []Prompt) error {
+		for _, prompt := range prompts {
+			records = append(records, newRequestLogRecord(prompt, true))
+		}
+		return nil
+	}); err != nil {
+		return nil, 0, err
+	}
+
+	switch format {
+	case exportFormatJSON:
+		data, err = json.MarshalIndent(records, "", "  ")
+	case exportFormatCSV:
+		data, err = requestLogRecordsToCSV(records)
+	default:
+		err = fmt.Errorf("not a supported format: %s", format)
+	}
+
+	return data, len(records), err
+}
+
+// serialize given records in CSV (with a header row)
+func requestLogRecordsToCSV(records []requestLogRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	text := func(s *string) string { // (null when redacted)
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+
+	_ = w.Write([]string{"requested_at", "completed_at", "chat_id", "model", "prompt_tokens", "result_tokens", "successful", "finish_reason", "prompt_text", "result_text"})
+	for _, record := range records {
+		_ = w.Write([]string{
+			record.RequestedAt.Format(time.RFC3339),
+			record.CompletedAt.Format(time.RFC3339),
+			strconv.FormatInt(record.ChatID, 10),
+			record.Model,
+			strconv.FormatUint(uint64(record.PromptTokens), 10),
+			strconv.FormatUint(uint64(record.ResultTokens), 10),
+			strconv.FormatBool(record.Successful),
+			record.FinishReason,
+			text(record.PromptText),
+			text(record.ResultText),
+		})
+	}
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
+
+// return a /export command handler
+//
+// (only in private chats, as the history may include messages from other chats)
+func exportCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("export command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if isGroupChat(message.Chat) {
+			_, _ = sendMessage(b, conf, msgExportInPrivateChat, chatID, &messageID)
+			return
+		}
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		format := strings.ToLower(strings.TrimSpace(args))
+		if format == "" {
+			format = exportFormatJSON
+		}
+		if format != exportFormatJSON && format != exportFormatCSV {
+			_, _ = sendMessage(b, conf, msgExportUsage, chatID, &messageID)
+			return
+		}
+
+		data, numRecords, err := exportUserHistory(db, message.From.ID, format)
+		if err != nil {
+			_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to export your history: %s", err), chatID, &messageID)
+			return
+		}
+		if numRecords <= 0 {
+			_, _ = sendMessage(b, conf, msgNoUsage, chatID, &messageID)
+			return
+		}
+
+		if _, err := sendFile(b, conf, data, chatID, &messageID, ptr(fmt.Sprintf(msgExportedHistoryFormat, numRecords, format))); err != nil {
+			log.Printf("failed to send exported history: %s", err)
+		}
+	}
+}
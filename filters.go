@@ -0,0 +1,151 @@
+// filters.go
+//
+// filters which are applied to all outgoing texts (eg. for deploying in workplaces)
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// types of output filters
+const (
+	outputFilterTypeRegex       = "regex"        // replace matches of `pattern` with `replacement`
+	outputFilterTypeBannedWords = "banned_words" // replace `words` (case insensitive) with `replacement`
+	outputFilterTypeDisclaimer  = "disclaimer"   // append `text` to the end
+)
+
+const (
+	defaultRegexFilterReplacement       = "[REDACTED]"
+	defaultBannedWordsFilterReplacement = "***"
+)
+
+// configuration of an output filter
+type outputFilterConfig struct {
+	Type string `json:"type"`
+
+	Pattern     string   `json:"pattern,omitempty"`     // for `regex`
+	Words       []string `json:"words,omitempty"`       // for `banned_words`
+	Replacement string   `json:"replacement,omitempty"` // for `regex` and `banned_words`
+	Text        string   `json:"text,omitempty"`        // for `disclaimer`
+}
+
+// output filter
+type outputFilter interface {
+	apply(text string) string
+}
+
+// filter which replaces matches of a regular expression
+type regexOutputFilter struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+func (f regexOutputFilter) apply(text string) string {
+	return f.re.ReplaceAllLiteralString(text, f.replacement)
+}
+
+// filter which appends a disclaimer
+type disclaimerOutputFilter struct {
+	text string
+}
+
+func (f disclaimerOutputFilter) apply(text string) string {
+	if strings.TrimSpace(text) == "" {
+		return text
+	}
+	return text + "\n\n" + f.text
+}
+
+// build output filters from given configurations
+func buildOutputFilters(configs []outputFilterConfig) (filters []outputFilter, err error) {
+	for i, c := range configs {
+		switch c.Type {
+		case outputFilterTypeRegex:
+			var re *regexp.Regexp
+			if re, err = regexp.Compile(c.Pattern); err != nil {
+				return nil, fmt.Errorf("failed to compile pattern of output filter #%d: %s", i, err)
+			}
+			filters = append(filters, regexOutputFilter{
+				re:          re,
+				replacement: valueOrDefault(c.Replacement, defaultRegexFilterReplacement),
+			})
+		case outputFilterTypeBannedWords:
+			if len(c.Words) <= 0 {
+				return nil, fmt.Errorf("no `words` in output filter #%d", i)
+			}
+			filters = append(filters, regexOutputFilter{
+				re:          bannedWordsRegexp(c.Words),
+				replacement: valueOrDefault(c.Replacement, defaultBannedWordsFilterReplacement),
+			})
+		case outputFilterTypeDisclaimer:
+			if c.Text == "" {
+				return nil, fmt.Errorf("no `text` in output filter #%d", i)
+			}
+			filters = append(filters, disclaimerOutputFilter{text: c.Text})
+		default:
+			return nil, fmt.Errorf("unknown type of output filter #%d: '%s'", i, c.Type)
+		}
+	}
+	return filters, nil
+}
+
+// build a case-insensitive regular expression which matches given words
+//
+// (word boundaries are only checked for words which start/end with ascii letters or digits,
+// as `\b` of RE2 is ascii-only)
+func bannedWordsRegexp(words []string) *regexp.Regexp {
+	isASCIIWordChar := func(r rune) bool {
+		return r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_')
+	}
+
+	alternatives := []string{}
+	for _, word := range words {
+		runes := []rune(word)
+		if len(runes) <= 0 {
+			continue
+		}
+
+		pattern := regexp.QuoteMeta(word)
+		if isASCIIWordChar(runes[0]) {
+			pattern = `\b` + pattern
+		}
+		if isASCIIWordChar(runes[len(runes)-1]) {
+			pattern = pattern + `\b`
+		}
+		alternatives = append(alternatives, pattern)
+	}
+
+	return regexp.MustCompile(`(?i)(?:` + strings.Join(alternatives, "|") + `)`)
+}
+
+// return given value, or the default one if it is empty
+func valueOrDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// apply the output filters of given config to the outgoing text
+func filterOutgoingText(conf config, text string) string {
+	for _, filter := range conf.outputFilters {
+		text = filter.apply(text)
+	}
+	return text
+}
+
+// get given config with the banned words of given chat appended to its output filters
+func withChatOutputFilters(conf config, db *Database, chatID int64) config {
+	if words := db.settingList(settingScopeChat, chatID, "banned_words"); len(words) > 0 {
+		conf.outputFilters = append(slices.Clip(conf.outputFilters), regexOutputFilter{
+			re:          bannedWordsRegexp(words),
+			replacement: defaultBannedWordsFilterReplacement,
+		})
+	}
+	return conf
+}
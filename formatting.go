@@ -0,0 +1,107 @@
+// formatting.go
+//
+// locale-aware formatting of numbers and dates
+
+package main
+
+import (
+	"time"
+
+	// my libraries
+	tg "github.com/meinside/telegram-bot-go"
+
+	// others
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// locale for formatting, when the user's locale is unknown
+var defaultLocale = language.English
+
+// layouts of date and time, keyed by base languages
+var dateTimeLayouts = map[string]struct {
+	date     string
+	dateTime string
+}{
+	"en": {"Jan 2, 2006", "Jan 2, 2006 15:04:05"},
+	"ko": {"2006년 1월 2일", "2006년 1월 2일 15:04:05"},
+	"ja": {"2006年1月2日", "2006年1月2日 15:04:05"},
+	"zh": {"2006年1月2日", "2006年1月2日 15:04:05"},
+	"de": {"02.01.2006", "02.01.2006 15:04:05"},
+	"fr": {"02/01/2006", "02/01/2006 15:04:05"},
+	"es": {"02/01/2006", "02/01/2006 15:04:05"},
+	"ru": {"02.01.2006", "02.01.2006 15:04:05"},
+}
+
+// get the locale of given user
+//
+// (the language of `/mysettings` if it is a valid language tag, or the language code of telegram)
+func userLocale(db *Database, user *tg.User) language.Tag {
+	if user == nil {
+		return defaultLocale
+	}
+
+	if lang := db.settingString(settingScopeUser, user.ID, "language"); lang != "" {
+		if tag, err := language.Parse(lang); err == nil {
+			return tag
+		}
+	}
+	if user.LanguageCode != nil {
+		if tag, err := language.Parse(*user.LanguageCode); err == nil {
+			return tag
+		}
+	}
+
+	return defaultLocale
+}
+
+// formatter of numbers and dates in a locale
+type formatter struct {
+	locale  language.Tag
+	printer *message.Printer
+}
+
+// create a formatter for given locale
+func newFormatter(locale language.Tag) formatter {
+	return formatter{
+		locale:  locale,
+		printer: message.NewPrinter(locale),
+	}
+}
+
+// format given integer (eg. with thousands separators)
+func (f formatter) number(n int64) string {
+	return f.printer.Sprintf("%d", n)
+}
+
+// format given percentage
+func (f formatter) percent(p float64) string {
+	return f.printer.Sprintf("%.1f%%", p)
+}
+
+// format given cost (in USD)
+func (f formatter) cost(c float64) string {
+	return f.printer.Sprintf("$%.4f", c)
+}
+
+// format the date of given time
+func (f formatter) date(t time.Time) string {
+	if layouts, exists := dateTimeLayouts[f.baseLanguage()]; exists {
+		return t.Format(layouts.date)
+	}
+	return t.Format("2006-01-02")
+}
+
+// format the date and time of given time
+func (f formatter) dateTime(t time.Time) string {
+	if layouts, exists := dateTimeLayouts[f.baseLanguage()]; exists {
+		return t.Format(layouts.dateTime)
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// base language of the locale (eg. "en" for "en-US")
+func (f formatter) baseLanguage() string {
+	base, _ := f.locale.Base()
+	return base.String()
+}
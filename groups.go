@@ -0,0 +1,134 @@
+// groups.go
+//
+// things for controlling which messages the bot answers in group chats
+
+package main
+
+import (
+	"strings"
+	"unicode/utf16"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+// modes of triggering answers in group chats
+type groupTriggerMode string
+
+const (
+	groupTriggerModeAll       groupTriggerMode = "all"       // answer all messages (default)
+	groupTriggerModeTriggered groupTriggerMode = "triggered" // answer only mentions, replies to the bot, and messages with trigger prefixes
+)
+
+// check if the bot should answer given message, in terms of group triggers
+func isTriggeredInGroup(conf config, db *Database, botUsername *string, message tg.Message) bool {
+	if !isGroupChat(message.Chat) || conf.GroupTriggerMode != groupTriggerModeTriggered {
+		return true
+	}
+
+	if isMentioningBot(botUsername, message) {
+		return true
+	}
+	if isReplyToBot(botUsername, message) && isReplyFollowUpEnabled(db, message.Chat.ID) {
+		return true
+	}
+	if _, exists := triggerPrefixOf(conf, message); exists {
+		return true
+	}
+
+	logVerbose(verboseTelegram, "ignoring message(%d) without triggers in group chat(%d)", message.MessageID, message.Chat.ID)
+
+	return false
+}
+
+// check if given message is a reply to a message of the bot
+func isReplyToBot(botUsername *string, message tg.Message) bool {
+	if botUsername == nil || message.ReplyToMessage == nil || message.ReplyToMessage.From == nil {
+		return false
+	}
+
+	from := message.ReplyToMessage.From
+	return from.IsBot && from.Username != nil && strings.EqualFold(*from.Username, *botUsername)
+}
+
+// check if given message mentions the bot (eg. @this_bot)
+func isMentioningBot(botUsername *string, message tg.Message) bool {
+	if botUsername == nil {
+		return false
+	}
+
+	text, entities := message.Text, message.Entities
+	if text == nil {
+		text, entities = message.Caption, message.CaptionEntities
+	}
+	if text == nil {
+		return false
+	}
+
+	// offsets and lengths of entities are in UTF-16 code units
+	units := utf16.Encode([]rune(*text))
+	for _, entity := range entities {
+		if entity.Type != tg.MessageEntityTypeMention || entity.Offset+entity.Length > len(units) {
+			continue
+		}
+		mention := string(utf16.Decode(units[entity.Offset : entity.Offset+entity.Length]))
+		if strings.EqualFold(mention, "@"+*botUsername) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// get the trigger prefix (of `group_trigger_prefixes`) which given message starts with
+func triggerPrefixOf(conf config, message tg.Message) (prefix string, exists bool) {
+	text := captionOf(message)
+	if message.Text != nil {
+		text = *message.Text
+	}
+
+	for _, prefix := range conf.GroupTriggerPrefixes {
+		if prefix != "" && len(text) >= len(prefix) && strings.EqualFold(text[:len(prefix)], prefix) {
+			return prefix, true
+		}
+	}
+
+	return "", false
+}
+
+// strip the trigger prefix from given message, so that it is not included in the prompt
+//
+// (offsets of entities are shifted, and entities in the prefix are dropped)
+func withoutTriggerPrefix(conf config, message tg.Message) tg.Message {
+	if !isGroupChat(message.Chat) || conf.GroupTriggerMode != groupTriggerModeTriggered {
+		return message
+	}
+	prefix, exists := triggerPrefixOf(conf, message)
+	if !exists {
+		return message
+	}
+
+	strip := func(text string, entities []tg.MessageEntity) (string, []tg.MessageEntity) {
+		shift := len(utf16.Encode([]rune(text[:len(prefix)])))
+
+		shifted := []tg.MessageEntity{}
+		for _, entity := range entities {
+			if entity.Offset < shift {
+				continue
+			}
+			entity.Offset -= shift
+			shifted = append(shifted, entity)
+		}
+
+		return text[len(prefix):], shifted
+	}
+
+	if message.Text != nil {
+		text, entities := strip(*message.Text, message.Entities)
+		message.Text, message.Entities = &text, entities
+	} else if message.Caption != nil {
+		caption, entities := strip(*message.Caption, message.CaptionEntities)
+		message.Caption, message.CaptionEntities = &caption, entities
+	}
+
+	return message
+}
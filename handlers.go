@@ -5,16 +5,23 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	// google ai
+	"github.com/google/generative-ai-go/genai"
 
 	// my libraries
+	gt "github.com/meinside/gemini-things-go"
 	tg "github.com/meinside/telegram-bot-go"
 )
 
@@ -26,13 +33,693 @@ const (
 )
 
 // return a /start command handler
-func startCommandHandler(conf config, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+func startCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
 	return func(b *tg.Bot, update tg.Update, _ string) {
 		if !isAllowed(update, allowedUsers) {
 			log.Printf("start command not allowed: %s", userNameFromUpdate(update))
 			return
 		}
 
+		setAdminMenuCommands(b, conf, db, update)
+
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+
+		_, _ = sendMessage(b, conf, msgStart, chatID, nil)
+	}
+}
+
+// return a /stats command handler
+func statsCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("stats command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		_, _ = sendMessage(b, conf, retrieveStats(conf, db, newFormatter(userLocale(db, update.GetFrom()))), chatID, &messageID)
+	}
+}
+
+// return a /mystats command handler
+func myStatsCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("mystats command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		_, _ = sendMessage(b, conf, retrieveUserStats(conf, db, message.From.ID, newFormatter(userLocale(db, update.GetFrom()))), chatID, &messageID)
+	}
+}
+
+// return a /help command handler
+func helpCommandHandler(conf config, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, _ string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("help command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		_, _ = sendMessage(b, conf, helpMessage(conf, newFormatter(userLocale(nil, update.GetFrom()))), chatID, &messageID)
+	}
+}
+
+// return a /privacy command handler
+func privacyCommandHandler(conf config) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, _ string) {
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		_, _ = sendMessage(b, conf, msgPrivacy, chatID, &messageID)
+	}
+}
+
+// return a 'no such command' handler
+func noSuchCommandHandler(conf config, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, cmd, args string) {
+	return func(b *tg.Bot, update tg.Update, cmd, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		_, _ = sendMessage(b, conf, fmt.Sprintf(msgCmdNotSupported, cmd), chatID, &messageID)
+	}
+}
+
+// return a callback query handler
+func callbackQueryHandler(ctx context.Context, conf config, db *Database, gtc, gtcFast *gt.Client, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, callbackQuery tg.CallbackQuery) {
+	return func(b *tg.Bot, update tg.Update, callbackQuery tg.CallbackQuery) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("callback query not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		if callbackQuery.Data == nil {
+			log.Printf("no data in callback query.")
+			return
+		}
+		data := *callbackQuery.Data
+
+		switch {
+		case strings.HasPrefix(data, callbackDataPrefixRetryFast):
+			request, exists := popCallbackValue[retryableRequest](data)
+			if !exists || gtcFast == nil {
+				_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgRetryExpired))
+				return
+			}
+			if callbackQuery.From.ID != request.userID {
+				// (only the requester can retry)
+				putCallbackValue(data, request)
+				_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgRetryNotYours))
+				return
+			}
+			_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgRetryingWithFasterModel))
+
+			// retry with the faster model, without the hard deadline
+			confFast := conf
+			confFast.GoogleGenerativeModel = conf.GoogleGenerativeModelFast
+			confFast.FirstTokenDeadlineSeconds = 0
+
+			dispatchToChat(ctx, request.chatID, update.UpdateID, func(ctx context.Context) {
+				ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second)
+				defer cancel()
+
+				answer(ctx, b, confFast, db, gtcFast, responseModeFastModel, request.history, request.original, request.chatID, request.userID, request.username, request.admin, request.messageID)
+			})
+		case strings.HasPrefix(data, callbackDataPrefixSuggestTitle):
+			handleTitleSuggestionCallback(b, conf, callbackQuery, data)
+		case strings.HasPrefix(data, callbackDataPrefixContinue):
+			handleContinueCallback(b, conf, callbackQuery, data)
+		case strings.HasPrefix(data, callbackDataPrefixShare):
+			handleShareCallback(b, conf, callbackQuery, data)
+		case strings.HasPrefix(data, callbackDataPrefixVoiceNote):
+			handleVoiceNoteCallback(ctx, b, conf, gtc, callbackQuery, data)
+		case strings.HasPrefix(data, callbackDataPrefixCalendar):
+			handleCalendarCallback(ctx, b, conf, callbackQuery, data)
+		case strings.HasPrefix(data, callbackDataPrefixAccess):
+			handleAccessCallback(b, conf, db, update, callbackQuery, data)
+		case strings.HasPrefix(data, callbackDataPrefixCostPreview):
+			handleCostPreviewCallback(ctx, b, conf, db, gtc, callbackQuery, data)
+		default:
+			log.Printf("unsupported callback query data: %s", data)
+		}
+	}
+}
+
+// return a /query command handler
+func queryCommandHandler(ctx context.Context, conf config, db *Database, gtc *gt.Client) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if !isAdmin(update, conf) {
+			log.Printf("query command not allowed: %s", userNameFromUpdate(update))
+
+			_, _ = sendMessage(b, conf, msgNotAdmin, chatID, &messageID)
+			return
+		}
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+		question := strings.TrimSpace(args)
+		if question == "" {
+			_, _ = sendMessage(b, conf, msgQueryUsage, chatID, &messageID)
+			return
+		}
+
+		_ = withRetries(b).SetMessageReaction(chatID, messageID, tg.NewMessageReactionWithEmoji("👌"))
+
+		var userID int64
+		if from := update.GetFrom(); from != nil {
+			userID = from.ID
+		}
+		ctx, end := beginInteractiveRequest(ctx, "query", chatID, userID, userNameFromUpdate(update))
+		defer end()
+
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second)
+		defer cancel()
+
+		var result string
+		if q, err := statsQueryFromQuestion(ctx, conf, gtc, question); err == nil {
+			logVerbose(verboseGemini, "converted question '%s' to stats query: %+v", question, q)
+
+			if rows, err := db.runStatsQuery(q); err == nil {
+				result = formatTable(rows)
+			} else {
+				result = fmt.Sprintf("Failed to run query: %s", err)
+			}
+		} else {
+			result = fmt.Sprintf("Failed to convert question to a query: %s", errorString(conf, err))
+		}
+
+		_, _ = sendMessage(b, conf, result, chatID, &messageID)
+	}
+}
+
+// return a /scribe command handler
+//
+// (usable by anyone in scribe chats, for respecting opt-outs)
+func scribeCommandHandler(conf config, db *Database) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		userID := message.From.ID
+		messageID := message.MessageID
+
+		if !isScribeChat(conf, chatID) || db == nil {
+			_, _ = sendMessage(b, conf, msgScribeNotEnabled, chatID, &messageID)
+			return
+		}
+
+		var msg string
+		switch strings.TrimSpace(args) {
+		case "optout":
+			if err := db.setScribeOptOut(chatID, userID, true); err == nil {
+				msg = msgScribeOptedOut
+			} else {
+				msg = fmt.Sprintf("Failed to opt out: %s", err)
+			}
+		case "optin":
+			if err := db.setScribeOptOut(chatID, userID, false); err == nil {
+				msg = msgScribeOptedIn
+			} else {
+				msg = fmt.Sprintf("Failed to opt in: %s", err)
+			}
+		default:
+			msg = msgScribeUsage
+		}
+
+		_, _ = sendMessage(b, conf, msg, chatID, &messageID)
+	}
+}
+
+// return a /queue command handler
+//
+// (admins see all jobs and can cancel them, other users see their own ones only)
+func queueCommandHandler(conf config, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("queue command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+		admin := isAdmin(update, conf)
+
+		var msg string
+		if command, value, _ := strings.Cut(strings.TrimSpace(args), " "); command == "" {
+			var userID *int64
+			if !admin {
+				userID = &message.From.ID
+			}
+			msg = formatJobs(listJobs(userID), admin)
+		} else if command != "cancel" {
+			msg = msgQueueUsage
+		} else if !admin {
+			msg = msgNotAdmin
+		} else if id, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err != nil {
+			msg = msgQueueUsage
+		} else if job, exists := cancelJob(id); !exists {
+			msg = fmt.Sprintf("No such job: #%d", id)
+		} else {
+			log.Printf("job #%d (%s) was canceled by %s", job.id, job.name, userNameFromUpdate(update))
+
+			if job.chatID != 0 {
+				_, _ = sendMessage(b, conf, msgJobCanceled, job.chatID, nil)
+			}
+			msg = fmt.Sprintf("Canceled job #%d (%s).", job.id, job.name)
+		}
+
+		_, _ = sendMessage(b, conf, msg, chatID, &messageID)
+	}
+}
+
+// format given jobs for displaying
+func formatJobs(jobs []trackedJob, withOwners bool) string {
+	if len(jobs) <= 0 {
+		return msgQueueEmpty
+	}
+
+	lines := []string{}
+	for _, job := range jobs {
+		line := fmt.Sprintf("#%d %s: %s for %s", job.id, job.name, job.state, time.Since(job.since).Round(time.Second))
+		if withOwners && job.userID != 0 {
+			line += fmt.Sprintf(" (%s in chat %d)", job.username, job.chatID)
+		}
+		lines = append(lines, line)
+	}
+	if wait, estimated := estimatedWait(); estimated {
+		lines = append(lines, "", fmt.Sprintf("Estimated wait: %s", wait.Round(time.Second)))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// return a /config command handler
+func configCommandHandler(ctx context.Context, conf config, db *Database, gtc, gtcFast *gt.Client) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, _ string) {
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if !isAdmin(update, conf) {
+			log.Printf("config command not allowed: %s", userNameFromUpdate(update))
+
+			_, _ = sendMessage(b, conf, msgNotAdmin, chatID, &messageID)
+			return
+		}
+
+		_ = withRetries(b).SetMessageReaction(chatID, messageID, tg.NewMessageReactionWithEmoji("👌"))
+
+		var fast geminiClient = nil
+		if gtcFast != nil {
+			fast = gtcFast
+		}
+		_, _ = sendMessage(b, conf, configDiagnostics(ctx, conf, db, gtc, fast), chatID, &messageID)
+	}
+}
+
+// return a /dbcheck command handler
+func dbCheckCommandHandler(conf config, db *Database) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, _ string) {
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if !isAdmin(update, conf) {
+			log.Printf("dbcheck command not allowed: %s", userNameFromUpdate(update))
+
+			_, _ = sendMessage(b, conf, msgNotAdmin, chatID, &messageID)
+			return
+		}
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		_ = withRetries(b).SetMessageReaction(chatID, messageID, tg.NewMessageReactionWithEmoji("👌"))
+
+		var msg string
+		if findings, err := db.checkIntegrity(); err == nil {
+			msg = strings.Join(findings, "\n")
+		} else {
+			msg = fmt.Sprintf("Failed to check the database: %s", err)
+		}
+
+		_, _ = sendMessage(b, conf, msg, chatID, &messageID)
+	}
+}
+
+// return a /harm_report command handler
+func harmReportCommandHandler(conf config, db *Database) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if !isAdmin(update, conf) {
+			log.Printf("harm report command not allowed: %s", userNameFromUpdate(update))
+
+			_, _ = sendMessage(b, conf, msgNotAdmin, chatID, &messageID)
+			return
+		}
+
+		days := defaultHarmReportDays
+		if d, err := strconv.Atoi(strings.TrimSpace(args)); err == nil && d > 0 {
+			days = d
+		}
+
+		_, _ = sendMessage(b, conf, retrieveHarmReport(conf, db, days, newFormatter(userLocale(db, update.GetFrom()))), chatID, &messageID)
+	}
+}
+
+// return a /verbose command handler
+func verboseCommandHandler(conf config) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if !isAdmin(update, conf) {
+			log.Printf("verbose command not allowed: %s", userNameFromUpdate(update))
+
+			_, _ = sendMessage(b, conf, msgNotAdmin, chatID, &messageID)
+			return
+		}
+
+		var msg string
+		params := strings.Fields(args)
+		switch len(params) {
+		case 0:
+			msg = verboseScopesStatus()
+		case 2:
+			var scopes []verboseScope
+			if params[0] == verboseAll {
+				scopes = allVerboseScopes
+			} else if scope, err := parseVerboseScope(params[0]); err == nil {
+				scopes = []verboseScope{scope}
+			} else {
+				msg = err.Error()
+				break
+			}
+
+			switch params[1] {
+			case "on":
+				setVerboseScopes(scopes, true)
+				msg = verboseScopesStatus()
+			case "off":
+				setVerboseScopes(scopes, false)
+				msg = verboseScopesStatus()
+			default:
+				msg = msgVerboseUsage
+			}
+		default:
+			msg = msgVerboseUsage
+		}
+
+		_, _ = sendMessage(b, conf, msg, chatID, &messageID)
+	}
+}
+
+// return a /analyze command handler
+//
+// (for table files with the command in their captions, see the message handler)
+func analyzeCommandHandler(ctx context.Context, conf config, db *Database, gtc *gt.Client, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("analyze command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		var document *tg.Document
+		if message.HasDocument() {
+			document = message.Document
+		} else if replied := repliedToMessage(*message); replied != nil && replied.HasDocument() {
+			document = replied.Document
+		}
+		if document == nil || !isTableDocument(*document) {
+			_, _ = sendMessage(b, conf, msgAnalyzeUsage, chatID, &messageID)
+			return
+		}
+
+		dispatchToChat(ctx, chatID, update.UpdateID, func(ctx context.Context) {
+			analyzeTable(ctx, b, conf, db, gtc, *document, args, chatID, message.From.ID, userNameFromUpdate(update), isAdmin(update, conf), messageID)
+		})
+	}
+}
+
+// return a /branch command handler
+func branchCommandHandler(conf config, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, _ string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("branch command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		replied := repliedToMessage(*message)
+		if replied == nil {
+			_, _ = sendMessage(b, conf, msgBranchUsage, chatID, &messageID)
+			return
+		}
+
+		// remember the replied message if it is not in the threads yet (eg. after restarts)
+		if _, exists := threadMessageFor(chatID, replied.MessageID); !exists {
+			role := chatMessageRoleUser
+			if replied.IsBot() {
+				role = chatMessageRoleModel
+			}
+			text := captionOf(*replied)
+			if replied.HasText() {
+				text = *replied.Text
+			}
+			rememberThreadMessage(threadMessage{
+				chatID:    chatID,
+				messageID: replied.MessageID,
+				role:      role,
+				text:      text,
+			})
+		}
+
+		// send a branch point which replies to the replied message
+		if sentMessageID, err := sendMessage(b, conf, msgBranched, chatID, &replied.MessageID); err == nil {
+			rememberThreadMessage(threadMessage{
+				chatID:          chatID,
+				messageID:       sentMessageID,
+				parentMessageID: &replied.MessageID,
+				role:            chatMessageRoleModel,
+			})
+		} else {
+			log.Printf("failed to send branch point: %s", redact(conf, err))
+		}
+	}
+}
+
+// return a /mysettings command handler
+func mySettingsCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("mysettings command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		userID := message.From.ID
+		messageID := message.MessageID
+
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		var msg string
+		if key, value, _ := strings.Cut(strings.TrimSpace(args), " "); key == "" {
+			if formatted, err := db.formatSettings(msgUserSettingsFormat, settingScopeUser, userID, userSettingDefinitions); err == nil {
+				msg = formatted
+			} else {
+				msg = fmt.Sprintf("Failed to load settings: %s", err)
+			}
+		} else if def, exists := findSettingDefinition(userSettingDefinitions, key); !exists || strings.TrimSpace(value) == "" {
+			msg = msgMySettingsUsage
+		} else if normalized, err := def.normalize(strings.TrimSpace(value)); err != nil {
+			msg = err.Error()
+		} else if err := db.setSettingValue(settingScopeUser, userID, key, normalized); err != nil {
+			msg = fmt.Sprintf("Failed to save settings: %s", err)
+		} else {
+			msg = msgSettingSaved
+		}
+
+		_, _ = sendMessage(b, conf, msg, chatID, &messageID)
+	}
+}
+
+// return a /chatsettings command handler
+func chatSettingsCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("chatsettings command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		var msg string
+		if key, value, _ := strings.Cut(strings.TrimSpace(args), " "); key == "" {
+			if formatted, err := db.formatSettings(msgChatSettingsFormat, settingScopeChat, chatID, chatSettingDefinitions); err == nil {
+				msg = formatted
+			} else {
+				msg = fmt.Sprintf("Failed to load settings: %s", err)
+			}
+		} else if def, exists := findSettingDefinition(chatSettingDefinitions, key); !exists || strings.TrimSpace(value) == "" {
+			msg = msgChatSettingsUsage
+		} else if isGroupChat(message.Chat) && !isChatAdmin(b, chatID, message.From.ID) {
+			msg = msgNotGroupAdmin
+		} else if key == "model" && !isAdmin(update, conf) { // models affect the costs of the bot
+			msg = msgNotAdmin
+		} else if normalized, err := def.normalize(strings.TrimSpace(value)); err != nil {
+			msg = err.Error()
+		} else if err := db.setSettingValue(settingScopeChat, chatID, key, normalized); err != nil {
+			msg = fmt.Sprintf("Failed to save settings: %s", err)
+		} else {
+			msg = msgSettingSaved
+		}
+
+		_, _ = sendMessage(b, conf, msg, chatID, &messageID)
+	}
+}
+
+// return a /leaderboard command handler
+//
+// (names are shown only in groups which opted in with `/chatsettings leaderboard on`)
+func leaderboardCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, _ string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("leaderboard command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
 		message := usableMessageFromUpdate(update)
 		if message == nil {
 			log.Printf("no usable message from update.")
@@ -40,21 +727,76 @@ func startCommandHandler(conf config, allowedUsers map[string]bool) func(b *tg.B
 		}
 
 		chatID := message.Chat.ID
+		messageID := message.MessageID
 
-		_, _ = sendMessage(b, conf, msgStart, chatID, nil)
+		if !isGroupChat(message.Chat) {
+			_, _ = sendMessage(b, conf, msgNotGroupChat, chatID, &messageID)
+			return
+		}
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		since := startOfWeek(time.Now())
+		usages, err := db.aggregateUserUsages(chatID, since)
+		if err != nil {
+			_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to aggregate usages: %s", err), chatID, &messageID)
+			return
+		}
+		if len(usages) <= 0 {
+			_, _ = sendMessage(b, conf, msgLeaderboardEmpty, chatID, &messageID)
+			return
+		}
+
+		// anonymize names unless the group opted in
+		showNames := db.settingBool(settingScopeChat, chatID, "leaderboard", false)
+		if !showNames {
+			slices.SortFunc(usages, func(a, b userUsage) int {
+				return int(a.UserID - b.UserID)
+			})
+			for i := range usages {
+				usages[i].Username = fmt.Sprintf("Member %d", i+1)
+			}
+		}
+
+		f := newFormatter(userLocale(db, update.GetFrom()))
+		ranking := func(value func(userUsage) int64, unit string) string {
+			sorted := slices.Clone(usages)
+			slices.SortStableFunc(sorted, func(a, b userUsage) int {
+				return int(value(b) - value(a))
+			})
+
+			lines := []string{}
+			for i, usage := range sorted[:min(len(sorted), numLeaderboardEntries)] {
+				lines = append(lines, fmt.Sprintf("%d. %s: %s %s", i+1, usage.Username, f.number(value(usage)), unit))
+			}
+			return strings.Join(lines, "\n")
+		}
+
+		msg := fmt.Sprintf(msgLeaderboardFormat,
+			f.date(since),
+			ranking(func(u userUsage) int64 { return u.NumPrompts }, "question(s)"),
+			ranking(func(u userUsage) int64 { return u.Tokens }, "token(s)"),
+		)
+		if !showNames {
+			msg += "\n\n" + msgLeaderboardAnonymized
+		}
+
+		_, _ = sendMessage(b, conf, msg, chatID, &messageID)
 	}
 }
 
-// return a /stats command handler
-func statsCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+// return a /watch command handler
+func watchCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
 	return func(b *tg.Bot, update tg.Update, args string) {
 		if !isAllowed(update, allowedUsers) {
-			log.Printf("stats command not allowed: %s", userNameFromUpdate(update))
+			log.Printf("watch command not allowed: %s", userNameFromUpdate(update))
 			return
 		}
 
 		message := usableMessageFromUpdate(update)
-		if message == nil {
+		if message == nil || message.From == nil {
 			log.Printf("no usable message from update.")
 			return
 		}
@@ -62,15 +804,53 @@ func statsCommandHandler(conf config, db *Database, allowedUsers map[string]bool
 		chatID := message.Chat.ID
 		messageID := message.MessageID
 
-		_, _ = sendMessage(b, conf, retrieveStats(db), chatID, &messageID)
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		watchURL, condition, err := parseWatchArgs(args)
+		if err != nil {
+			_, _ = sendMessage(b, conf, err.Error(), chatID, &messageID)
+			return
+		}
+		if watches, err := db.loadWatches(chatID); err != nil {
+			_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to load watches: %s", err), chatID, &messageID)
+			return
+		} else if len(watches) >= maxWatchesPerChat {
+			_, _ = sendMessage(b, conf, fmt.Sprintf(msgTooManyWatchesFormat, maxWatchesPerChat), chatID, &messageID)
+			return
+		}
+
+		// fetch the current content for comparing with later ones
+		content, err := fetchWatchContent(conf, watchURL)
+		if err != nil {
+			_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to fetch the url: %s", err), chatID, &messageID)
+			return
+		}
+
+		watch := Watch{
+			ChatID:        chatID,
+			UserID:        message.From.ID,
+			URL:           watchURL,
+			Condition:     condition,
+			LastContent:   content,
+			LastCheckedAt: time.Now(),
+		}
+		if err := db.saveWatch(&watch); err != nil {
+			_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to save the watch: %s", err), chatID, &messageID)
+			return
+		}
+
+		_, _ = sendMessage(b, conf, fmt.Sprintf(msgWatchAddedFormat, watch.ID, watch.URL, conf.WatchIntervalMinutes), chatID, &messageID)
 	}
 }
 
-// return a /help command handler
-func helpCommandHandler(conf config, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+// return a /watches command handler
+func watchesCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
 	return func(b *tg.Bot, update tg.Update, _ string) {
 		if !isAllowed(update, allowedUsers) {
-			log.Printf("help command not allowed: %s", userNameFromUpdate(update))
+			log.Printf("watches command not allowed: %s", userNameFromUpdate(update))
 			return
 		}
 
@@ -83,13 +863,30 @@ func helpCommandHandler(conf config, allowedUsers map[string]bool) func(b *tg.Bo
 		chatID := message.Chat.ID
 		messageID := message.MessageID
 
-		_, _ = sendMessage(b, conf, helpMessage(conf), chatID, &messageID)
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		var msg string
+		if watches, err := db.loadWatches(chatID); err == nil {
+			msg = formatWatches(watches, newFormatter(userLocale(db, update.GetFrom())))
+		} else {
+			msg = fmt.Sprintf("Failed to load watches: %s", err)
+		}
+
+		_, _ = sendMessage(b, conf, msg, chatID, &messageID)
 	}
 }
 
-// return a /privacy command handler
-func privacyCommandHandler(conf config) func(b *tg.Bot, update tg.Update, args string) {
-	return func(b *tg.Bot, update tg.Update, _ string) {
+// return an /unwatch command handler
+func unwatchCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("unwatch command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
 		message := usableMessageFromUpdate(update)
 		if message == nil {
 			log.Printf("no usable message from update.")
@@ -99,15 +896,46 @@ func privacyCommandHandler(conf config) func(b *tg.Bot, update tg.Update, args s
 		chatID := message.Chat.ID
 		messageID := message.MessageID
 
-		_, _ = sendMessage(b, conf, msgPrivacy, chatID, &messageID)
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		var msg string
+		if id, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(args), "#"), 10, 64); err != nil {
+			msg = msgUnwatchUsage
+		} else if deleted, err := db.deleteWatch(chatID, uint(id)); err != nil {
+			msg = fmt.Sprintf("Failed to remove the watch: %s", err)
+		} else if !deleted {
+			msg = msgNoSuchWatch
+		} else {
+			msg = msgWatchRemoved
+		}
+
+		_, _ = sendMessage(b, conf, msg, chatID, &messageID)
 	}
 }
 
-// return a 'no such command' handler
-func noSuchCommandHandler(conf config, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, cmd, args string) {
-	return func(b *tg.Bot, update tg.Update, cmd, args string) {
+// beginning (monday 00:00) of the week of given time
+func startOfWeek(t time.Time) time.Time {
+	daysSinceMonday := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, t.Location())
+}
+
+// return a /respond_in command handler
+//
+// (shorthand for `/chatsettings respond_in`)
+func respondInCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	chatSettingsHandler := chatSettingsCommandHandler(conf, db, allowedUsers)
+
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if strings.TrimSpace(args) != "" {
+			chatSettingsHandler(b, update, "respond_in "+strings.TrimSpace(args))
+			return
+		}
+
 		if !isAllowed(update, allowedUsers) {
-			log.Printf("command not allowed: %s", userNameFromUpdate(update))
+			log.Printf("respond_in command not allowed: %s", userNameFromUpdate(update))
 			return
 		}
 
@@ -120,8 +948,272 @@ func noSuchCommandHandler(conf config, allowedUsers map[string]bool) func(b *tg.
 		chatID := message.Chat.ID
 		messageID := message.MessageID
 
-		_, _ = sendMessage(b, conf, fmt.Sprintf(msgCmdNotSupported, cmd), chatID, &messageID)
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		language := db.settingString(settingScopeChat, chatID, "respond_in")
+		_, _ = sendMessage(b, conf, fmt.Sprintf(msgRespondInFormat, orUnset(language)), chatID, &messageID)
+	}
+}
+
+// chat title and description suggested for a group chat
+type titleSuggestion struct {
+	ChatID      int64  `json:"-"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// return a /suggest_title command handler
+func suggestTitleCommandHandler(ctx context.Context, conf config, db *Database, gtc *gt.Client, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, _ string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("suggest title command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if !isGroupChat(message.Chat) {
+			_, _ = sendMessage(b, conf, msgNotGroupChat, chatID, &messageID)
+			return
+		}
+		if !isChatAdmin(b, chatID, message.From.ID) {
+			_, _ = sendMessage(b, conf, msgNotGroupAdmin, chatID, &messageID)
+			return
+		}
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		// recent conversations (in chronological order)
+		prompts, err := db.loadRecentChatPrompts(chatID, numRecentPromptsForTitleSuggestion)
+		if err != nil {
+			_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to load recent conversations: %s", err), chatID, &messageID)
+			return
+		}
+		if len(prompts) <= 0 {
+			_, _ = sendMessage(b, conf, msgNoRecentConversation, chatID, &messageID)
+			return
+		}
+		conversations := []string{}
+		for i := len(prompts) - 1; i >= 0; i-- {
+			conversations = append(conversations, prompts[i].Text)
+			if prompts[i].Result.Successful {
+				conversations = append(conversations, fmt.Sprintf("[%s] %s", chatMessageRoleModel, prompts[i].Result.Text))
+			}
+		}
+
+		_ = withRetries(b).SetMessageReaction(chatID, messageID, tg.NewMessageReactionWithEmoji("👌"))
+
+		ctx, end := beginInteractiveRequest(ctx, "suggest_title", chatID, message.From.ID, userName(message.From))
+		defer end()
+
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second)
+		defer cancel()
+
+		var suggestion titleSuggestion
+		generated, err := generateText(ctx, gtc, fmt.Sprintf(titleSuggestionPromptFormat, strings.Join(conversations, "\n--------\n")), nil, &gt.GenerationOptions{
+			HarmBlockThreshold: conf.GoogleAIHarmBlockThreshold,
+			Config: &genai.GenerationConfig{
+				ResponseMIMEType: "application/json",
+				ResponseSchema: &genai.Schema{
+					Type: genai.TypeObject,
+					Properties: map[string]*genai.Schema{
+						"title": {
+							Type: genai.TypeString,
+						},
+						"description": {
+							Type: genai.TypeString,
+						},
+					},
+					Required: []string{"title", "description"},
+				},
+			},
+		})
+		if err == nil {
+			err = json.Unmarshal([]byte(generated), &suggestion)
+		}
+		if err != nil {
+			_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to suggest a title: %s", errorString(conf, err)), chatID, &messageID)
+			return
+		}
+		suggestion.ChatID = chatID
+
+		// ask for confirmation
+		key := fmt.Sprintf("%s%d/%d", callbackDataPrefixSuggestTitle, chatID, messageID)
+		putCallbackValue(key, suggestion)
+
+		button := func(text, action string) tg.InlineKeyboardButton {
+			return tg.InlineKeyboardButton{
+				Text:         text,
+				CallbackData: ptr(key + "/" + action),
+			}
+		}
+		options := messageOptions(chatID, &messageID).
+			SetReplyMarkup(tg.NewInlineKeyboardMarkup([][]tg.InlineKeyboardButton{
+				{button(msgApplyTitle, "title"), button(msgApplyDescription, "description")},
+				{button(msgApplyBoth, "both"), button(msgCancel, "cancel")},
+			}))
+		if res := withRetries(b).SendMessage(chatID, filterOutgoingText(conf, fmt.Sprintf(msgTitleSuggestionFormat, suggestion.Title, suggestion.Description)), options); !res.Ok {
+			log.Printf("failed to send title suggestion: %s", *res.Description)
+		}
+	}
+}
+
+// return a /broadcast command handler
+func broadcastCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("broadcast command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+		if isGroupChat(message.Chat) && !isChatAdmin(b, chatID, message.From.ID) {
+			_, _ = sendMessage(b, conf, msgNotGroupAdmin, chatID, &messageID)
+			return
+		}
+
+		var chatTitle string
+		if message.Chat.Title != nil {
+			chatTitle = *message.Chat.Title
+		} else {
+			chatTitle = message.From.FirstName
+		}
+
+		var msg string
+		switch strings.TrimSpace(args) {
+		case "optin":
+			if err := db.setBroadcastSubscription(chatID, chatTitle, true); err == nil {
+				msg = msgBroadcastOptedIn
+			} else {
+				msg = fmt.Sprintf("Failed to opt in: %s", err)
+			}
+		case "optout":
+			if err := db.setBroadcastSubscription(chatID, chatTitle, false); err == nil {
+				msg = msgBroadcastOptedOut
+			} else {
+				msg = fmt.Sprintf("Failed to opt out: %s", err)
+			}
+		default:
+			msg = msgBroadcastUsage
+		}
+
+		_, _ = sendMessage(b, conf, msg, chatID, &messageID)
+	}
+}
+
+// return a /broadcast_gen command handler
+func broadcastGenCommandHandler(ctx context.Context, conf config, db *Database, gtc *gt.Client) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if !isAdmin(update, conf) {
+			log.Printf("broadcast gen command not allowed: %s", userNameFromUpdate(update))
+
+			_, _ = sendMessage(b, conf, msgNotAdmin, chatID, &messageID)
+			return
+		}
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+		group, prompt := parseBroadcastArgs(args)
+		if prompt == "" {
+			_, _ = sendMessage(b, conf, msgBroadcastGenUsage, chatID, &messageID)
+			return
+		}
+		targets, err := broadcastTargets(conf, db, group)
+		if err != nil {
+			_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to get chats to broadcast to: %s", err), chatID, &messageID)
+			return
+		}
+		if len(targets) <= 0 {
+			_, _ = sendMessage(b, conf, msgBroadcastNoTargets, chatID, &messageID)
+			return
+		}
+
+		_ = withRetries(b).SetMessageReaction(chatID, messageID, tg.NewMessageReactionWithEmoji("👌"))
+
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second+time.Duration(len(targets)*broadcastIntervalMilliseconds)*time.Millisecond)
+		defer cancel()
+
+		delivered, failed, err := runBroadcast(ctx, b, conf, db, gtc, message.From.ID, prompt, targets)
+		if err != nil {
+			_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to broadcast: %s", errorString(conf, err)), chatID, &messageID)
+			return
+		}
+		_, _ = sendMessage(b, conf, fmt.Sprintf(msgBroadcastResultFormat, delivered, failed), chatID, &messageID)
+	}
+}
+
+// apply (or cancel) a suggested chat title and/or description with given callback query
+func handleTitleSuggestionCallback(b *tg.Bot, conf config, callbackQuery tg.CallbackQuery, data string) {
+	idx := strings.LastIndex(data, "/")
+	key, action := data[:idx], data[idx+1:]
+
+	suggestion, exists := popCallbackValue[titleSuggestion](key)
+	if !exists {
+		_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgSuggestionExpired))
+		return
+	}
+	if !isChatAdmin(b, suggestion.ChatID, callbackQuery.From.ID) {
+		putCallbackValue(key, suggestion) // put it back for admins
+
+		_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgNotGroupAdmin))
+		return
+	}
+
+	errs := []error{}
+	if action == "title" || action == "both" {
+		if res := b.SetChatTitle(suggestion.ChatID, suggestion.Title); !res.Ok {
+			errs = append(errs, fmt.Errorf("failed to set chat title: %s", *res.Description))
+		}
+	}
+	if action == "description" || action == "both" {
+		if res := b.SetChatDescription(suggestion.ChatID, suggestion.Description); !res.Ok {
+			errs = append(errs, fmt.Errorf("failed to set chat description: %s", *res.Description))
+		}
+	}
+
+	text := msgSuggestionApplied
+	if action == "cancel" {
+		text = msgSuggestionCanceled
+	} else if err := errors.Join(errs...); err != nil {
+		log.Printf("failed to apply title suggestion: %s", redact(conf, err))
+
+		text = err.Error()
 	}
+	_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(text))
 }
 
 // generate user's name
@@ -154,7 +1246,7 @@ func repliedToMessage(message tg.Message) *tg.Message {
 // convert given telegram bot message to an genai chat message,
 //
 // (if it was sent from bot, make it an assistant's message)
-func convertMessage(bot *tg.Bot, message tg.Message, otherGroupedMessages ...tg.Message) (cm *chatMessage, err error) {
+func convertMessage(bot telegramClient, message tg.Message, otherGroupedMessages ...tg.Message) (cm *chatMessage, err error) {
 	var role chatMessageRole
 	if message.IsBot() {
 		role = chatMessageRoleModel
@@ -165,12 +1257,12 @@ func convertMessage(bot *tg.Bot, message tg.Message, otherGroupedMessages ...tg.
 	if message.HasText() {
 		return &chatMessage{
 			role: role,
-			text: *message.Text,
+			text: textWithEntities(*message.Text, message.Entities),
 		}, nil
 	} else if message.HasPhoto() || message.HasVideo() || message.HasVideoNote() || message.HasAudio() || message.HasVoice() || message.HasDocument() {
 		var text string
 		if message.HasCaption() {
-			text = *message.Caption
+			text = textWithEntities(*message.Caption, message.CaptionEntities)
 		} else {
 			text = defaultPromptForMedias
 		}
@@ -198,61 +1290,53 @@ func convertMessage(bot *tg.Bot, message tg.Message, otherGroupedMessages ...tg.
 	return nil, err
 }
 
-// extract file bytes from given message
-func filesFromMessage(bot *tg.Bot, message tg.Message) (files [][]byte, err error) {
-	var bytes []byte
-	if message.HasPhoto() {
-		files = [][]byte{}
-
+// get the type and file ids of the media in given message (all sizes of photos)
+func mediaFileIDsOf(message tg.Message) (mediaType string, fileIDs []string) {
+	switch {
+	case message.HasPhoto():
 		for _, photo := range message.Photo {
-			if bytes, err = readMedia(bot, "photo", photo.FileID); err == nil {
-				files = append(files, bytes)
-			} else {
-				err = fmt.Errorf("failed to read photo content: %s", err)
-				break
-			}
+			fileIDs = append(fileIDs, photo.FileID)
 		}
+		return "photo", fileIDs
+	case message.HasVideo():
+		return "video", []string{message.Video.FileID}
+	case message.HasVideoNote():
+		return "video note", []string{message.VideoNote.FileID}
+	case message.HasAudio():
+		return "audio", []string{message.Audio.FileID}
+	case message.HasVoice():
+		return "voice", []string{message.Voice.FileID}
+	case message.HasDocument():
+		return "document", []string{message.Document.FileID}
+	}
+	return "", nil
+}
 
-		if err == nil {
-			return files, nil
-		}
-	} else if message.HasVideo() {
-		if bytes, err = readMedia(bot, "video", message.Video.FileID); err == nil {
-			return [][]byte{bytes}, nil
-		} else {
-			err = fmt.Errorf("failed to read video content: %s", err)
-		}
-	} else if message.HasVideoNote() {
-		if bytes, err = readMedia(bot, "video note", message.VideoNote.FileID); err == nil {
-			return [][]byte{bytes}, nil
-		} else {
-			err = fmt.Errorf("failed to read video note content: %s", err)
-		}
-	} else if message.HasAudio() {
-		if bytes, err = readMedia(bot, "audio", message.Audio.FileID); err == nil {
-			return [][]byte{bytes}, nil
-		} else {
-			err = fmt.Errorf("failed to read audio content: %s", err)
-		}
-	} else if message.HasVoice() {
-		if bytes, err = readMedia(bot, "voice", message.Voice.FileID); err == nil {
-			return [][]byte{bytes}, nil
-		} else {
-			err = fmt.Errorf("failed to read voice content: %s", err)
-		}
-	} else if message.HasDocument() {
-		if bytes, err = readMedia(bot, "document", message.Document.FileID); err == nil {
-			return [][]byte{bytes}, nil
-		} else {
-			err = fmt.Errorf("failed to read document content: %s", err)
+// extract file bytes from given message
+func filesFromMessage(bot telegramClient, message tg.Message) (files [][]byte, err error) {
+	mediaType, fileIDs := mediaFileIDsOf(message)
+	for _, fileID := range fileIDs {
+		var bytes []byte
+		if bytes, err = readMedia(bot, mediaType, fileID); err != nil {
+			return nil, fmt.Errorf("failed to read %s content: %s", mediaType, err)
 		}
+		files = append(files, bytes)
 	}
 
-	return nil, err
+	return files, nil
 }
 
 // read bytes from given media
-func readMedia(bot *tg.Bot, mediaType, fileID string) (result []byte, err error) {
+//
+// (the ones which were downloaded for cost previews are not downloaded again)
+func readMedia(bot telegramClient, mediaType, fileID string) (result []byte, err error) {
+	if previewed, exists := takePreviewedMedia(fileID); exists {
+		logVerbose(verboseFiles, "reusing %s downloaded for the cost preview: %s", mediaType, fileID)
+		return previewed, nil
+	}
+
+	logVerbose(verboseFiles, "reading %s with file id: %s", mediaType, fileID)
+
 	if res := bot.GetFile(fileID); !res.Ok {
 		err = fmt.Errorf("Failed to read bytes from %s: %s", mediaType, *res.Description)
 	} else {
@@ -285,11 +1369,8 @@ func readFileContentAtURL(url string) (content []byte, err error) {
 }
 
 // convert chat messages to a prompt for logging
-func messagesToPrompt(parent, original *chatMessage) string {
-	messages := []chatMessage{}
-	if parent != nil {
-		messages = append(messages, *parent)
-	}
+func messagesToPrompt(history []chatMessage, original *chatMessage) string {
+	messages := append([]chatMessage{}, history...)
 	if original != nil {
 		messages = append(messages, *original)
 	}
@@ -306,3 +1387,121 @@ func messagesToPrompt(parent, original *chatMessage) string {
 
 	return strings.Join(lines, "\n--------\n")
 }
+
+// schema of stats queries for structured output
+func statsQuerySchema() *genai.Schema {
+	columns := []string{}
+	for column := range statsQueryColumns {
+		columns = append(columns, column)
+	}
+	slices.Sort(columns)
+
+	column := &genai.Schema{
+		Type: genai.TypeString,
+		Enum: columns,
+	}
+
+	return &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"columns": {
+				Type:        genai.TypeArray,
+				Description: "columns to select as they are",
+				Items:       column,
+			},
+			"aggregates": {
+				Type:        genai.TypeArray,
+				Description: "aggregated columns to select",
+				Items: &genai.Schema{
+					Type: genai.TypeObject,
+					Properties: map[string]*genai.Schema{
+						"function": {
+							Type: genai.TypeString,
+							Enum: statsQueryAggregates,
+						},
+						"column": column,
+					},
+					Required: []string{"function", "column"},
+				},
+			},
+			"filters": {
+				Type:        genai.TypeArray,
+				Description: "conditions which are joined with AND",
+				Items: &genai.Schema{
+					Type: genai.TypeObject,
+					Properties: map[string]*genai.Schema{
+						"column": column,
+						"operator": {
+							Type: genai.TypeString,
+							Enum: statsQueryOperators,
+						},
+						"value": {
+							Type: genai.TypeString,
+						},
+					},
+					Required: []string{"column", "operator", "value"},
+				},
+			},
+			"group_by": {
+				Type:  genai.TypeArray,
+				Items: column,
+			},
+			"order_by": {
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"column": {
+						Type:        genai.TypeString,
+						Description: "one of the selected columns, or an aggregate in the form of '{function}_{column}'",
+					},
+					"descending": {
+						Type: genai.TypeBoolean,
+					},
+				},
+				Required: []string{"column"},
+			},
+			"limit": {
+				Type: genai.TypeInteger,
+			},
+		},
+	}
+}
+
+// convert given natural language question to a stats query with structured output
+func statsQueryFromQuestion(ctx context.Context, conf config, gtc geminiClient, question string) (q statsQuery, err error) {
+	prompt := fmt.Sprintf(statsQueryPromptFormat,
+		time.Now().Format("2006-01-02"),
+		question,
+	)
+
+	opts := &gt.GenerationOptions{
+		HarmBlockThreshold: conf.GoogleAIHarmBlockThreshold,
+		Config: &genai.GenerationConfig{
+			ResponseMIMEType: "application/json",
+			ResponseSchema:   statsQuerySchema(),
+		},
+	}
+
+	var generated string
+	if generated, err = generateText(ctx, gtc, prompt, nil, opts); err == nil {
+		err = json.Unmarshal([]byte(generated), &q)
+	}
+
+	return q, err
+}
+
+// format given rows as a text table
+func formatTable(rows [][]string) string {
+	if len(rows) <= 1 {
+		return msgQueryEmptyResult
+	}
+
+	lines := []string{}
+	for i, row := range rows {
+		lines = append(lines, strings.Join(row, " | "))
+		if i == 0 {
+			lines = append(lines, strings.Repeat("-", len(lines[0])))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -5,19 +5,25 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"regexp"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	// google ai
+	"github.com/google/generative-ai-go/genai"
 	"google.golang.org/api/googleapi"
 
 	// my libraries
+	gt "github.com/meinside/gemini-things-go"
 	tg "github.com/meinside/telegram-bot-go"
 	"github.com/meinside/version-go"
 
@@ -43,6 +49,9 @@ func redact(conf config, err error) (redacted string) {
 	if strings.Contains(redacted, *conf.TelegramBotToken) {
 		redacted = strings.ReplaceAll(redacted, *conf.TelegramBotToken, redactedString)
 	}
+	if conf.userAPIKey != nil && strings.Contains(redacted, *conf.userAPIKey) {
+		redacted = strings.ReplaceAll(redacted, *conf.userAPIKey, redactedString)
+	}
 
 	return redacted
 }
@@ -61,15 +70,68 @@ func isAllowed(update tg.Update, allowedUsers map[string]bool) bool {
 		username = *update.EditedMessage.From.Username
 	} else if update.HasInlineQuery() && update.InlineQuery.From.Username != nil {
 		username = *update.InlineQuery.From.Username
+	} else if update.HasCallbackQuery() && update.CallbackQuery.From.Username != nil {
+		username = *update.CallbackQuery.From.Username
 	}
 
 	if _, exists := allowedUsers[username]; exists {
 		return true
 	}
 
+	// users and chats allowed by ids
+	if isAllowedID(update) {
+		return true
+	}
+
+	// users approved by admins
+	if from := update.GetFrom(); from != nil && isApprovedUser(from) {
+		return true
+	}
+
 	return false
 }
 
+// checks if given update is from an admin
+func isAdmin(update tg.Update, conf config) bool {
+	if from := update.GetFrom(); from != nil && from.Username != nil {
+		return slices.Contains(conf.AdminTelegramUsers, *from.Username)
+	}
+
+	return false
+}
+
+// checks if given user is an admin of given chat
+func isChatAdmin(bot telegramClient, chatID, userID int64) bool {
+	if res := bot.GetChatMember(chatID, userID); res.Ok {
+		return slices.Contains([]string{"creator", "administrator"}, string(res.Result.Status))
+	} else {
+		log.Printf("failed to get chat member: %s", *res.Description)
+	}
+
+	return false
+}
+
+// checks if given user is a member of given chat
+func isChatMember(bot telegramClient, chatID, userID int64) bool {
+	if res := bot.GetChatMember(chatID, userID); res.Ok {
+		switch res.Result.Status {
+		case tg.ChatMemberStatusCreator, tg.ChatMemberStatusAdministrator, tg.ChatMemberStatusMember:
+			return true
+		case tg.ChatMemberStatusRestricted:
+			return res.Result.IsMember != nil && *res.Result.IsMember
+		}
+	} else {
+		log.Printf("failed to get chat member: %s", *res.Description)
+	}
+
+	return false
+}
+
+// checks if given chat is a group chat
+func isGroupChat(chat tg.Chat) bool {
+	return chat.Type == tg.ChatTypeGroup || chat.Type == tg.ChatType("supergroup")
+}
+
 // get usable message from given update
 func usableMessageFromUpdate(update tg.Update) (message *tg.Message) {
 	if update.HasMessage() &&
@@ -95,8 +157,25 @@ func usableMessageFromUpdate(update tg.Update) (message *tg.Message) {
 	return message
 }
 
+// get the caption of given message (empty if none)
+func captionOf(message tg.Message) string {
+	if message.HasCaption() {
+		return *message.Caption
+	}
+
+	return ""
+}
+
+// text (or caption) of given message
+func textOrCaptionOf(message tg.Message) string {
+	if message.Text != nil {
+		return *message.Text
+	}
+	return captionOf(message)
+}
+
 // convert telegram bot message into chat messages
-func chatMessagesFromTGMessage(bot *tg.Bot, message tg.Message, otherGroupedMessages ...tg.Message) (parent, original *chatMessage, err error) {
+func chatMessagesFromTGMessage(bot telegramClient, message tg.Message, otherGroupedMessages ...tg.Message) (parent, original *chatMessage, err error) {
 	replyTo := repliedToMessage(message)
 	errs := []error{}
 
@@ -120,14 +199,86 @@ func chatMessagesFromTGMessage(bot *tg.Bot, message tg.Message, otherGroupedMess
 }
 
 // generate a help message with version info
-func helpMessage(conf config) string {
-	return fmt.Sprintf(msgHelp,
+func helpMessage(conf config, f formatter) string {
+	return strings.TrimSpace(fmt.Sprintf(msgHelp,
 		*conf.GoogleGenerativeModel,
 		version.Build(version.OS|version.Architecture|version.Revision),
 		cmdStats, descStats,
 		cmdPrivacy, descPrivacy,
 		cmdHelp, descHelp,
-	)
+		formatModelInfos(conf, f),
+	))
+}
+
+// generate a non-streamed answer to given prompt, and return its text
+func generateText(ctx context.Context, gtc geminiClient, prompt string, files map[string]io.Reader, opts *gt.GenerationOptions) (text string, err error) {
+	var res *genai.GenerateContentResponse
+	if res, err = gtc.Generate(ctx, prompt, files, opts); err != nil {
+		return "", err
+	}
+
+	return textFromResponse(res)
+}
+
+// generate a non-streamed answer to given prompt (with the model of `conf`), and save it to the request logs
+//
+// (for generations without answers to users, eg. moderation and watches, so that they are also counted
+// in the daily token budget, costs, and /stats; `userID` is 0 for the ones which are not requested by users)
+func generateTextLogged(ctx context.Context, conf config, db *Database, gtc geminiClient, chatID, userID int64, username, prompt string, opts *gt.GenerationOptions) (text string, err error) {
+	requestedAt := time.Now()
+
+	var numTokensInput, numTokensOutput int32
+	var finishReason string
+	var res *genai.GenerateContentResponse
+	if res, err = gtc.Generate(ctx, prompt, nil, opts); err == nil {
+		if res.UsageMetadata != nil {
+			numTokensInput, numTokensOutput = res.UsageMetadata.PromptTokenCount, res.UsageMetadata.CandidatesTokenCount
+		}
+		if len(res.Candidates) > 0 {
+			finishReason = res.Candidates[0].FinishReason.String()
+		}
+		text, err = textFromResponse(res)
+	}
+
+	result := text
+	if err != nil {
+		result = errorString(conf, err)
+	}
+	model := *conf.GoogleGenerativeModel
+	duration := time.Since(requestedAt)
+	savePromptAndResult(db, chatID, userID, username, prompt, uint(numTokensInput), result, uint(numTokensOutput), err == nil, finishReason, model, duration, stageLatencies{generation: duration}, requestCost(conf, model, uint(numTokensInput), uint(numTokensOutput)))
+
+	return text, err
+}
+
+// get the text of the first candidate from given response
+func textFromResponse(res *genai.GenerateContentResponse) (text string, err error) {
+	texts := []string{}
+	for _, candidate := range res.Candidates {
+		if candidate.Content == nil {
+			continue
+		}
+		for _, part := range candidate.Content.Parts {
+			if t, ok := part.(genai.Text); ok {
+				texts = append(texts, string(t))
+			}
+		}
+		break // use the first candidate only
+	}
+	if len(texts) <= 0 {
+		return "", fmt.Errorf("no text in the generated answer")
+	}
+
+	return strings.Join(texts, ""), nil
+}
+
+// rewind given files (readers) for reusing them
+func rewindFiles(files map[string]io.Reader) {
+	for _, file := range files {
+		if seeker, ok := file.(io.Seeker); ok {
+			_, _ = seeker.Seek(0, io.SeekStart)
+		}
+	}
 }
 
 // convert error to string
@@ -153,6 +304,78 @@ func standardizeJSON(b []byte) ([]byte, error) {
 	return ast.Pack(), nil
 }
 
+const (
+	callbackValueTTL  = 24 * time.Hour // values of buttons which are not pressed for this long are forgotten
+	maxCallbackValues = 1000           // the oldest values are forgotten when there are more than this
+)
+
+// a value waiting for a callback query
+type callbackValue struct {
+	value     any
+	expiresAt time.Time
+}
+
+// values waiting for callback queries, keyed by their callback data
+var callbackValues = struct {
+	sync.Mutex
+
+	values map[string]callbackValue
+}{
+	values: map[string]callbackValue{},
+}
+
+// keep given value until a callback query with given data arrives (for `callbackValueTTL`)
+func putCallbackValue(data string, value any) {
+	putCallbackValueFor(data, value, callbackValueTTL)
+}
+
+// keep given value until a callback query with given data arrives (for given duration)
+//
+// (expired values are swept here, and the oldest ones are forgotten when there are too many)
+func putCallbackValueFor(data string, value any, ttl time.Duration) {
+	callbackValues.Lock()
+	defer callbackValues.Unlock()
+
+	now := time.Now()
+	for key, v := range callbackValues.values {
+		if now.After(v.expiresAt) {
+			delete(callbackValues.values, key)
+		}
+	}
+	for len(callbackValues.values) >= maxCallbackValues {
+		oldest, oldestExpiresAt := "", time.Time{}
+		for key, v := range callbackValues.values {
+			if oldest == "" || v.expiresAt.Before(oldestExpiresAt) {
+				oldest, oldestExpiresAt = key, v.expiresAt
+			}
+		}
+		delete(callbackValues.values, oldest)
+	}
+
+	callbackValues.values[data] = callbackValue{
+		value:     value,
+		expiresAt: now.Add(ttl),
+	}
+}
+
+// take out the value kept for given callback data
+func popCallbackValue[T any](data string) (value T, exists bool) {
+	callbackValues.Lock()
+	defer callbackValues.Unlock()
+
+	var v callbackValue
+	if v, exists = callbackValues.values[data]; exists {
+		delete(callbackValues.values, data)
+
+		if time.Now().After(v.expiresAt) {
+			return value, false
+		}
+		value, exists = v.value.(T)
+	}
+
+	return value, exists
+}
+
 // get the address (pointer) of a value
 func ptr[T any](v T) *T {
 	return &v
@@ -163,7 +386,14 @@ func convertPromptWithURLs(conf config, prompt string) (converted string, files
 	files = [][]byte{}
 
 	re := regexp.MustCompile(urlRegexp)
+	reTGMessageLink := regexp.MustCompile(tgMessageLinkRegexp)
 	for _, url := range re.FindAllString(prompt, -1) {
+		if reTGMessageLink.MatchString(url) {
+			continue // telegram message links are handled separately
+		}
+
+		logVerbose(verboseTools, "fetching content of url: %s", url)
+
 		if content, contentType, err := fetchURLContent(conf, url); err == nil {
 			if supportedHTTPContentType(contentType) {
 				// replace url with fetched content
@@ -181,6 +411,139 @@ func convertPromptWithURLs(conf config, prompt string) (converted string, files
 	return prompt, files
 }
 
+// a media message which was seen by this bot
+type seenMediaMessage struct {
+	chatID  int64
+	fileIDs []string
+}
+
+// media messages which were seen by this bot, keyed by their link paths (eg. "c/1234567890/42" or "username/42")
+var seenMediaMessages = struct {
+	sync.Mutex
+
+	messages map[string]seenMediaMessage
+	keys     []string // for evicting old ones
+}{
+	messages: map[string]seenMediaMessage{},
+}
+
+const (
+	maxSeenMediaMessages = 1000
+)
+
+// get file ids of given message's media
+func fileIDsFromMessage(message tg.Message) (fileIDs []string) {
+	if message.HasPhoto() {
+		fileIDs = append(fileIDs, message.Photo[len(message.Photo)-1].FileID) // the largest one
+	} else if message.HasVideo() {
+		fileIDs = append(fileIDs, message.Video.FileID)
+	} else if message.HasVideoNote() {
+		fileIDs = append(fileIDs, message.VideoNote.FileID)
+	} else if message.HasAudio() {
+		fileIDs = append(fileIDs, message.Audio.FileID)
+	} else if message.HasVoice() {
+		fileIDs = append(fileIDs, message.Voice.FileID)
+	} else if message.HasDocument() {
+		fileIDs = append(fileIDs, message.Document.FileID)
+	}
+
+	return fileIDs
+}
+
+// remember given media message (and its replied one) for resolving links to them later
+func rememberMediaMessage(message tg.Message) {
+	for _, msg := range []*tg.Message{&message, repliedToMessage(message)} {
+		if msg == nil {
+			continue
+		}
+
+		fileIDs := fileIDsFromMessage(*msg)
+		if len(fileIDs) <= 0 {
+			continue
+		}
+
+		keys := []string{}
+		if strings.HasPrefix(fmt.Sprintf("%d", msg.Chat.ID), "-100") {
+			keys = append(keys, fmt.Sprintf("c/%s/%d", strings.TrimPrefix(fmt.Sprintf("%d", msg.Chat.ID), "-100"), msg.MessageID))
+		}
+		if msg.Chat.Username != nil {
+			keys = append(keys, fmt.Sprintf("%s/%d", strings.ToLower(*msg.Chat.Username), msg.MessageID))
+		}
+
+		seenMediaMessages.Lock()
+		for _, key := range keys {
+			if _, exists := seenMediaMessages.messages[key]; !exists {
+				seenMediaMessages.keys = append(seenMediaMessages.keys, key)
+			}
+			seenMediaMessages.messages[key] = seenMediaMessage{
+				chatID:  msg.Chat.ID,
+				fileIDs: fileIDs,
+			}
+		}
+		for len(seenMediaMessages.keys) > maxSeenMediaMessages {
+			delete(seenMediaMessages.messages, seenMediaMessages.keys[0])
+			seenMediaMessages.keys = seenMediaMessages.keys[1:]
+		}
+		seenMediaMessages.Unlock()
+	}
+}
+
+// replace all references to telegram files in given prompt to attached files
+//
+// - `tgfile://FILE_ID`: only resolved when `allowFileIDs` is true (eg. for admins)
+// - `https://t.me/c/CHAT/MESSAGE` or `https://t.me/USERNAME/MESSAGE`: resolved only when the message was seen by this bot,
+// and it is in the chat of given `chatID` (or the user of `userID` is a member of its chat)
+func convertPromptWithTelegramFileReferences(bot telegramClient, conf config, prompt string, chatID, userID int64, allowFileIDs bool) (converted string, files [][]byte) {
+	files = [][]byte{}
+
+	resolve := func(reference string, fileIDs []string) {
+		resolved := [][]byte{}
+		for _, fileID := range fileIDs {
+			if bytes, err := readMedia(bot, "referenced file", fileID); err == nil {
+				resolved = append(resolved, bytes)
+			} else {
+				log.Printf("failed to read referenced file '%s': %s", reference, redact(conf, err))
+				return
+			}
+		}
+
+		prompt = strings.Replace(prompt, reference, fmt.Sprintf(tgFileRefToFileFormat, reference), 1)
+		files = append(files, resolved...)
+	}
+
+	// file ids
+	if allowFileIDs {
+		for _, match := range regexp.MustCompile(tgFileIDRegexp).FindAllStringSubmatch(prompt, -1) {
+			logVerbose(verboseFiles, "resolving telegram file id: %s", match[1])
+
+			resolve(match[0], []string{match[1]})
+		}
+	}
+
+	// message links
+	for _, match := range regexp.MustCompile(tgMessageLinkRegexp).FindAllStringSubmatch(prompt, -1) {
+		key := fmt.Sprintf("%s/%s", strings.ToLower(match[1]), match[2])
+
+		seenMediaMessages.Lock()
+		seen, exists := seenMediaMessages.messages[key]
+		seenMediaMessages.Unlock()
+
+		if !exists {
+			continue
+		}
+		if seen.chatID != chatID && !isChatMember(bot, seen.chatID, userID) {
+			log.Printf("not resolving telegram message link '%s' for user(%d): not a member of chat(%d)", match[0], userID, seen.chatID)
+			continue
+		}
+
+		logVerbose(verboseFiles, "resolving telegram message link: %s", match[0])
+
+		resolve(match[0], seen.fileIDs)
+	}
+
+	return prompt, files
+}
+
 // fetch the content from given url and convert it to text for prompting.
 func fetchURLContent(conf config, url string) (content []byte, contentType string, err error) {
 	client := &http.Client{
@@ -343,3 +706,59 @@ func supportedHTTPContentType(contentType string) bool {
 		}
 	}(contentType)
 }
+
+// replace data urls and fenced base64 blocks in given prompt with attached files
+//
+// (only the ones which are not larger than `maxEmbeddedDataBytes`, and sniffed as supported types;
+// they are numbered after `numAttached` files which are already attached, as they will be appended to them)
+func convertPromptWithEmbeddedData(conf config, prompt string, numAttached int) (converted string, files [][]byte) {
+	files = [][]byte{}
+
+	embed := func(match, encoded string) {
+		encoded = strings.Join(strings.Fields(encoded), "") // remove whitespaces and line breaks
+		if base64.StdEncoding.DecodedLen(len(encoded)) > maxEmbeddedDataBytes {
+			log.Printf("embedded data is too large: %d bytes (max: %d)", base64.StdEncoding.DecodedLen(len(encoded)), maxEmbeddedDataBytes)
+			return
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			logVerbose(verboseFiles, "failed to decode embedded data: %s", err)
+			return
+		}
+
+		mimeType := http.DetectContentType(decoded)
+		if !isSupportedEmbeddedType(mimeType) {
+			logVerbose(verboseFiles, "unsupported type of embedded data: %s", mimeType)
+			return
+		}
+
+		logVerbose(verboseFiles, "attaching embedded data: %s, %d bytes", mimeType, len(decoded))
+
+		prompt = strings.Replace(prompt, match, fmt.Sprintf(embeddedDataToFileFormat, numAttached+len(files)+1, mimeType), 1)
+		files = append(files, decoded)
+	}
+
+	// data urls
+	for _, match := range regexp.MustCompile(dataURLRegexp).FindAllStringSubmatch(prompt, -1) {
+		embed(match[0], match[2])
+	}
+
+	// fenced base64 blocks
+	for _, match := range regexp.MustCompile(fencedBase64Regexp).FindAllStringSubmatch(prompt, -1) {
+		embed(match[0], match[1])
+	}
+
+	return prompt, files
+}
+
+// check if given (sniffed) mime type of embedded data is supported
+func isSupportedEmbeddedType(mimeType string) bool {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+
+	return strings.HasPrefix(mimeType, "image/") ||
+		strings.HasPrefix(mimeType, "audio/") ||
+		strings.HasPrefix(mimeType, "video/") ||
+		strings.HasPrefix(mimeType, "text/") ||
+		mimeType == "application/pdf"
+}
@@ -0,0 +1,291 @@
+// keys.go
+//
+// users' own google ai api keys (bring-your-own-key mode),
+// registered with `/setkey` in direct messages and stored encrypted with `user_api_keys_secret`
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	// my libraries
+	gt "github.com/meinside/gemini-things-go"
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	maxUserClients = 100 // the least recently used clients are closed when there are more than this
+)
+
+// gemini-things clients with users' own api keys, keyed by user ids and model names
+var userClients = struct {
+	sync.Mutex
+
+	clients map[string]*userClient
+}{
+	clients: map[string]*userClient{},
+}
+
+// a cached client with a user's own api key
+//
+// (fields are guarded by `userClients`)
+type userClient struct {
+	keyHash  [sha256.Size]byte // for detecting changed keys
+	client   *gt.Client
+	lastUsed time.Time // for closing the least recently used ones
+
+	refs    int  // number of generations which are using the client
+	evicted bool // removed from the cache, and will be closed when released by all generations
+}
+
+// get an AEAD cipher with the key derived from `user_api_keys_secret`
+func userAPIKeyCipher(conf config) (aead cipher.AEAD, err error) {
+	if conf.UserAPIKeysSecret == nil || *conf.UserAPIKeysSecret == "" {
+		return nil, fmt.Errorf("`user_api_keys_secret` is not configured")
+	}
+
+	key := sha256.Sum256([]byte(*conf.UserAPIKeysSecret))
+
+	var block cipher.Block
+	if block, err = aes.NewCipher(key[:]); err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt given api key (base64-encoded nonce + ciphertext)
+func encryptUserAPIKey(conf config, apiKey string) (encrypted string, err error) {
+	var aead cipher.AEAD
+	if aead, err = userAPIKeyCipher(conf); err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(apiKey), nil)), nil
+}
+
+// decrypt given encrypted api key
+func decryptUserAPIKey(conf config, encrypted string) (apiKey string, err error) {
+	var aead cipher.AEAD
+	if aead, err = userAPIKeyCipher(conf); err != nil {
+		return "", err
+	}
+
+	var sealed []byte
+	if sealed, err = base64.StdEncoding.DecodeString(encrypted); err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("encrypted api key is too short")
+	}
+
+	var decrypted []byte
+	if decrypted, err = aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil); err != nil {
+		return "", err
+	}
+	return string(decrypted), nil
+}
+
+// get the api key registered by given user (false if there is none, or bring-your-own-key mode is not enabled)
+func userAPIKey(conf config, db *Database, userID int64) (apiKey string, exists bool) {
+	if db == nil || conf.UserAPIKeysSecret == nil {
+		return "", false
+	}
+
+	saved, err := db.loadUserAPIKey(userID)
+	if err != nil {
+		return "", false
+	}
+
+	if apiKey, err = decryptUserAPIKey(conf, saved.EncryptedKey); err != nil {
+		log.Printf("failed to decrypt api key of user(%d): %s", userID, redact(conf, err))
+		return "", false
+	}
+	return apiKey, true
+}
+
+// get the model of given config with a client of given user's own api key, and a function for releasing the client
+//
+// (returns given config and client as they are if the client could not be initialized)
+func clientForUserAPIKey(conf config, gtc geminiClient, userID int64, apiKey string) (config, geminiClient, func()) {
+	confUser := conf
+	confUser.userAPIKey = ptr(apiKey) // (for redacting errors with the user's key, along with the bot's one)
+
+	model := *conf.GoogleGenerativeModel
+	cacheKey := fmt.Sprintf("%d/%s", userID, model)
+	keyHash := sha256.Sum256([]byte(apiKey))
+
+	userClients.Lock()
+	defer userClients.Unlock()
+
+	cached, exists := userClients.clients[cacheKey]
+	if !exists || cached.keyHash != keyHash {
+		client, err := gt.NewClient(apiKey, model)
+		if err != nil {
+			log.Printf("failed to initialize gemini-things client with the api key of user(%d): %s", userID, redact(confUser, err))
+
+			return conf, gtc, func() {}
+		}
+		client.SetTimeout(conf.AnswerTimeoutSeconds)
+		client.SetSystemInstructionFunc(func() string {
+			if confUser.SystemInstruction == nil {
+				return defaultSystemInstruction(confUser)
+			} else {
+				return *confUser.SystemInstruction
+			}
+		})
+
+		if exists { // (the key was changed)
+			evictUserClient(confUser, cacheKey, cached)
+		}
+		cached = &userClient{keyHash: keyHash, client: client}
+		userClients.clients[cacheKey] = cached
+	}
+	cached.lastUsed = time.Now()
+	cached.refs++
+
+	// evict the least recently used ones
+	for len(userClients.clients) > maxUserClients {
+		var oldestKey string
+		for key, c := range userClients.clients {
+			if oldestKey == "" || c.lastUsed.Before(userClients.clients[oldestKey].lastUsed) {
+				oldestKey = key
+			}
+		}
+		evictUserClient(confUser, oldestKey, userClients.clients[oldestKey])
+	}
+
+	var once sync.Once
+	return confUser, cached.client, func() {
+		once.Do(func() {
+			userClients.Lock()
+			defer userClients.Unlock()
+
+			cached.refs--
+			if cached.evicted && cached.refs <= 0 {
+				closeUserClient(confUser, cached)
+			}
+		})
+	}
+}
+
+// remove given cached client from the cache, and close it if no generations are using it
+//
+// (should be called while holding the lock of `userClients`)
+func evictUserClient(conf config, cacheKey string, cached *userClient) {
+	delete(userClients.clients, cacheKey)
+
+	cached.evicted = true
+	if cached.refs <= 0 {
+		closeUserClient(conf, cached)
+	}
+}
+
+// close given cached client
+func closeUserClient(conf config, cached *userClient) {
+	if err := cached.client.Close(); err != nil {
+		log.Printf("failed to close gemini-things client of user api key: %s", redact(conf, err))
+	}
+}
+
+// forget cached clients of given user (when the api key is changed or removed),
+// and close them when they are not used anymore
+func forgetUserClients(conf config, userID int64) {
+	userClients.Lock()
+	defer userClients.Unlock()
+
+	prefix := fmt.Sprintf("%d/", userID)
+	for key, cached := range userClients.clients {
+		if strings.HasPrefix(key, prefix) {
+			evictUserClient(conf, key, cached)
+		}
+	}
+}
+
+// return a /setkey command handler
+//
+// (`/setkey <api key>` for registering, `/setkey clear` for removing, and `/setkey` for checking)
+func setKeyCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("setkey command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+		userID := message.From.ID
+		args = strings.TrimSpace(args)
+
+		// api keys should not be exposed in group chats
+		if message.Chat.Type != tg.ChatTypePrivate {
+			if args != "" {
+				_ = withRetries(b).DeleteMessage(chatID, messageID)
+			}
+			_, _ = sendMessage(b, conf, msgSetKeyOnlyInPrivate, chatID, nil)
+			return
+		}
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+		if conf.UserAPIKeysSecret == nil {
+			_, _ = sendMessage(b, conf, msgSetKeyNotEnabled, chatID, &messageID)
+			return
+		}
+
+		var msg string
+		switch args {
+		case "":
+			if _, exists := userAPIKey(conf, db, userID); exists {
+				msg = msgSetKeyRegistered
+			} else {
+				msg = msgSetKeyNotRegistered
+			}
+		case "clear":
+			if err := db.deleteUserAPIKey(userID); err != nil {
+				msg = fmt.Sprintf("Failed to remove your api key: %s", redact(conf, err))
+			} else {
+				forgetUserClients(conf, userID)
+				msg = msgSetKeyCleared
+			}
+		default:
+			// remove the message with the api key
+			_ = withRetries(b).DeleteMessage(chatID, messageID)
+
+			if encrypted, err := encryptUserAPIKey(conf, args); err != nil {
+				msg = fmt.Sprintf("Failed to encrypt your api key: %s", redact(conf, err))
+			} else if err := db.saveUserAPIKey(UserAPIKey{
+				UserID:       userID,
+				EncryptedKey: encrypted,
+			}); err != nil {
+				msg = fmt.Sprintf("Failed to save your api key: %s", redact(conf, err))
+			} else {
+				forgetUserClients(conf, userID)
+				msg = msgSetKeySaved
+			}
+			_, _ = sendMessage(b, conf, msg, chatID, nil)
+			return
+		}
+
+		_, _ = sendMessage(b, conf, msg, chatID, &messageID)
+	}
+}
@@ -0,0 +1,176 @@
+// knowledge.go
+//
+// knowledge files pinned as persistent context of chats ("project context")
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	// keys of chat settings for the pinned knowledge file
+	settingKeyContextFileID   = "context_file_id"
+	settingKeyContextFileName = "context_file_name"
+
+	maxCachedContextFileBytes = 50 * 1024 * 1024 // the oldest ones are forgotten when they are larger than this in total
+)
+
+// contents of pinned knowledge files, keyed by their telegram file ids
+// (for not downloading them from telegram on every generation)
+var contextFiles = struct {
+	sync.Mutex
+
+	contents map[string][]byte
+	order    []string
+	bytes    int
+}{
+	contents: map[string][]byte{},
+}
+
+// read the content of given knowledge file (from the memory if possible)
+func contextFileContent(bot telegramClient, fileID string) (content []byte, err error) {
+	contextFiles.Lock()
+	content, exists := contextFiles.contents[fileID]
+	contextFiles.Unlock()
+	if exists {
+		return content, nil
+	}
+
+	if content, err = readMedia(bot, "document", fileID); err != nil {
+		return nil, err
+	}
+
+	contextFiles.Lock()
+	defer contextFiles.Unlock()
+
+	// (files larger than the limit are not kept at all)
+	if _, exists := contextFiles.contents[fileID]; !exists && len(content) <= maxCachedContextFileBytes {
+		contextFiles.contents[fileID] = content
+		contextFiles.order = append(contextFiles.order, fileID)
+		contextFiles.bytes += len(content)
+
+		// forget the oldest ones
+		for contextFiles.bytes > maxCachedContextFileBytes {
+			oldest := contextFiles.order[0]
+			contextFiles.bytes -= len(contextFiles.contents[oldest])
+			delete(contextFiles.contents, oldest)
+			contextFiles.order = contextFiles.order[1:]
+		}
+	}
+
+	return content, nil
+}
+
+// get the turns with the pinned knowledge file of given chat, for prepending to the history (nil if not pinned)
+//
+// (the file is uploaded only once in a while, as identical ones are reused)
+func pinnedContextMessages(bot telegramClient, conf config, db *Database, chatID int64) []chatMessage {
+	fileID := db.settingString(settingScopeChat, chatID, settingKeyContextFileID)
+	if fileID == "" {
+		return nil
+	}
+	fileName := db.settingString(settingScopeChat, chatID, settingKeyContextFileName)
+
+	content, err := contextFileContent(bot, fileID)
+	if err != nil {
+		log.Printf("failed to read pinned context of chat(%d): %s", chatID, redact(conf, err))
+		return nil
+	}
+
+	logVerbose(verboseFiles, "prepending pinned context '%s' of chat(%d)", fileName, chatID)
+
+	return []chatMessage{
+		{
+			role:  chatMessageRoleUser,
+			text:  fmt.Sprintf(pinnedContextPromptFormat, fileName),
+			files: [][]byte{content},
+		},
+		{
+			role: chatMessageRoleModel,
+			text: pinnedContextAcknowledgement,
+		},
+	}
+}
+
+// return a /context command handler
+//
+// (`set` as a reply to a document, `show`, and `clear`; only admins of groups can set or clear it in group chats)
+func contextCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("context command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		var msg string
+		switch action := strings.TrimSpace(args); action {
+		case "show":
+			if fileName := db.settingString(settingScopeChat, chatID, settingKeyContextFileName); fileName != "" {
+				msg = fmt.Sprintf(msgContextShowFormat, fileName)
+			} else {
+				msg = msgContextNotPinned
+			}
+		case "set", "clear":
+			if isGroupChat(message.Chat) && !isChatAdmin(b, chatID, message.From.ID) {
+				msg = msgNotGroupAdmin
+				break
+			}
+
+			if action == "clear" {
+				if err := setContextFile(db, chatID, "", ""); err != nil {
+					msg = fmt.Sprintf("Failed to clear the context: %s", err)
+				} else {
+					msg = msgContextCleared
+				}
+				break
+			}
+
+			replied := repliedToMessage(*message)
+			if replied == nil || !replied.HasDocument() {
+				msg = msgContextUsage
+				break
+			}
+			fileName := replied.Document.FileID
+			if replied.Document.FileName != nil {
+				fileName = *replied.Document.FileName
+			}
+			if err := setContextFile(db, chatID, replied.Document.FileID, fileName); err != nil {
+				msg = fmt.Sprintf("Failed to pin the context: %s", err)
+			} else {
+				msg = fmt.Sprintf(msgContextPinnedFormat, fileName)
+			}
+		default:
+			msg = msgContextUsage
+		}
+
+		_, _ = sendMessage(b, conf, msg, chatID, &messageID)
+	}
+}
+
+// save (or reset with empty values) the pinned knowledge file of given chat
+func setContextFile(db *Database, chatID int64, fileID, fileName string) error {
+	if err := db.setSettingValue(settingScopeChat, chatID, settingKeyContextFileID, fileID); err != nil {
+		return err
+	}
+	return db.setSettingValue(settingScopeChat, chatID, settingKeyContextFileName, fileName)
+}
@@ -0,0 +1,125 @@
+// latency.go
+//
+// latencies of each stage of answers (for verbose logs, `/debug`, and metrics of the admin console)
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	numGenerationsForAverageLatencies = 100
+)
+
+// latencies of the stages of an answer
+type stageLatencies struct {
+	download   time.Duration // downloading files of the prompt from telegram
+	upload     time.Duration // uploading files of the history to gemini
+	firstToken time.Duration // from the request of generation to the first token
+	generation time.Duration // from the request of generation to its end
+	delivery   time.Duration // sending and editing messages of the answer on telegram
+}
+
+// format latencies for logging
+func (l stageLatencies) String() string {
+	return fmt.Sprintf("download: %s, upload: %s, first token: %s, generation: %s, delivery: %s",
+		l.download.Round(time.Millisecond),
+		l.upload.Round(time.Millisecond),
+		l.firstToken.Round(time.Millisecond),
+		l.generation.Round(time.Millisecond),
+		l.delivery.Round(time.Millisecond),
+	)
+}
+
+// latencies saved in given generated result
+func latenciesOf(generated Generated) stageLatencies {
+	return stageLatencies{
+		download:   time.Duration(generated.DownloadMilliseconds) * time.Millisecond,
+		upload:     time.Duration(generated.UploadMilliseconds) * time.Millisecond,
+		firstToken: time.Duration(generated.FirstTokenMilliseconds) * time.Millisecond,
+		generation: time.Duration(generated.GenerationMilliseconds) * time.Millisecond,
+		delivery:   time.Duration(generated.DeliveryMilliseconds) * time.Millisecond,
+	}
+}
+
+// format latencies of given prompt and its result for displaying
+func formatLatencies(prompt Prompt, f formatter) string {
+	latencies := latenciesOf(prompt.Result)
+
+	return fmt.Sprintf(msgDebugLatenciesFormat,
+		f.dateTime(prompt.CreatedAt),
+		prompt.Result.GenerativeModel,
+		latencies.download.Round(time.Millisecond),
+		latencies.upload.Round(time.Millisecond),
+		latencies.firstToken.Round(time.Millisecond),
+		latencies.generation.Round(time.Millisecond),
+		latencies.delivery.Round(time.Millisecond),
+		(time.Duration(prompt.Result.DurationMilliseconds) * time.Millisecond).Round(time.Millisecond),
+	)
+}
+
+// return a /debug command handler
+//
+// (shows latencies of the stages of the latest answer in the chat)
+func debugCommandHandler(conf config, db *Database) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, _ string) {
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if !isAdmin(update, conf) {
+			log.Printf("debug command not allowed: %s", userNameFromUpdate(update))
+
+			_, _ = sendMessage(b, conf, msgNotAdmin, chatID, &messageID)
+			return
+		}
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		var msg string
+		if prompts, err := db.loadRecentChatPrompts(chatID, 1); err != nil {
+			msg = fmt.Sprintf("Failed to load the latest answer: %s", err)
+		} else if len(prompts) <= 0 {
+			msg = msgDebugNoAnswers
+		} else {
+			msg = formatLatencies(prompts[0], newFormatter(userLocale(db, message.From)))
+		}
+
+		_, _ = sendMessage(b, conf, msg, chatID, &messageID)
+	}
+}
+
+// format average latencies of recent answers for the metrics of the admin console (empty if there is none)
+func averageLatenciesMetrics(db *Database) (metrics [][2]string) {
+	average, count, err := db.averageLatencies(numGenerationsForAverageLatencies)
+	if err != nil {
+		log.Printf("failed to calculate average latencies: %s", err)
+		return nil
+	}
+	if count <= 0 {
+		return nil
+	}
+
+	label := func(stage string) string {
+		return fmt.Sprintf("%s (average of recent %d)", stage, count)
+	}
+	return [][2]string{
+		{label("Download"), average.download.Round(time.Millisecond).String()},
+		{label("Upload"), average.upload.Round(time.Millisecond).String()},
+		{label("First token"), average.firstToken.Round(time.Millisecond).String()},
+		{label("Generation"), average.generation.Round(time.Millisecond).String()},
+		{label("Delivery"), average.delivery.Round(time.Millisecond).String()},
+	}
+}
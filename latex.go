@@ -0,0 +1,241 @@
+// latex.go
+//
+// rendering of LaTeX formulas to images (with `latex` and `dvipng`)
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	latexTimeoutSeconds       = 20
+	latexDPI                  = "300"
+	maxLatexFormulasPerAnswer = 5
+	maxPhotoCaptionLength     = 1024
+
+	latexDocumentFormat = `\documentclass{article}
+\usepackage{amsmath,amssymb}
+\pagestyle{empty}
+\begin{document}
+\[
+%s
+\]
+\end{document}
+`
+)
+
+var (
+	// display formulas in answers: $$...$$ or \[...\]
+	latexDisplayFormulaRegex = regexp.MustCompile(`(?s)\$\$(.+?)\$\$|\\\[(.+?)\\\]`)
+
+	// commands (control words) in formulas: \name
+	latexCommandRegex = regexp.MustCompile(`\\([A-Za-z]+)`)
+
+	// control symbols in formulas: \ followed by a non-letter
+	latexControlSymbolRegex = regexp.MustCompile(`\\([^A-Za-z])`)
+
+	// environments in formulas: \begin{name} and \end{name}
+	latexEnvironmentRegex = regexp.MustCompile(`\\(?:begin|end)\s*\{([^}]*)\}`)
+)
+
+// commands which are allowed in formulas (only the ones for typesetting math)
+//
+// (formulas are also from answers of models, so anything else, eg. for reading files or redefining things, is not allowed;
+// latex is also run in kpathsea's paranoid mode, in an empty temporary directory)
+var latexAllowedCommands = func() map[string]bool {
+	allowed := map[string]bool{}
+	for _, command := range strings.Fields(`
+		alpha beta gamma delta epsilon varepsilon zeta eta theta vartheta iota kappa lambda mu nu xi pi varpi rho varrho sigma varsigma tau upsilon phi varphi chi psi omega
+		Gamma Delta Theta Lambda Xi Pi Sigma Upsilon Phi Psi Omega
+		frac dfrac tfrac cfrac sqrt binom dbinom tbinom
+		sum prod coprod int iint iiint oint bigcup bigcap bigoplus bigotimes bigvee bigwedge lim limsup liminf sup inf max min arg det exp log ln lg
+		sin cos tan cot sec csc arcsin arccos arctan sinh cosh tanh coth deg dim gcd hom ker Pr
+		left right middle big Big bigg Bigg bigl bigr Bigl Bigr biggl biggr Biggl Biggr
+		cdot cdots ldots dots ddots vdots times div pm mp ast star circ bullet oplus ominus otimes oslash odot wedge vee cap cup setminus
+		leq le geq ge neq ne approx equiv sim simeq cong propto ll gg prec succ preceq succeq subset supset subseteq supseteq in notin ni mid parallel perp models
+		to gets mapsto implies impliedby iff rightarrow leftarrow leftrightarrow Rightarrow Leftarrow Leftrightarrow longrightarrow longleftarrow longmapsto uparrow downarrow hookrightarrow
+		infty partial nabla forall exists nexists emptyset varnothing neg lnot top bot angle triangle hbar ell Re Im aleph prime backslash
+		langle rangle lceil rceil lfloor rfloor lvert rvert lVert rVert vert Vert
+		hat widehat bar overline underline vec dot ddot tilde widetilde check breve acute grave overbrace underbrace overset underset stackrel overrightarrow overleftarrow
+		mathbf mathrm mathit mathcal mathbb mathfrak mathsf mathtt boldsymbol operatorname text textbf textit textrm mbox
+		displaystyle textstyle scriptstyle scriptscriptstyle limits nolimits
+		quad qquad hspace vspace phantom hphantom vphantom
+		begin end hline cline substack tag notag nonumber
+		pmod bmod mod
+	`) {
+		allowed[command] = true
+	}
+	return allowed
+}()
+
+// environments which are allowed in formulas
+var latexAllowedEnvironments = map[string]bool{
+	"matrix": true, "pmatrix": true, "bmatrix": true, "Bmatrix": true, "vmatrix": true, "Vmatrix": true, "smallmatrix": true,
+	"cases": true, "aligned": true, "alignedat": true, "gathered": true, "split": true, "array": true,
+}
+
+// control symbols which are allowed in formulas (for spacing and escaped characters)
+const latexAllowedControlSymbols = ",:;! {}\\|_#%&$"
+
+// check if given formula has only the allowed commands, environments, and control symbols
+func checkLatexFormula(formula string) error {
+	if strings.Contains(formula, "^^") { // (characters in hex, which can spell forbidden commands)
+		return fmt.Errorf("'^^' is not allowed in formulas")
+	}
+	for _, matches := range latexCommandRegex.FindAllStringSubmatch(formula, -1) {
+		if !latexAllowedCommands[matches[1]] {
+			return fmt.Errorf("command '%s' is not allowed in formulas", matches[0])
+		}
+	}
+	for _, matches := range latexControlSymbolRegex.FindAllStringSubmatch(formula, -1) {
+		if !strings.Contains(latexAllowedControlSymbols, matches[1]) {
+			return fmt.Errorf("control symbol '%s' is not allowed in formulas", matches[0])
+		}
+	}
+	for _, matches := range latexEnvironmentRegex.FindAllStringSubmatch(formula, -1) {
+		if !latexAllowedEnvironments[strings.TrimSpace(matches[1])] {
+			return fmt.Errorf("environment '%s' is not allowed in formulas", matches[1])
+		}
+	}
+	return nil
+}
+
+// find display formulas in given text (at most `maxLatexFormulasPerAnswer`)
+func latexFormulasIn(text string) (formulas []string) {
+	for _, matches := range latexDisplayFormulaRegex.FindAllStringSubmatch(text, maxLatexFormulasPerAnswer) {
+		formula := matches[1]
+		if formula == "" {
+			formula = matches[2]
+		}
+		if formula = strings.TrimSpace(formula); formula != "" {
+			formulas = append(formulas, formula)
+		}
+	}
+	return formulas
+}
+
+// render given LaTeX formula to a PNG image
+func renderLatex(ctx context.Context, formula string) (png []byte, err error) {
+	if err = checkLatexFormula(formula); err != nil {
+		return nil, err
+	}
+
+	// (an empty directory only for this formula)
+	var dir string
+	if dir, err = os.MkdirTemp("", "latex-*"); err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = os.WriteFile(filepath.Join(dir, "formula.tex"), []byte(fmt.Sprintf(latexDocumentFormat, formula)), 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write formula: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, latexTimeoutSeconds*time.Second)
+	defer cancel()
+
+	// .tex => .dvi
+	cmd := exec.CommandContext(ctx, "latex", "-interaction=nonstopmode", "-halt-on-error", "-no-shell-escape", "formula.tex")
+	cmd.Dir = dir
+	cmd.Env = latexEnv(dir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to run latex: %s", latexError(output, err))
+	}
+
+	// .dvi => .png
+	cmd = exec.CommandContext(ctx, "dvipng", "-T", "tight", "-D", latexDPI, "-bg", "White", "-o", "formula.png", "formula.dvi")
+	cmd.Dir = dir
+	cmd.Env = latexEnv(dir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to run dvipng: %s (%s)", err, strings.TrimSpace(string(output)))
+	}
+
+	return os.ReadFile(filepath.Join(dir, "formula.png"))
+}
+
+// environment variables for running latex and dvipng in given directory
+//
+// (with kpathsea's paranoid mode, files cannot be opened with absolute paths, in parent directories, or as dotfiles,
+// and files in the home directory are not looked up)
+func latexEnv(dir string) []string {
+	return append(os.Environ(),
+		"openin_any=p",
+		"openout_any=p",
+		"shell_escape=f",
+		"HOME="+dir,
+		"TEXMFHOME="+dir,
+	)
+}
+
+// extract the first error line (starting with '!') from the output of latex
+func latexError(output []byte, err error) string {
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "!") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "!"))
+		}
+	}
+	return err.Error()
+}
+
+// render display formulas in given answer, and send them as photos replying to it
+func sendLatexFormulasIn(ctx context.Context, bot telegramClient, conf config, answer string, chatID, messageID int64) {
+	for _, formula := range latexFormulasIn(answer) {
+		if png, err := renderLatex(ctx, formula); err == nil {
+			if _, err := sendPhoto(bot, conf, png, chatID, &messageID, nil); err != nil {
+				log.Printf("failed to send rendered formula: %s", err)
+			}
+		} else {
+			log.Printf("failed to render formula '%s': %s", formula, err)
+		}
+	}
+}
+
+// return a /latex command handler
+func latexCommandHandler(ctx context.Context, conf config, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("latex command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		formula := strings.TrimSpace(args)
+		if formula == "" {
+			_, _ = sendMessage(b, conf, msgLatexUsage, chatID, &messageID)
+			return
+		}
+
+		_ = b.SendChatAction(chatID, tg.ChatActionUploadPhoto, chatActionOptions(chatID, &messageID))
+
+		if png, err := renderLatex(ctx, formula); err == nil {
+			caption := []rune(formula)
+			if len(caption) > maxPhotoCaptionLength {
+				caption = caption[:maxPhotoCaptionLength]
+			}
+			if _, err := sendPhoto(b, conf, png, chatID, &messageID, ptr(string(caption))); err != nil {
+				log.Printf("failed to send rendered formula: %s", err)
+			}
+		} else {
+			_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to render the formula: %s", err), chatID, &messageID)
+		}
+	}
+}
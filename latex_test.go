@@ -0,0 +1,70 @@
+// latex_test.go
+//
+// tests of rejecting unsafe LaTeX formulas
+
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRenderLatexRejected(t *testing.T) {
+	formulas := []string{
+		`\input{/etc/passwd}`,
+		`^^5cinput{/etc/passwd}`,
+		`\makeatletter\@@input /etc/passwd`,
+		`\@@input /etc/passwd`,
+		`\scantokens{\input /etc/passwd}`,
+		`\InputIfFileExists{/etc/passwd}{}{}`,
+		`\IfFileExists{/etc/passwd}{yes}{no}`,
+		`\pdffiledump length 100 {/etc/passwd}`,
+		`\pdfmdfivesum file {/etc/passwd}`,
+		`\begin{filecontents}{x.tex}x\end{filecontents}`,
+		`\@ifundefined{x}{}{}`,
+	}
+
+	for _, formula := range formulas {
+		if _, err := renderLatex(context.Background(), formula); err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("expected formula '%s' to be rejected, got: %v", formula, err)
+		}
+	}
+}
+
+func TestRenderLatexFileContentNotLeaked(t *testing.T) {
+	passwd, err := os.ReadFile("/etc/passwd")
+	if err != nil || len(passwd) <= 0 {
+		t.Skip("no /etc/passwd to read")
+	}
+	firstLine, _, _ := strings.Cut(string(passwd), "\n")
+
+	png, err := renderLatex(context.Background(), `\InputIfFileExists{/etc/passwd}{}{}`)
+	if len(png) > 0 {
+		t.Errorf("expected nothing to be rendered, got %d bytes", len(png))
+	}
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if strings.Contains(err.Error(), firstLine) {
+		t.Errorf("expected the file content not to reach the output, got: %s", err)
+	}
+}
+
+func TestCheckLatexFormulaAllowed(t *testing.T) {
+	formulas := []string{
+		`e^{i\pi} + 1 = 0`,
+		`\frac{-b \pm \sqrt{b^2 - 4ac}}{2a}`,
+		`\sum_{n=1}^{\infty} \frac{1}{n^2} = \frac{\pi^2}{6}`,
+		`\begin{pmatrix} a & b \\ c & d \end{pmatrix}`,
+		`f(x) = \begin{cases} 1 & \text{if } x > 0 \\ 0 & \text{otherwise} \end{cases}`,
+		`\mathbb{R}^n \to \mathbb{R}, \quad \left\{ x \,\middle|\, x > 0 \right\}`,
+	}
+
+	for _, formula := range formulas {
+		if err := checkLatexFormula(formula); err != nil {
+			t.Errorf("expected formula '%s' to be allowed, got: %s", formula, err)
+		}
+	}
+}
@@ -8,6 +8,10 @@ import (
 	"os"
 )
 
+const (
+	flagExportLogs = "--export-logs"
+)
+
 func main() {
 	if len(os.Args) <= 1 {
 		printUsage()
@@ -15,7 +19,11 @@ func main() {
 		confFilepath := os.Args[1]
 
 		if conf, err := loadConfig(confFilepath); err == nil {
-			runBot(conf)
+			if len(os.Args) > 2 && os.Args[2] == flagExportLogs {
+				exportRequestLogsToStdout(conf, os.Args[3:])
+			} else {
+				runBot(conf)
+			}
 		} else {
 			log.Printf("failed to load config: %s", err)
 		}
@@ -25,6 +33,9 @@ func main() {
 // print usage string
 func printUsage() {
 	fmt.Printf(`
-Usage: %s [config_filepath]
-`, os.Args[0])
+Usage: %[1]s [config_filepath | s3://BUCKET/KEY | gs://BUCKET/OBJECT]
+
+  Export request logs to stdout in JSONL:
+    %[1]s CONFIG %[2]s [days] [texts]
+`, os.Args[0], flagExportLogs)
 }
@@ -0,0 +1,351 @@
+// markdown.go
+//
+// rendering of markdown in answers with telegram's formatting options
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"unicode"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+// formats of answers
+type answerFormat string
+
+const (
+	answerFormatPlain      answerFormat = "plain"      // send answers as they are (default)
+	answerFormatHTML       answerFormat = "html"       // convert markdown to telegram's HTML
+	answerFormatMarkdownV2 answerFormat = "markdownv2" // convert markdown to telegram's MarkdownV2
+)
+
+// description of telegram errors for malformed entities
+const errorDescriptionCantParseEntities = "can't parse entities"
+
+var (
+	markdownHeadingRegex = regexp.MustCompile(`^#{1,6}\s+(.*)$`)
+	markdownBulletRegex  = regexp.MustCompile(`^(\s*)[*+-]\s+(.*)$`)
+)
+
+// markup of a telegram parse mode
+type markup interface {
+	escape(text string) string
+	code(text string) string
+	pre(lang, text string) string
+	bold(text string) string
+	italic(text string) string
+	strikethrough(text string) string
+	link(text, url string) string
+	quote(lines []string) string
+}
+
+// markup of telegram's HTML parse mode
+type htmlMarkup struct{}
+
+var htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+func (htmlMarkup) escape(text string) string { return htmlEscaper.Replace(text) }
+func (m htmlMarkup) code(text string) string { return "<code>" + m.escape(text) + "</code>" }
+func (m htmlMarkup) pre(lang, text string) string {
+	if lang == "" {
+		return "<pre>" + m.escape(text) + "</pre>"
+	}
+	return fmt.Sprintf(`<pre><code class="language-%s">%s</code></pre>`, m.escape(lang), m.escape(text))
+}
+func (htmlMarkup) bold(text string) string          { return "<b>" + text + "</b>" }
+func (htmlMarkup) italic(text string) string        { return "<i>" + text + "</i>" }
+func (htmlMarkup) strikethrough(text string) string { return "<s>" + text + "</s>" }
+func (m htmlMarkup) link(text, url string) string {
+	return fmt.Sprintf(`<a href="%s">%s</a>`, m.escape(url), text)
+}
+func (htmlMarkup) quote(lines []string) string {
+	return "<blockquote>" + strings.Join(lines, "\n") + "</blockquote>"
+}
+
+// markup of telegram's MarkdownV2 parse mode
+type markdownV2Markup struct{}
+
+var (
+	markdownV2Escaper     = regexp.MustCompile("[_*\\[\\]()~`>#+\\-=|{}.!\\\\]")
+	markdownV2CodeEscaper = strings.NewReplacer("\\", "\\\\", "`", "\\`")
+	markdownV2URLEscaper  = strings.NewReplacer("\\", "\\\\", ")", "\\)")
+)
+
+func (markdownV2Markup) escape(text string) string {
+	return markdownV2Escaper.ReplaceAllString(text, `\$0`)
+}
+func (markdownV2Markup) code(text string) string {
+	return "`" + markdownV2CodeEscaper.Replace(text) + "`"
+}
+func (markdownV2Markup) pre(lang, text string) string {
+	return "```" + lang + "\n" + markdownV2CodeEscaper.Replace(text) + "\n```"
+}
+func (markdownV2Markup) bold(text string) string          { return "*" + text + "*" }
+func (markdownV2Markup) italic(text string) string        { return "_" + text + "_" }
+func (markdownV2Markup) strikethrough(text string) string { return "~" + text + "~" }
+func (markdownV2Markup) link(text, url string) string {
+	return "[" + text + "](" + markdownV2URLEscaper.Replace(url) + ")"
+}
+func (markdownV2Markup) quote(lines []string) string {
+	return ">" + strings.Join(lines, "\n>")
+}
+
+// get the parse mode and markup of given answer format (nil for plain texts)
+func parseModeAndMarkup(format answerFormat) (*tg.ParseMode, markup) {
+	switch format {
+	case answerFormatHTML:
+		return ptr(tg.ParseModeHTML), htmlMarkup{}
+	case answerFormatMarkdownV2:
+		return ptr(tg.ParseModeMarkdownV2), markdownV2Markup{}
+	default:
+		return nil, nil
+	}
+}
+
+// convert given markdown text with markup
+//
+// (unclosed markers are kept as they are, so partially streamed texts are also converted safely)
+func convertMarkdown(text string, m markup) string {
+	var sb strings.Builder
+
+	lines := strings.Split(text, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		if lang, isFence := strings.CutPrefix(trimmed, "```"); isFence { // fenced code blocks (unclosed ones continue to the end)
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			sb.WriteString(m.pre(strings.TrimSpace(lang), strings.Join(code, "\n")))
+		} else if strings.HasPrefix(trimmed, ">") { // consecutive lines of blockquotes
+			var quoted []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quoted = append(quoted, convertInlineMarkdown(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")), m))
+			}
+			i--
+			sb.WriteString(m.quote(quoted))
+		} else if matches := markdownHeadingRegex.FindStringSubmatch(trimmed); matches != nil { // headings
+			sb.WriteString(m.bold(convertInlineMarkdown(matches[1], m)))
+		} else if matches := markdownBulletRegex.FindStringSubmatch(line); matches != nil { // bullets
+			sb.WriteString(matches[1] + "• " + convertInlineMarkdown(matches[2], m))
+		} else {
+			sb.WriteString(convertInlineMarkdown(line, m))
+		}
+
+		if i < len(lines)-1 {
+			sb.WriteString("\n")
+		}
+	}
+
+	return sb.String()
+}
+
+// convert inline elements (code spans, emphases, and links) of given markdown text with markup
+func convertInlineMarkdown(text string, m markup) string {
+	var sb strings.Builder
+
+	runes := []rune(text)
+	literal := []rune{}
+	flush := func() {
+		sb.WriteString(m.escape(string(literal)))
+		literal = literal[:0]
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		rest := string(runes[i:])
+
+		switch {
+		case r == '\\' && i+1 < len(runes) && unicode.IsPunct(runes[i+1]): // escaped characters
+			literal = append(literal, runes[i+1])
+			i++
+			continue
+		case r == '`': // code spans
+			if end := strings.IndexRune(string(runes[i+1:]), '`'); end > 0 {
+				content := []rune(string(runes[i+1:])[:end])
+				flush()
+				sb.WriteString(m.code(string(content)))
+				i += len(content) + 1
+				continue
+			}
+		case strings.HasPrefix(rest, "**") || strings.HasPrefix(rest, "__") || strings.HasPrefix(rest, "~~"): // bolds and strikethroughs
+			marker := rest[:2]
+			if end := strings.Index(rest[2:], marker); end > 0 {
+				content := []rune(rest[2 : 2+end])
+				flush()
+				if marker == "~~" {
+					sb.WriteString(m.strikethrough(convertInlineMarkdown(string(content), m)))
+				} else {
+					sb.WriteString(m.bold(convertInlineMarkdown(string(content), m)))
+				}
+				i += len(content) + 3
+				continue
+			}
+		case r == '*' || r == '_': // italics
+			if end := closingItalicMarker(runes, i); end > 0 {
+				content := runes[i+1 : end]
+				flush()
+				sb.WriteString(m.italic(convertInlineMarkdown(string(content), m)))
+				i = end
+				continue
+			}
+		case r == '[': // links
+			if label, url, length, ok := markdownLink(runes[i:]); ok {
+				flush()
+				sb.WriteString(m.link(convertInlineMarkdown(label, m), url))
+				i += length - 1
+				continue
+			}
+		}
+
+		literal = append(literal, r)
+	}
+	flush()
+
+	return sb.String()
+}
+
+// find the index of the closing italic marker for the opening one at `start`, or -1 if there is none
+//
+// (underscores in words, like snake_case identifiers, are not treated as markers)
+func closingItalicMarker(runes []rune, start int) int {
+	marker := runes[start]
+	if marker == '_' && start > 0 && isWordRune(runes[start-1]) {
+		return -1
+	}
+	if start+1 >= len(runes) || unicode.IsSpace(runes[start+1]) {
+		return -1
+	}
+
+	for i := start + 1; i < len(runes); i++ {
+		if runes[i] != marker || unicode.IsSpace(runes[i-1]) {
+			continue
+		}
+		if marker == '_' && i+1 < len(runes) && isWordRune(runes[i+1]) {
+			continue
+		}
+		if i > start+1 {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// check if given rune is a part of a word
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// parse a markdown link at the beginning of given runes, and return its label, url, and length
+func markdownLink(runes []rune) (label, url string, length int, ok bool) {
+	text := string(runes)
+
+	closing := strings.Index(text, "](")
+	if closing <= 1 || strings.Contains(text[:closing], "\n") {
+		return "", "", 0, false
+	}
+	end, depth := -1, 0 // (parentheses in urls are allowed when they are balanced)
+	for i, r := range text[closing+2:] {
+		if r == '(' {
+			depth++
+		} else if r == ')' {
+			if depth == 0 {
+				end = i
+				break
+			}
+			depth--
+		}
+	}
+	if end <= 0 {
+		return "", "", 0, false
+	}
+
+	label = text[1:closing]
+	url = text[closing+2 : closing+2+end]
+	if strings.ContainsAny(url, " \n") {
+		return "", "", 0, false
+	}
+
+	return label, url, len([]rune(text[:closing+2+end+1])), true
+}
+
+// filter given answer, and format it with `answer_format` (parse mode is nil for plain texts)
+func formatOutgoingText(conf config, text string) (formatted string, parseMode *tg.ParseMode) {
+	text = filterOutgoingText(conf, text)
+
+	parseMode, m := parseModeAndMarkup(conf.AnswerFormat)
+	if parseMode == nil {
+		return text, nil
+	}
+
+	return convertMarkdown(text, m), parseMode
+}
+
+// check if given error description of telegram is for malformed entities
+func isParseEntitiesError(description *string) bool {
+	return description != nil && strings.Contains(*description, errorDescriptionCantParseEntities)
+}
+
+// send given answer to the chat, formatted with `answer_format`
+//
+// (falls back to a plain text when telegram fails to parse the formatted one)
+func sendFormattedMessage(bot telegramClient, conf config, message string, chatID int64, messageID *int64) (sentMessageID int64, err error) {
+	formatted, parseMode := formatOutgoingText(conf, message)
+	if parseMode == nil {
+		return sendMessage(bot, conf, message, chatID, messageID)
+	}
+
+	_ = bot.SendChatAction(chatID, tg.ChatActionTyping, chatActionOptions(chatID, messageID))
+
+	logVerbose(verboseTelegram, "sending formatted message to chat(%d): '%s'", chatID, formatted)
+
+	options := messageOptions(chatID, messageID).
+		SetParseMode(*parseMode)
+
+	if res := withRetries(bot).SendMessage(chatID, formatted, options); res.Ok {
+		rememberMessageTopic(*res.Result)
+
+		return res.Result.MessageID, nil
+	} else if !isParseEntitiesError(res.Description) {
+		return 0, fmt.Errorf("failed to send message: %s (requested message: %s)", *res.Description, formatted)
+	} else {
+		log.Printf("failed to send formatted message, falling back to a plain text: %s", *res.Description)
+	}
+
+	return sendMessage(bot, conf, message, chatID, messageID)
+}
+
+// update a message in the chat with given answer, formatted with `answer_format`
+//
+// (falls back to a plain text when telegram fails to parse the formatted one)
+func updateFormattedMessage(bot telegramClient, conf config, message string, chatID int64, messageID int64) (err error) {
+	formatted, parseMode := formatOutgoingText(conf, message)
+	if parseMode == nil {
+		return updateMessage(bot, conf, message, chatID, messageID)
+	}
+
+	_ = bot.SendChatAction(chatID, tg.ChatActionTyping, chatActionOptions(chatID, &messageID))
+
+	logVerbose(verboseTelegram, "updating formatted message in chat(%d): '%s'", chatID, formatted)
+
+	options := tg.OptionsEditMessageText{}.
+		SetIDs(chatID, messageID).
+		SetParseMode(*parseMode)
+
+	if res := withRetries(bot).EditMessageText(formatted, options); res.Ok {
+		return nil
+	} else if !isParseEntitiesError(res.Description) {
+		return fmt.Errorf("failed to send message: %s (requested message: %s)", *res.Description, formatted)
+	} else {
+		log.Printf("failed to update formatted message, falling back to a plain text: %s", *res.Description)
+	}
+
+	return updateMessage(bot, conf, message, chatID, messageID)
+}
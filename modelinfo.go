@@ -0,0 +1,88 @@
+// modelinfo.go
+//
+// metadata (token limits and supported methods) of configured models
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	// google ai
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/option"
+)
+
+const (
+	modelInfoTimeoutSeconds = 10
+)
+
+// metadata of configured models, keyed by model names
+var modelInfos = struct {
+	sync.RWMutex
+
+	infos map[string]*genai.ModelInfo
+}{
+	infos: map[string]*genai.ModelInfo{},
+}
+
+// names of configured models
+func configuredModels(conf config) (models []string) {
+	models = append(models, *conf.GoogleGenerativeModel)
+	if conf.GoogleGenerativeModelFast != nil {
+		models = append(models, *conf.GoogleGenerativeModelFast)
+	}
+	return models
+}
+
+// fetch metadata of configured models from the models api
+func fetchModelInfos(ctx context.Context, conf config) {
+	ctx, cancel := context.WithTimeout(ctx, modelInfoTimeoutSeconds*time.Second)
+	defer cancel()
+
+	client, err := genai.NewClient(ctx, option.WithAPIKey(*conf.GoogleAIAPIKey))
+	if err != nil {
+		log.Printf("failed to initialize client for fetching model infos: %s", redact(conf, err))
+		return
+	}
+	defer client.Close()
+
+	for _, model := range configuredModels(conf) {
+		if info, err := client.GenerativeModel(model).Info(ctx); err == nil {
+			modelInfos.Lock()
+			modelInfos.infos[model] = info
+			modelInfos.Unlock()
+		} else {
+			log.Printf("failed to fetch info of model '%s': %s", model, redact(conf, err))
+		}
+	}
+}
+
+// format metadata of configured models for displaying (empty if not fetched)
+func formatModelInfos(conf config, f formatter) string {
+	modelInfos.RLock()
+	defer modelInfos.RUnlock()
+
+	lines := []string{}
+	for _, model := range configuredModels(conf) {
+		info, exists := modelInfos.infos[model]
+		if !exists {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("- %s: input %s / output %s tokens (%s)",
+			model,
+			f.number(int64(info.InputTokenLimit)),
+			f.number(int64(info.OutputTokenLimit)),
+			strings.Join(info.SupportedGenerationMethods, ", "),
+		))
+	}
+	if len(lines) <= 0 {
+		return ""
+	}
+
+	return "Models:\n" + strings.Join(lines, "\n")
+}
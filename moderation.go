@@ -0,0 +1,181 @@
+// moderation.go
+//
+// moderation assistant mode of group chats: flagging (or reporting) messages which violate the rules
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	// google ai
+	"github.com/google/generative-ai-go/genai"
+
+	// my libraries
+	gt "github.com/meinside/gemini-things-go"
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+// rules of moderation when `moderation_rules` is not given
+var defaultModerationRules = []string{
+	"No spam, scams, or unsolicited advertisements.",
+	"No toxic, hateful, harassing, or threatening messages.",
+}
+
+// actions suggested for violations
+type moderationAction string
+
+const (
+	moderationActionNone   moderationAction = "none"
+	moderationActionWarn   moderationAction = "warn"
+	moderationActionDelete moderationAction = "delete"
+	moderationActionBan    moderationAction = "ban"
+)
+
+// result of evaluating a message against the rules
+type moderationVerdict struct {
+	Violation       bool             `json:"violation"`
+	Rule            string           `json:"rule"`
+	Reason          string           `json:"reason"`
+	SuggestedAction moderationAction `json:"suggested_action"`
+}
+
+// check if given chat is in the moderation mode
+func isModeratedChat(conf config, chatID int64) bool {
+	return slices.Contains(conf.ModerationChatIDs, chatID)
+}
+
+// evaluate given message against the rules (with the cheap model), and flag or report it if it violates any of them
+//
+// (messages are deleted only with `moderation_auto_delete`, and nobody is banned by the bot)
+func moderateMessage(ctx context.Context, bot telegramClient, conf config, db *Database, gtc geminiClient, message tg.Message) {
+	if message.From == nil || message.From.IsBot {
+		return
+	}
+	text := strings.TrimSpace(textOrCaptionOf(message))
+	if text == "" || strings.HasPrefix(text, "/") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	verdict, err := evaluateMessage(ctx, conf, db, gtc, message.Chat.ID, text)
+	if err != nil {
+		log.Printf("failed to evaluate message(%d) in chat(%d): %s", message.MessageID, message.Chat.ID, redact(conf, err))
+		return
+	}
+	if !verdict.Violation || verdict.SuggestedAction == moderationActionNone {
+		logVerbose(verboseGemini, "message(%d) in chat(%d) does not violate the rules", message.MessageID, message.Chat.ID)
+		return
+	}
+
+	chatID := message.Chat.ID
+	messageID := message.MessageID
+
+	// delete it (only when allowed in the config)
+	deleted := false
+	if conf.ModerationAutoDelete && (verdict.SuggestedAction == moderationActionDelete || verdict.SuggestedAction == moderationActionBan) {
+		if res := withRetries(bot).DeleteMessage(chatID, messageID); res.Ok {
+			deleted = true
+		} else {
+			log.Printf("failed to delete flagged message(%d) in chat(%d): %s", messageID, chatID, *res.Description)
+		}
+	}
+
+	// leave it in the audit log
+	log.Printf("flagged message(%d) of %s in chat(%d): %s (suggested action: %s, deleted: %t)", messageID, userName(message.From), chatID, verdict.Rule, verdict.SuggestedAction, deleted)
+	if db != nil {
+		if err := db.saveModerationLog(ModerationLog{
+			ChatID:          chatID,
+			MessageID:       messageID,
+			UserID:          message.From.ID,
+			Username:        userName(message.From),
+			Text:            text,
+			Rule:            verdict.Rule,
+			Reason:          verdict.Reason,
+			SuggestedAction: string(verdict.SuggestedAction),
+			Deleted:         deleted,
+		}); err != nil {
+			log.Printf("failed to save moderation log: %s", err)
+		}
+	}
+
+	// report it to the admins, or flag it in the chat
+	report := fmt.Sprintf(msgModerationReportFormat, userName(message.From), verdict.Rule, verdict.Reason, verdict.SuggestedAction)
+	if deleted {
+		report += msgModerationDeleted
+	}
+	if conf.ModerationReportsChatID != nil {
+		report = fmt.Sprintf(msgModerationChatFormat, chatTitle(message.Chat), text) + report
+		_, _ = sendMessage(bot, conf, report, *conf.ModerationReportsChatID, nil)
+	} else if deleted {
+		_, _ = sendMessage(bot, conf, report, chatID, nil)
+	} else {
+		_, _ = sendMessage(bot, conf, report, chatID, &messageID)
+	}
+}
+
+// evaluate given text (of given chat) against `moderation_rules`
+func evaluateMessage(ctx context.Context, conf config, db *Database, gtc geminiClient, chatID int64, text string) (verdict moderationVerdict, err error) {
+	rules := []string{}
+	for i, rule := range conf.ModerationRules {
+		rules = append(rules, fmt.Sprintf("%d. %s", i+1, rule))
+	}
+
+	var generated string
+	if generated, err = generateTextLogged(ctx, conf, db, gtc, chatID, 0, moderationUsername, fmt.Sprintf(moderationPromptFormat, strings.Join(rules, "\n"), text), &gt.GenerationOptions{
+		HarmBlockThreshold: ptr(genai.HarmBlockNone), // (for evaluating harmful messages too)
+		Config: &genai.GenerationConfig{
+			Temperature:      ptr[float32](0),
+			ResponseMIMEType: "application/json",
+			ResponseSchema: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"violation": {
+						Type: genai.TypeBoolean,
+					},
+					"rule": {
+						Type:        genai.TypeString,
+						Description: "the violated rule (empty if none)",
+					},
+					"reason": {
+						Type:        genai.TypeString,
+						Description: "a short reason of the violation (empty if none)",
+					},
+					"suggested_action": {
+						Type:   genai.TypeString,
+						Format: "enum",
+						Enum: []string{
+							string(moderationActionNone),
+							string(moderationActionWarn),
+							string(moderationActionDelete),
+							string(moderationActionBan),
+						},
+					},
+				},
+				Required: []string{"violation", "rule", "reason", "suggested_action"},
+			},
+		},
+	}); err != nil {
+		return verdict, err
+	}
+
+	if err = json.Unmarshal([]byte(generated), &verdict); err != nil {
+		return verdict, fmt.Errorf("failed to parse the verdict: %w", err)
+	}
+	return verdict, nil
+}
+
+// title of given chat (or its id if it has no title)
+func chatTitle(chat tg.Chat) string {
+	if chat.Title != nil {
+		return *chat.Title
+	}
+	return fmt.Sprintf("%d", chat.ID)
+}
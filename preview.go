@@ -0,0 +1,273 @@
+// preview.go
+//
+// previews of estimated tokens and costs of prompts with large documents or videos, before processing them
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	// google ai
+	"github.com/google/generative-ai-go/genai"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+// a prompt waiting for the user's confirmation
+type costPreviewRequest struct {
+	updates      []tg.Update
+	mediaGroupID *string
+}
+
+// size of the largest document or video in given updates
+func largestFileSize(updates []tg.Update) (size int) {
+	for _, update := range updates {
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			continue
+		}
+
+		if message.HasDocument() {
+			size = max(size, message.Document.FileSize)
+		} else if message.HasVideo() && message.Video.FileSize != nil {
+			size = max(size, *message.Video.FileSize)
+		}
+	}
+	return size
+}
+
+// check if given updates have a document or video larger than `cost_preview_min_file_bytes`
+func needsCostPreview(conf config, updates []tg.Update) bool {
+	return conf.CostPreviewMinFileBytes > 0 && largestFileSize(updates) >= conf.CostPreviewMinFileBytes
+}
+
+const (
+	previewedMediaTTL      = 10 * time.Minute  // media downloaded for previews are kept for this long (or until they are processed)
+	maxPreviewedMediaBytes = 100 * 1024 * 1024 // the oldest ones are forgotten when they are larger than this in total
+)
+
+// a media file downloaded for a cost preview
+type previewedMediaFile struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+// media files downloaded for cost previews, keyed by their file ids
+//
+// (reused when the previewed prompts are processed, for not downloading them again)
+var previewedMedia = struct {
+	sync.Mutex
+
+	files map[string]previewedMediaFile
+	keys  []string // in the order of being kept
+	bytes int
+}{
+	files: map[string]previewedMediaFile{},
+}
+
+// keep given media file downloaded for a cost preview
+func keepPreviewedMedia(fileID string, data []byte) {
+	previewedMedia.Lock()
+	defer previewedMedia.Unlock()
+
+	if _, exists := previewedMedia.files[fileID]; exists {
+		return
+	}
+	previewedMedia.files[fileID] = previewedMediaFile{
+		data:      data,
+		expiresAt: time.Now().Add(previewedMediaTTL),
+	}
+	previewedMedia.keys = append(previewedMedia.keys, fileID)
+	previewedMedia.bytes += len(data)
+
+	// forget expired (or the oldest) ones
+	now := time.Now()
+	for len(previewedMedia.keys) > 0 {
+		oldest := previewedMedia.keys[0]
+		if file, exists := previewedMedia.files[oldest]; exists && now.Before(file.expiresAt) && previewedMedia.bytes <= maxPreviewedMediaBytes {
+			break
+		}
+		forgetPreviewedMedia(oldest)
+	}
+}
+
+// take out the media file downloaded for a cost preview
+func takePreviewedMedia(fileID string) (data []byte, exists bool) {
+	previewedMedia.Lock()
+	defer previewedMedia.Unlock()
+
+	var file previewedMediaFile
+	if file, exists = previewedMedia.files[fileID]; exists {
+		forgetPreviewedMedia(fileID)
+
+		if time.Now().After(file.expiresAt) {
+			return nil, false
+		}
+	}
+	return file.data, exists
+}
+
+// forget the media file of given file id (should be called with the lock held)
+func forgetPreviewedMedia(fileID string) {
+	if file, exists := previewedMedia.files[fileID]; exists {
+		previewedMedia.bytes -= len(file.data)
+		delete(previewedMedia.files, fileID)
+	}
+	if i := slices.Index(previewedMedia.keys, fileID); i >= 0 {
+		previewedMedia.keys = slices.Delete(previewedMedia.keys, i, i+1)
+	}
+}
+
+// forget the media files downloaded for the cost preview of given updates (when it is canceled)
+func forgetPreviewedMediaOf(updates []tg.Update) {
+	previewedMedia.Lock()
+	defer previewedMedia.Unlock()
+
+	for _, update := range updates {
+		if message := usableMessageFromUpdate(update); message != nil {
+			_, fileIDs := mediaFileIDsOf(*message)
+			for _, fileID := range fileIDs {
+				forgetPreviewedMedia(fileID)
+			}
+		}
+	}
+}
+
+// count tokens of the prompt in given updates with the count-tokens API
+//
+// (files are uploaded for counting them, as large ones cannot be sent inline;
+// identical ones are reused when the prompt is processed, with the database)
+func countPromptTokens(ctx context.Context, bot telegramClient, conf config, db *Database, gtc geminiClient, updates []tg.Update) (tokens int32, err error) {
+	client := tokenCountingClient()
+	if client == nil {
+		return 0, fmt.Errorf("client for counting tokens is not initialized")
+	}
+
+	parts := []genai.Part{}
+	for _, update := range updates {
+		message := usableMessageFromUpdate(update)
+		if message == nil {
+			continue
+		}
+
+		if text := textOrCaptionOf(*message); text != "" {
+			parts = append(parts, genai.Text(text))
+		}
+
+		mediaType, fileIDs := mediaFileIDsOf(*message)
+		for _, fileID := range fileIDs {
+			var file []byte
+			if file, err = readMedia(bot, mediaType, fileID); err != nil {
+				return 0, fmt.Errorf("failed to read %s content: %w", mediaType, err)
+			}
+			keepPreviewedMedia(fileID, file)
+
+			var uploaded []genai.FileData
+			if uploaded, err = uploadFilesDeduplicated(ctx, conf, db, gtc, [][]byte{file}); err != nil {
+				return 0, fmt.Errorf("failed to upload %s for counting tokens: %w", mediaType, err)
+			}
+			for _, upload := range uploaded {
+				parts = append(parts, upload)
+			}
+		}
+	}
+
+	var res *genai.CountTokensResponse
+	if res, err = client.GenerativeModel(*conf.GoogleGenerativeModel).CountTokens(ctx, parts...); err != nil {
+		return 0, fmt.Errorf("failed to count tokens: %w", err)
+	}
+	return res.TotalTokens, nil
+}
+
+// reply with the estimated tokens (and cost) of the prompt in given updates, and Proceed/Cancel buttons
+//
+// (returns false if tokens could not be counted, so that the prompt should be processed as usual)
+func offerCostPreview(ctx context.Context, bot telegramClient, conf config, db *Database, gtc geminiClient, updates []tg.Update, mediaGroupID *string) bool {
+	message := usableMessageFromUpdate(updates[0])
+	if message == nil {
+		return false
+	}
+	chatID := message.Chat.ID
+	messageID := message.MessageID
+
+	_ = bot.SendChatAction(chatID, tg.ChatActionTyping, chatActionOptions(chatID, &messageID))
+
+	tokens, err := countPromptTokens(ctx, bot, conf, db, gtc, updates)
+	if err != nil {
+		log.Printf("failed to preview the cost of message(%d) in chat(%d): %s", messageID, chatID, redact(conf, err))
+		return false
+	}
+
+	f := newFormatter(userLocale(db, message.From))
+	preview := fmt.Sprintf(msgCostPreviewFormat, f.number(int64(largestFileSize(updates))), f.number(int64(tokens)))
+	if _, exists := conf.ModelPricing[*conf.GoogleGenerativeModel]; exists {
+		preview += fmt.Sprintf(msgCostPreviewCostFormat, f.cost(requestCost(conf, *conf.GoogleGenerativeModel, uint(tokens), 0)))
+	}
+
+	key := fmt.Sprintf("%s%d/%d", callbackDataPrefixCostPreview, chatID, messageID)
+	putCallbackValue(key, costPreviewRequest{
+		updates:      updates,
+		mediaGroupID: mediaGroupID,
+	})
+
+	button := func(text, action string) tg.InlineKeyboardButton {
+		return tg.InlineKeyboardButton{
+			Text:         text,
+			CallbackData: ptr(key + "/" + action),
+		}
+	}
+	options := messageOptions(chatID, &messageID).
+		SetReplyMarkup(tg.NewInlineKeyboardMarkup([][]tg.InlineKeyboardButton{
+			{button(msgCostPreviewProceed, "proceed"), button(msgCostPreviewCancel, "cancel")},
+		}))
+	if res := withRetries(bot).SendMessage(chatID, filterOutgoingText(conf, preview), options); !res.Ok {
+		log.Printf("failed to send cost preview: %s", *res.Description)
+	}
+
+	return true
+}
+
+// process (or cancel) the previewed prompt with given callback query
+func handleCostPreviewCallback(ctx context.Context, b *tg.Bot, conf config, db *Database, gtc geminiClient, callbackQuery tg.CallbackQuery, data string) {
+	idx := strings.LastIndex(data, "/")
+	key, action := data[:idx], data[idx+1:]
+
+	request, exists := popCallbackValue[costPreviewRequest](key)
+	if !exists {
+		_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgCostPreviewExpired))
+		return
+	}
+
+	message := usableMessageFromUpdate(request.updates[0])
+	if message == nil || message.From == nil || message.From.ID != callbackQuery.From.ID {
+		// (only the sender of the prompt can decide)
+		putCallbackValue(key, request)
+		_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgCostPreviewNotYours))
+		return
+	}
+
+	// remove the preview with its buttons
+	if callbackQuery.Message != nil {
+		if res := withRetries(b).DeleteMessage(callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID); !res.Ok {
+			log.Printf("failed to delete cost preview: %s", *res.Description)
+		}
+	}
+
+	if action != "proceed" {
+		forgetPreviewedMediaOf(request.updates)
+
+		_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgCostPreviewCanceled))
+		return
+	}
+	_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgCostPreviewProcessing))
+
+	dispatchToChat(ctx, message.Chat.ID, request.updates[0].UpdateID, func(ctx context.Context) {
+		handleMessages(ctx, b, conf, db, gtc, request.updates, request.mediaGroupID)
+	})
+}
@@ -0,0 +1,57 @@
+// pricing.go
+//
+// costs of requests with the pricing table of models, and the monthly budget cap
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// pricing of a model (in USD, per 1M tokens)
+type modelPricing struct {
+	InputPerMillionTokens  float64 `json:"input"`
+	OutputPerMillionTokens float64 `json:"output"`
+}
+
+// calculate the cost of a request with `model_pricing` (0 if the model is not in the table)
+func requestCost(conf config, model string, promptTokens, resultTokens uint) float64 {
+	pricing, exists := conf.ModelPricing[model]
+	if !exists {
+		return 0
+	}
+
+	return (float64(promptTokens)*pricing.InputPerMillionTokens + float64(resultTokens)*pricing.OutputPerMillionTokens) / 1_000_000
+}
+
+// beginning of this month (in local time)
+func beginningOfMonth() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+}
+
+// check if the costs of this month reached `monthly_budget_cap`, and reply with the budget if so
+//
+// (admins are still served, and it is reset at the beginning of each month, in local time)
+func exceedsMonthlyBudgetCap(bot telegramClient, conf config, db *Database, chatID int64, admin bool, messageID int64) bool {
+	if conf.MonthlyBudgetCap <= 0 || db == nil || admin {
+		return false
+	}
+
+	spent, err := db.sumCostsSince(beginningOfMonth())
+	if err != nil {
+		log.Printf("failed to sum costs of this month: %s", err)
+		return false
+	}
+	if spent < conf.MonthlyBudgetCap {
+		return false
+	}
+
+	logVerbose(verboseGemini, "monthly budget cap is reached: %.4f of %.4f", spent, conf.MonthlyBudgetCap)
+
+	_, _ = sendMessage(bot, conf, fmt.Sprintf(msgBudgetCapReachedFormat, conf.MonthlyBudgetCap), chatID, &messageID)
+
+	return true
+}
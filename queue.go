@@ -0,0 +1,150 @@
+// queue.go
+//
+// tracking of queued and in-flight jobs
+
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// states of tracked jobs
+type jobState string
+
+const (
+	jobStateQueued   jobState = "queued"
+	jobStateInFlight jobState = "in flight"
+)
+
+// max number of recent durations of interactive requests, for estimating waits
+const maxRecentJobDurations = 20
+
+// a queued or in-flight job
+type trackedJob struct {
+	id          int64
+	name        string
+	chatID      int64 // 0 for background jobs
+	userID      int64 // 0 for background jobs
+	username    string
+	interactive bool
+	state       jobState
+	since       time.Time
+
+	cancel context.CancelFunc
+}
+
+// jobs which are queued or in flight
+var trackedJobs = struct {
+	sync.Mutex
+
+	lastID          int64
+	jobs            map[int64]*trackedJob
+	recentDurations []time.Duration
+}{
+	jobs: map[int64]*trackedJob{},
+}
+
+// start tracking a job, and return a cancelable context, its id, and a function for untracking it
+func trackJob(ctx context.Context, name string, chatID, userID int64, username string, interactive bool, state jobState) (context.Context, int64, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	trackedJobs.Lock()
+	trackedJobs.lastID++
+	job := &trackedJob{
+		id:          trackedJobs.lastID,
+		name:        name,
+		chatID:      chatID,
+		userID:      userID,
+		username:    username,
+		interactive: interactive,
+		state:       state,
+		since:       time.Now(),
+		cancel:      cancel,
+	}
+	trackedJobs.jobs[job.id] = job
+	trackedJobs.Unlock()
+
+	return ctx, job.id, func() {
+		cancel()
+
+		trackedJobs.Lock()
+		defer trackedJobs.Unlock()
+
+		if job.interactive && job.state == jobStateInFlight {
+			trackedJobs.recentDurations = append(trackedJobs.recentDurations, time.Since(job.since))
+			if len(trackedJobs.recentDurations) > maxRecentJobDurations {
+				trackedJobs.recentDurations = trackedJobs.recentDurations[1:]
+			}
+		}
+		delete(trackedJobs.jobs, job.id)
+	}
+}
+
+// change the state of a tracked job
+func setJobState(id int64, state jobState) {
+	trackedJobs.Lock()
+	defer trackedJobs.Unlock()
+
+	if job, exists := trackedJobs.jobs[id]; exists && job.state != state {
+		job.state = state
+		job.since = time.Now()
+	}
+}
+
+// get the tracked jobs (of given user only, if `userID` is not nil), ordered by their ids
+func listJobs(userID *int64) (jobs []trackedJob) {
+	trackedJobs.Lock()
+	defer trackedJobs.Unlock()
+
+	for _, job := range trackedJobs.jobs {
+		if userID == nil || job.userID == *userID {
+			jobs = append(jobs, *job)
+		}
+	}
+	slices.SortFunc(jobs, func(a, b trackedJob) int {
+		return int(a.id - b.id)
+	})
+
+	return jobs
+}
+
+// cancel a tracked job with given id
+func cancelJob(id int64) (job trackedJob, exists bool) {
+	trackedJobs.Lock()
+	defer trackedJobs.Unlock()
+
+	if tracked, exists := trackedJobs.jobs[id]; exists {
+		tracked.cancel()
+
+		return *tracked, true
+	}
+	return trackedJob{}, false
+}
+
+// estimate the wait until in-flight interactive requests are finished,
+// with the average duration of recent ones (false if there is no data for estimating)
+func estimatedWait() (wait time.Duration, estimated bool) {
+	trackedJobs.Lock()
+	defer trackedJobs.Unlock()
+
+	if len(trackedJobs.recentDurations) <= 0 {
+		return 0, false
+	}
+
+	var sum time.Duration
+	for _, d := range trackedJobs.recentDurations {
+		sum += d
+	}
+	average := sum / time.Duration(len(trackedJobs.recentDurations))
+
+	for _, job := range trackedJobs.jobs {
+		if job.interactive && job.state == jobStateInFlight {
+			wait = max(wait, average-time.Since(job.since))
+		}
+	}
+
+	return wait, true
+}
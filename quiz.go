@@ -0,0 +1,271 @@
+// quiz.go
+//
+// quizzes of generated multiple-choice questions, posted as telegram quiz polls one by one
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	// google ai
+	"github.com/google/generative-ai-go/genai"
+
+	// my libraries
+	gt "github.com/meinside/gemini-things-go"
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	defaultQuizQuestions = 5
+	maxQuizQuestions     = 10
+
+	// limits of telegram polls
+	maxPollQuestionLength    = 300
+	maxPollOptionLength      = 100
+	maxPollExplanationLength = 200
+	minPollOptions           = 2
+	maxPollOptions           = 10
+
+	quizKeyPrefix = "quiz/" // for keeping quiz sessions, keyed by the ids of their current polls
+	pollTypeQuiz  = "quiz"
+)
+
+// a generated multiple-choice question
+type quizQuestion struct {
+	Question      string   `json:"question"`
+	Options       []string `json:"options"`
+	CorrectOption int      `json:"correct_option"`
+	Explanation   string   `json:"explanation"`
+}
+
+// a quiz in progress
+type quizSession struct {
+	chatID    int64
+	userID    int64
+	messageID int64
+
+	topic     string
+	questions []quizQuestion
+	current   int // index of the question which is being asked
+	score     int // number of correct answers
+}
+
+// parse arguments of /quiz: `<topic> [n]`
+func parseQuizArgs(args string) (topic string, n int) {
+	n = defaultQuizQuestions
+
+	fields := strings.Fields(args)
+	if len(fields) > 1 {
+		if number, err := strconv.Atoi(fields[len(fields)-1]); err == nil && number > 0 {
+			n = min(number, maxQuizQuestions)
+			fields = fields[:len(fields)-1]
+		}
+	}
+
+	return strings.Join(fields, " "), n
+}
+
+// truncate given text to given number of runes
+func truncateRunes(text string, length int) string {
+	if runes := []rune(text); len(runes) > length {
+		return string(runes[:length-1]) + "…"
+	}
+	return text
+}
+
+// generate multiple-choice questions about given topic
+//
+// (invalid questions are left out, so fewer questions than requested may be returned)
+func generateQuiz(ctx context.Context, conf config, db *Database, gtc geminiClient, chatID, userID int64, topic string, n int) (questions []quizQuestion, err error) {
+	prompt := settingsInstruction(db, chatID, userID) + fmt.Sprintf(quizPromptFormat, n, topic)
+
+	var generated string
+	if generated, err = generateText(ctx, gtc, prompt, nil, &gt.GenerationOptions{
+		HarmBlockThreshold: conf.GoogleAIHarmBlockThreshold,
+		Config: &genai.GenerationConfig{
+			ResponseMIMEType: "application/json",
+			ResponseSchema: &genai.Schema{
+				Type: genai.TypeArray,
+				Items: &genai.Schema{
+					Type: genai.TypeObject,
+					Properties: map[string]*genai.Schema{
+						"question": {
+							Type: genai.TypeString,
+						},
+						"options": {
+							Type: genai.TypeArray,
+							Items: &genai.Schema{
+								Type: genai.TypeString,
+							},
+						},
+						"correct_option": {
+							Type:        genai.TypeInteger,
+							Description: "0-based index of the correct option",
+						},
+						"explanation": {
+							Type: genai.TypeString,
+						},
+					},
+					Required: []string{"question", "options", "correct_option", "explanation"},
+				},
+			},
+		},
+	}); err != nil {
+		return nil, err
+	}
+
+	var generatedQuestions []quizQuestion
+	if err = json.Unmarshal([]byte(generated), &generatedQuestions); err != nil {
+		return nil, fmt.Errorf("failed to parse generated questions: %w", err)
+	}
+	for _, question := range generatedQuestions {
+		if question.Question == "" ||
+			len(question.Options) < minPollOptions ||
+			len(question.Options) > maxPollOptions ||
+			question.CorrectOption < 0 ||
+			question.CorrectOption >= len(question.Options) {
+			continue
+		}
+		questions = append(questions, question)
+
+		if len(questions) >= n {
+			break
+		}
+	}
+	if len(questions) <= 0 {
+		return nil, fmt.Errorf("no valid questions were generated")
+	}
+
+	return questions, nil
+}
+
+// send the current question of given quiz session as a quiz poll
+func sendQuizQuestion(bot telegramClient, conf config, session *quizSession) error {
+	question := session.questions[session.current]
+
+	pollOptions := []tg.InputPollOption{}
+	for _, option := range question.Options {
+		pollOptions = append(pollOptions, tg.InputPollOption{
+			Text: truncateRunes(filterOutgoingText(conf, option), maxPollOptionLength),
+		})
+	}
+
+	options := tg.OptionsSendPoll{}.
+		SetType(pollTypeQuiz).
+		SetIsAnonymous(false). // for receiving answers
+		SetCorrectOptionID(question.CorrectOption).
+		SetReplyParameters(tg.ReplyParameters{
+			MessageID: session.messageID,
+		})
+	if question.Explanation != "" {
+		options.SetExplanation(truncateRunes(filterOutgoingText(conf, question.Explanation), maxPollExplanationLength))
+	}
+	if threadID, exists := topicOfMessage(session.chatID, &session.messageID); exists {
+		options.SetMessageThreadID(threadID)
+	}
+
+	text := fmt.Sprintf(msgQuizQuestionFormat, session.current+1, len(session.questions), filterOutgoingText(conf, question.Question))
+	res := withRetries(bot).SendPoll(session.chatID, truncateRunes(text, maxPollQuestionLength), pollOptions, options)
+	if !res.Ok {
+		return fmt.Errorf("failed to send quiz poll: %s", *res.Description)
+	}
+	if res.Result.Poll == nil {
+		return fmt.Errorf("no poll in the sent message")
+	}
+
+	putCallbackValue(quizKeyPrefix+res.Result.Poll.ID, session)
+
+	return nil
+}
+
+// handle an answer to a quiz poll, and send the next question (or the summary at the end)
+func handleQuizAnswer(bot telegramClient, conf config, answer tg.PollAnswer) {
+	key := quizKeyPrefix + answer.PollID
+	session, exists := popCallbackValue[*quizSession](key)
+	if !exists {
+		return
+	}
+
+	// count answers of the user who started the quiz only
+	if answer.User == nil || answer.User.ID != session.userID {
+		putCallbackValue(key, session)
+		return
+	}
+
+	if len(answer.OptionIDs) > 0 && answer.OptionIDs[0] == session.questions[session.current].CorrectOption {
+		session.score++
+	}
+
+	session.current++
+	if session.current < len(session.questions) {
+		if err := sendQuizQuestion(bot, conf, session); err != nil {
+			log.Printf("failed to send the next quiz question: %s", err)
+
+			_, _ = sendMessage(bot, conf, fmt.Sprintf("Failed to send the next question: %s", err), session.chatID, &session.messageID)
+		}
+		return
+	}
+
+	_, _ = sendMessage(bot, conf, fmt.Sprintf(msgQuizSummaryFormat, session.topic, session.score, len(session.questions)), session.chatID, &session.messageID)
+}
+
+// return a /quiz command handler
+func quizCommandHandler(ctx context.Context, conf config, db *Database, gtc geminiClient, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("quiz command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		userID := message.From.ID
+		messageID := message.MessageID
+
+		topic, n := parseQuizArgs(args)
+		if topic == "" {
+			_, _ = sendMessage(b, conf, msgQuizUsage, chatID, &messageID)
+			return
+		}
+
+		if exceedsMonthlyBudgetCap(b, conf, db, chatID, isAdmin(update, conf), messageID) ||
+			exceedsDailyTokenQuota(b, conf, db, chatID, userID, isAdmin(update, conf), messageID) {
+			return
+		}
+
+		_ = withRetries(b).SetMessageReaction(chatID, messageID, tg.NewMessageReactionWithEmoji("👌"))
+
+		ctx, end := beginInteractiveRequest(ctx, "quiz", chatID, userID, userNameFromUpdate(update))
+		defer end()
+
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second)
+		defer cancel()
+
+		questions, err := generateQuiz(ctx, conf, db, gtc, chatID, userID, topic, n)
+		if err != nil {
+			_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to generate a quiz: %s", errorString(conf, err)), chatID, &messageID)
+			return
+		}
+
+		if err := sendQuizQuestion(b, conf, &quizSession{
+			chatID:    chatID,
+			userID:    userID,
+			messageID: messageID,
+			topic:     topic,
+			questions: questions,
+		}); err != nil {
+			_, _ = sendMessage(b, conf, err.Error(), chatID, &messageID)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// remoteconfig.go
+//
+// functions for loading config files from remote object storages (s3://, gs://)
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	remoteConfigTimeoutSeconds = 30
+
+	gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// read config bytes from given path,
+//
+// which can be a local filepath, or an url of `s3://BUCKET/KEY` or `gs://BUCKET/OBJECT`.
+func readConfigBytes(fpath string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(fpath, "s3://"):
+		return readS3Object(fpath)
+	case strings.HasPrefix(fpath, "gs://"):
+		return readGCSObject(fpath)
+	default:
+		return os.ReadFile(fpath)
+	}
+}
+
+// split given object url into bucket and key
+func splitObjectURL(objectURL string) (bucket, key string, err error) {
+	var u *url.URL
+	if u, err = url.Parse(objectURL); err != nil {
+		return "", "", fmt.Errorf("failed to parse object url '%s': %s", objectURL, err)
+	}
+
+	bucket, key = u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return "", "", fmt.Errorf("bucket or key is missing in object url '%s'", objectURL)
+	}
+
+	return bucket, key, nil
+}
+
+// read the body of given http request
+func readRemoteObject(req *http.Request) (body []byte, err error) {
+	client := &http.Client{
+		Timeout: remoteConfigTimeoutSeconds * time.Second,
+	}
+
+	var resp *http.Response
+	if resp, err = client.Do(req); err != nil {
+		return nil, fmt.Errorf("failed to request object: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if body, err = io.ReadAll(resp.Body); err != nil {
+		return nil, fmt.Errorf("failed to read object: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http error %d while reading object: %s", resp.StatusCode, string(body))
+	}
+
+	return body, nil
+}
+
+// read an object from AWS S3 with credentials from environment variables
+//
+// (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, and AWS_REGION or AWS_DEFAULT_REGION)
+func readS3Object(objectURL string) ([]byte, error) {
+	bucket, key, err := splitObjectURL(objectURL)
+	if err != nil {
+		return nil, err
+	}
+
+	accessKeyID, secretAccessKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKeyID == "" || secretAccessKey == "" {
+		return nil, fmt.Errorf("`AWS_ACCESS_KEY_ID` and/or `AWS_SECRET_ACCESS_KEY` environment variables are missing")
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	// (virtual-hosted-style urls with dots in bucket names fail to match the wildcard certificate)
+	host := fmt.Sprintf("%s.s3.%s.amazonaws.com", bucket, region)
+	path := "/" + s3EncodePath(key)
+	if strings.Contains(bucket, ".") {
+		host = fmt.Sprintf("s3.%s.amazonaws.com", region)
+		path = "/" + s3EncodePath(bucket) + path
+	}
+
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodGet, "https://"+host+path, nil); err != nil {
+		return nil, fmt.Errorf("failed to create http request: %s", err)
+	}
+	req.URL.RawPath = path // (keep the encoding which is signed)
+	signS3Request(req, host, path, region, accessKeyID, secretAccessKey, os.Getenv("AWS_SESSION_TOKEN"), time.Now().UTC())
+
+	return readRemoteObject(req)
+}
+
+// encode each segment of given path for S3 canonical uris,
+//
+// leaving only the unreserved characters of RFC 3986 (A-Z, a-z, 0-9, '-', '.', '_', '~') as they are
+func s3EncodePath(path string) string {
+	const upperHex = "0123456789ABCDEF"
+
+	var sb strings.Builder
+	for _, c := range []byte(path) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/':
+			sb.WriteByte(c)
+		default:
+			sb.WriteByte('%')
+			sb.WriteByte(upperHex[c>>4])
+			sb.WriteByte(upperHex[c&0x0f])
+		}
+	}
+	return sb.String()
+}
+
+// sign given S3 GET request with AWS Signature Version 4
+//
+// (headers which are already set in the request are also signed)
+//
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signS3Request(req *http.Request, host, path, region, accessKeyID, secretAccessKey, sessionToken string, now time.Time) {
+	const service = "s3"
+	const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" // sha256 of empty payload
+
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("Host", host)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		values := slices.Clone(req.Header.Values(name))
+		for i, value := range values {
+			values[i] = strings.Join(strings.Fields(value), " ")
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		path,
+		"", // no query string
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKeyID, scope, signedHeaders, signature))
+}
+
+// calculate hex-encoded sha256 hash of given data
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// calculate hmac-sha256 of given data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// read an object from Google Cloud Storage
+//
+// (access token is read from `GOOGLE_OAUTH_ACCESS_TOKEN` environment variable, or from the metadata server on GCP)
+func readGCSObject(objectURL string) ([]byte, error) {
+	bucket, object, err := splitObjectURL(objectURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var token string
+	if token, err = gcpAccessToken(); err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodGet, fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media", url.PathEscape(bucket), url.PathEscape(object)), nil); err != nil {
+		return nil, fmt.Errorf("failed to create http request: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return readRemoteObject(req)
+}
+
+// get an access token for Google Cloud APIs
+func gcpAccessToken() (token string, err error) {
+	if token = os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodGet, gcpMetadataTokenURL, nil); err != nil {
+		return "", fmt.Errorf("failed to create http request: %s", err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	var body []byte
+	if body, err = readRemoteObject(req); err != nil {
+		return "", fmt.Errorf("failed to get access token from the metadata server: %s", err)
+	}
+
+	var res struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.Unmarshal(body, &res); err != nil {
+		return "", fmt.Errorf("failed to parse access token: %s", err)
+	}
+
+	return res.AccessToken, nil
+}
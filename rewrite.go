@@ -0,0 +1,68 @@
+// rewrite.go
+//
+// rewriting replied messages (shorten, expand, formal, casual, and bulletize)
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	rewriteTemperature = 0.2 // low temperature for faithful rewrites
+)
+
+// prompts of rewriting commands
+var rewritePromptFormats = map[string]string{
+	cmdShorten:   shortenPromptFormat,
+	cmdExpand:    expandPromptFormat,
+	cmdFormal:    formalPromptFormat,
+	cmdCasual:    casualPromptFormat,
+	cmdBulletize: bulletizePromptFormat,
+}
+
+// return a handler of given rewriting command (eg. /shorten)
+//
+// (rewrites the replied message, or the text given with the command)
+func rewriteCommandHandler(ctx context.Context, conf config, db *Database, gtc geminiClient, allowedUsers map[string]bool, cmd string) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("%s command not allowed: %s", strings.TrimPrefix(cmd, "/"), userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		text := strings.TrimSpace(args)
+		if replied := repliedToMessage(*message); replied != nil {
+			text = strings.TrimSpace(textOrCaptionOf(*replied))
+		}
+		if text == "" {
+			_, _ = sendMessage(b, conf, fmt.Sprintf(msgRewriteUsageFormat, cmd, cmd), chatID, &messageID)
+			return
+		}
+
+		dispatchToChat(ctx, chatID, update.UpdateID, func(ctx context.Context) {
+			ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second)
+			defer cancel()
+
+			answer(ctx, b, conf, db, gtc, responseModeRewrite, nil, &chatMessage{
+				role: chatMessageRoleUser,
+				text: fmt.Sprintf(rewritePromptFormats[cmd], text),
+			}, chatID, message.From.ID, userNameFromUpdate(update), isAdmin(update, conf), messageID)
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// scheduler.go
+//
+// functions for running scheduled jobs
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	lowPriorityPollIntervalSeconds = 5   // interval for checking in-flight interactive requests
+	lowPriorityMaxWaitMinutes      = 30  // low priority jobs will run anyway after waiting for interactive requests this long
+	lowPriorityBudgetRatio         = 0.9 // low priority jobs will be rescheduled when this ratio of `daily_token_budget` is used
+	downgradeBudgetRatio           = 0.8 // non-admin users will be answered with the fallback model when this ratio of `daily_token_budget` is used
+
+	logRetentionIntervalHours = 6 // interval of deleting request logs older than `log_retention_days`
+)
+
+// number of interactive requests which are in flight
+var numInteractiveRequests atomic.Int64
+
+// mark the beginning of an interactive request, and return its (cancelable) context and a function for marking its end
+//
+// (low priority jobs will wait until there are no interactive requests in flight)
+func beginInteractiveRequest(ctx context.Context, name string, chatID, userID int64, username string) (context.Context, func()) {
+	numInteractiveRequests.Add(1)
+
+	ctx, _, untrack := trackJob(ctx, name, chatID, userID, username, true, jobStateInFlight)
+
+	return ctx, func() {
+		untrack()
+
+		numInteractiveRequests.Add(-1)
+	}
+}
+
+// parse given time of day in the form of 'HH:MM'
+func parseTimeOfDay(hhmm string) (hour, minute int, err error) {
+	var t time.Time
+	if t, err = time.Parse("15:04", hhmm); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse time of day '%s': %s", hhmm, err)
+	}
+
+	return t.Hour(), t.Minute(), nil
+}
+
+// calculate the next time of given time of day after `now`
+func nextTimeOfDay(now time.Time, hour, minute int) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+
+	return next
+}
+
+// run given job every day at given time of day (in local time), until `ctx` is done
+func runDaily(ctx context.Context, hhmm string, job func(ctx context.Context)) error {
+	hour, minute, err := parseTimeOfDay(hhmm)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			next := nextTimeOfDay(time.Now(), hour, minute)
+			timer := time.NewTimer(time.Until(next))
+
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+				log.Printf("running daily job scheduled at %s", hhmm)
+
+				job(ctx)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// run given job once at given time, unless `ctx` is done before it
+func runAt(ctx context.Context, at time.Time, job func(ctx context.Context)) {
+	go func() {
+		timer := time.NewTimer(time.Until(at))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+			job(ctx)
+		}
+	}()
+}
+
+// run given job at every interval, until `ctx` is done
+func runEvery(ctx context.Context, interval time.Duration, job func(ctx context.Context)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				job(ctx)
+			}
+		}
+	}()
+}
+
+// run given job with low priority, until `ctx` is done
+//
+// it waits until there are no interactive requests in flight (for up to `lowPriorityMaxWaitMinutes`, for not being starved), and
+// reschedules itself to the next day when the usage of today is near `daily_token_budget`.
+func runLowPriority(ctx context.Context, conf config, db *Database, name string, job func(ctx context.Context)) {
+	ctx, id, untrack := trackJob(ctx, name, 0, 0, "", false, jobStateQueued)
+	defer untrack()
+
+	var waitingSince time.Time // since when it has been waiting for interactive requests
+	for {
+		var wait time.Duration
+		if nearDailyTokenBudget(conf, db) {
+			now := time.Now()
+			wait = time.Until(nextTimeOfDay(now, 0, 0))
+			waitingSince = time.Time{}
+
+			log.Printf("rescheduling low priority job '%s' after %s, as the daily token budget is nearly used up", name, wait.Round(time.Second))
+		} else if numInteractiveRequests.Load() > 0 && (waitingSince.IsZero() || time.Since(waitingSince) < lowPriorityMaxWaitMinutes*time.Minute) {
+			wait = lowPriorityPollIntervalSeconds * time.Second
+			if waitingSince.IsZero() {
+				waitingSince = time.Now()
+			}
+
+			logVerbose(verboseGemini, "low priority job '%s' is waiting for interactive requests to finish", name)
+		} else {
+			if numInteractiveRequests.Load() > 0 {
+				log.Printf("running low priority job '%s' anyway, after waiting for interactive requests for %d minutes", name, lowPriorityMaxWaitMinutes)
+			}
+
+			setJobState(id, jobStateInFlight)
+
+			job(ctx)
+			return
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// check if the token usage of today is near `daily_token_budget`
+func nearDailyTokenBudget(conf config, db *Database) bool {
+	return dailyTokenBudgetUsage(conf, db) >= lowPriorityBudgetRatio
+}
+
+// get the ratio of `daily_token_budget` used today (0 if there is no budget or database)
+//
+// (it is reset at midnight, in local time)
+func dailyTokenBudgetUsage(conf config, db *Database) float64 {
+	if conf.DailyTokenBudget <= 0 || db == nil {
+		return 0
+	}
+
+	now := time.Now()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	used, err := db.sumTokensSince(midnight)
+	if err != nil {
+		log.Printf("failed to sum tokens used today: %s", err)
+		return 0
+	}
+
+	return float64(used) / float64(conf.DailyTokenBudget)
+}
+
+// check if given user has used up `daily_token_quota` today, and reply with the quota if so
+//
+// (admins have no quota, and it is reset at midnight, in local time)
+func exceedsDailyTokenQuota(bot telegramClient, conf config, db *Database, chatID, userID int64, admin bool, messageID int64) bool {
+	if conf.DailyTokenQuota <= 0 || db == nil || admin {
+		return false
+	}
+
+	now := time.Now()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	used, err := db.sumUserTokensSince(userID, midnight)
+	if err != nil {
+		log.Printf("failed to sum tokens used today by user(%d): %s", userID, err)
+		return false
+	}
+	if used < conf.DailyTokenQuota {
+		return false
+	}
+
+	logVerbose(verboseGemini, "user(%d) has used up the daily token quota: %d of %d", userID, used, conf.DailyTokenQuota)
+
+	resetsIn := midnight.AddDate(0, 0, 1).Sub(now).Round(time.Minute)
+	_, _ = sendMessage(bot, conf, fmt.Sprintf(msgQuotaExceededFormat, used, conf.DailyTokenQuota, max(conf.DailyTokenQuota-used, 0), resetsIn), chatID, &messageID)
+
+	return true
+}
+
+// delete request logs older than `log_retention_days`
+func deleteExpiredRequestLogs(conf config, db *Database) {
+	if conf.LogRetentionDays <= 0 || db == nil {
+		return
+	}
+
+	until := time.Now().AddDate(0, 0, -conf.LogRetentionDays)
+	if deleted, err := db.deletePromptsBefore(until); err != nil {
+		log.Printf("failed to delete expired request logs: %s", err)
+	} else if deleted > 0 {
+		logVerbose(verboseDB, "deleted %d request log(s) created before %s", deleted, until.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,98 @@
+// scribe.go
+//
+// functions for the scribe mode of group chats
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	// my libraries
+	gt "github.com/meinside/gemini-things-go"
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+// check if given chat is in the scribe mode
+func isScribeChat(conf config, chatID int64) bool {
+	return slices.Contains(conf.ScribeChatIDs, chatID)
+}
+
+// collect given message quietly for the daily summary
+func scribeMessage(db *Database, message tg.Message) {
+	if db == nil || message.From == nil || message.From.IsBot {
+		return
+	}
+
+	var text string
+	if message.HasText() {
+		text = *message.Text
+	} else if message.HasCaption() {
+		text = *message.Caption
+	}
+	text = strings.TrimSpace(text)
+	if text == "" || strings.HasPrefix(text, "/") {
+		return
+	}
+
+	if db.isScribeOptedOut(message.Chat.ID, message.From.ID) {
+		return
+	}
+
+	logVerbose(verboseDB, "scribing message in chat(%d) from %s", message.Chat.ID, userName(message.From))
+
+	if err := db.saveScribedMessage(ScribedMessage{
+		ChatID:   message.Chat.ID,
+		UserID:   message.From.ID,
+		Username: userName(message.From),
+		Text:     text,
+	}); err != nil {
+		log.Printf("failed to save scribed message: %s", err)
+	}
+}
+
+// summarize the collected messages of all scribe chats, and post the summaries
+func summarizeScribedMessages(ctx context.Context, bot telegramClient, conf config, db *Database, gtc geminiClient) {
+	for _, chatID := range conf.ScribeChatIDs {
+		until := time.Now()
+
+		messages, err := db.loadScribedMessages(chatID)
+		if err != nil {
+			log.Printf("failed to load scribed messages of chat(%d): %s", chatID, err)
+			continue
+		}
+		if len(messages) <= 0 {
+			continue
+		}
+
+		lines := []string{}
+		for _, message := range messages {
+			lines = append(lines, fmt.Sprintf("[%s] %s: %s", message.CreatedAt.Format("15:04"), message.Username, message.Text))
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second)
+		summary, err := generateTextLogged(ctx, conf, db, gtc, chatID, 0, scribeUsername, fmt.Sprintf(scribeSummaryPromptFormat, strings.Join(lines, "\n")), &gt.GenerationOptions{
+			HarmBlockThreshold: conf.GoogleAIHarmBlockThreshold,
+		})
+		cancel()
+
+		if err != nil {
+			log.Printf("failed to summarize scribed messages of chat(%d): %s", chatID, errorString(conf, err))
+			continue
+		}
+
+		if _, err := sendMessage(bot, conf, fmt.Sprintf(msgScribeSummaryFormat, newFormatter(defaultLocale).date(until), summary), chatID, nil); err != nil {
+			log.Printf("failed to send scribe summary to chat(%d): %s", chatID, redact(conf, err))
+			continue
+		}
+
+		// delete the summarized messages
+		if err := db.deleteScribedMessages(chatID, until); err != nil {
+			log.Printf("failed to delete scribed messages of chat(%d): %s", chatID, err)
+		}
+	}
+}
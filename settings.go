@@ -0,0 +1,345 @@
+// settings.go
+//
+// key/value settings of chats and users (with global defaults)
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	// my libraries
+	gt "github.com/meinside/gemini-things-go"
+)
+
+// scopes of settings
+type settingScope string
+
+const (
+	settingScopeGlobal settingScope = "global"
+	settingScopeChat   settingScope = "chat"
+	settingScopeUser   settingScope = "user"
+)
+
+// kinds of setting values
+type settingKind int
+
+const (
+	settingKindString settingKind = iota
+	settingKindBool
+	settingKindList // comma-separated values
+)
+
+// definition of a setting
+type settingDefinition struct {
+	key  string
+	kind settingKind
+}
+
+// user-level settings (in all chats)
+var userSettingDefinitions = []settingDefinition{
+	{key: "language", kind: settingKindString},
+	{key: "length", kind: settingKindString},
+	{key: "voice", kind: settingKindString},
+}
+
+// chat-level settings
+var chatSettingDefinitions = []settingDefinition{
+	{key: "persona", kind: settingKindString},
+	{key: "model", kind: settingKindString},
+	{key: "stream", kind: settingKindBool},
+	{key: "draft", kind: settingKindBool}, // stream to a draft, then replace it with a final message
+	{key: "respond_in", kind: settingKindString},
+	{key: "leaderboard", kind: settingKindBool},     // show names in `/leaderboard`
+	{key: "reply_followups", kind: settingKindBool}, // answer replies to the bot as follow-ups (in `triggered` group chats)
+	{key: "stop_sequences", kind: settingKindList},  // stop generating answers at these sequences (instead of `stop_sequences`)
+	{key: "banned_words", kind: settingKindList},    // replace these words in answers (in addition to `output_filters`)
+}
+
+// value for resetting a setting
+const settingValueReset = "reset"
+
+// find the definition of a setting with given key
+func findSettingDefinition(definitions []settingDefinition, key string) (settingDefinition, bool) {
+	for _, def := range definitions {
+		if def.key == key {
+			return def, true
+		}
+	}
+	return settingDefinition{}, false
+}
+
+// normalize given value for the kind of setting
+func (d settingDefinition) normalize(value string) (string, error) {
+	if value == settingValueReset {
+		return "", nil
+	}
+
+	switch d.kind {
+	case settingKindBool:
+		switch strings.ToLower(value) {
+		case "on", "true", "yes":
+			return "true", nil
+		case "off", "false", "no":
+			return "false", nil
+		}
+		return "", fmt.Errorf("'%s' should be one of: on, off", d.key)
+	case settingKindList:
+		values := []string{}
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		if len(values) <= 0 {
+			return "", fmt.Errorf("'%s' should be comma-separated values", d.key)
+		}
+		return strings.Join(values, ","), nil
+	default:
+		return value, nil
+	}
+}
+
+// cache of setting values, keyed by scope, scope id, and key
+type settingsCache struct {
+	sync.RWMutex
+
+	values map[string]string // empty values are cached too, for the missing ones
+}
+
+// key for the cache of settings
+func settingsCacheKey(scope settingScope, scopeID int64, key string) string {
+	return fmt.Sprintf("%s/%d/%s", scope, scopeID, key)
+}
+
+// get the value of a setting (from the cache if possible)
+func (d *Database) settingValue(scope settingScope, scopeID int64, key string) (string, error) {
+	cacheKey := settingsCacheKey(scope, scopeID, key)
+
+	d.settings.RLock()
+	value, exists := d.settings.values[cacheKey]
+	d.settings.RUnlock()
+	if exists {
+		return value, nil
+	}
+
+	value, _, err := d.loadSettingValue(scope, scopeID, key)
+	if err != nil {
+		return "", err
+	}
+
+	d.settings.Lock()
+	if d.settings.values == nil {
+		d.settings.values = map[string]string{}
+	}
+	d.settings.values[cacheKey] = value
+	d.settings.Unlock()
+
+	return value, nil
+}
+
+// set the value of a setting (empty value for resetting it)
+func (d *Database) setSettingValue(scope settingScope, scopeID int64, key, value string) error {
+	if err := d.saveSettingValue(scope, scopeID, key, value); err != nil {
+		return err
+	}
+
+	d.settings.Lock()
+	if d.settings.values == nil {
+		d.settings.values = map[string]string{}
+	}
+	d.settings.values[settingsCacheKey(scope, scopeID, key)] = value
+	d.settings.Unlock()
+
+	return nil
+}
+
+// get the string value of a setting, falling back to the global one if it is not set
+func (d *Database) settingString(scope settingScope, scopeID int64, key string) string {
+	if d == nil {
+		return ""
+	}
+
+	value, err := d.settingValue(scope, scopeID, key)
+	if err != nil {
+		log.Printf("failed to load setting '%s' of %s(%d): %s", key, scope, scopeID, err)
+	}
+	if value == "" && scope != settingScopeGlobal {
+		if value, err = d.settingValue(settingScopeGlobal, 0, key); err != nil {
+			log.Printf("failed to load global setting '%s': %s", key, err)
+		}
+	}
+	return value
+}
+
+// get the bool value of a setting, or `fallback` if it is not set
+func (d *Database) settingBool(scope settingScope, scopeID int64, key string, fallback bool) bool {
+	if value := d.settingString(scope, scopeID, key); value != "" {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return fallback
+}
+
+// get the comma-separated values of a setting (nil if it is not set)
+func (d *Database) settingList(scope settingScope, scopeID int64, key string) (values []string) {
+	if value := d.settingString(scope, scopeID, key); value != "" {
+		values = strings.Split(value, ",")
+	}
+	return values
+}
+
+// format the settings of given scope for displaying
+func (d *Database) formatSettings(format string, scope settingScope, scopeID int64, definitions []settingDefinition) (string, error) {
+	values := []any{}
+	for _, def := range definitions {
+		value, err := d.settingValue(scope, scopeID, def.key)
+		if err != nil {
+			return "", err
+		}
+		values = append(values, orUnset(value))
+	}
+	return fmt.Sprintf(format, values...), nil
+}
+
+// return given value, or a placeholder if it is empty
+func orUnset(value string) string {
+	if value == "" {
+		return "(not set)"
+	}
+	return value
+}
+
+// build instructions from the chat-level and user-level settings, to be prepended to the prompt
+//
+// (chat persona comes first, then the user's preferences, so that the user's ones take precedence;
+// except for the pinned language of the chat, which comes last)
+func settingsInstruction(db *Database, chatID, userID int64) string {
+	if db == nil {
+		return ""
+	}
+
+	lines := []string{}
+	if persona := db.settingString(settingScopeChat, chatID, "persona"); persona != "" {
+		lines = append(lines, fmt.Sprintf("- Persona: %s", persona))
+	}
+	pinnedLanguage := db.settingString(settingScopeChat, chatID, "respond_in")
+	if language := db.settingString(settingScopeUser, userID, "language"); language != "" && pinnedLanguage == "" {
+		lines = append(lines, fmt.Sprintf("- Answer in language: %s", language))
+	}
+	if length := db.settingString(settingScopeUser, userID, "length"); length != "" {
+		lines = append(lines, fmt.Sprintf("- Length of the answer: %s", length))
+	}
+	if voice := db.settingString(settingScopeUser, userID, "voice"); voice != "" {
+		lines = append(lines, fmt.Sprintf("- Voice (tone) of the answer: %s", voice))
+	}
+
+	if pinnedLanguage != "" { // pinned language of the chat overrides the user's one
+		lines = append(lines, fmt.Sprintf("- Always answer in language: %s, regardless of the language of the request", pinnedLanguage))
+	}
+
+	if len(lines) <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(settingsInstructionFormat, strings.Join(lines, "\n"))
+}
+
+// check if answers should be streamed in given chat (default: true)
+func isStreamingEnabled(db *Database, chatID int64) bool {
+	return db.settingBool(settingScopeChat, chatID, "stream", true)
+}
+
+// check if streamed answers should be replaced with final messages in given chat (default: false)
+func isDraftModeEnabled(db *Database, chatID int64) bool {
+	return db.settingBool(settingScopeChat, chatID, "draft", false)
+}
+
+// check if replies to the bot should be answered as follow-ups (without mentions) in given chat (default: true)
+func isReplyFollowUpEnabled(db *Database, chatID int64) bool {
+	return db.settingBool(settingScopeChat, chatID, "reply_followups", true)
+}
+
+// get the stop sequences for answering in given chat (the ones of the chat-level settings, or `stop_sequences`)
+func stopSequences(conf config, db *Database, chatID int64) []string {
+	stops := db.settingList(settingScopeChat, chatID, "stop_sequences")
+	if len(stops) <= 0 {
+		stops = conf.StopSequences
+	}
+	if len(stops) > maxStopSequences {
+		stops = stops[:maxStopSequences]
+	}
+	return stops
+}
+
+// gemini-things clients for models of chat-level settings, keyed by model names
+var modelClients = struct {
+	sync.Mutex
+
+	clients map[string]*gt.Client
+}{
+	clients: map[string]*gt.Client{},
+}
+
+// get the model (and its client) for answering in given chat, and whether it was downgraded or not
+//
+// the fallback model is used for non-admin users when the daily token budget is nearly used up,
+// and the model of the chat-level settings otherwise.
+func clientForChat(conf config, db *Database, gtc geminiClient, chatID int64, admin bool) (confModel config, client geminiClient, downgraded bool) {
+	if fallback := fallbackModel(conf); !admin && fallback != nil && dailyTokenBudgetUsage(conf, db) >= downgradeBudgetRatio {
+		confModel, client = clientForModel(conf, gtc, *fallback)
+		return confModel, client, true
+	}
+
+	confModel, client = clientForModel(conf, gtc, db.settingString(settingScopeChat, chatID, "model"))
+	return confModel, client, false
+}
+
+// get the model for answering when the daily token budget is nearly used up (nil if there is none)
+func fallbackModel(conf config) *string {
+	if conf.GoogleGenerativeModelFallback != nil {
+		return conf.GoogleGenerativeModelFallback
+	}
+	return conf.GoogleGenerativeModelFast
+}
+
+// get given model (and its client)
+//
+// (returns given config and client as they are if model is empty or the default one)
+func clientForModel(conf config, gtc geminiClient, model string) (config, geminiClient) {
+	if model == "" || model == *conf.GoogleGenerativeModel {
+		return conf, gtc
+	}
+
+	confModel := conf
+	confModel.GoogleGenerativeModel = ptr(model)
+
+	modelClients.Lock()
+	defer modelClients.Unlock()
+
+	client, exists := modelClients.clients[model]
+	if !exists {
+		var err error
+		if client, err = gt.NewClient(*conf.GoogleAIAPIKey, model); err != nil {
+			log.Printf("failed to initialize gemini-things client with model '%s': %s", model, redact(conf, err))
+
+			return conf, gtc
+		}
+		client.SetTimeout(conf.AnswerTimeoutSeconds)
+		client.SetSystemInstructionFunc(func() string {
+			if confModel.SystemInstruction == nil {
+				return defaultSystemInstruction(confModel)
+			} else {
+				return *confModel.SystemInstruction
+			}
+		})
+
+		modelClients.clients[model] = client
+	}
+
+	return confModel, client
+}
@@ -0,0 +1,171 @@
+// share.go
+//
+// sharing code-heavy answers to a paste service (github gist, or a self-hosted pastebin) with a share button
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+const (
+	githubGistsURL   = "https://api.github.com/gists"
+	sharedAnswerFile = "answer.md"
+
+	sharedAnswerTTL = 1 * time.Hour // answers which are not shared for this long are forgotten (they are full texts, unlike other button values)
+)
+
+// paste service setting struct
+type pasteSetting struct {
+	GitHubToken  string `json:"github_token,omitempty"`   // for creating secret gists
+	PastebinURL  string `json:"pastebin_url,omitempty"`   // or a self-hosted pastebin which accepts POSTed contents, and responds with their urls
+	MinCodeLines int    `json:"min_code_lines,omitempty"` // answers with at least this many lines in code blocks get a share button (default: 10)
+}
+
+// an answer waiting for being shared
+type sharedAnswer struct {
+	userID int64 // only the requester can share it
+	text   string
+}
+
+// count lines in the code blocks of given text
+func countCodeLines(text string) (count int) {
+	inCodeBlock := false
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCodeBlock = !inCodeBlock
+			continue
+		}
+		if inCodeBlock {
+			count++
+		}
+	}
+	return count
+}
+
+// get a share button for given answer, if it is code-heavy and `paste` is configured (empty otherwise)
+func shareButtons(conf config, text string, chatID, userID, messageID int64) []tg.InlineKeyboardButton {
+	if conf.Paste == nil || countCodeLines(text) < conf.Paste.MinCodeLines {
+		return nil
+	}
+
+	key := fmt.Sprintf("%s%d/%d", callbackDataPrefixShare, chatID, messageID)
+	putCallbackValueFor(key, sharedAnswer{
+		userID: userID,
+		text:   filterOutgoingText(conf, text),
+	}, sharedAnswerTTL)
+
+	return []tg.InlineKeyboardButton{
+		{
+			Text:         msgShare,
+			CallbackData: ptr(key),
+		},
+	}
+}
+
+// put given buttons on the message of an answer
+func putAnswerButtons(bot telegramClient, chatID, messageID int64, buttons []tg.InlineKeyboardButton) {
+	if res := withRetries(bot).EditMessageReplyMarkup(tg.OptionsEditMessageReplyMarkup{}.
+		SetIDs(chatID, messageID).
+		SetReplyMarkup(tg.NewInlineKeyboardMarkup([][]tg.InlineKeyboardButton{buttons}))); !res.Ok {
+		log.Printf("failed to put buttons on the answer: %s", *res.Description)
+	}
+}
+
+// upload given text to the configured paste service, and return its url
+func uploadToPaste(conf config, text string) (url string, err error) {
+	client := &http.Client{
+		Timeout: time.Duration(conf.FetchURLTimeoutSeconds) * time.Second,
+	}
+
+	var req *http.Request
+	if conf.Paste.GitHubToken != "" {
+		var body []byte
+		if body, err = json.Marshal(map[string]any{
+			"description": "answer of telegram gemini bot",
+			"public":      false,
+			"files": map[string]any{
+				sharedAnswerFile: map[string]string{"content": text},
+			},
+		}); err != nil {
+			return "", err
+		}
+		if req, err = http.NewRequest(http.MethodPost, githubGistsURL, bytes.NewReader(body)); err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+conf.Paste.GitHubToken)
+		req.Header.Set("Accept", "application/vnd.github+json")
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		if req, err = http.NewRequest(http.MethodPost, conf.Paste.PastebinURL, strings.NewReader(text)); err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	var resp *http.Response
+	if resp, err = client.Do(req); err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body []byte
+	if body, err = io.ReadAll(resp.Body); err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("http %d", resp.StatusCode)
+	}
+
+	if conf.Paste.GitHubToken != "" {
+		var gist struct {
+			HTMLURL string `json:"html_url"`
+		}
+		if err = json.Unmarshal(body, &gist); err != nil {
+			return "", err
+		}
+		return gist.HTMLURL, nil
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// upload the answer to the paste service with given callback query, and reply with its url
+func handleShareCallback(b telegramClient, conf config, callbackQuery tg.CallbackQuery, data string) {
+	shared, exists := popCallbackValue[sharedAnswer](data)
+	if !exists {
+		_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgShareExpired))
+		return
+	}
+	if shared.userID != callbackQuery.From.ID {
+		putCallbackValueFor(data, shared, sharedAnswerTTL)
+		_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgShareNotYours))
+		return
+	}
+	_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{})
+
+	if callbackQuery.Message == nil {
+		return
+	}
+	chatID := callbackQuery.Message.Chat.ID
+	messageID := callbackQuery.Message.MessageID
+
+	url, err := uploadToPaste(conf, shared.text)
+	if err != nil {
+		log.Printf("failed to share the answer: %s", err)
+
+		putCallbackValueFor(data, shared, sharedAnswerTTL) // put it back for retrying
+		_, _ = sendMessage(b, conf, msgShareFailed, chatID, &messageID)
+		return
+	}
+
+	_, _ = sendMessage(b, conf, fmt.Sprintf(msgSharedFormat, url), chatID, &messageID)
+}
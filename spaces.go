@@ -0,0 +1,252 @@
+// spaces.go
+//
+// named knowledge spaces (shared documents and memories) which multiple chats can join
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+var spaceNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// check if given user can manage (and join) given space
+func canAccessSpace(db *Database, space Space, userID int64) bool {
+	if space.OwnerID == userID {
+		return true
+	}
+	member, err := db.isSpaceMember(space.ID, userID)
+	if err != nil {
+		log.Printf("failed to check member(%d) of space '%s': %s", userID, space.Name, err)
+	}
+	return member
+}
+
+// get the turns with the documents and memories of spaces joined by given chat, for prepending to the history
+func spaceContextMessages(bot telegramClient, conf config, db *Database, chatID int64) (messages []chatMessage) {
+	if db == nil {
+		return nil
+	}
+
+	spaces, err := db.loadJoinedSpaces(chatID)
+	if err != nil {
+		log.Printf("failed to load spaces joined by chat(%d): %s", chatID, err)
+		return nil
+	}
+
+	for _, space := range spaces {
+		items, err := db.loadSpaceItems(space.ID)
+		if err != nil {
+			log.Printf("failed to load items of space '%s': %s", space.Name, err)
+			continue
+		}
+		if len(items) <= 0 {
+			continue
+		}
+
+		memories := []string{}
+		files := [][]byte{}
+		for _, item := range items {
+			if item.FileID == "" {
+				memories = append(memories, "- "+item.Text)
+				continue
+			}
+
+			content, err := contextFileContent(bot, item.FileID)
+			if err != nil {
+				log.Printf("failed to read '%s' of space '%s': %s", item.Text, space.Name, redact(conf, err))
+				continue
+			}
+			files = append(files, content)
+		}
+
+		logVerbose(verboseFiles, "prepending space '%s' (%d files, %d memories) of chat(%d)", space.Name, len(files), len(memories), chatID)
+
+		messages = append(messages, chatMessage{
+			role:  chatMessageRoleUser,
+			text:  fmt.Sprintf(spaceContextPromptFormat, space.Name, strings.Join(memories, "\n")),
+			files: files,
+		}, chatMessage{
+			role: chatMessageRoleModel,
+			text: spaceContextAcknowledgement,
+		})
+	}
+
+	return messages
+}
+
+// return a /space command handler
+//
+// (`create`, `join`, `leave`, `add` as a reply to a document, `remember`, `forget`, `allow`, `deny`, `show`, and `list`;
+// only the owner and members of a space can manage or join it, and only admins of groups can join or leave it in group chats)
+func spaceCommandHandler(conf config, db *Database, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("space command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		chatID := message.Chat.ID
+		messageID := message.MessageID
+
+		if db == nil {
+			_, _ = sendMessage(b, conf, databaseUnavailableMessage(conf), chatID, &messageID)
+			return
+		}
+
+		_, _ = sendMessage(b, conf, handleSpaceCommand(b, db, *message, args), chatID, &messageID)
+	}
+}
+
+// handle given /space command, and return the message for replying
+func handleSpaceCommand(bot telegramClient, db *Database, message tg.Message, args string) string {
+	chatID := message.Chat.ID
+	userID := message.From.ID
+
+	fields := strings.Fields(args)
+	if len(fields) == 0 || fields[0] == "list" {
+		spaces, err := db.loadJoinedSpaces(chatID)
+		if err != nil {
+			return fmt.Sprintf("Failed to load spaces: %s", err)
+		}
+		if len(spaces) <= 0 {
+			return msgSpaceNoneJoined
+		}
+		names := []string{}
+		for _, space := range spaces {
+			names = append(names, "- "+space.Name)
+		}
+		return fmt.Sprintf(msgSpaceListFormat, strings.Join(names, "\n"))
+	}
+	if len(fields) < 2 {
+		return msgSpaceUsage
+	}
+	action, name := fields[0], strings.ToLower(fields[1])
+
+	if action == "create" {
+		if !spaceNameRegexp.MatchString(name) {
+			return msgSpaceInvalidName
+		}
+		if _, err := db.loadSpace(name); err == nil {
+			return fmt.Sprintf(msgSpaceExistsFormat, name)
+		}
+		if err := db.saveSpace(&Space{Name: name, OwnerID: userID}); err != nil {
+			return fmt.Sprintf("Failed to create the space: %s", err)
+		}
+		return fmt.Sprintf(msgSpaceCreatedFormat, name, name)
+	}
+
+	space, err := db.loadSpace(name)
+	if err != nil || !canAccessSpace(db, space, userID) {
+		// (not telling if it exists or not)
+		return fmt.Sprintf(msgSpaceNotAccessibleFormat, name)
+	}
+
+	switch action {
+	case "join", "leave":
+		if isGroupChat(message.Chat) && !isChatAdmin(bot, chatID, userID) {
+			return msgNotGroupAdmin
+		}
+
+		if action == "join" {
+			if err := db.joinSpace(space.ID, chatID); err != nil {
+				return fmt.Sprintf("Failed to join the space: %s", err)
+			}
+			return fmt.Sprintf(msgSpaceJoinedFormat, name)
+		}
+		if err := db.leaveSpace(space.ID, chatID); err != nil {
+			return fmt.Sprintf("Failed to leave the space: %s", err)
+		}
+		return fmt.Sprintf(msgSpaceLeftFormat, name)
+	case "add":
+		replied := repliedToMessage(message)
+		if replied == nil || !replied.HasDocument() {
+			return msgSpaceUsage
+		}
+		fileName := replied.Document.FileID
+		if replied.Document.FileName != nil {
+			fileName = *replied.Document.FileName
+		}
+		if err := db.saveSpaceItem(&SpaceItem{SpaceID: space.ID, UserID: userID, FileID: replied.Document.FileID, Text: fileName}); err != nil {
+			return fmt.Sprintf("Failed to add the document: %s", err)
+		}
+		return fmt.Sprintf(msgSpaceAddedFormat, fileName, name)
+	case "remember":
+		memory := strings.TrimSpace(strings.Join(fields[2:], " "))
+		if memory == "" {
+			return msgSpaceUsage
+		}
+		if err := db.saveSpaceItem(&SpaceItem{SpaceID: space.ID, UserID: userID, Text: memory}); err != nil {
+			return fmt.Sprintf("Failed to save the memory: %s", err)
+		}
+		return fmt.Sprintf(msgSpaceRememberedFormat, name)
+	case "forget":
+		if len(fields) < 3 {
+			return msgSpaceUsage
+		}
+		id, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return msgSpaceUsage
+		}
+		if deleted, err := db.deleteSpaceItem(space.ID, uint(id)); err != nil {
+			return fmt.Sprintf("Failed to forget the item: %s", err)
+		} else if !deleted {
+			return fmt.Sprintf(msgSpaceNoSuchItemFormat, id, name)
+		}
+		return fmt.Sprintf(msgSpaceForgotFormat, id, name)
+	case "allow", "deny":
+		if space.OwnerID != userID {
+			return msgSpaceNotOwner
+		}
+		if len(fields) < 3 {
+			return msgSpaceUsage
+		}
+		memberID, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return msgSpaceUsage
+		}
+
+		if action == "allow" {
+			if err := db.addSpaceMember(space.ID, memberID); err != nil {
+				return fmt.Sprintf("Failed to allow the user: %s", err)
+			}
+			return fmt.Sprintf(msgSpaceAllowedFormat, memberID, name)
+		}
+		// (direct messages of the user cannot query the space anymore)
+		if err := db.removeSpaceMember(space.ID, memberID); err != nil {
+			return fmt.Sprintf("Failed to deny the user: %s", err)
+		}
+		return fmt.Sprintf(msgSpaceDeniedFormat, memberID, name)
+	case "show":
+		items, err := db.loadSpaceItems(space.ID)
+		if err != nil {
+			return fmt.Sprintf("Failed to load items of the space: %s", err)
+		}
+		if len(items) <= 0 {
+			return fmt.Sprintf(msgSpaceEmptyFormat, name)
+		}
+		lines := []string{}
+		for _, item := range items {
+			if item.FileID != "" {
+				lines = append(lines, fmt.Sprintf("%d. (document) %s", item.ID, item.Text))
+			} else {
+				lines = append(lines, fmt.Sprintf("%d. %s", item.ID, item.Text))
+			}
+		}
+		return fmt.Sprintf(msgSpaceShowFormat, name, strings.Join(lines, "\n"))
+	}
+
+	return msgSpaceUsage
+}
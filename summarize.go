@@ -0,0 +1,98 @@
+// summarize.go
+//
+// structured summaries of urls, documents, and replied messages
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+// get what to summarize from given message (or the replied one), or the url or text given with the command
+//
+// (documents take precedence over texts)
+func summarySource(bot telegramClient, message tg.Message, args string) (source string, files [][]byte, err error) {
+	source = strings.TrimSpace(args)
+
+	document := message.Document
+	if replied := repliedToMessage(message); replied != nil {
+		if document == nil && replied.HasDocument() {
+			document = replied.Document
+		}
+		if source == "" {
+			source = strings.TrimSpace(textOrCaptionOf(*replied))
+		}
+	}
+
+	if document != nil {
+		var content []byte
+		if content, err = readMedia(bot, "document", document.FileID); err != nil {
+			return "", nil, err
+		}
+		return summaryOfAttachedDocument, [][]byte{content}, nil
+	}
+
+	return source, nil, nil
+}
+
+// summarize the url, document, or text of given message, and reply with the summary
+func summarize(ctx context.Context, bot telegramClient, conf config, db *Database, gtc geminiClient, message tg.Message, userName string, admin bool, args string) {
+	chatID := message.Chat.ID
+	messageID := message.MessageID
+
+	source, files, err := summarySource(bot, message, args)
+	if err != nil {
+		_, _ = sendMessage(bot, conf, fmt.Sprintf("Failed to read the document: %s", redact(conf, err)), chatID, &messageID)
+		return
+	}
+	if source == "" {
+		_, _ = sendMessage(bot, conf, msgSummarizeUsage, chatID, &messageID)
+		return
+	}
+
+	prompt := fmt.Sprintf(summarizePromptFormat, source)
+
+	// fetch the contents of urls (if they are not fetched in all prompts)
+	if !conf.ReplaceHTTPURLsInPrompt {
+		var fetched [][]byte
+		prompt, fetched = convertPromptWithURLs(conf, prompt)
+		files = append(files, fetched...)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	answer(ctx, bot, conf, db, gtc, responseModeStreamed, nil, &chatMessage{
+		role:  chatMessageRoleUser,
+		text:  prompt,
+		files: files,
+	}, chatID, message.From.ID, userName, admin, messageID)
+}
+
+// return a /summarize command handler
+//
+// (summarizes the url or text given with the command, or the replied message or document)
+func summarizeCommandHandler(ctx context.Context, conf config, db *Database, gtc geminiClient, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("summarize command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		dispatchToChat(ctx, message.Chat.ID, update.UpdateID, func(ctx context.Context) {
+			summarize(ctx, b, conf, db, gtc, *message, userNameFromUpdate(update), isAdmin(update, conf), args)
+		})
+	}
+}
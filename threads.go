@@ -0,0 +1,303 @@
+// threads.go
+//
+// conversation threads which are built from chains of replied messages
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	// google ai
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/option"
+)
+
+const (
+	maxThreadMessages = 10000 // number of messages kept in memory
+	maxThreadDepth    = 20    // default max depth of reply chains for histories
+)
+
+// a message in conversation threads
+type threadMessage struct {
+	chatID          int64
+	messageID       int64
+	parentMessageID *int64 // id of the replied message (if any)
+
+	role chatMessageRole
+	text string // empty for branch points
+
+	numFiles int
+}
+
+// messages of conversation threads, keyed by chat and message ids
+var threadMessages = struct {
+	sync.Mutex
+
+	messages map[string]threadMessage
+	keys     []string // for evicting old ones
+}{
+	messages: map[string]threadMessage{},
+}
+
+// generate a key for given chat and message ids
+func threadMessageKey(chatID, messageID int64) string {
+	return fmt.Sprintf("%d/%d", chatID, messageID)
+}
+
+// remember given message of a conversation thread
+func rememberThreadMessage(message threadMessage) {
+	threadMessages.Lock()
+	defer threadMessages.Unlock()
+
+	key := threadMessageKey(message.chatID, message.messageID)
+	if _, exists := threadMessages.messages[key]; !exists {
+		threadMessages.keys = append(threadMessages.keys, key)
+	}
+	threadMessages.messages[key] = message
+
+	for len(threadMessages.keys) > maxThreadMessages {
+		delete(threadMessages.messages, threadMessages.keys[0])
+		threadMessages.keys = threadMessages.keys[1:]
+	}
+}
+
+// get a remembered message of a conversation thread
+func threadMessageFor(chatID, messageID int64) (message threadMessage, exists bool) {
+	threadMessages.Lock()
+	defer threadMessages.Unlock()
+
+	message, exists = threadMessages.messages[threadMessageKey(chatID, messageID)]
+	return message, exists
+}
+
+// build a history of chat messages by walking up the reply chain from given message,
+//
+// (in chronological order, not including the given message itself)
+func threadHistoryBefore(chatID, messageID int64, maxDepth int) (history []chatMessage) {
+	message, exists := threadMessageFor(chatID, messageID)
+	for depth := 0; exists && message.parentMessageID != nil && depth < maxDepth; depth++ {
+		if message, exists = threadMessageFor(chatID, *message.parentMessageID); exists && message.text != "" {
+			text := message.text
+			if message.numFiles > 0 {
+				text = fmt.Sprintf("%s (%d file(s) omitted)", text, message.numFiles)
+			}
+
+			history = append([]chatMessage{{
+				role: message.role,
+				text: text,
+			}}, history...)
+		}
+	}
+
+	return history
+}
+
+// merge consecutive chat messages of the same role into one,
+// (as histories of generations should alternate between roles)
+func mergeConsecutiveRoles(messages []chatMessage) (merged []chatMessage) {
+	for _, message := range messages {
+		if len(merged) > 0 && merged[len(merged)-1].role == message.role {
+			last := &merged[len(merged)-1]
+			last.text = last.text + "\n\n" + message.text
+			last.files = append(last.files, message.files...)
+		} else {
+			merged = append(merged, message)
+		}
+	}
+
+	return merged
+}
+
+// counter of tokens with the count-tokens API (eg. *genai.GenerativeModel)
+type tokenCounter interface {
+	CountTokens(ctx context.Context, parts ...genai.Part) (*genai.CountTokensResponse, error)
+}
+
+// client for counting tokens of histories and previewed prompts (reused for all of them), and cached numbers of tokens of chat messages
+var historyTokens = struct {
+	sync.Mutex
+
+	client *genai.Client
+
+	counts map[[sha256.Size]byte]int32
+	keys   [][sha256.Size]byte // for evicting old ones
+}{
+	counts: map[[sha256.Size]byte]int32{},
+}
+
+// initialize the client for counting tokens (of histories with `max_history_tokens`, and prompts with `cost_preview_min_file_bytes`)
+func initHistoryTokenCounter(conf config) (err error) {
+	var client *genai.Client
+	if client, err = genai.NewClient(context.Background(), option.WithAPIKey(*conf.GoogleAIAPIKey)); err != nil {
+		return err
+	}
+
+	historyTokens.Lock()
+	defer historyTokens.Unlock()
+
+	historyTokens.client = client
+
+	return nil
+}
+
+// close the client for counting tokens
+func closeHistoryTokenCounter() {
+	historyTokens.Lock()
+	defer historyTokens.Unlock()
+
+	if historyTokens.client != nil {
+		_ = historyTokens.client.Close()
+		historyTokens.client = nil
+	}
+}
+
+// get the client for counting tokens (nil if it is not initialized)
+func tokenCountingClient() *genai.Client {
+	historyTokens.Lock()
+	defer historyTokens.Unlock()
+
+	return historyTokens.client
+}
+
+// generate a key of the cached number of tokens of given chat message with given model
+func tokenCountKey(model string, message chatMessage) [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d:%s", model, len(message.text), message.text)
+	for _, file := range message.files {
+		fmt.Fprintf(h, "%d:", len(file))
+		h.Write(file)
+	}
+
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// get the cached number of tokens of given chat message
+func cachedTokenCount(model string, message chatMessage) (count int32, exists bool) {
+	historyTokens.Lock()
+	defer historyTokens.Unlock()
+
+	count, exists = historyTokens.counts[tokenCountKey(model, message)]
+	return count, exists
+}
+
+// cache the number of tokens of given chat message
+func cacheTokenCount(model string, message chatMessage, count int32) {
+	historyTokens.Lock()
+	defer historyTokens.Unlock()
+
+	key := tokenCountKey(model, message)
+	if _, exists := historyTokens.counts[key]; !exists {
+		historyTokens.keys = append(historyTokens.keys, key)
+	}
+	historyTokens.counts[key] = count
+
+	for len(historyTokens.keys) > maxThreadMessages {
+		delete(historyTokens.counts, historyTokens.keys[0])
+		historyTokens.keys = historyTokens.keys[1:]
+	}
+}
+
+// count tokens of given chat messages with one request (or without any, if all of them are cached)
+//
+// (when only one of them is not cached yet, its number of tokens is cached from the result)
+func countHistoryTokens(ctx context.Context, counter tokenCounter, model string, messages []chatMessage) (tokens int32, err error) {
+	var cached int32
+	uncached := []int{}
+	for i, message := range messages {
+		if count, exists := cachedTokenCount(model, message); exists {
+			cached += count
+		} else {
+			uncached = append(uncached, i)
+		}
+	}
+	if len(uncached) <= 0 {
+		return cached, nil
+	}
+
+	parts := []genai.Part{}
+	for _, message := range messages {
+		parts = append(parts, genai.Text(message.text))
+		for _, file := range message.files {
+			parts = append(parts, genai.Blob{
+				MIMEType: http.DetectContentType(file),
+				Data:     file,
+			})
+		}
+	}
+
+	var res *genai.CountTokensResponse
+	if res, err = counter.CountTokens(ctx, parts...); err != nil {
+		return 0, err
+	}
+	if len(uncached) == 1 {
+		cacheTokenCount(model, messages[uncached[0]], max(res.TotalTokens-cached, 0))
+	}
+	return res.TotalTokens, nil
+}
+
+// find the index of the oldest turn of given history from which the rest fits in given number of tokens
+//
+// (the whole history is counted first, and the cut point is binary-searched only when it does not fit)
+func historyCutPoint(ctx context.Context, counter tokenCounter, model string, history []chatMessage, maxTokens int32) (from int, tokens int32, err error) {
+	if tokens, err = countHistoryTokens(ctx, counter, model, history); err != nil || tokens <= maxTokens {
+		return 0, tokens, err
+	}
+
+	// (an empty rest always fits)
+	low, high := 1, len(history)
+	tokens = 0
+	for low < high {
+		mid := (low + high) / 2
+
+		var count int32
+		if count, err = countHistoryTokens(ctx, counter, model, history[mid:]); err != nil {
+			return 0, 0, err
+		}
+		if count <= maxTokens {
+			high, tokens = mid, count
+		} else {
+			low = mid + 1
+		}
+	}
+	return low, tokens, nil
+}
+
+// trim the oldest turns of given history, so that its number of tokens fits in `max_history_tokens`
+//
+// (tokens are counted with the count-tokens API; history is returned as it is if counting fails)
+func trimHistoryToTokenBudget(ctx context.Context, conf config, history []chatMessage) []chatMessage {
+	if conf.MaxHistoryTokens <= 0 || len(history) <= 0 {
+		return history
+	}
+
+	client := tokenCountingClient()
+	if client == nil {
+		return history
+	}
+
+	// (counted with the bot's api key even for users' own keys, as counting tokens is free)
+	model := *conf.GoogleGenerativeModel
+	from, total, err := historyCutPoint(ctx, client.GenerativeModel(model), model, history, conf.MaxHistoryTokens)
+	if err != nil {
+		log.Printf("failed to count tokens of history: %s", redact(conf, err))
+		return history
+	}
+
+	if from > 0 {
+		// trimmed histories should start with the user's turn
+		for from < len(history) && history[from].role != chatMessageRoleUser {
+			from++
+		}
+
+		logVerbose(verboseGemini, "trimmed %d oldest turn(s) of history (%d tokens left)", from, total)
+	}
+
+	return history[from:]
+}
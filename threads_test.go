@@ -0,0 +1,107 @@
+// threads_test.go
+//
+// tests of trimming histories to the token budget
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	// google ai
+	"github.com/google/generative-ai-go/genai"
+)
+
+// fake token counter which counts words of texts as tokens
+type fakeTokenCounter struct {
+	numRequests int
+}
+
+func (c *fakeTokenCounter) CountTokens(ctx context.Context, parts ...genai.Part) (*genai.CountTokensResponse, error) {
+	c.numRequests++
+
+	var tokens int32
+	for _, part := range parts {
+		if text, ok := part.(genai.Text); ok {
+			tokens += int32(len(strings.Fields(string(text))))
+		}
+	}
+	return &genai.CountTokensResponse{TotalTokens: tokens}, nil
+}
+
+// get a history of given number of turns, with 10 tokens each
+func historyOfTurns(name string, num int) (history []chatMessage) {
+	for i := range num {
+		role := chatMessageRoleUser
+		if i%2 == 1 {
+			role = chatMessageRoleModel
+		}
+		history = append(history, chatMessage{
+			role: role,
+			text: fmt.Sprintf("%s turn %d", name, i) + strings.Repeat(" token", 7),
+		})
+	}
+	return history
+}
+
+func TestHistoryCutPoint(t *testing.T) {
+	tests := []struct {
+		name           string
+		numTurns       int
+		maxTokens      int32
+		expectedFrom   int
+		expectedTokens int32
+		maxRequests    int
+	}{
+		{name: "fits", numTurns: 16, maxTokens: 1000, expectedFrom: 0, expectedTokens: 160, maxRequests: 1},
+		{name: "trimmed", numTurns: 16, maxTokens: 55, expectedFrom: 11, expectedTokens: 50, maxRequests: 1 + 4},
+		{name: "nothing_fits", numTurns: 16, maxTokens: 5, expectedFrom: 16, expectedTokens: 0, maxRequests: 1 + 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			model := "model-" + test.name
+			history := historyOfTurns(test.name, test.numTurns)
+
+			counter := &fakeTokenCounter{}
+			from, tokens, err := historyCutPoint(context.Background(), counter, model, history, test.maxTokens)
+			if err != nil {
+				t.Fatalf("failed to find the cut point: %s", err)
+			}
+			if from != test.expectedFrom || tokens != test.expectedTokens {
+				t.Errorf("expected cut point %d (%d tokens), got %d (%d tokens)", test.expectedFrom, test.expectedTokens, from, tokens)
+			}
+			if counter.numRequests > test.maxRequests {
+				t.Errorf("expected at most %d count-tokens requests, got %d", test.maxRequests, counter.numRequests)
+			}
+		})
+	}
+}
+
+func TestCountHistoryTokensCached(t *testing.T) {
+	model := "model-cached"
+	history := historyOfTurns("cached", 10)
+
+	// only the newest turn is not cached yet
+	for _, message := range history[:len(history)-1] {
+		cacheTokenCount(model, message, 10)
+	}
+
+	counter := &fakeTokenCounter{}
+	if tokens, err := countHistoryTokens(context.Background(), counter, model, history); err != nil || tokens != 100 {
+		t.Fatalf("expected 100 tokens, got %d (error: %v)", tokens, err)
+	}
+	if counter.numRequests != 1 {
+		t.Errorf("expected 1 count-tokens request, got %d", counter.numRequests)
+	}
+
+	// (the newest turn is cached from the result of the whole history)
+	if tokens, err := countHistoryTokens(context.Background(), counter, model, history); err != nil || tokens != 100 {
+		t.Fatalf("expected 100 tokens, got %d (error: %v)", tokens, err)
+	}
+	if counter.numRequests != 1 {
+		t.Errorf("expected no more count-tokens requests, got %d", counter.numRequests-1)
+	}
+}
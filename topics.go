@@ -0,0 +1,139 @@
+// topics.go
+//
+// things for controlling where the bot answers in forum supergroups
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+// modes of answering in forum supergroups
+type forumTopicsMode string
+
+const (
+	forumTopicsModeAll       forumTopicsMode = "all"       // answer in all topics (default)
+	forumTopicsModeDedicated forumTopicsMode = "dedicated" // answer only in the dedicated topic of each forum
+	forumTopicsModeDMOnly    forumTopicsMode = "dm_only"   // answer only in direct messages, and redirect users there
+)
+
+const (
+	maxTopicMessages = 10000 // number of messages whose topics are kept in memory
+)
+
+// topics (message thread ids) of messages in forum supergroups, keyed by chat and message ids
+var messageTopics = struct {
+	sync.Mutex
+
+	topics map[string]int64
+	keys   []string // for evicting old ones
+}{
+	topics: map[string]int64{},
+}
+
+// remember the topic of given message (if it is in a forum topic)
+func rememberMessageTopic(message tg.Message) {
+	if message.IsTopicMessage == nil || !*message.IsTopicMessage || message.MessageThreadID == nil {
+		return
+	}
+
+	messageTopics.Lock()
+	defer messageTopics.Unlock()
+
+	key := threadMessageKey(message.Chat.ID, message.MessageID)
+	if _, exists := messageTopics.topics[key]; !exists {
+		messageTopics.keys = append(messageTopics.keys, key)
+	}
+	messageTopics.topics[key] = *message.MessageThreadID
+
+	for len(messageTopics.keys) > maxTopicMessages {
+		delete(messageTopics.topics, messageTopics.keys[0])
+		messageTopics.keys = messageTopics.keys[1:]
+	}
+}
+
+// get the remembered topic of given message
+func topicOfMessage(chatID int64, messageID *int64) (threadID int64, exists bool) {
+	if messageID == nil {
+		return 0, false
+	}
+
+	messageTopics.Lock()
+	defer messageTopics.Unlock()
+
+	threadID, exists = messageTopics.topics[threadMessageKey(chatID, *messageID)]
+	return threadID, exists
+}
+
+// options for sending a message as a reply to given message (if any), in the same topic
+func messageOptions(chatID int64, messageID *int64) tg.OptionsSendMessage {
+	options := tg.OptionsSendMessage{}
+	if messageID != nil {
+		options.SetReplyParameters(tg.ReplyParameters{
+			MessageID: *messageID,
+		})
+	}
+	if threadID, exists := topicOfMessage(chatID, messageID); exists {
+		options.SetMessageThreadID(threadID)
+	}
+	return options
+}
+
+// options for sending a chat action in the topic of given message
+func chatActionOptions(chatID int64, messageID *int64) tg.OptionsSendChatAction {
+	options := tg.OptionsSendChatAction{}
+	if threadID, exists := topicOfMessage(chatID, messageID); exists {
+		options.SetMessageThreadID(threadID)
+	}
+	return options
+}
+
+// check if the bot can answer given message, in terms of forum topics
+//
+// (in `dm_only` mode, a redirecting message will be sent as a reply)
+func isAnswerableInTopic(bot telegramClient, conf config, botUsername *string, message tg.Message) bool {
+	if message.Chat.IsForum == nil || !*message.Chat.IsForum {
+		return true
+	}
+
+	switch conf.ForumTopicsMode {
+	case forumTopicsModeDedicated:
+		topicID, exists := conf.DedicatedForumTopicIDs[message.Chat.ID]
+		if !exists {
+			log.Printf("no dedicated topic is configured for forum chat(%d)", message.Chat.ID)
+			return false
+		}
+		if message.MessageThreadID == nil || *message.MessageThreadID != topicID {
+			logVerbose(verboseTelegram, "ignoring message outside of the dedicated topic in forum chat(%d)", message.Chat.ID)
+			return false
+		}
+		return true
+	case forumTopicsModeDMOnly:
+		redirect := msgDMOnly
+		if botUsername != nil {
+			redirect = fmt.Sprintf(msgDMOnlyFormat, *botUsername)
+		}
+		_, _ = sendMessage(bot, conf, redirect, message.Chat.ID, &message.MessageID)
+		return false
+	default:
+		return true
+	}
+}
+
+// wrap given command handler, so that it runs only where the bot can answer in forum supergroups
+func topicGuarded(conf config, botUsername *string, handler func(b *tg.Bot, update tg.Update, args string)) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if message := usableMessageFromUpdate(update); message != nil {
+			rememberMessageTopic(*message)
+			if !isAnswerableInTopic(b, conf, botUsername, *message) {
+				return
+			}
+		}
+
+		handler(b, update, args)
+	}
+}
@@ -0,0 +1,71 @@
+// uploads.go
+//
+// uploading files to Gemini, deduplicated by the hashes of their contents
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	// google ai
+	"github.com/google/generative-ai-go/genai"
+)
+
+const (
+	// uploaded files are deleted by Gemini after 48 hours, so reuse them only before that (with some margin)
+	uploadedFileReusableDuration = 47 * time.Hour
+)
+
+// upload given files (or reuse the identical ones which were uploaded before), and return them as parts of a prompt
+//
+// (without the database, files are uploaded every time)
+func uploadFilesDeduplicated(ctx context.Context, conf config, db *Database, gtc geminiClient, files [][]byte) (uploaded []genai.FileData, err error) {
+	for i, file := range files {
+		sum := sha256.Sum256(file)
+		hash := hex.EncodeToString(sum[:])
+
+		// reuse the one which was uploaded before
+		if db != nil {
+			if reusable, exists := db.loadUploadedFile(hash, time.Now().Add(-uploadedFileReusableDuration)); exists {
+				logVerbose(verboseFiles, "reusing uploaded file: %s (hash: %s)", reusable.URI, hash)
+
+				uploaded = append(uploaded, genai.FileData{
+					MIMEType: reusable.MIMEType,
+					URI:      reusable.URI,
+				})
+				continue
+			}
+		}
+
+		// or upload it
+		var data []genai.FileData
+		if data, err = gtc.UploadFilesAndWait(ctx, map[string]io.Reader{
+			fmt.Sprintf("file %d", i+1): bytes.NewReader(file),
+		}); err != nil {
+			return nil, err
+		}
+		for _, upload := range data {
+			logVerbose(verboseFiles, "uploaded file: %s (hash: %s)", upload.URI, hash)
+
+			if db != nil {
+				if err := db.saveUploadedFile(UploadedFile{
+					Hash:     hash,
+					URI:      upload.URI,
+					MIMEType: upload.MIMEType,
+				}); err != nil {
+					log.Printf("failed to save uploaded file: %s", err)
+				}
+			}
+		}
+		uploaded = append(uploaded, data...)
+	}
+
+	return uploaded, nil
+}
@@ -0,0 +1,147 @@
+// verbose.go
+//
+// scoped verbose logging
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	// my libraries
+	gt "github.com/meinside/gemini-things-go"
+)
+
+type verboseScope string
+
+// verbose scopes
+const (
+	verboseTelegram verboseScope = "telegram"
+	verboseGemini   verboseScope = "gemini"
+	verboseStream   verboseScope = "stream"
+	verboseDB       verboseScope = "db"
+	verboseFiles    verboseScope = "files"
+	verboseTools    verboseScope = "tools"
+
+	verboseAll = "all"
+)
+
+// all available verbose scopes
+var allVerboseScopes = []verboseScope{
+	verboseTelegram,
+	verboseGemini,
+	verboseStream,
+	verboseDB,
+	verboseFiles,
+	verboseTools,
+}
+
+// sampling and truncation of verbose logs in the `stream` scope
+type verboseStreamSetting struct {
+	MaxDeltaChars int `json:"max_delta_chars,omitempty"` // text deltas longer than this are truncated (0 for logging them fully)
+	EveryNthDelta int `json:"every_nth_delta,omitempty"` // only the first and every nth text delta are logged (0 or 1 for logging all of them)
+}
+
+// verbose scopes enabled at runtime
+var enabledVerboseScopes = struct {
+	sync.RWMutex
+
+	scopes map[verboseScope]bool
+}{
+	scopes: map[verboseScope]bool{},
+}
+
+// parse given verbose scope
+func parseVerboseScope(scope string) (verboseScope, error) {
+	s := verboseScope(strings.ToLower(strings.TrimSpace(scope)))
+	if slices.Contains(allVerboseScopes, s) {
+		return s, nil
+	}
+
+	return "", fmt.Errorf("no such verbose scope: '%s'", scope)
+}
+
+// initialize verbose scopes with given configuration
+//
+// (`verbose: true` enables all scopes)
+func initVerboseScopes(conf config) {
+	if conf.Verbose {
+		setVerboseScopes(allVerboseScopes, true)
+		return
+	}
+
+	for _, scope := range conf.VerboseScopes {
+		if s, err := parseVerboseScope(scope); err == nil {
+			setVerboseScopes([]verboseScope{s}, true)
+		} else {
+			log.Printf("ignoring verbose scope: %s", err)
+		}
+	}
+}
+
+// enable or disable given verbose scopes
+func setVerboseScopes(scopes []verboseScope, enabled bool) {
+	enabledVerboseScopes.Lock()
+	defer enabledVerboseScopes.Unlock()
+
+	for _, scope := range scopes {
+		enabledVerboseScopes.scopes[scope] = enabled
+	}
+}
+
+// check if given verbose scope is enabled
+func isVerbose(scope verboseScope) bool {
+	enabledVerboseScopes.RLock()
+	defer enabledVerboseScopes.RUnlock()
+
+	return enabledVerboseScopes.scopes[scope]
+}
+
+// print a verbose log if given scope is enabled
+func logVerbose(scope verboseScope, format string, v ...any) {
+	if isVerbose(scope) {
+		log.Printf(fmt.Sprintf("[verbose:%s] %s", scope, format), v...)
+	}
+}
+
+// generate a status string of all verbose scopes
+func verboseScopesStatus() string {
+	lines := []string{}
+	for _, scope := range allVerboseScopes {
+		status := "off"
+		if isVerbose(scope) {
+			status = "on"
+		}
+		lines = append(lines, fmt.Sprintf("- %s: %s", scope, status))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// print a verbose log of given stream callback data (`n`th text delta of the answer) if the `stream` scope is enabled,
+// sampled and truncated with `verbose_stream`
+func logVerboseStream(conf config, chatID int64, n int, data gt.StreamCallbackData) {
+	if !isVerbose(verboseStream) {
+		return
+	}
+
+	if data.TextDelta == nil {
+		logVerbose(verboseStream, "streaming answer to chat(%d): %+v", chatID, data)
+		return
+	}
+
+	setting := conf.VerboseStream
+	if setting.EveryNthDelta > 1 && n > 1 && n%setting.EveryNthDelta != 0 {
+		return
+	}
+
+	delta := []rune(*data.TextDelta)
+	if setting.MaxDeltaChars > 0 && len(delta) > setting.MaxDeltaChars {
+		logVerbose(verboseStream, "streaming answer to chat(%d): delta #%d (%d chars): %q...", chatID, n, len(delta), string(delta[:setting.MaxDeltaChars]))
+	} else {
+		logVerbose(verboseStream, "streaming answer to chat(%d): delta #%d (%d chars): %q", chatID, n, len(delta), string(delta))
+	}
+}
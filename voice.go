@@ -0,0 +1,253 @@
+// voice.go
+//
+// transcripts and summaries of long voice notes, voice notes as prompts for photos,
+// and transcripts of audio, voice, and video notes with /transcribe
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	// my libraries
+	gt "github.com/meinside/gemini-things-go"
+	tg "github.com/meinside/telegram-bot-go"
+)
+
+// long voice note which is waiting for the choice of the user
+type voiceNoteRequest struct {
+	fileID string
+
+	chatID    int64
+	messageID int64
+}
+
+// check if given message is a long voice note without any caption
+//
+// (voice notes replying to photos are not, as they are prompts for the photos)
+func isLongVoiceNote(message tg.Message) bool {
+	return message.HasVoice() && !message.HasCaption() && message.Voice.Duration >= minLongVoiceNoteSeconds &&
+		!isVoicePromptForPhotos(message)
+}
+
+// check if given message is a voice note without any caption, replying to (or grouped with) photos
+func isVoicePromptForPhotos(message tg.Message, otherGroupedMessages ...tg.Message) bool {
+	if !message.HasVoice() || message.HasCaption() {
+		return false
+	}
+
+	if replied := repliedToMessage(message); replied != nil && replied.HasPhoto() {
+		return true
+	}
+	for _, grouped := range otherGroupedMessages {
+		if grouped.HasPhoto() {
+			return true
+		}
+	}
+	return false
+}
+
+// convert given voice note to a prompt: its transcript as the text, and the replied (or grouped) photos as files
+func voicePromptForPhotos(ctx context.Context, bot telegramClient, conf config, gtc geminiClient, message tg.Message, otherGroupedMessages ...tg.Message) (prompt *chatMessage, err error) {
+	var transcript string
+	if transcript, err = transcribeVoiceNote(ctx, bot, conf, gtc, message.Voice.FileID); err != nil {
+		return nil, fmt.Errorf("failed to transcribe the voice note: %w", err)
+	}
+
+	photos := otherGroupedMessages
+	if replied := repliedToMessage(message); replied != nil {
+		photos = append([]tg.Message{*replied}, photos...)
+	}
+
+	files := [][]byte{}
+	for _, photo := range photos {
+		if !photo.HasPhoto() {
+			continue
+		}
+		if fs, err := filesFromMessage(bot, photo); err == nil {
+			files = append(files, fs...)
+		} else {
+			return nil, err
+		}
+	}
+
+	logVerbose(verboseFiles, "transcribed voice note(%d) as a prompt for %d photo file(s)", message.MessageID, len(files))
+
+	return &chatMessage{
+		role:  chatMessageRoleUser,
+		text:  strings.TrimSpace(transcript),
+		files: files,
+	}, nil
+}
+
+// offer buttons for choosing what to do with a long voice note
+func offerVoiceNoteOptions(bot telegramClient, conf config, message tg.Message) {
+	chatID := message.Chat.ID
+	messageID := message.MessageID
+
+	key := fmt.Sprintf("%s%d/%d", callbackDataPrefixVoiceNote, chatID, messageID)
+	putCallbackValue(key, voiceNoteRequest{
+		fileID:    message.Voice.FileID,
+		chatID:    chatID,
+		messageID: messageID,
+	})
+
+	button := func(text, action string) tg.InlineKeyboardButton {
+		return tg.InlineKeyboardButton{
+			Text:         text,
+			CallbackData: ptr(key + "/" + action),
+		}
+	}
+	options := messageOptions(chatID, &messageID).
+		SetReplyMarkup(tg.NewInlineKeyboardMarkup([][]tg.InlineKeyboardButton{
+			{button(msgVoiceNoteTranscript, "transcript"), button(msgVoiceNoteSummary, "summary"), button(msgVoiceNoteBoth, "both")},
+		}))
+	if res := withRetries(bot).SendMessage(chatID, filterOutgoingText(conf, fmt.Sprintf(msgVoiceNoteOptionsFormat, message.Voice.Duration/60, message.Voice.Duration%60)), options); !res.Ok {
+		log.Printf("failed to send voice note options: %s", *res.Description)
+	}
+}
+
+// transcribe and/or summarize a long voice note with given callback query
+func handleVoiceNoteCallback(ctx context.Context, b *tg.Bot, conf config, gtc geminiClient, callbackQuery tg.CallbackQuery, data string) {
+	idx := strings.LastIndex(data, "/")
+	key, action := data[:idx], data[idx+1:]
+
+	request, exists := popCallbackValue[voiceNoteRequest](key)
+	if !exists {
+		_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgVoiceNoteExpired))
+		return
+	}
+	_ = b.AnswerCallbackQuery(callbackQuery.ID, tg.OptionsAnswerCallbackQuery{}.SetText(msgVoiceNoteProcessing))
+
+	ctx, end := beginInteractiveRequest(ctx, "voice_note", request.chatID, callbackQuery.From.ID, userName(&callbackQuery.From))
+	defer end()
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	// transcribe
+	transcript, err := transcribeVoiceNote(ctx, b, conf, gtc, request.fileID)
+	if err != nil {
+		_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to transcribe the voice note: %s", errorString(conf, err)), request.chatID, &request.messageID)
+		return
+	}
+	if action == "transcript" || action == "both" {
+		_, _ = sendMessage(b, conf, fmt.Sprintf(msgVoiceNoteTranscriptFormat, transcript), request.chatID, &request.messageID)
+	}
+
+	// then condense
+	if action == "summary" || action == "both" {
+		summary, err := generateText(ctx, gtc, fmt.Sprintf(voiceNoteSummaryPromptFormat, transcript), nil, &gt.GenerationOptions{
+			HarmBlockThreshold: conf.GoogleAIHarmBlockThreshold,
+		})
+		if err != nil {
+			_, _ = sendMessage(b, conf, fmt.Sprintf("Failed to summarize the voice note: %s", errorString(conf, err)), request.chatID, &request.messageID)
+			return
+		}
+		_, _ = sendMessage(b, conf, fmt.Sprintf(msgVoiceNoteSummaryFormat, summary), request.chatID, &request.messageID)
+	}
+}
+
+// transcribe the voice note with given file id
+func transcribeVoiceNote(ctx context.Context, bot telegramClient, conf config, gtc geminiClient, fileID string) (transcript string, err error) {
+	var voice []byte
+	if voice, err = readMedia(bot, "voice", fileID); err != nil {
+		return "", err
+	}
+
+	return generateText(ctx, gtc, voiceNoteTranscriptionPrompt, map[string]io.Reader{
+		"voice": bytes.NewReader(voice),
+	}, &gt.GenerationOptions{
+		HarmBlockThreshold: conf.GoogleAIHarmBlockThreshold,
+	})
+}
+
+// media (type and file id) of given message which can be transcribed
+func transcribableMediaOf(message tg.Message) (mediaType, fileID string, exists bool) {
+	switch {
+	case message.HasVoice():
+		return "voice note", message.Voice.FileID, true
+	case message.HasAudio():
+		return "audio", message.Audio.FileID, true
+	case message.HasVideoNote():
+		return "video note", message.VideoNote.FileID, true
+	case message.HasVideo():
+		return "video", message.Video.FileID, true
+	}
+	return "", "", false
+}
+
+// transcribe the media of given message (or the replied one), and reply with the transcript
+//
+// (with `timestamps` in args, each utterance is prefixed with its timestamp)
+func transcribe(ctx context.Context, bot telegramClient, conf config, gtc geminiClient, message tg.Message, args string) {
+	chatID := message.Chat.ID
+	messageID := message.MessageID
+
+	mediaType, fileID, exists := transcribableMediaOf(message)
+	if !exists {
+		if replied := repliedToMessage(message); replied != nil {
+			mediaType, fileID, exists = transcribableMediaOf(*replied)
+		}
+	}
+	if !exists {
+		_, _ = sendMessage(bot, conf, msgTranscribeUsage, chatID, &messageID)
+		return
+	}
+
+	ctx, end := beginInteractiveRequest(ctx, "transcribe", chatID, message.From.ID, userName(message.From))
+	defer end()
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	_ = withRetries(bot).SetMessageReaction(chatID, messageID, tg.NewMessageReactionWithEmoji("👌"))
+
+	media, err := readMedia(bot, mediaType, fileID)
+	if err != nil {
+		_, _ = sendMessage(bot, conf, fmt.Sprintf("Failed to read the %s: %s", mediaType, redact(conf, err)), chatID, &messageID)
+		return
+	}
+
+	promptFormat := transcriptionPromptFormat
+	if strings.TrimSpace(args) == "timestamps" {
+		promptFormat = transcriptionWithTimestampsPromptFormat
+	}
+	transcript, err := generateText(ctx, gtc, fmt.Sprintf(promptFormat, mediaType), map[string]io.Reader{
+		mediaType: bytes.NewReader(media),
+	}, &gt.GenerationOptions{
+		HarmBlockThreshold: conf.GoogleAIHarmBlockThreshold,
+	})
+	if err != nil {
+		_, _ = sendMessage(bot, conf, fmt.Sprintf("Failed to transcribe the %s: %s", mediaType, errorString(conf, err)), chatID, &messageID)
+		return
+	}
+
+	// (long transcripts are sent in multiple messages)
+	for _, chunk := range splitIntoChunks(strings.TrimSpace(transcript), maxMessageLength) {
+		_, _ = sendMessage(bot, conf, chunk, chatID, &messageID)
+	}
+}
+
+// return a /transcribe command handler
+func transcribeCommandHandler(ctx context.Context, conf config, gtc geminiClient, allowedUsers map[string]bool) func(b *tg.Bot, update tg.Update, args string) {
+	return func(b *tg.Bot, update tg.Update, args string) {
+		if !isAllowed(update, allowedUsers) {
+			log.Printf("transcribe command not allowed: %s", userNameFromUpdate(update))
+			return
+		}
+
+		message := usableMessageFromUpdate(update)
+		if message == nil || message.From == nil {
+			log.Printf("no usable message from update.")
+			return
+		}
+
+		transcribe(ctx, b, conf, gtc, *message, args)
+	}
+}
@@ -0,0 +1,152 @@
+// watch.go
+//
+// watching urls for conditions, and notifying chats when they occur
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	// google ai
+	"github.com/google/generative-ai-go/genai"
+
+	// my libraries
+	gt "github.com/meinside/gemini-things-go"
+)
+
+const (
+	maxWatchesPerChat     = 10
+	maxWatchContentLength = 30000 // in runes
+)
+
+// result of checking a watch
+type watchCheckResult struct {
+	Occurred bool   `json:"occurred"`
+	Summary  string `json:"summary"`
+}
+
+// parse arguments of `/watch` into a url and a condition
+func parseWatchArgs(args string) (watchURL, condition string, err error) {
+	watchURL, condition, _ = strings.Cut(strings.TrimSpace(args), " ")
+	condition = strings.TrimSpace(condition)
+	if watchURL == "" || condition == "" {
+		return "", "", fmt.Errorf("%s", msgWatchUsage)
+	}
+
+	if parsed, err := url.Parse(watchURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", "", fmt.Errorf("not a valid http(s) url: %s", watchURL)
+	}
+
+	return watchURL, condition, nil
+}
+
+// fetch the text content of a watched url
+func fetchWatchContent(conf config, watchURL string) (string, error) {
+	content, contentType, err := fetchURLContent(conf, watchURL)
+	if err != nil {
+		return "", err
+	}
+	if !supportedHTTPContentType(contentType) {
+		return "", fmt.Errorf("content type %s cannot be watched", contentType)
+	}
+
+	if runes := []rune(string(content)); len(runes) > maxWatchContentLength {
+		return string(runes[:maxWatchContentLength]), nil
+	}
+	return string(content), nil
+}
+
+// check all watches, and notify chats of the ones whose conditions occurred
+func checkWatches(ctx context.Context, bot telegramClient, conf config, db *Database, gtc geminiClient) {
+	watches, err := db.loadAllWatches()
+	if err != nil {
+		log.Printf("failed to load watches: %s", err)
+		return
+	}
+
+	for _, watch := range watches {
+		if ctx.Err() != nil {
+			return
+		}
+
+		checkWatch(ctx, bot, conf, db, gtc, watch)
+	}
+}
+
+// check a watch, and notify its chat if its condition occurred
+func checkWatch(ctx context.Context, bot telegramClient, conf config, db *Database, gtc geminiClient, watch Watch) {
+	content, err := fetchWatchContent(conf, watch.URL)
+	if err != nil {
+		log.Printf("failed to fetch watched url %s: %s", watch.URL, err)
+		return
+	}
+
+	// skip if nothing was changed
+	if content == watch.LastContent {
+		logVerbose(verboseTools, "no changes in watched url: %s", watch.URL)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.AnswerTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	var result watchCheckResult
+	generated, err := generateTextLogged(ctx, conf, db, gtc, watch.ChatID, watch.UserID, watchUsername, fmt.Sprintf(watchCheckPromptFormat, watch.Condition, watch.LastContent, content), &gt.GenerationOptions{
+		HarmBlockThreshold: conf.GoogleAIHarmBlockThreshold,
+		Config: &genai.GenerationConfig{
+			ResponseMIMEType: "application/json",
+			ResponseSchema: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"occurred": {
+						Type: genai.TypeBoolean,
+					},
+					"summary": {
+						Type: genai.TypeString,
+					},
+				},
+				Required: []string{"occurred", "summary"},
+			},
+		},
+	})
+	if err == nil {
+		err = json.Unmarshal([]byte(generated), &result)
+	}
+	if err != nil {
+		log.Printf("failed to check watched url %s: %s", watch.URL, errorString(conf, err))
+		return // will be checked again with the same previous content
+	}
+
+	if result.Occurred {
+		_, _ = sendMessage(bot, conf, fmt.Sprintf(msgWatchOccurredFormat, watch.ID, watch.Condition, watch.URL, result.Summary), watch.ChatID, nil)
+	}
+
+	watch.LastContent = content
+	watch.LastCheckedAt = time.Now()
+	if err := db.saveWatch(&watch); err != nil {
+		log.Printf("failed to save watch #%d: %s", watch.ID, err)
+	}
+}
+
+// format given watches for displaying
+func formatWatches(watches []Watch, f formatter) string {
+	if len(watches) <= 0 {
+		return msgNoWatches
+	}
+
+	lines := []string{}
+	for _, watch := range watches {
+		checked := "not checked yet"
+		if !watch.LastCheckedAt.IsZero() {
+			checked = "checked at " + f.dateTime(watch.LastCheckedAt)
+		}
+		lines = append(lines, fmt.Sprintf("#%d %s\n  - %s (%s)", watch.ID, watch.URL, watch.Condition, checked))
+	}
+	return strings.Join(lines, "\n")
+}